@@ -0,0 +1,182 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// AuditRecord describes one call to a Database made through an AuditedStore.
+type AuditRecord struct {
+	Time  time.Time `json:"time"`            // when the call returned
+	Actor string    `json:"actor,omitempty"` // who made the call, from its context
+	Op    string    `json:"op"`              // the method called, such as "Save"
+	Short string    `json:"short,omitempty"` // the link affected, if the call has one
+
+	// Err is the error the call returned. A record with a nil Err means
+	// the operation was committed by the underlying Database.
+	Err error `json:"-"`
+}
+
+// MarshalJSON encodes r, with Err as its message in an "error" field.
+func (r AuditRecord) MarshalJSON() ([]byte, error) {
+	type record AuditRecord // without the MarshalJSON method
+	v := struct {
+		record
+		Error string `json:"error,omitempty"`
+	}{record: record(r)}
+	if r.Err != nil {
+		v.Error = r.Err.Error()
+	}
+	return json.Marshal(v)
+}
+
+// AuditWriter returns an AuditedStore.Audit function that writes each record
+// to w as a line of JSON. Failed writes are logged, since the audited call
+// has already returned.
+func AuditWriter(w io.Writer) func(AuditRecord) {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(r AuditRecord) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := enc.Encode(r); err != nil {
+			log.Printf("writing audit record: %v", err)
+		}
+	}
+}
+
+// AuditedStore is a Database that reports every Save, Delete and SaveStats
+// call on the wrapped Database to Audit, once the call has returned, so
+// that a record without an error is only made for a committed operation.
+// Reads are reported too if AuditReads is set.
+//
+// The Database methods have no context, so their records have no actor.
+// Callers that know who is acting should use the Context variants, such as
+// SaveContext, with a context carrying the actor under ActorKey.
+type AuditedStore struct {
+	Database
+
+	// Audit is called with the record of each audited call. It can write
+	// to a file with AuditWriter, or anywhere else, such as another store.
+	Audit func(AuditRecord)
+
+	// ActorKey is the context key whose string value identifies the actor
+	// of a call, such as the login of the user making a request.
+	ActorKey any
+
+	// AuditReads is whether Load, LoadAll, LoadStats and LastStatsFlush
+	// calls are also audited.
+	AuditReads bool
+
+	// Now returns the time of records. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// NewAuditedStore returns an AuditedStore passing the calls made on it to
+// db, and the records of them to audit.
+func NewAuditedStore(db Database, audit func(AuditRecord)) *AuditedStore {
+	return &AuditedStore{Database: db, Audit: audit}
+}
+
+// record reports the call op on short, which returned err, to s.Audit.
+func (s *AuditedStore) record(ctx context.Context, op, short string, err error) {
+	if s.Audit == nil {
+		return
+	}
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	r := AuditRecord{Time: now().UTC(), Op: op, Short: short, Err: err}
+	if s.ActorKey != nil {
+		r.Actor, _ = ctx.Value(s.ActorKey).(string)
+	}
+	s.Audit(r)
+}
+
+// recordRead is like record, for calls only audited if s.AuditReads is set.
+func (s *AuditedStore) recordRead(ctx context.Context, op, short string, err error) {
+	if s.AuditReads {
+		s.record(ctx, op, short, err)
+	}
+}
+
+func (s *AuditedStore) Save(link *Link) error {
+	return s.SaveContext(context.Background(), link)
+}
+
+// SaveContext saves link, recording the actor in ctx.
+func (s *AuditedStore) SaveContext(ctx context.Context, link *Link) error {
+	err := s.Database.Save(link)
+	s.record(ctx, "Save", link.Name(), err)
+	return err
+}
+
+func (s *AuditedStore) Delete(short string) error {
+	return s.DeleteContext(context.Background(), short)
+}
+
+// DeleteContext deletes the link short, recording the actor in ctx.
+func (s *AuditedStore) DeleteContext(ctx context.Context, short string) error {
+	err := s.Database.Delete(short)
+	s.record(ctx, "Delete", short, err)
+	return err
+}
+
+func (s *AuditedStore) SaveStats(stats ClickStats) error {
+	return s.SaveStatsContext(context.Background(), stats)
+}
+
+// SaveStatsContext saves stats, recording the actor in ctx. The record has
+// no short name, since stats cover many links.
+func (s *AuditedStore) SaveStatsContext(ctx context.Context, stats ClickStats) error {
+	err := s.Database.SaveStats(stats)
+	s.record(ctx, "SaveStats", "", err)
+	return err
+}
+
+func (s *AuditedStore) Load(short string) (*Link, error) {
+	return s.LoadContext(context.Background(), short)
+}
+
+// LoadContext loads the link short, passing ctx along to the wrapped
+// Database if it supports it, and recording the actor in ctx if reads are
+// audited.
+func (s *AuditedStore) LoadContext(ctx context.Context, short string) (*Link, error) {
+	var link *Link
+	var err error
+	if db, ok := s.Database.(interface {
+		LoadContext(context.Context, string) (*Link, error)
+	}); ok {
+		link, err = db.LoadContext(ctx, short)
+	} else {
+		link, err = s.Database.Load(short)
+	}
+	s.recordRead(ctx, "Load", short, err)
+	return link, err
+}
+
+func (s *AuditedStore) LoadAll() ([]*Link, error) {
+	links, err := s.Database.LoadAll()
+	s.recordRead(context.Background(), "LoadAll", "", err)
+	return links, err
+}
+
+func (s *AuditedStore) LoadStats() (ClickStats, error) {
+	stats, err := s.Database.LoadStats()
+	s.recordRead(context.Background(), "LoadStats", "", err)
+	return stats, err
+}
+
+func (s *AuditedStore) LastStatsFlush() (time.Time, error) {
+	t, err := s.Database.LastStatsFlush()
+	s.recordRead(context.Background(), "LastStatsFlush", "", err)
+	return t, err
+}
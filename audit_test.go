@@ -0,0 +1,81 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestAuditedStore(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []AuditRecord
+	s := NewAuditedStore(db, func(r AuditRecord) { records = append(records, r) })
+	type actorKey struct{}
+	s.ActorKey = actorKey{}
+	now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.Now = func() time.Time { return now }
+	ctx := context.WithValue(context.Background(), actorKey{}, "alice@example.com")
+
+	if err := s.SaveContext(ctx, &Link{Short: "a", Long: "http://a/"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(&Link{Short: "b", Long: "http://b/"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SaveStatsContext(ctx, ClickStats{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	// Reads aren't audited by default.
+	if _, err := s.LoadContext(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteContext(ctx, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("DeleteContext(missing) got %v, want fs.ErrNotExist", err)
+	}
+	s.AuditReads = true
+	if _, err := s.LoadContext(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []AuditRecord{
+		{Time: now, Actor: "alice@example.com", Op: "Save", Short: "a"},
+		{Time: now, Op: "Save", Short: "b"},
+		{Time: now, Actor: "alice@example.com", Op: "SaveStats"},
+		{Time: now, Actor: "alice@example.com", Op: "Delete", Short: "missing", Err: fs.ErrNotExist},
+		{Time: now, Actor: "alice@example.com", Op: "Load", Short: "b"},
+	}
+	if diff := cmp.Diff(want, records, cmpopts.EquateErrors()); diff != "" {
+		t.Errorf("audit records (-want +got):\n%s", diff)
+	}
+}
+
+func TestAuditWriter(t *testing.T) {
+	var buf bytes.Buffer
+	audit := AuditWriter(&buf)
+	now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	audit(AuditRecord{Time: now, Actor: "alice", Op: "Save", Short: "a"})
+	audit(AuditRecord{Time: now, Op: "Delete", Short: "b", Err: fs.ErrNotExist})
+
+	want := strings.Join([]string{
+		`{"time":"2023-03-01T12:00:00Z","actor":"alice","op":"Save","short":"a"}`,
+		`{"time":"2023-03-01T12:00:00Z","op":"Delete","short":"b","error":"file does not exist"}`,
+		"",
+	}, "\n")
+	if got := buf.String(); got != want {
+		t.Errorf("AuditWriter wrote:\n%s\nwant:\n%s", got, want)
+	}
+}
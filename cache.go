@@ -0,0 +1,292 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RefreshingCache is a Database that serves links from an in-memory snapshot
+// of another Database, so that loading a link doesn't wait on the backend.
+//
+// The snapshot is replaced with a fresh copy of all links on an interval in
+// the background. Saves and deletes are written to the backend and then
+// applied to the snapshot immediately. Loading a link missing from the
+// snapshot, such as an alias or a link created elsewhere since the last
+// refresh, falls through to the backend. Stats are not cached.
+type RefreshingCache struct {
+	db Database
+
+	// mu serializes changes to the snapshot. Readers don't take it.
+	mu       sync.Mutex
+	snapshot atomic.Pointer[cacheSnapshot]
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// cacheSnapshot is an immutable copy of all links.
+type cacheSnapshot struct {
+	links     map[string]*Link // keyed by linkID
+	refreshed time.Time
+}
+
+// NewRefreshingCache returns a RefreshingCache serving links from db, and
+// refreshing them every interval until Close is called. It loads the initial
+// snapshot before returning.
+func NewRefreshingCache(db Database, interval time.Duration) (*RefreshingCache, error) {
+	c := &RefreshingCache{db: db, stop: make(chan struct{})}
+	if err := c.Refresh(); err != nil {
+		return nil, err
+	}
+	go c.refreshLoop(interval)
+	return c, nil
+}
+
+func (c *RefreshingCache) refreshLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Refresh(); err != nil {
+				log.Printf("refreshing link cache: %v", err)
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Close stops refreshing the cache in the background.
+func (c *RefreshingCache) Close() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// Refresh replaces the snapshot with all links currently in the backend.
+func (c *RefreshingCache) Refresh() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	links, err := c.db.LoadAll()
+	if err != nil {
+		return err
+	}
+	m := make(map[string]*Link, len(links))
+	for _, link := range links {
+		m[linkID(link.Name())] = link
+	}
+	c.snapshot.Store(&cacheSnapshot{links: m, refreshed: time.Now()})
+	return nil
+}
+
+// LastRefresh returns when the snapshot was last fully refreshed.
+func (c *RefreshingCache) LastRefresh() time.Time {
+	return c.snapshot.Load().refreshed
+}
+
+// update applies f to a copy of the current snapshot's links and stores the
+// result as the new snapshot. c.mu must be held.
+func (c *RefreshingCache) update(f func(links map[string]*Link)) {
+	old := c.snapshot.Load()
+	m := make(map[string]*Link, len(old.links)+1)
+	for id, link := range old.links {
+		m[id] = link
+	}
+	f(m)
+	c.snapshot.Store(&cacheSnapshot{links: m, refreshed: old.refreshed})
+}
+
+// LoadAll returns all links in the snapshot.
+//
+// The caller owns the returned values.
+func (c *RefreshingCache) LoadAll() ([]*Link, error) {
+	snapshot := c.snapshot.Load()
+	links := make([]*Link, 0, len(snapshot.links))
+	for _, link := range snapshot.links {
+		l := *link
+		links = append(links, &l)
+	}
+	return links, nil
+}
+
+// Load returns a Link by its short name from the snapshot, or from the
+// backend if it is not in the snapshot.
+//
+// The caller owns the returned value.
+func (c *RefreshingCache) Load(short string) (*Link, error) {
+	if link, ok := c.snapshot.Load().links[linkID(short)]; ok {
+		l := *link
+		return &l, nil
+	}
+	return c.db.Load(short)
+}
+
+// Save saves link to the backend, and then to the snapshot.
+func (c *RefreshingCache) Save(link *Link) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.db.Save(link); err != nil {
+		return err
+	}
+	// Cache the link as stored, with any defaults the backend applied.
+	stored, err := c.db.Load(link.Name())
+	if err != nil {
+		return err
+	}
+	c.update(func(links map[string]*Link) {
+		links[linkID(stored.Name())] = stored
+	})
+	return nil
+}
+
+// Delete deletes a link from the backend, and then from the snapshot.
+func (c *RefreshingCache) Delete(short string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.db.Delete(short)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	c.update(func(links map[string]*Link) {
+		delete(links, linkID(short))
+	})
+	return err
+}
+
+// LoadStats returns click stats from the backend.
+func (c *RefreshingCache) LoadStats() (ClickStats, error) {
+	return c.db.LoadStats()
+}
+
+// SaveStats records click stats in the backend.
+func (c *RefreshingCache) SaveStats(stats ClickStats) error {
+	return c.db.SaveStats(stats)
+}
+
+// LastStatsFlush returns when the backend last saved stats.
+func (c *RefreshingCache) LastStatsFlush() (time.Time, error) {
+	return c.db.LastStatsFlush()
+}
+
+// WriteThroughStore is a Database that keeps a cache Database, such as a
+// local SQLiteDB, in front of a durable backend Database.
+//
+// Writes go to the backend first, and only reach the cache once the backend
+// has accepted them, so the cache never holds a link the backend rejected.
+// If a backend write fails, the link is removed from the cache, since the
+// failed write may still have been partly applied. Loads are served from the
+// cache, falling through to the backend on a miss and backfilling the cache.
+// LoadAll and stats always use the backend, as the cache may be partial.
+type WriteThroughStore struct {
+	cache   Database
+	backend Database
+
+	// mu serializes writes, and cache backfills with them, so that a
+	// backfill can't overwrite a newer write with the link it loaded.
+	mu sync.Mutex
+}
+
+// NewWriteThroughStore returns a WriteThroughStore caching links from backend
+// in cache.
+func NewWriteThroughStore(cache, backend Database) *WriteThroughStore {
+	return &WriteThroughStore{cache: cache, backend: backend}
+}
+
+// invalidate removes short from the cache. s.mu must be held.
+func (s *WriteThroughStore) invalidate(short string) {
+	if err := s.cache.Delete(short); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("invalidating cached link %q: %v", short, err)
+	}
+}
+
+// fill caches link, as loaded from the backend. If it can't be cached, any
+// stale copy is removed instead. s.mu must be held.
+func (s *WriteThroughStore) fill(link *Link) {
+	l := *link
+	if err := s.cache.Save(&l); err != nil {
+		log.Printf("caching link %q: %v", link.Name(), err)
+		s.invalidate(link.Name())
+	}
+}
+
+// LoadAll returns all links from the backend.
+func (s *WriteThroughStore) LoadAll() ([]*Link, error) {
+	return s.backend.LoadAll()
+}
+
+// Load returns a Link by its short name from the cache, or from the backend
+// if it is not cached.
+//
+// The caller owns the returned value.
+func (s *WriteThroughStore) Load(short string) (*Link, error) {
+	link, err := s.cache.Load(short)
+	if err == nil {
+		return link, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("loading cached link %q: %v", short, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	link, err = s.backend.Load(short)
+	if err != nil {
+		return nil, err
+	}
+	s.fill(link)
+	return link, nil
+}
+
+// Save saves link to the backend, and then to the cache. If the backend
+// fails, the link is removed from the cache.
+func (s *WriteThroughStore) Save(link *Link) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.backend.Save(link); err != nil {
+		s.invalidate(link.Name())
+		return err
+	}
+	// Cache the link as stored, with any defaults the backend applied.
+	stored, err := s.backend.Load(link.Name())
+	if err != nil {
+		s.invalidate(link.Name())
+		return nil
+	}
+	s.fill(stored)
+	return nil
+}
+
+// Delete deletes a link from the backend, and then from the cache.
+func (s *WriteThroughStore) Delete(short string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.backend.Delete(short)
+	s.invalidate(short)
+	return err
+}
+
+// LoadStats returns click stats from the backend.
+func (s *WriteThroughStore) LoadStats() (ClickStats, error) {
+	return s.backend.LoadStats()
+}
+
+// SaveStats records click stats in the backend.
+func (s *WriteThroughStore) SaveStats(stats ClickStats) error {
+	return s.backend.SaveStats(stats)
+}
+
+// LastStatsFlush returns when the backend last saved stats.
+func (s *WriteThroughStore) LastStatsFlush() (time.Time, error) {
+	return s.backend.LastStatsFlush()
+}
@@ -0,0 +1,146 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRefreshingCache(t *testing.T) {
+	backend, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Save(&Link{Short: "a", Long: "one"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewRefreshingCache(backend, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	refreshed := c.LastRefresh()
+
+	// writes through the cache are visible immediately
+	if err := c.Save(&Link{Short: "b", Long: "two"}); err != nil {
+		t.Fatal(err)
+	}
+	if link, err := c.Load("b"); err != nil || link.Long != "two" {
+		t.Errorf("c.Load(%q) = %v, %v; want Long %q", "b", link, err, "two")
+	}
+	if _, err := backend.Load("b"); err != nil {
+		t.Errorf("backend.Load(%q): %v", "b", err)
+	}
+
+	// writes to the backend are not seen until the next refresh
+	if err := backend.Save(&Link{Short: "a", Long: "changed"}); err != nil {
+		t.Fatal(err)
+	}
+	if link, _ := c.Load("a"); link.Long != "one" {
+		t.Errorf("c.Load(%q).Long before refresh = %q, want %q", "a", link.Long, "one")
+	}
+	if err := c.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if link, _ := c.Load("a"); link.Long != "changed" {
+		t.Errorf("c.Load(%q).Long after refresh = %q, want %q", "a", link.Long, "changed")
+	}
+	if !c.LastRefresh().After(refreshed) {
+		t.Errorf("c.LastRefresh() = %v, want after %v", c.LastRefresh(), refreshed)
+	}
+
+	if err := c.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Load("a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("c.Load(%q) after delete got %v, want fs.ErrNotExist", "a", err)
+	}
+	links, err := c.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[0].Short != "b" {
+		t.Errorf("c.LoadAll() = %v, want only %q", links, "b")
+	}
+}
+
+func TestWriteThroughStore(t *testing.T) {
+	backendDB, err := NewSQLiteDB(path.Join(t.TempDir(), "backend.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := newFaultyStore(backendDB)
+	cache, err := NewSQLiteDB(path.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewWriteThroughStore(cache, backend)
+
+	if err := s.Save(&Link{Short: "a", Long: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	if link, err := cache.Load("a"); err != nil || link.Long != "one" {
+		t.Errorf("cache.Load(%q) after Save = %v, %v; want Long %q", "a", link, err, "one")
+	}
+
+	// a failed backend write leaves nothing in the cache
+	errBoom := errors.New("boom")
+	backend.setFault("Save", fault{Err: errBoom})
+	if err := s.Save(&Link{Short: "a", Long: "two"}); err != errBoom {
+		t.Fatalf("s.Save with failing backend got %v, want %v", err, errBoom)
+	}
+	if link, err := cache.Load("a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("cache.Load(%q) after failed Save = %v, %v; want fs.ErrNotExist", "a", link, err)
+	}
+	backend.clearFault("Save")
+
+	// loads fall through to the backend and backfill the cache
+	if link, err := s.Load("a"); err != nil || link.Long != "one" {
+		t.Errorf("s.Load(%q) = %v, %v; want Long %q", "a", link, err, "one")
+	}
+	if link, err := cache.Load("a"); err != nil || link.Long != "one" {
+		t.Errorf("cache.Load(%q) after backfill = %v, %v; want Long %q", "a", link, err, "one")
+	}
+
+	if err := s.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load("a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("s.Load(%q) after Delete got %v, want fs.ErrNotExist", "a", err)
+	}
+}
+
+func TestFallbackStore(t *testing.T) {
+	backend, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Save(&Link{Short: "a", Long: "http://a/"}); err != nil {
+		t.Fatal(err)
+	}
+	s := NewFallbackStore(backend, func(short string) (*Link, bool) {
+		if short == "private" {
+			return nil, false
+		}
+		return &Link{Short: short, Long: "http://search/?q=" + short}, true
+	})
+
+	if link, err := s.Load("a"); err != nil || link.Long != "http://a/" {
+		t.Errorf("s.Load(%q) = %v, %v; want stored link", "a", link, err)
+	}
+	if link, err := s.Load("b"); err != nil || link.Long != "http://search/?q=b" {
+		t.Errorf("s.Load(%q) = %v, %v; want fallback link", "b", link, err)
+	}
+	if _, err := s.Load("private"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("s.Load(%q) got %v, want fs.ErrNotExist", "private", err)
+	}
+	if _, err := backend.Load("b"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("backend.Load(%q) got %v, want fallback not stored", "b", err)
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// NewURLCanonicalizer returns a canonicalizer for Options.Canonicalizer
+// that lowercases the scheme and host of a URL, removes the port if it is
+// the default for the scheme, and removes the query parameters named in
+// stripParams, such as tracking parameters. A name ending in "*" removes
+// every parameter with that prefix, so "utm_*" removes utm_source and
+// utm_medium. The query is only re-encoded if a parameter is removed.
+//
+// Templates and URLs without a scheme are returned unchanged. Paths are
+// left alone, since servers may treat "/page" and "/page/" differently; a
+// canonicalizer that trims trailing slashes can wrap this one.
+func NewURLCanonicalizer(stripParams ...string) func(string) (string, error) {
+	return func(long string) (string, error) {
+		if strings.Contains(long, "{{") {
+			return long, nil
+		}
+		u, err := url.Parse(long)
+		if err != nil {
+			return "", fmt.Errorf("invalid long URL: %w", err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return long, nil
+		}
+		u.Scheme = strings.ToLower(u.Scheme)
+		u.Host = strings.ToLower(u.Host)
+		if port := u.Port(); (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+			u.Host = strings.TrimSuffix(u.Host, ":"+port)
+		}
+		if len(stripParams) > 0 && u.RawQuery != "" {
+			q := u.Query()
+			stripped := false
+			for name := range q {
+				if stripParam(name, stripParams) {
+					q.Del(name)
+					stripped = true
+				}
+			}
+			if stripped {
+				u.RawQuery = q.Encode()
+			}
+		}
+		return u.String(), nil
+	}
+}
+
+// stripParam reports whether the query parameter name is matched by one of
+// patterns, as described by NewURLCanonicalizer.
+func stripParam(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == p {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalLong returns long as canonicalized by o.Canonicalizer, or long
+// itself if there is none.
+func (o *Options) canonicalLong(long string) (string, error) {
+	if o.Canonicalizer == nil {
+		return long, nil
+	}
+	canonical, err := o.Canonicalizer(long)
+	if err != nil {
+		return "", fmt.Errorf("canonicalizing long URL %q: %w", long, err)
+	}
+	return canonical, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"path"
+	"testing"
+)
+
+func TestURLCanonicalizer(t *testing.T) {
+	canonicalize := NewURLCanonicalizer("utm_*", "ref")
+	tests := []struct {
+		long, want string
+	}{
+		{"HTTPS://Example.COM:443/Page", "https://example.com/Page"},
+		{"http://example.com:80/", "http://example.com/"},
+		{"http://example.com:8080/", "http://example.com:8080/"},
+		{"https://example.com/?b=2&utm_source=x&a=1&ref=y", "https://example.com/?a=1&b=2"},
+		{"https://example.com/?b=2&a=1", "https://example.com/?b=2&a=1"},
+		{"http://go/{{.Path}}", "http://go/{{.Path}}"},
+		{"no-scheme", "no-scheme"},
+	}
+	for _, tt := range tests {
+		got, err := canonicalize(tt.long)
+		if err != nil {
+			t.Errorf("canonicalize(%q) error: %v", tt.long, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("canonicalize(%q) = %q, want %q", tt.long, got, tt.want)
+		}
+	}
+}
+
+// Test that SQLiteDB stores and looks up canonical Long URLs.
+func Test_SQLiteDB_Canonicalizer(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Canonicalizer = NewURLCanonicalizer("utm_source")
+
+	if err := db.Save(&Link{Short: "a", Long: "https://Example.com:443/page?utm_source=mail"}); err != nil {
+		t.Fatal(err)
+	}
+	link, err := db.Load("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://example.com/page"; link.Long != want {
+		t.Errorf("Load(a).Long = %q, want %q", link.Long, want)
+	}
+
+	links, err := db.LoadByLong("https://EXAMPLE.com/page?utm_source=chat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[0].Short != "a" {
+		t.Errorf("LoadByLong got %v, want link a", links)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CheckOptions configures CheckLinks.
+type CheckOptions struct {
+	// Concurrency is the most links checked at once. If zero, 8 is used.
+	Concurrency int
+
+	// Timeout is how long to wait for each link's destination. If zero,
+	// 10 seconds is used.
+	Timeout time.Duration
+
+	// Client makes the requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// LinkHealth is the result of checking a link's destination.
+type LinkHealth struct {
+	Short string // name of the link, as returned by Link.Name
+	URL   string // the Long URL that was checked
+
+	// Unverifiable is set for links that weren't checked, such as
+	// templates, which have no fixed destination.
+	Unverifiable bool
+
+	StatusCode int   // status of the response, if there was one
+	Reachable  bool  // whether the destination responded with a non-error status
+	Err        error // error reaching the destination, if any
+}
+
+// checkLinks checks the Long URL of each link with a HEAD request, falling
+// back to GET for servers that don't support HEAD. It returns a LinkHealth
+// for each link, in order, or ctx.Err() if ctx is done first.
+func checkLinks(ctx context.Context, links []*Link, opts CheckOptions) ([]LinkHealth, error) {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 8
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	client := httpClient(opts.Client)
+
+	results := make([]LinkHealth, len(links))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, link := range links {
+		results[i] = LinkHealth{Short: link.Name(), URL: link.Long}
+		if strings.Contains(link.Long, "{{") {
+			results[i].Unverifiable = true
+			continue
+		}
+		if u, err := url.Parse(link.Long); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			results[i].Unverifiable = true
+			continue
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return nil, ctx.Err()
+		}
+		wg.Add(1)
+		go func(h *LinkHealth) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			h.StatusCode, h.Err = checkURL(ctx, client, h.URL, timeout)
+			h.Reachable = h.Err == nil && h.StatusCode < 400
+		}(&results[i])
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// checkURL returns the status code of a HEAD request for u, or of a GET
+// request if HEAD is not allowed.
+func checkURL(ctx context.Context, client *http.Client, u string, timeout time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var code int
+	for _, method := range []string{"HEAD", "GET"} {
+		req, err := http.NewRequestWithContext(ctx, method, u, nil)
+		if err != nil {
+			return 0, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		code = resp.StatusCode
+		if code != http.StatusMethodNotAllowed && code != http.StatusNotImplemented {
+			break
+		}
+	}
+	return code, nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+)
+
+func TestCheckLinks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+		case "/get-only":
+			if r.Method != "GET" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for short, long := range map[string]string{
+		"ok":       srv.URL + "/ok",
+		"getonly":  srv.URL + "/get-only",
+		"broken":   srv.URL + "/gone",
+		"template": srv.URL + "/{{.Path}}",
+	} {
+		if err := db.Save(&Link{Short: short, Long: long}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err := db.CheckLinks(context.Background(), CheckOptions{Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type want struct {
+		code         int
+		reachable    bool
+		unverifiable bool
+	}
+	wants := map[string]want{
+		"ok":       {200, true, false},
+		"getonly":  {200, true, false},
+		"broken":   {404, false, false},
+		"template": {0, false, true},
+	}
+	if len(results) != len(wants) {
+		t.Fatalf("CheckLinks got %d results, want %d", len(results), len(wants))
+	}
+	for _, h := range results {
+		got := want{h.StatusCode, h.Reachable, h.Unverifiable}
+		if got != wants[h.Short] {
+			t.Errorf("CheckLinks result for %q got %+v, want %+v", h.Short, got, wants[h.Short])
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.CheckLinks(ctx, CheckOptions{}); err != context.Canceled {
+		t.Errorf("CheckLinks with canceled context got %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// Codec transforms link fields on their way to and from storage, such as to
+// encrypt them at rest. Decode must reverse Encode.
+type Codec interface {
+	Encode(plaintext []byte) ([]byte, error)
+	Decode(encoded []byte) ([]byte, error)
+}
+
+// AESGCMCodec is a Codec that encrypts with AES-GCM, using a random nonce
+// for each value.
+type AESGCMCodec struct {
+	aead cipher.AEAD
+}
+
+// NewAESGCMCodec returns an AESGCMCodec using key, which must be 16, 24 or
+// 32 bytes long to select AES-128, AES-192 or AES-256.
+func NewAESGCMCodec(key []byte) (*AESGCMCodec, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &AESGCMCodec{aead: aead}, nil
+}
+
+// Encode returns plaintext encrypted, prefixed by its nonce.
+func (c *AESGCMCodec) Encode(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decode returns the plaintext of a value returned by Encode.
+func (c *AESGCMCodec) Decode(encoded []byte) ([]byte, error) {
+	n := c.aead.NonceSize()
+	if len(encoded) < n {
+		return nil, errors.New("encrypted value is too short")
+	}
+	return c.aead.Open(nil, encoded[:n], encoded[n:], nil)
+}
+
+// encodeField returns s encoded by o.Codec, as base64 text so that it can
+// be stored in place of s.
+func (o *Options) encodeField(s string) (string, error) {
+	b, err := o.Codec.Encode([]byte(s))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// decodeField reverses encodeField.
+func (o *Options) decodeField(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	b, err = o.Codec.Decode(b)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// encodeFields returns a copy of link to store, with its destination URLs,
+// and its owner if o.CodecOwner is set, encoded by o.Codec. It returns link
+// itself if o.Codec is nil.
+func (o *Options) encodeFields(link *Link) (*Link, error) {
+	if o.Codec == nil {
+		return link, nil
+	}
+	l := *link
+	var err error
+	if l.Long, err = o.encodeField(link.Long); err != nil {
+		return nil, fmt.Errorf("encoding link %q: %w", link.Name(), err)
+	}
+	if len(link.Destinations) > 0 {
+		l.Destinations = make([]WeightedDest, len(link.Destinations))
+		for i, d := range link.Destinations {
+			if d.URL, err = o.encodeField(d.URL); err != nil {
+				return nil, fmt.Errorf("encoding link %q: %w", link.Name(), err)
+			}
+			l.Destinations[i] = d
+		}
+	}
+	if o.CodecOwner && link.Owner != "" {
+		if l.Owner, err = o.encodeField(link.Owner); err != nil {
+			return nil, fmt.Errorf("encoding link %q: %w", link.Name(), err)
+		}
+	}
+	return &l, nil
+}
+
+// decodeFields reverses encodeFields, modifying link in place. It does nothing
+// if o.Codec is nil.
+func (o *Options) decodeFields(link *Link) error {
+	if o.Codec == nil {
+		return nil
+	}
+	var err error
+	if link.Long, err = o.decodeField(link.Long); err != nil {
+		return fmt.Errorf("decoding link %q: %w", link.Name(), err)
+	}
+	for i := range link.Destinations {
+		if link.Destinations[i].URL, err = o.decodeField(link.Destinations[i].URL); err != nil {
+			return fmt.Errorf("decoding link %q: %w", link.Name(), err)
+		}
+	}
+	if o.CodecOwner && link.Owner != "" {
+		if link.Owner, err = o.decodeField(link.Owner); err != nil {
+			return fmt.Errorf("decoding link %q: %w", link.Name(), err)
+		}
+	}
+	return nil
+}
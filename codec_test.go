@@ -0,0 +1,63 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"bytes"
+	"path"
+	"strings"
+	"testing"
+)
+
+func Test_SQLiteDB_Codec(t *testing.T) {
+	codec, err := NewAESGCMCodec(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Codec = codec
+
+	const long = "http://secret.example.com/"
+	if err := db.Save(&Link{Short: "a", Long: long, Owner: "foo@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored, owner string
+	if err := db.db.QueryRow("SELECT Long, Owner FROM Links WHERE ID = ?", linkID("a")).Scan(&stored, &owner); err != nil {
+		t.Fatal(err)
+	}
+	if stored == long || strings.Contains(stored, "secret") {
+		t.Errorf("stored Long is %q, want ciphertext", stored)
+	}
+	if owner != "foo@example.com" {
+		t.Errorf("stored Owner is %q, want plaintext without CodecOwner", owner)
+	}
+
+	link, err := db.Load("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Long != long {
+		t.Errorf("db.Load got Long %q, want %q", link.Long, long)
+	}
+	links, err := db.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[0].Long != long {
+		t.Errorf("db.LoadAll got %v, want Long %q", links, long)
+	}
+
+	// a different key can't read the link
+	db.Codec, err = NewAESGCMCodec(bytes.Repeat([]byte{2}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Load("a"); err == nil {
+		t.Error("db.Load with the wrong key succeeded, want error")
+	}
+}
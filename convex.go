@@ -1,29 +1,355 @@
 package golink
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"log"
+	"math"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 type LinkDocument struct {
-	Id       string  `json:"normalizedId"`
-	Short    string  `json:"short"`
-	Long     string  `json:"long"`
-	Created  float64 `json:"created"`
-	LastEdit float64 `json:"lastEdit"`
-	Owner    string  `json:"owner"`
+	Id       string     `json:"normalizedId"`
+	Short    string     `json:"short"`
+	Long     string     `json:"long"`
+	Created  ConvexTime `json:"created"`
+	LastEdit ConvexTime `json:"lastEdit"`
+	Owner    string     `json:"owner"`
+
+	Destinations  []WeightedDest `json:"destinations,omitempty"`
+	RedirectCode  int            `json:"redirectCode,omitempty"`
+	Namespace     string         `json:"namespace,omitempty"`
+	CreatedFrom   string         `json:"createdFrom,omitempty"`
+	EditCount     int            `json:"editCount,omitempty"` // set by the store mutation
+	AllowedOwners []string       `json:"allowedOwners,omitempty"`
+	ExpiresAt     ConvexTime     `json:"expiresAt,omitempty"`
+	IconURL       string         `json:"iconUrl,omitempty"`
+	Pinned        bool           `json:"pinned,omitempty"`
+	MaxUses       int            `json:"maxUses,omitempty"`
+	UseCount      int            `json:"useCount,omitempty"` // set by the consumeUse mutation
+	Version       int            `json:"version,omitempty"`  // set by each mutation that changes the link
+	Source        string         `json:"source,omitempty"`
+
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// ConvexTime is a timestamp in a Convex document, in Unix seconds, which
+// are fractional for times stored with Options.MillisecondTimes. It is
+// written as a number, but can be read from either a number or an RFC 3339
+// string, for deployments whose schema stores timestamps as ISO strings.
+type ConvexTime float64
+
+func (t *ConvexTime) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		parsed, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return fmt.Errorf("invalid Convex timestamp: %w", err)
+		}
+		*t = ConvexTime(float64(parsed.UnixNano()) / 1e9)
+		return nil
+	}
+	var f float64
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("invalid Convex timestamp %s: %w", b, err)
+	}
+	*t = ConvexTime(f)
+	return nil
+}
+
+// convexTime returns t as a ConvexTime, to the millisecond.
+func convexTime(t time.Time) ConvexTime {
+	return ConvexTime(float64(t.UnixMilli()) / 1e3)
+}
+
+// time returns t as a time.Time, rounded to the millisecond, which is the
+// most precision float64 seconds reliably carry.
+func (t ConvexTime) time() time.Time {
+	return time.UnixMilli(int64(math.Round(float64(t) * 1e3)))
+}
+
+// link returns the Link stored in doc.
+func (doc *LinkDocument) link() *Link {
+	var expiresAt time.Time
+	if doc.ExpiresAt != 0 {
+		expiresAt = doc.ExpiresAt.time()
+	}
+	// Links stored before edits were counted have no count.
+	editCount := doc.EditCount
+	if editCount == 0 {
+		editCount = 1
+	}
+	return &Link{
+		Short:    doc.Short,
+		Long:     doc.Long,
+		Created:  doc.Created.time(),
+		LastEdit: doc.LastEdit.time(),
+		Owner:    doc.Owner,
+
+		Destinations:  doc.Destinations,
+		RedirectCode:  doc.RedirectCode,
+		Namespace:     doc.Namespace,
+		CreatedFrom:   doc.CreatedFrom,
+		EditCount:     editCount,
+		AllowedOwners: doc.AllowedOwners,
+		ExpiresAt:     expiresAt,
+		IconURL:       doc.IconURL,
+		Pinned:        doc.Pinned,
+		MaxUses:       doc.MaxUses,
+		UseCount:      doc.UseCount,
+		Source:        doc.Source,
+		Headers:       doc.Headers,
+	}
+}
+
+// encodeDoc returns doc for sending to Convex, with its fields renamed by
+// c.FieldMap.
+func (c *ConvexDB) encodeDoc(doc *LinkDocument) (any, error) {
+	if len(c.FieldMap) == 0 {
+		return doc, nil
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	renamed := make(map[string]json.RawMessage, len(fields))
+	for name, value := range fields {
+		if mapped, ok := c.FieldMap[name]; ok {
+			name = mapped
+		}
+		renamed[name] = value
+	}
+	return renamed, nil
+}
+
+// decodeLink returns the Link in a document received from Convex, reversing
+// c.FieldMap. It returns nil if data is null. CreatedFrom is left out, as
+// only LoadWithMeta returns it.
+func (c *ConvexDB) decodeLink(data json.RawMessage) (*Link, error) {
+	link, err := c.decodeLinkMeta(data)
+	if link != nil {
+		link.CreatedFrom = ""
+	}
+	return link, err
+}
+
+// decodeLinkMeta is like decodeLink, but keeps CreatedFrom.
+func (c *ConvexDB) decodeLinkMeta(data json.RawMessage) (*Link, error) {
+	if len(c.FieldMap) > 0 {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, err
+		}
+		if fields == nil {
+			return nil, nil
+		}
+		reverse := make(map[string]string, len(c.FieldMap))
+		for name, mapped := range c.FieldMap {
+			reverse[mapped] = name
+		}
+		renamed := make(map[string]json.RawMessage, len(fields))
+		for name, value := range fields {
+			if orig, ok := reverse[name]; ok {
+				name = orig
+			}
+			renamed[name] = value
+		}
+		var err error
+		if data, err = json.Marshal(renamed); err != nil {
+			return nil, err
+		}
+	}
+	var doc *LinkDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, nil
+	}
+	link := doc.link()
+	if err := c.decodeFields(link); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// decodeLinks returns the Links in an array of documents received from
+// Convex, reversing c.FieldMap.
+func (c *ConvexDB) decodeLinks(data json.RawMessage) ([]*Link, error) {
+	var docs []json.RawMessage
+	if err := json.Unmarshal(data, &docs); err != nil {
+		return nil, err
+	}
+	var links []*Link
+	for _, doc := range docs {
+		link, err := c.decodeLink(doc)
+		if err != nil {
+			return nil, err
+		}
+		if link != nil {
+			links = append(links, link)
+		}
+	}
+	return links, nil
 }
 
 type StatsMap = map[string]interface{}
 
+// ConvexDB stores Links in a Convex deployment.
+//
+// ConvexDB is safe for concurrent use by multiple goroutines. Its
+// configuration must not be changed while it is in use, each request is
+// built from its own copy of the arguments, and the query cache is guarded
+// by its own mutex.
 type ConvexDB struct {
-	url   string
-	token string
+	Options
+
+	// QueryCacheTTL is how long query results are cached for. Repeated
+	// identical queries (same function path and arguments) within that
+	// window reuse the earlier result without a round-trip to Convex.
+	// Zero, the default, disables caching: only enable it for callers that
+	// can tolerate stale reads.
+	QueryCacheTTL time.Duration
+
+	// QueryCacheInvalidation maps a mutation path, such as "store", to the
+	// query paths whose cached results it invalidates, such as
+	// "load:loadOne". Mutations not listed here invalidate the whole cache.
+	QueryCacheInvalidation map[string][]string
+
+	// ContextHeaders maps context keys to the names of HTTP headers to send
+	// their values in, such as a request or trace ID key to "X-Request-Id".
+	// For each Convex call made with a context carrying a string value for
+	// one of these keys, that value is sent in the corresponding header, so
+	// that the call can be correlated with the request that caused it.
+	ContextHeaders map[any]string
+
+	// FieldMap renames the fields of link documents, for deployments whose
+	// schema predates this package. It maps the JSON field names of
+	// LinkDocument to the names used by the deployment, such as "short" to
+	// "slug" and "long" to "destination". Any LinkDocument field can be
+	// mapped, and unmapped fields keep their names.
+	FieldMap map[string]string
+
+	// StrictStats makes LoadStats fail if any entry in the stats returned
+	// by Convex is malformed, rather than skipping it.
+	StrictStats bool
+
+	// LoadManyConcurrency is the most load:loadOne queries LoadMany has in
+	// flight for deployments without the load:loadMany query. If zero, 8
+	// is used.
+	LoadManyConcurrency int
+
+	transport ConvexTransport
+	token     TokenProvider
+	cache     queryCache
+}
+
+// queryCache holds cached query results for a ConvexDB.
+type queryCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]queryCacheEntry
+	hits    int64
+	misses  int64
+}
+
+type queryCacheEntry struct {
+	path    string
+	value   json.RawMessage
+	expires time.Time
+}
+
+// maxQueryCacheEntries is the cache size above which expired entries are
+// pruned when a new entry is added.
+const maxQueryCacheEntries = 1024
+
+// queryCacheKey returns the cache key for args. The token is not part of
+// args.Args at this point, so it never contributes to the key.
+func queryCacheKey(args *UdfExecution) ([sha256.Size]byte, error) {
+	encodedArgs, err := json.Marshal(args.Args)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	h := sha256.New()
+	io.WriteString(h, args.Path)
+	h.Write([]byte{0})
+	io.WriteString(h, args.Format)
+	h.Write([]byte{0})
+	h.Write(encodedArgs)
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key, nil
+}
+
+func (qc *queryCache) get(key [sha256.Size]byte, now time.Time) (json.RawMessage, bool) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	entry, ok := qc.entries[key]
+	if !ok || !now.Before(entry.expires) {
+		qc.misses++
+		return nil, false
+	}
+	qc.hits++
+	return entry.value, true
+}
+
+func (qc *queryCache) put(key [sha256.Size]byte, entry queryCacheEntry, now time.Time) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	if qc.entries == nil {
+		qc.entries = make(map[[sha256.Size]byte]queryCacheEntry)
+	}
+	if len(qc.entries) >= maxQueryCacheEntries {
+		for k, e := range qc.entries {
+			if !now.Before(e.expires) {
+				delete(qc.entries, k)
+			}
+		}
+	}
+	qc.entries[key] = entry
+}
+
+// invalidate removes cached results for the given query paths, or all cached
+// results if paths is nil.
+func (qc *queryCache) invalidate(paths []string) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	if paths == nil {
+		qc.entries = nil
+		return
+	}
+	for k, e := range qc.entries {
+		for _, path := range paths {
+			if e.path == path {
+				delete(qc.entries, k)
+				break
+			}
+		}
+	}
+}
+
+// QueryCacheStats returns the number of query cache hits and misses. Both are
+// zero if QueryCacheTTL is unset.
+func (c *ConvexDB) QueryCacheStats() (hits, misses int64) {
+	c.cache.mu.Lock()
+	defer c.cache.mu.Unlock()
+	return c.cache.hits, c.cache.misses
 }
 
 type UdfExecution struct {
@@ -38,168 +364,1917 @@ type ConvexResponse struct {
 	ErrorMessage string          `json:"errorMessage"`
 }
 
+// NewConvexDB returns a ConvexDB that calls the functions in src/convex
+// through the query and mutation API of the Convex deployment at url.
 func NewConvexDB(url string, token string) *ConvexDB {
-	return &ConvexDB{url: url, token: token}
+	return NewConvexDBWithTransport(&UDFTransport{URL: url}, token)
+}
+
+// NewConvexDBWithTransport returns a ConvexDB that makes calls with t, such
+// as an *HTTPActionTransport.
+func NewConvexDBWithTransport(t ConvexTransport, token string) *ConvexDB {
+	return NewConvexDBWithTokenProvider(t, StaticToken(token))
+}
+
+// TokenProvider returns the authorization token for a call to Convex, such
+// as a short-lived token rotated by another process. It is called for
+// every call, so it should cache the token itself if fetching it is
+// expensive. A TokenProvider must be safe for concurrent use.
+type TokenProvider func(ctx context.Context) (string, error)
+
+// StaticToken returns a TokenProvider that always returns token.
+func StaticToken(token string) TokenProvider {
+	return func(context.Context) (string, error) { return token, nil }
+}
+
+// NewConvexDBWithTokenProvider returns a ConvexDB that makes calls with t,
+// authorized by the token returned by token for each call. If token
+// returns an error, the call fails with that error without being made.
+func NewConvexDBWithTokenProvider(t ConvexTransport, token TokenProvider) *ConvexDB {
+	return &ConvexDB{Options: Options{MaxLongLength: DefaultMaxLongLength}, transport: t, token: token}
 }
 
-func (c *ConvexDB) mutation(args *UdfExecution) error {
-	args.Args["token"] = c.token
-	url := fmt.Sprintf("%s/api/mutation", c.url)
-	encodedArgs, err := json.Marshal(args)
+// call runs the function described by args using the given Convex API
+// endpoint ("query" or "mutation"), and returns its result value.
+//
+// Values in ctx for the keys in c.ContextHeaders are sent as HTTP headers.
+func (c *ConvexDB) call(ctx context.Context, endpoint string, args *UdfExecution) (json.RawMessage, error) {
+	token, err := c.token(ctx)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("convex: getting authorization token: %w", err)
+	}
+	return c.callWithToken(ctx, endpoint, args, token)
+}
+
+// callWithToken is like call, but authorizes the call with token.
+func (c *ConvexDB) callWithToken(ctx context.Context, endpoint string, args *UdfExecution, token string) (json.RawMessage, error) {
+	// Add the token to a copy of args.Args rather than the caller's map, so
+	// that a UdfExecution can be safely reused or shared between goroutines.
+	udfArgs := make(map[string]interface{}, len(args.Args)+1)
+	for k, v := range args.Args {
+		udfArgs[k] = v
+	}
+	udfArgs["token"] = token
+	var header http.Header
+	for key, name := range c.ContextHeaders {
+		if value, ok := ctx.Value(key).(string); ok && value != "" {
+			if header == nil {
+				header = make(http.Header)
+			}
+			header.Set(name, value)
+		}
+	}
+	return c.transport.Call(ctx, endpoint, &UdfExecution{Path: args.Path, Args: udfArgs, Format: args.Format}, header)
+}
+
+func (c *ConvexDB) mutation(ctx context.Context, args *UdfExecution) error {
+	_, err := c.mutationValue(ctx, args)
+	return err
+}
+
+// mutationValue is like mutation, but also returns the mutation's result.
+func (c *ConvexDB) mutationValue(ctx context.Context, args *UdfExecution) (json.RawMessage, error) {
+	value, err := c.call(ctx, "mutation", args)
+	if c.QueryCacheTTL > 0 {
+		// Invalidate even if the mutation failed, since it may have been
+		// applied before the failure was reported.
+		c.cache.invalidate(c.QueryCacheInvalidation[args.Path])
+	}
+	return value, err
+}
+
+func (c *ConvexDB) query(ctx context.Context, args *UdfExecution) (json.RawMessage, error) {
+	if c.QueryCacheTTL <= 0 {
+		return c.call(ctx, "query", args)
 	}
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(encodedArgs))
+	key, err := queryCacheKey(args)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if value, ok := c.cache.get(key, c.now()); ok {
+		return value, nil
+	}
+	value, err := c.call(ctx, "query", args)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.put(key, queryCacheEntry{path: args.Path, value: value, expires: c.now().Add(c.QueryCacheTTL)}, c.now())
+	return value, nil
+}
+
+// runQueriesConcurrency is the most queries RunQueries has in flight.
+const runQueriesConcurrency = 4
+
+// RunQueries runs several queries concurrently, such as those needed to
+// render a dashboard. Convex has no endpoint that runs multiple queries in
+// one request, so at most a few are in flight at once. Each query is
+// authorized and cached like ConvexDB's own queries.
+//
+// The result for each query is at the same index in the returned slice,
+// with Status "success" and its Value, or Status "error" and its
+// ErrorMessage, so that one failing query doesn't fail the rest. The error
+// is non-nil only if ctx is done before every query has been run.
+func (c *ConvexDB) RunQueries(ctx context.Context, queries []UdfExecution) ([]ConvexResponse, error) {
+	results := make([]ConvexResponse, len(queries))
+	sem := make(chan struct{}, runQueriesConcurrency)
+	var wg sync.WaitGroup
+	for i := range queries {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return results, ctx.Err()
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() { <-sem; wg.Done() }()
+			value, err := c.query(ctx, &queries[i])
+			if err != nil {
+				results[i] = ConvexResponse{Status: "error", ErrorMessage: err.Error()}
+				return
+			}
+			results[i] = ConvexResponse{Status: "success", Value: value}
+		}(i)
+	}
+	wg.Wait()
+	return results, ctx.Err()
+}
+
+func (c *ConvexDB) LoadAll() ([]*Link, error) {
+	links, err := c.loadStored()
+	if err != nil {
+		return nil, err
 	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("unexpected status code from Convex: %d", resp.StatusCode)
+	for i, link := range links {
+		links[i] = c.transform(link)
 	}
+	return links, nil
+}
 
-	defer resp.Body.Close()
-	var convexResponse ConvexResponse
-	err = json.NewDecoder(resp.Body).Decode(&convexResponse)
+// LoadNamespace returns all Links in namespace. The empty namespace selects
+// links in the default namespace.
+func (c *ConvexDB) LoadNamespace(namespace string) ([]*Link, error) {
+	args := UdfExecution{"load:loadNamespace", map[string]interface{}{"namespace": namespace}, "json"}
+	resp, err := c.query(context.Background(), &args)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if convexResponse.Status == "success" {
-		return nil
+	return c.decodeLinks(resp)
+}
+
+// LoadModifiedSince returns the Links last edited at or after t, for
+// incremental syncing. Deleted links are not reported, so a periodic full
+// LoadAll is still needed to reconcile deletions.
+func (c *ConvexDB) LoadModifiedSince(t time.Time) ([]*Link, error) {
+	args := UdfExecution{"load:loadModifiedSince", map[string]interface{}{"since": float64(t.Unix())}, "json"}
+	resp, err := c.query(context.Background(), &args)
+	if err != nil {
+		return nil, err
 	}
-	if convexResponse.Status == "error" {
-		return fmt.Errorf("error from Convex: %s", convexResponse.ErrorMessage)
+	return c.decodeLinks(resp)
+}
+
+// LoadOwnerless returns the Links whose Owner is empty or only whitespace,
+// ordered by creation time, as SQLiteDB.LoadOwnerless does.
+func (c *ConvexDB) LoadOwnerless() ([]*Link, error) {
+	args := UdfExecution{"load:loadOwnerless", map[string]interface{}{}, "json"}
+	resp, err := c.query(context.Background(), &args)
+	if err != nil {
+		return nil, err
 	}
-	return fmt.Errorf("unexpected response from Convex: %s", resp.Body)
+	return c.decodeLinks(resp)
 }
 
-func (c *ConvexDB) query(args *UdfExecution) (json.RawMessage, error) {
-	args.Args["token"] = c.token
-	url := fmt.Sprintf("%s/api/query", c.url)
-	encodedArgs, err := json.Marshal(args)
+// AllIDs returns the normalized ID of every link, in order, as
+// SQLiteDB.AllIDs does. Only the IDs are sent by the deployment.
+func (c *ConvexDB) AllIDs() ([]string, error) {
+	args := UdfExecution{"load:loadIDs", map[string]interface{}{}, "json"}
+	resp, err := c.query(context.Background(), &args)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(encodedArgs))
+	var ids []string
+	if err := json.Unmarshal(resp, &ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// CountBySource returns the number of links created with each app, as
+// SQLiteDB.CountBySource does. The deployment counts them with the
+// load:countBySource query, so the links aren't sent.
+func (c *ConvexDB) CountBySource() (map[string]int, error) {
+	args := UdfExecution{"load:countBySource", map[string]interface{}{}, "json"}
+	resp, err := c.query(context.Background(), &args)
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("unexpected status code from Convex: %d: %s", resp.StatusCode, body)
+	var counts map[string]int
+	if err := json.Unmarshal(resp, &counts); err != nil {
+		return nil, err
+	}
+	if counts == nil {
+		counts = make(map[string]int)
 	}
+	return counts, nil
+}
 
-	defer resp.Body.Close()
-	var convexResponse ConvexResponse
-	err = json.NewDecoder(resp.Body).Decode(&convexResponse)
+// LoadByLong returns the Links whose Long URL is long, once canonicalized
+// by c.Canonicalizer, as SQLiteDB.LoadByLong does.
+func (c *ConvexDB) LoadByLong(long string) ([]*Link, error) {
+	long, err := c.canonicalLong(long)
 	if err != nil {
 		return nil, err
 	}
-	if convexResponse.Status == "success" {
-		return convexResponse.Value, nil
+	links, err := c.loadStored()
+	if err != nil {
+		return nil, err
 	}
-	if convexResponse.Status == "error" {
-		return nil, fmt.Errorf("error from Convex: %s", convexResponse.ErrorMessage)
+	var matched []*Link
+	for _, link := range links {
+		if link.Long == long {
+			matched = append(matched, link)
+		}
 	}
-	return nil, fmt.Errorf("unexpected response from Convex: %s", resp.Body)
+	return matched, nil
 }
 
-func (c *ConvexDB) LoadAll() ([]*Link, error) {
+// LoadByLongPattern returns the Links whose Long URL matches pattern, with
+// the pattern syntax of SQLiteDB.LoadByLongPattern. Links are matched as
+// stored, before any LoadTransform. An empty pattern matches no links.
+func (c *ConvexDB) LoadByLongPattern(pattern string) ([]*Link, error) {
+	if pattern == "" {
+		return nil, nil
+	}
 	args := UdfExecution{"load:loadAll", map[string]interface{}{}, "json"}
-	resp, err := c.query(&args)
+	resp, err := c.query(context.Background(), &args)
 	if err != nil {
 		return nil, err
 	}
-	var docs []LinkDocument
-	decoder := json.NewDecoder(bytes.NewReader(resp))
-	decoder.UseNumber()
-	err = decoder.Decode(&docs)
+	links, err := c.decodeLinks(resp)
 	if err != nil {
 		return nil, err
 	}
-	var links []*Link
-	for _, doc := range docs {
-		link := Link{
-			Short:    doc.Short,
-			Long:     doc.Long,
-			Created:  time.Unix(int64(doc.Created), 0),
-			LastEdit: time.Unix(int64(doc.LastEdit), 0),
-			Owner:    doc.Owner,
+	match := longMatcher(pattern)
+	var matched []*Link
+	for _, link := range links {
+		if match(link.Long) {
+			matched = append(matched, link)
 		}
-		links = append(links, &link)
 	}
-	return links, nil
+	return matched, nil
 }
 
-func (c *ConvexDB) Load(short string) (*Link, error) {
-	args := UdfExecution{"load:loadOne", map[string]interface{}{"normalizedId": linkID(short)}, "json"}
-	resp, err := c.query(&args)
+// LoadCreatedBetween returns the Links created from from to to inclusive,
+// ordered by creation time. A zero to means until now. Times are compared
+// as the stored Unix seconds, so their time zones don't matter.
+func (c *ConvexDB) LoadCreatedBetween(from, to time.Time) ([]*Link, error) {
+	if to.IsZero() {
+		to = c.now()
+	}
+	args := UdfExecution{"load:loadCreatedBetween", map[string]interface{}{"from": float64(from.Unix()), "to": float64(to.Unix())}, "json"}
+	resp, err := c.query(context.Background(), &args)
 	if err != nil {
 		return nil, err
 	}
-	var doc *LinkDocument
-	decoder := json.NewDecoder(bytes.NewReader(resp))
-	decoder.UseNumber()
-	err = decoder.Decode(&doc)
+	return c.decodeLinks(resp)
+}
+
+// ListLinks returns the page of links described by opts, ordered by
+// normalized name. An offset past the last link returns an empty page.
+//
+// The page and the total are read by the load:listLinks query, so that
+// they agree, and only the page's links are sent back, though Convex still
+// reads every matching link to count them.
+func (c *ConvexDB) ListLinks(opts ListOptions) (*LinkPage, error) {
+	if opts.Offset < 0 {
+		return nil, fmt.Errorf("invalid offset %d", opts.Offset)
+	}
+	args := UdfExecution{"load:listLinks", map[string]interface{}{"offset": opts.Offset, "n": opts.limit(), "owner": opts.Owner}, "json"}
+	resp, err := c.query(context.Background(), &args)
 	if err != nil {
 		return nil, err
 	}
-	if doc == nil {
-		err := fs.ErrNotExist
+	var page struct {
+		Links json.RawMessage `json:"links"`
+		Total int             `json:"total"`
+	}
+	if err := json.Unmarshal(resp, &page); err != nil {
 		return nil, err
 	}
+	items, err := c.decodeLinks(page.Links)
+	if err != nil {
+		return nil, err
+	}
+	if items == nil {
+		items = []*Link{}
+	}
+	return newLinkPage(items, page.Total, opts), nil
+}
 
-	link := Link{
-		Short:    doc.Short,
-		Long:     doc.Long,
-		Created:  time.Unix(int64(doc.Created), 0),
-		LastEdit: time.Unix(int64(doc.LastEdit), 0),
-		Owner:    doc.Owner,
+// LoadPage returns up to n links ordered by normalized name, starting after
+// cursor, and the cursor of the next page. The empty cursor starts at the
+// first link, and an empty next cursor means there are no more links.
+//
+// Cursors are opaque strings that may be persisted and passed to LoadPage
+// after a restart, or to another process using the same store, to resume a
+// sync. A cursor records the last link returned rather than an offset, so
+// resuming never repeats or skips links that existed throughout the sync:
+// links saved or deleted after the cursor's position are seen (or not) as
+// they are when their page is loaded, and links added before it are only
+// seen by a new sync. A cursor stays valid even if the link it names is
+// deleted. A string that is not a cursor returns an error wrapping
+// ErrInvalidCursor.
+//
+// Unlike ListLinks, LoadPage doesn't count the links, so Convex only reads
+// the requested page.
+func (c *ConvexDB) LoadPage(cursor string, n int) ([]*Link, string, error) {
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if n <= 0 {
+		return nil, "", fmt.Errorf("invalid page size %d", n)
+	}
+	// Load one extra link to tell whether there is another page.
+	args := UdfExecution{"load:loadPage", map[string]interface{}{"after": after, "n": n + 1}, "json"}
+	resp, err := c.query(context.Background(), &args)
+	if err != nil {
+		return nil, "", err
 	}
-	return &link, nil
+	links, err := c.decodeLinks(resp)
+	if err != nil {
+		return nil, "", err
+	}
+	return pageLinks(links, n)
 }
 
-func (c *ConvexDB) Save(link *Link) error {
-	document := LinkDocument{
-		Id:       linkID(link.Short),
-		Short:    link.Short,
-		Long:     link.Long,
-		Created:  float64(link.Created.Unix()),
-		LastEdit: float64(link.LastEdit.Unix()),
-		Owner:    link.Owner,
+// RandomLink returns a link chosen uniformly at random, as
+// SQLiteDB.RandomLink does. The choice is made with c.Rand and passed to the
+// load:loadRandom query, so only the chosen link is sent back, though
+// Convex still reads every link to count them.
+//
+// It returns fs.ErrNotExist if there are no links.
+func (c *ConvexDB) RandomLink() (*Link, error) {
+	// r is in [0, 1), with the precision of a float64.
+	r := float64(c.randInt63n(1<<53)) / (1 << 53)
+	args := UdfExecution{"load:loadRandom", map[string]interface{}{"r": r}, "json"}
+	resp, err := c.query(context.Background(), &args)
+	if err != nil {
+		return nil, err
+	}
+	link, err := c.decodeLink(resp)
+	if err != nil {
+		return nil, err
 	}
-	args := UdfExecution{"store", map[string]interface{}{"link": document}, "json"}
-	return c.mutation(&args)
+	if link == nil {
+		return nil, fs.ErrNotExist
+	}
+	return c.transform(link), nil
 }
 
-func (c *ConvexDB) LoadStats() (ClickStats, error) {
-	args := UdfExecution{"stats:loadStats", map[string]interface{}{}, "json"}
-	response, err := c.query(&args)
+// LoadMostEdited returns the n links that have been saved the most times,
+// most edited first, to find links that keep being changed.
+func (c *ConvexDB) LoadMostEdited(n int) ([]*Link, error) {
+	args := UdfExecution{"load:loadMostEdited", map[string]interface{}{"n": n}, "json"}
+	resp, err := c.query(context.Background(), &args)
 	if err != nil {
 		return nil, err
 	}
-	var stats StatsMap
-	decoder := json.NewDecoder(bytes.NewReader(response))
-	decoder.UseNumber()
-	err = decoder.Decode(&stats)
+	return c.decodeLinks(resp)
+}
+
+func (c *ConvexDB) LoadAllMap() (map[string]*Link, error) {
+	links, err := c.LoadAll()
 	if err != nil {
 		return nil, err
 	}
-	clicks := make(ClickStats)
-	for k, v := range stats {
-		num, err := v.(json.Number).Float64()
+	return linkMap(links)
+}
+
+func (c *ConvexDB) FindCollisions() (map[string][]*Link, error) {
+	links, err := c.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+	return findCollisions(links), nil
+}
+
+// Renormalize recomputes the ID of every link under the current
+// normalization, as SQLiteDB.Renormalize does. The IDs are changed by the
+// renormalize mutation in one transaction, which fails with ErrConflict,
+// changing nothing, if links are saved or deleted after they are loaded
+// here. Stats and aliases refer to links by document, so they need no
+// changes.
+func (c *ConvexDB) Renormalize() (int, error) {
+	args := UdfExecution{"load:loadAll", map[string]interface{}{}, "json"}
+	resp, err := c.query(context.Background(), &args)
+	if err != nil {
+		return 0, err
+	}
+	var docs []json.RawMessage
+	if err := json.Unmarshal(resp, &docs); err != nil {
+		return 0, err
+	}
+	idField := "normalizedId"
+	if mapped, ok := c.FieldMap[idField]; ok {
+		idField = mapped
+	}
+
+	type rename struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	renames := []rename{}
+	byID := make(map[string]string) // new ID -> link name
+	for _, doc := range docs {
+		link, err := c.decodeLink(doc)
 		if err != nil {
-			return nil, err
+			return 0, err
+		}
+		if link == nil {
+			continue
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(doc, &fields); err != nil {
+			return 0, err
+		}
+		var id string
+		if err := json.Unmarshal(fields[idField], &id); err != nil {
+			return 0, err
+		}
+		newID := linkID(link.Name())
+		if other, ok := byID[newID]; ok {
+			return 0, fmt.Errorf("links %q and %q have the same normalized ID %q", other, link.Name(), newID)
+		}
+		byID[newID] = link.Name()
+		if newID != id {
+			renames = append(renames, rename{From: id, To: newID})
 		}
-		clicks[k] = int(num)
 	}
-	return clicks, nil
+	if len(renames) == 0 {
+		return 0, nil
+	}
+
+	args = UdfExecution{"renormalize", map[string]interface{}{"renames": renames}, "json"}
+	resp, err = c.mutationValue(context.Background(), &args)
+	if err != nil {
+		return 0, err
+	}
+	var result struct {
+		Status       string `json:"status"`
+		NormalizedId string `json:"normalizedId"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return 0, err
+	}
+	switch result.Status {
+	case "updated":
+		return len(renames), nil
+	case "conflict":
+		return 0, fmt.Errorf("%w: %q changed during renormalization", ErrConflict, result.NormalizedId)
+	default:
+		return 0, fmt.Errorf("unexpected renormalize status %q", result.Status)
+	}
 }
 
-func (c *ConvexDB) SaveStats(stats ClickStats) error {
-	mungedStats := make(map[string]int)
-	for id, clicks := range stats {
-		mungedStats[linkID(id)] = clicks
+// DetectCycles returns the cycles of links whose Long URL or destinations
+// point at each other through LinkHosts, such as go/a pointing at go/b and
+// go/b back at go/a, which redirect forever. See findCycles.
+func (c *ConvexDB) DetectCycles() ([][]string, error) {
+	links, err := c.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+	return findCycles(links, c.linkHosts()), nil
+}
+
+// CheckLinks checks whether the destination of each stored link is still
+// reachable, making at most opts.Concurrency requests at once. Template
+// links can't be checked and are marked Unverifiable. The store is not
+// modified.
+func (c *ConvexDB) CheckLinks(ctx context.Context, opts CheckOptions) ([]LinkHealth, error) {
+	links, err := c.LoadAll()
+	if err != nil {
+		return nil, err
 	}
-	args := UdfExecution{"stats:saveStats", map[string]interface{}{"stats": mungedStats}, "json"}
-	return c.mutation(&args)
+	return checkLinks(ctx, links, opts)
+}
+
+func (c *ConvexDB) Load(short string) (*Link, error) {
+	return c.LoadContext(context.Background(), short)
+}
+
+// LoadContext is like Load, but sends the values in ctx selected by
+// c.ContextHeaders along with the query.
+func (c *ConvexDB) LoadContext(ctx context.Context, short string) (*Link, error) {
+	if err := checkLoadShort(short); err != nil {
+		return nil, err
+	}
+	args := UdfExecution{"load:loadOne", map[string]interface{}{"normalizedId": linkID(short)}, "json"}
+	resp, err := c.query(ctx, &args)
+	if err != nil {
+		return nil, err
+	}
+	link, err := c.decodeLink(resp)
+	if err != nil {
+		return nil, err
+	}
+	if link == nil {
+		return nil, fs.ErrNotExist
+	}
+	return c.transform(link), nil
+}
+
+// LoadMany returns the Links with the given short names, keyed by the names
+// as passed. Names without a link are left out. The links are loaded by one
+// load:loadMany query or, for deployments without it, by a load:loadOne
+// query for each name, at most c.LoadManyConcurrency at once.
+//
+// If some names fail to load, the links that did load are returned along
+// with an error joining the error for each of those names, and ctx.Err() if
+// ctx is done before every name has been loaded.
+func (c *ConvexDB) LoadMany(ctx context.Context, shorts []string) (map[string]*Link, error) {
+	// Names that normalize to the same ID are loaded once.
+	var ids []string
+	byID := make(map[string][]string)
+	for _, short := range shorts {
+		if checkShort(short) != nil {
+			continue
+		}
+		id := linkID(short)
+		if _, ok := byID[id]; !ok {
+			ids = append(ids, id)
+		}
+		byID[id] = append(byID[id], short)
+	}
+	links := make(map[string]*Link)
+	if len(ids) == 0 {
+		return links, nil
+	}
+
+	args := UdfExecution{"load:loadMany", map[string]interface{}{"normalizedIds": ids}, "json"}
+	resp, err := c.query(ctx, &args)
+	if err != nil && isMissingFunction(err) {
+		return c.loadEach(ctx, ids, byID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var docs []json.RawMessage
+	if err := json.Unmarshal(resp, &docs); err != nil {
+		return nil, err
+	}
+	if len(docs) != len(ids) {
+		return nil, fmt.Errorf("load:loadMany returned %d links for %d IDs", len(docs), len(ids))
+	}
+	for i, doc := range docs {
+		link, err := c.decodeLink(doc)
+		if err != nil {
+			return nil, err
+		}
+		if link == nil {
+			continue
+		}
+		for _, short := range byID[ids[i]] {
+			links[short] = c.transform(link)
+		}
+	}
+	return links, nil
+}
+
+// loadEach is LoadMany for deployments without the load:loadMany query. It
+// loads the names of each ID in byID with a load:loadOne query.
+func (c *ConvexDB) loadEach(ctx context.Context, ids []string, byID map[string][]string) (map[string]*Link, error) {
+	concurrency := c.LoadManyConcurrency
+	if concurrency <= 0 {
+		concurrency = 8
+	}
+	links := make(map[string]*Link)
+	var errs []error
+	var mu sync.Mutex // guards links and errs
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return links, errors.Join(append(errs, ctx.Err())...)
+		}
+		wg.Add(1)
+		go func(shorts []string) {
+			defer func() { <-sem; wg.Done() }()
+			link, err := c.LoadContext(ctx, shorts[0])
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case errors.Is(err, fs.ErrNotExist):
+			case err != nil:
+				errs = append(errs, fmt.Errorf("loading %q: %w", shorts[0], err))
+			default:
+				for _, short := range shorts {
+					links[short] = link
+				}
+			}
+		}(byID[id])
+	}
+	wg.Wait()
+	return links, errors.Join(errs...)
+}
+
+// LoadWithMeta is like Load, but also returns the link's CreatedFrom, for
+// administrators investigating abuse.
+func (c *ConvexDB) LoadWithMeta(short string) (*Link, error) {
+	if err := checkLoadShort(short); err != nil {
+		return nil, err
+	}
+	args := UdfExecution{"load:loadOne", map[string]interface{}{"normalizedId": linkID(short)}, "json"}
+	resp, err := c.query(context.Background(), &args)
+	if err != nil {
+		return nil, err
+	}
+	link, err := c.decodeLinkMeta(resp)
+	if err != nil {
+		return nil, err
+	}
+	if link == nil {
+		return nil, fs.ErrNotExist
+	}
+	return link, nil
+}
+
+func (c *ConvexDB) LoadWithStats(short string) (*Link, int, error) {
+	if err := checkLoadShort(short); err != nil {
+		return nil, 0, err
+	}
+	args := UdfExecution{"load:loadWithStats", map[string]interface{}{"normalizedId": linkID(short)}, "json"}
+	resp, err := c.query(context.Background(), &args)
+	if err != nil {
+		return nil, 0, err
+	}
+	var result *struct {
+		Link   json.RawMessage `json:"link"`
+		Clicks float64         `json:"clicks"`
+	}
+	err = json.Unmarshal(resp, &result)
+	if err != nil {
+		return nil, 0, err
+	}
+	if result == nil {
+		return nil, 0, fs.ErrNotExist
+	}
+	link, err := c.decodeLink(result.Link)
+	if err != nil {
+		return nil, 0, err
+	}
+	if link == nil {
+		return nil, 0, fs.ErrNotExist
+	}
+	return link, int(result.Clicks), nil
+}
+
+func (c *ConvexDB) Save(link *Link) error {
+	if err := c.checkReserved(link.Name()); err != nil {
+		return err
+	}
+	return c.SaveAdmin(link)
+}
+
+// SaveAdmin is like Save, but allows links with reserved short names.
+func (c *ConvexDB) SaveAdmin(link *Link) error {
+	_, err := c.store(link, nil, false)
+	return err
+}
+
+// SaveNew saves link as Save does, but only if no link or alias has its
+// name, checking and saving in one store mutation. It returns an error
+// wrapping ErrLinkExists otherwise.
+func (c *ConvexDB) SaveNew(link *Link) error {
+	_, err := c.saveNew(link)
+	return err
+}
+
+// saveNew is SaveNew, returning the link as stored.
+func (c *ConvexDB) saveNew(link *Link) (*Link, error) {
+	if err := c.checkReserved(link.Name()); err != nil {
+		return nil, err
+	}
+	return c.store(link, nil, true)
+}
+
+// CreateRandomShort saves a link to long owned by owner under a new random
+// short name of length characters, as described by
+// SQLiteDB.CreateRandomShort, and returns it.
+func (c *ConvexDB) CreateRandomShort(long, owner string, length int) (*Link, error) {
+	return c.createRandomShort(c.saveNew, long, owner, length)
+}
+
+// LoadVersioned is like Load, but also returns the stored version of the
+// link, an opaque token to pass to SaveIfVersion. The version is kept in
+// the link document by the mutations, since Convex doesn't expose a
+// document revision, and changes with every change to the link.
+func (c *ConvexDB) LoadVersioned(short string) (*Link, string, error) {
+	if err := checkLoadShort(short); err != nil {
+		return nil, "", err
+	}
+	args := UdfExecution{"load:loadOne", map[string]interface{}{"normalizedId": linkID(short)}, "json"}
+	resp, err := c.query(context.Background(), &args)
+	if err != nil {
+		return nil, "", err
+	}
+	link, err := c.decodeLink(resp)
+	if err != nil {
+		return nil, "", err
+	}
+	if link == nil {
+		return nil, "", fs.ErrNotExist
+	}
+	field := "version"
+	if mapped, ok := c.FieldMap[field]; ok {
+		field = mapped
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(resp, &doc); err != nil {
+		return nil, "", err
+	}
+	// Links stored before versions were kept are at version 1.
+	version := 1.0
+	if raw, ok := doc[field]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return nil, "", fmt.Errorf("invalid version of link %q: %w", short, err)
+		}
+	}
+	return c.transform(link), strconv.Itoa(int(version)), nil
+}
+
+// SaveIfVersion saves link as Save does, but only if the stored link is
+// still at version, as returned by LoadVersioned. The check and the save
+// are made by one store mutation. It returns an error wrapping ErrConflict
+// if the link has changed since, and fs.ErrNotExist if it no longer exists.
+func (c *ConvexDB) SaveIfVersion(link *Link, version string) error {
+	if err := c.checkReserved(link.Name()); err != nil {
+		return err
+	}
+	expected, err := strconv.Atoi(version)
+	if err != nil {
+		return fmt.Errorf("invalid link version %q", version)
+	}
+	_, err = c.store(link, &expected, false)
+	return err
+}
+
+// store saves link with the store mutation, if expectedVersion is nil or
+// the stored link is at *expectedVersion, and, if createOnly is set, only if
+// the link doesn't exist yet. It returns the link as stored.
+func (c *ConvexDB) store(link *Link, expectedVersion *int, createOnly bool) (_ *Link, err error) {
+	link, encoded, err := c.storeDocument(link)
+	if err != nil {
+		return nil, err
+	}
+	if expectedVersion == nil {
+		// A conditional save never creates a link.
+		var charged []bool
+		if charged, err = c.limitCreations([]*Link{link}); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				c.refundLinks([]*Link{link}, charged)
+			}
+		}()
+	}
+	args := UdfExecution{"store", map[string]interface{}{"link": encoded}, "json"}
+	c.setQuotaArgs(args.Args)
+	if expectedVersion != nil {
+		args.Args["expectedVersion"] = *expectedVersion
+	}
+	if createOnly {
+		args.Args["createOnly"] = true
+	}
+	resp, err := c.mutationValue(context.Background(), &args)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Created  bool `json:"created"`
+		Missing  bool `json:"missing"`
+		Conflict bool `json:"conflict"`
+		Exists   bool `json:"exists"`
+		storeQuotaResult
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return nil, err
+	}
+	if result.Missing {
+		return nil, fs.ErrNotExist
+	}
+	if result.Conflict {
+		return nil, fmt.Errorf("%w: %q is no longer at version %d", ErrConflict, link.Name(), *expectedVersion)
+	}
+	if result.Exists {
+		return nil, fmt.Errorf("%q: %w", link.Name(), ErrLinkExists)
+	}
+	if err := c.quotaError(link, result.storeQuotaResult); err != nil {
+		return nil, err
+	}
+	ev := ChangeEvent{Type: ChangeUpdate, Short: link.Name(), Link: link}
+	if result.Created {
+		ev.Type = ChangeCreate
+	}
+	c.notify(ev)
+	return link, nil
+}
+
+// limitCreations counts the links that don't exist yet against
+// c.CreationLimiter, and returns a *CreationRateLimitedError if any of their
+// owners is over the limit. Unlike SQLiteDB, which checks in the
+// transaction that inserts the link, it has to load the links to tell new
+// ones from updates, so it does so only if a limiter is set. It returns
+// whether each link was counted, to refund with refundLinks if it isn't
+// saved; if it fails, it refunds them itself.
+func (c *ConvexDB) limitCreations(links []*Link) (charged []bool, err error) {
+	if c.CreationLimiter == nil {
+		return nil, nil
+	}
+	var names []string
+	for _, link := range links {
+		if link.Owner != "" {
+			names = append(names, link.Name())
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	existing, err := c.LoadMany(context.Background(), names)
+	if err != nil {
+		return nil, err
+	}
+	charged = make([]bool, len(links))
+	var owners []string
+	for i, link := range links {
+		if _, ok := existing[link.Name()]; ok {
+			continue
+		}
+		if err := c.checkCreationRate(link.Owner, &owners); err != nil {
+			c.refundCreations(owners)
+			return nil, err
+		}
+		charged[i] = link.Owner != ""
+	}
+	return charged, nil
+}
+
+// refundLinks refunds the creations of links counted by limitCreations, as
+// reported by charged.
+func (c *ConvexDB) refundLinks(links []*Link, charged []bool) {
+	var owners []string
+	for i, ok := range charged {
+		if ok {
+			owners = append(owners, links[i].Owner)
+		}
+	}
+	if len(owners) > 0 {
+		c.refundCreations(owners)
+	}
+}
+
+// storeDocument prepares link to be saved, and returns it along with the
+// encoded document for the store and storeMany mutations.
+func (c *ConvexDB) storeDocument(link *Link) (*Link, any, error) {
+	link, err := c.prepareSave(link)
+	if err != nil {
+		return nil, nil, err
+	}
+	stored, err := c.encodeFields(link)
+	if err != nil {
+		return nil, nil, err
+	}
+	document := LinkDocument{
+		Id:       linkID(link.Name()),
+		Short:    link.Short,
+		Long:     stored.Long,
+		Created:  convexTime(link.Created),
+		LastEdit: convexTime(link.LastEdit),
+		Owner:    stored.Owner,
+
+		Destinations:  stored.Destinations,
+		RedirectCode:  link.RedirectCode,
+		Namespace:     link.Namespace,
+		CreatedFrom:   link.CreatedFrom,
+		AllowedOwners: link.AllowedOwners,
+		IconURL:       link.IconURL,
+		Pinned:        link.Pinned,
+		MaxUses:       link.MaxUses,
+		Source:        link.Source,
+		Headers:       link.Headers,
+	}
+	if !link.ExpiresAt.IsZero() {
+		document.ExpiresAt = convexTime(link.ExpiresAt)
+	}
+	encoded, err := c.encodeDoc(&document)
+	if err != nil {
+		return nil, nil, err
+	}
+	return link, encoded, nil
+}
+
+// setQuotaArgs adds c's link quotas to the arguments of the store and
+// storeMany mutations.
+func (c *ConvexDB) setQuotaArgs(args map[string]interface{}) {
+	if c.MaxLinksPerOwner > 0 {
+		args["maxLinksPerOwner"] = c.MaxLinksPerOwner
+	}
+	if c.MaxTotalLinks > 0 {
+		args["maxTotalLinks"] = c.MaxTotalLinks
+	}
+}
+
+// storeQuotaResult is the part of the store and storeMany results that
+// reports a link not saved because of a quota.
+type storeQuotaResult struct {
+	// QuotaCount is set to the owner's number of links if the link
+	// was not saved because they are at maxLinksPerOwner.
+	QuotaCount *int `json:"quotaCount"`
+	// TotalCount is set to the number of links if the link was not
+	// saved because there are maxTotalLinks.
+	TotalCount *int `json:"totalCount"`
+}
+
+// quotaError returns the error for link not being saved as reported by r,
+// or nil if it was not refused.
+func (c *ConvexDB) quotaError(link *Link, r storeQuotaResult) error {
+	if r.TotalCount != nil {
+		return &QuotaExceededError{Count: *r.TotalCount, Limit: c.MaxTotalLinks}
+	}
+	if r.QuotaCount != nil {
+		return &QuotaExceededError{Owner: link.Owner, Count: *r.QuotaCount, Limit: c.MaxLinksPerOwner}
+	}
+	return nil
+}
+
+// saveManyBatchSize is the most links SaveMany sends in one storeMany
+// mutation, to stay within Convex's limits on a transaction.
+const saveManyBatchSize = 100
+
+// SaveMany saves links as Save does, and reports how many were created and
+// how many replaced existing links. Links are sent to the storeMany
+// mutation in batches of saveManyBatchSize, each saved in one transaction.
+//
+// If saving fails, the result counts the links that were saved before the
+// failure: those in earlier batches, and, if a link is refused by a quota,
+// those before it in its batch.
+func (c *ConvexDB) SaveMany(links []*Link) (BatchResult, error) {
+	var result BatchResult
+	for len(links) > 0 {
+		batch := links
+		if len(batch) > saveManyBatchSize {
+			batch = batch[:saveManyBatchSize]
+		}
+		links = links[len(batch):]
+
+		prepared := make([]*Link, len(batch))
+		docs := make([]any, len(batch))
+		for i, link := range batch {
+			if err := c.checkReserved(link.Name()); err != nil {
+				return result, err
+			}
+			var err error
+			prepared[i], docs[i], err = c.storeDocument(link)
+			if err != nil {
+				return result, err
+			}
+		}
+		charged, err := c.limitCreations(prepared)
+		if err != nil {
+			return result, err
+		}
+		args := UdfExecution{"storeMany", map[string]interface{}{"links": docs}, "json"}
+		c.setQuotaArgs(args.Args)
+		resp, err := c.mutationValue(context.Background(), &args)
+		if err != nil {
+			c.refundLinks(prepared, charged)
+			return result, err
+		}
+		var stored struct {
+			// Created has an entry for each link saved, in order.
+			Created []bool `json:"created"`
+			storeQuotaResult
+		}
+		if err := json.Unmarshal(resp, &stored); err != nil {
+			c.refundLinks(prepared, charged)
+			return result, err
+		}
+		for i, created := range stored.Created {
+			ev := ChangeEvent{Type: ChangeUpdate, Short: prepared[i].Name(), Link: prepared[i]}
+			if created {
+				ev.Type = ChangeCreate
+				result.Created++
+			} else {
+				result.Updated++
+			}
+			c.notify(ev)
+		}
+		if len(stored.Created) < len(prepared) {
+			// The links after those saved were refused.
+			if charged != nil {
+				n := len(stored.Created)
+				c.refundLinks(prepared[n:], charged[n:])
+			}
+			if err := c.quotaError(prepared[len(stored.Created)], stored.storeQuotaResult); err != nil {
+				return result, err
+			}
+			return result, fmt.Errorf("storeMany saved %d of %d links", len(stored.Created), len(prepared))
+		}
+	}
+	return result, nil
+}
+
+func (c *ConvexDB) Delete(short string) error {
+	args := UdfExecution{"remove", map[string]interface{}{"normalizedId": linkID(short)}, "json"}
+	resp, err := c.mutationValue(context.Background(), &args)
+	if err != nil {
+		return err
+	}
+	// The remove mutation returns "link" or "alias" for what it deleted, or
+	// false if there was nothing to delete. Older deployments return true
+	// for either, which is taken to be a link.
+	var deleted any
+	if err := json.Unmarshal(resp, &deleted); err != nil {
+		return err
+	}
+	switch deleted {
+	case false, nil:
+		return fs.ErrNotExist
+	case "alias":
+		return nil
+	}
+	c.notify(ChangeEvent{Type: ChangeDelete, Short: short})
+	return nil
+}
+
+// deleteManyBatchSize is the most links DeleteMany sends in one
+// remove:removeMany mutation.
+const deleteManyBatchSize = 100
+
+// DeleteMany removes the links with the given short names, with the same
+// semantics as SQLiteDB.DeleteMany, except that they are deleted in
+// batches of deleteManyBatchSize, each in one transaction. If a batch
+// fails, deleted counts the links deleted by earlier batches.
+func (c *ConvexDB) DeleteMany(shorts []string) (deleted int, err error) {
+	for len(shorts) > 0 {
+		batch := shorts
+		if len(batch) > deleteManyBatchSize {
+			batch = batch[:deleteManyBatchSize]
+		}
+		shorts = shorts[len(batch):]
+
+		names := make(map[string]string, len(batch)) // by ID, for change events
+		ids := make([]string, 0, len(batch))
+		for _, short := range batch {
+			id := linkID(short)
+			if _, ok := names[id]; !ok {
+				names[id] = short
+				ids = append(ids, id)
+			}
+		}
+		args := UdfExecution{"remove:removeMany", map[string]interface{}{"normalizedIds": ids}, "json"}
+		resp, err := c.mutationValue(context.Background(), &args)
+		if err != nil {
+			return deleted, err
+		}
+		var removed []string
+		if err := json.Unmarshal(resp, &removed); err != nil {
+			return deleted, err
+		}
+		deleted += len(removed)
+		for _, id := range removed {
+			c.notify(ChangeEvent{Type: ChangeDelete, Short: names[id]})
+		}
+	}
+	return deleted, nil
+}
+
+// LoadStats returns click stats for links.
+//
+// Malformed entries in the stats returned by Convex are skipped and logged,
+// unless c.StrictStats is set, in which case any malformed entry fails the
+// whole call. Use LoadStatsPartial to handle the malformed entries directly.
+func (c *ConvexDB) LoadStats() (ClickStats, error) {
+	clicks, errs, err := c.LoadStatsPartial()
+	if err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		if c.StrictStats {
+			return nil, errors.Join(errs...)
+		}
+		log.Printf("convex: skipped %d malformed stats entries: %v", len(errs), errors.Join(errs...))
+	}
+	return clicks, nil
+}
+
+// LoadStatsPartial is like LoadStats, but returns the well-formed entries
+// along with an error for each malformed entry, whatever c.StrictStats is.
+func (c *ConvexDB) LoadStatsPartial() (clicks ClickStats, skipped []error, err error) {
+	args := UdfExecution{"stats:loadStats", map[string]interface{}{}, "json"}
+	response, err := c.query(context.Background(), &args)
+	if err != nil {
+		return nil, nil, err
+	}
+	var stats map[string]json.RawMessage
+	if err := json.Unmarshal(response, &stats); err != nil {
+		return nil, nil, err
+	}
+	clicks = make(ClickStats)
+	for k, v := range stats {
+		var num *float64
+		if err := json.Unmarshal(v, &num); err != nil || num == nil {
+			if err == nil {
+				err = errors.New("null clicks")
+			}
+			skipped = append(skipped, fmt.Errorf("stats for %q: %w", k, err))
+			continue
+		}
+		clicks[k] = int(*num)
+	}
+	return clicks, skipped, nil
+}
+
+// statsPageSize is the number of links whose stats StatsSeq loads at once.
+const statsPageSize = 256
+
+// StatsSeq streams the total clicks of each link that has any, keyed by
+// the link's name as SQLiteDB.StatsSeq keys them, loading them from Convex
+// a page at a time with the stats:loadStatsPage query. Iteration stops with ctx.Err() if ctx is done.
+// Pages are separate queries, so links changed during iteration may be
+// missed or seen twice.
+func (c *ConvexDB) StatsSeq(ctx context.Context) StatEntrySeq {
+	return func(yield func(StatEntry, error) bool) {
+		var cursor interface{} // nil for the first page
+		for {
+			if err := ctx.Err(); err != nil {
+				yield(StatEntry{}, err)
+				return
+			}
+			args := UdfExecution{"stats:loadStatsPage", map[string]interface{}{"cursor": cursor, "numItems": statsPageSize}, "json"}
+			resp, err := c.query(ctx, &args)
+			if err != nil {
+				yield(StatEntry{}, err)
+				return
+			}
+			var page struct {
+				Page []struct {
+					Short  string  `json:"short"`
+					Clicks float64 `json:"clicks"`
+				} `json:"page"`
+				IsDone         bool   `json:"isDone"`
+				ContinueCursor string `json:"continueCursor"`
+			}
+			if err := json.Unmarshal(resp, &page); err != nil {
+				yield(StatEntry{}, err)
+				return
+			}
+			for _, e := range page.Page {
+				if !yield(StatEntry{Short: e.Short, Clicks: int(e.Clicks)}, nil) {
+					return
+				}
+			}
+			if page.IsDone {
+				return
+			}
+			cursor = page.ContinueCursor
+		}
+	}
+}
+
+// LoadStatsSince returns the clicks on each link recorded by SaveStats at
+// or after t, keyed by the link's name, as SQLiteDB.LoadStatsSince does. The
+// stats:saveStats mutation logs each flush in the statsLog table for this,
+// alongside the running totals.
+func (c *ConvexDB) LoadStatsSince(t time.Time) (ClickStats, error) {
+	args := UdfExecution{"stats:loadStatsSince", map[string]interface{}{"since": float64(t.Unix())}, "json"}
+	resp, err := c.query(context.Background(), &args)
+	if err != nil {
+		return nil, err
+	}
+	var byName map[string]float64
+	if err := json.Unmarshal(resp, &byName); err != nil {
+		return nil, err
+	}
+	stats := make(ClickStats, len(byName))
+	for name, clicks := range byName {
+		stats[name] = int(clicks)
+	}
+	return stats, nil
+}
+
+// rawStatRow is an entry of the statsLog table, as returned by the
+// stats:loadRawStats and stats:loadRawStatsPage queries.
+type rawStatRow struct {
+	Short   string     `json:"short"`
+	Created ConvexTime `json:"created"`
+	Clicks  float64    `json:"clicks"`
+}
+
+func (r rawStatRow) row() StatRow {
+	return StatRow{Short: r.Short, Created: r.Created.time(), Clicks: int(r.Clicks)}
+}
+
+// LoadRawStats returns the clicks on the link short recorded by each
+// SaveStats call, oldest first, as SQLiteDB.LoadRawStats does. They are
+// read from the statsLog table, so clicks saved before the deployment had
+// that table are only counted in the totals returned by LoadStats.
+func (c *ConvexDB) LoadRawStats(short string) ([]StatRow, error) {
+	args := UdfExecution{"stats:loadRawStats", map[string]interface{}{"normalizedId": linkID(short)}, "json"}
+	resp, err := c.query(context.Background(), &args)
+	if err != nil {
+		return nil, err
+	}
+	var rows []rawStatRow
+	if err := json.Unmarshal(resp, &rows); err != nil {
+		return nil, err
+	}
+	var stats []StatRow
+	for _, r := range rows {
+		stats = append(stats, r.row())
+	}
+	return stats, nil
+}
+
+// LoadAllRawStats streams the clicks on every link recorded by each
+// SaveStats call, oldest first, loading them a page at a time with the
+// stats:loadRawStatsPage query. Like LoadRawStats, it only has the clicks
+// logged in the statsLog table. Iteration stops with ctx.Err() if ctx is
+// done.
+func (c *ConvexDB) LoadAllRawStats(ctx context.Context) StatRowSeq {
+	return func(yield func(StatRow, error) bool) {
+		var cursor interface{} // nil for the first page
+		for {
+			if err := ctx.Err(); err != nil {
+				yield(StatRow{}, err)
+				return
+			}
+			args := UdfExecution{"stats:loadRawStatsPage", map[string]interface{}{"cursor": cursor, "numItems": statsPageSize}, "json"}
+			resp, err := c.query(ctx, &args)
+			if err != nil {
+				yield(StatRow{}, err)
+				return
+			}
+			var page struct {
+				Page           []rawStatRow `json:"page"`
+				IsDone         bool         `json:"isDone"`
+				ContinueCursor string       `json:"continueCursor"`
+			}
+			if err := json.Unmarshal(resp, &page); err != nil {
+				yield(StatRow{}, err)
+				return
+			}
+			for _, r := range page.Page {
+				if !yield(r.row(), nil) {
+					return
+				}
+			}
+			if page.IsDone {
+				return
+			}
+			cursor = page.ContinueCursor
+		}
+	}
+}
+
+// LoadStatsForLinks returns the total clicks for each of the given links,
+// keyed by the short names as provided, with the same semantics as
+// SQLiteDB.LoadStatsForLinks.
+func (c *ConvexDB) LoadStatsForLinks(shorts []string) (map[string]int, error) {
+	clicks := make(map[string]int, len(shorts))
+	if len(shorts) == 0 {
+		return clicks, nil
+	}
+	ids := make([]string, len(shorts))
+	for i, short := range shorts {
+		ids[i] = linkID(short)
+	}
+	args := UdfExecution{"stats:loadStatsForLinks", map[string]interface{}{"normalizedIds": ids}, "json"}
+	response, err := c.query(context.Background(), &args)
+	if err != nil {
+		return nil, err
+	}
+	var byID map[string]float64
+	if err := json.Unmarshal(response, &byID); err != nil {
+		return nil, err
+	}
+	for _, short := range shorts {
+		clicks[short] = int(byID[linkID(short)])
+	}
+	return clicks, nil
+}
+
+// Touch sets the LastEdit time of a link to now, without otherwise changing
+// it, to record that the link was reviewed. If short is an alias, its
+// canonical link is touched.
+//
+// It returns fs.ErrNotExist if the link does not exist.
+func (c *ConvexDB) Touch(short string) error {
+	args := UdfExecution{"touch", map[string]interface{}{"normalizedId": linkID(short), "lastEdit": float64(convexTime(c.storedTime(c.now())))}, "json"}
+	resp, err := c.mutationValue(context.Background(), &args)
+	if err != nil {
+		return err
+	}
+	var touched bool
+	if err := json.Unmarshal(resp, &touched); err != nil {
+		return err
+	}
+	if !touched {
+		return fs.ErrNotExist
+	}
+	return nil
+}
+
+// ConsumeUse records a use of a link and returns it, as SQLiteDB.ConsumeUse
+// does. The count is checked and incremented by the consumeUse mutation, so
+// concurrent calls can't use a link more than MaxUses times.
+func (c *ConvexDB) ConsumeUse(short string) (*Link, error) {
+	args := UdfExecution{"consumeUse", map[string]interface{}{"normalizedId": linkID(short), "deleteExhausted": c.DeleteExhaustedLinks}, "json"}
+	resp, err := c.mutationValue(context.Background(), &args)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Status  string          `json:"status"`
+		Link    json.RawMessage `json:"link"`
+		Deleted bool            `json:"deleted"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return nil, err
+	}
+	switch result.Status {
+	case "used":
+	case "exhausted":
+		return nil, fmt.Errorf("%q: %w", short, ErrLinkExhausted)
+	case "missing":
+		return nil, fs.ErrNotExist
+	default:
+		return nil, fmt.Errorf("unexpected consumeUse status %q", result.Status)
+	}
+	link, err := c.decodeLink(result.Link)
+	if err != nil {
+		return nil, err
+	}
+	if link == nil {
+		return nil, fs.ErrNotExist
+	}
+	if result.Deleted {
+		c.notify(ChangeEvent{Type: ChangeDelete, Short: link.Name()})
+	}
+	return c.transform(link), nil
+}
+
+// Pin marks a link as Pinned, as SQLiteDB.Pin does.
+func (c *ConvexDB) Pin(short string) error {
+	return c.setPinned(short, true)
+}
+
+// Unpin clears the Pinned mark of a link, as SQLiteDB.Unpin does.
+func (c *ConvexDB) Unpin(short string) error {
+	return c.setPinned(short, false)
+}
+
+func (c *ConvexDB) setPinned(short string, pinned bool) error {
+	args := UdfExecution{"pin", map[string]interface{}{"normalizedId": linkID(short), "pinned": pinned}, "json"}
+	resp, err := c.mutationValue(context.Background(), &args)
+	if err != nil {
+		return err
+	}
+	var found bool
+	if err := json.Unmarshal(resp, &found); err != nil {
+		return err
+	}
+	if !found {
+		return fs.ErrNotExist
+	}
+	return nil
+}
+
+// LoadPinned returns the Pinned links, most recently edited first.
+func (c *ConvexDB) LoadPinned() ([]*Link, error) {
+	args := UdfExecution{"load:loadPinned", map[string]interface{}{}, "json"}
+	resp, err := c.query(context.Background(), &args)
+	if err != nil {
+		return nil, err
+	}
+	return c.decodeLinks(resp)
+}
+
+// UpdateLong sets the Long URL of a link to newLong and its LastEdit time
+// to now, but only if its Long URL is still expectedOld, in a single
+// mutation. It behaves as SQLiteDB.UpdateLong, but is not supported with
+// a Codec, since Convex can't compare encoded URLs.
+func (c *ConvexDB) UpdateLong(short, expectedOld, newLong string) error {
+	if c.Codec != nil {
+		return errors.New("UpdateLong is not supported with a Codec")
+	}
+	newLong, err := c.canonicalLong(newLong)
+	if err != nil {
+		return err
+	}
+	if err := c.checkLong(newLong); err != nil {
+		return err
+	}
+	args := UdfExecution{"updateLong", map[string]interface{}{
+		"normalizedId": linkID(short),
+		"expectedOld":  expectedOld,
+		"long":         newLong,
+		"lastEdit":     float64(convexTime(c.storedTime(c.now()))),
+	}, "json"}
+	resp, err := c.mutationValue(context.Background(), &args)
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Status string          `json:"status"`
+		Link   json.RawMessage `json:"link"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return err
+	}
+	switch result.Status {
+	case "missing":
+		return fs.ErrNotExist
+	case "conflict":
+		return fmt.Errorf("%w: %q no longer points to %q", ErrConflict, short, expectedOld)
+	case "updated":
+	default:
+		return fmt.Errorf("unexpected updateLong status %q", result.Status)
+	}
+	link, err := c.decodeLink(result.Link)
+	if err != nil {
+		return err
+	}
+	if link != nil {
+		c.notify(ChangeEvent{Type: ChangeUpdate, Short: link.Name(), Link: link})
+	}
+	return nil
+}
+
+// RewriteLongs replaces match with replace in the Long URL of every link, as
+// SQLiteDB.RewriteLongs does. The changes are made by the rewriteLongs
+// mutation in one transaction, which fails with ErrConflict, changing
+// nothing, if any of the links are edited after they are loaded here. Like
+// UpdateLong, it is not supported with a Codec.
+func (c *ConvexDB) RewriteLongs(match, replace string) (int, error) {
+	if c.Codec != nil {
+		return 0, errors.New("RewriteLongs is not supported with a Codec")
+	}
+	links, err := c.loadStored()
+	if err != nil {
+		return 0, err
+	}
+	changed, err := c.planRewrite(links, match, replace)
+	if err != nil || len(changed) == 0 {
+		return 0, err
+	}
+	oldLongs := make(map[string]string, len(links))
+	for _, link := range links {
+		oldLongs[linkID(link.Name())] = link.Long
+	}
+	lastEdit := c.storedTime(c.now())
+	updates := make([]map[string]interface{}, len(changed))
+	for i, link := range changed {
+		link.LastEdit = lastEdit
+		updates[i] = map[string]interface{}{
+			"normalizedId": linkID(link.Name()),
+			"expectedOld":  oldLongs[linkID(link.Name())],
+			"long":         link.Long,
+		}
+	}
+	args := UdfExecution{"rewriteLongs", map[string]interface{}{
+		"updates":  updates,
+		"lastEdit": float64(convexTime(lastEdit)),
+	}, "json"}
+	resp, err := c.mutationValue(context.Background(), &args)
+	if err != nil {
+		return 0, err
+	}
+	var result struct {
+		Status       string `json:"status"`
+		NormalizedId string `json:"normalizedId"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return 0, err
+	}
+	switch result.Status {
+	case "conflict":
+		return 0, fmt.Errorf("%w: %q was edited during the rewrite", ErrConflict, result.NormalizedId)
+	case "updated":
+	default:
+		return 0, fmt.Errorf("unexpected rewriteLongs status %q", result.Status)
+	}
+	for _, link := range changed {
+		c.notify(ChangeEvent{Type: ChangeUpdate, Short: link.Name(), Link: link})
+	}
+	return len(changed), nil
+}
+
+// SetOwners sets the Owner of each link named in mapping to the owner it
+// maps to, and its LastEdit to now, as SQLiteDB.SetOwners does. The links
+// are changed by one setOwners mutation.
+func (c *ConvexDB) SetOwners(mapping map[string]string) (int, error) {
+	if len(mapping) == 0 {
+		return 0, nil
+	}
+	shorts := make([]string, 0, len(mapping))
+	for short := range mapping {
+		shorts = append(shorts, short)
+	}
+	sort.Strings(shorts)
+	byID := make(map[string]string, len(shorts))
+	updates := make([]map[string]interface{}, len(shorts))
+	for i, short := range shorts {
+		stored, err := c.encodeFields(&Link{Short: short, Owner: mapping[short]})
+		if err != nil {
+			return 0, err
+		}
+		byID[linkID(short)] = short
+		updates[i] = map[string]interface{}{
+			"normalizedId": linkID(short),
+			"owner":        stored.Owner,
+		}
+	}
+	args := UdfExecution{"setOwners", map[string]interface{}{
+		"updates":  updates,
+		"lastEdit": float64(convexTime(c.storedTime(c.now()))),
+	}, "json"}
+	resp, err := c.mutationValue(context.Background(), &args)
+	if err != nil {
+		return 0, err
+	}
+	var result struct {
+		Links   []json.RawMessage `json:"links"`
+		Missing []string          `json:"missing"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return 0, err
+	}
+	for _, doc := range result.Links {
+		link, err := c.decodeLink(doc)
+		if err != nil {
+			return 0, err
+		}
+		if link != nil {
+			c.notify(ChangeEvent{Type: ChangeUpdate, Short: link.Name(), Link: link})
+		}
+	}
+	if len(result.Missing) > 0 {
+		missing := make([]string, len(result.Missing))
+		for i, id := range result.Missing {
+			missing[i] = byID[id]
+		}
+		sort.Strings(missing)
+		return len(result.Links), &MissingLinksError{Shorts: missing}
+	}
+	return len(result.Links), nil
+}
+
+// PreviewRewriteLongs returns the names of the links that RewriteLongs
+// would change, without changing them, or the error it would return.
+func (c *ConvexDB) PreviewRewriteLongs(match, replace string) ([]string, error) {
+	links, err := c.loadStored()
+	if err != nil {
+		return nil, err
+	}
+	changed, err := c.planRewrite(links, match, replace)
+	if err != nil {
+		return nil, err
+	}
+	return linkNames(changed), nil
+}
+
+// loadStored returns all links as stored, without applying
+// c.LoadTransform.
+func (c *ConvexDB) loadStored() ([]*Link, error) {
+	args := UdfExecution{"load:loadAll", map[string]interface{}{}, "json"}
+	resp, err := c.query(context.Background(), &args)
+	if err != nil {
+		return nil, err
+	}
+	return c.decodeLinks(resp)
+}
+
+// ResetAllStats deletes the click stats of every link, leaving the links
+// themselves alone.
+func (c *ConvexDB) ResetAllStats() error {
+	args := UdfExecution{"stats:resetAllStats", map[string]interface{}{}, "json"}
+	return c.mutation(context.Background(), &args)
+}
+
+// SaveStats adds stats, the clicks since the last call, to the stored
+// totals, as described by Database.
+func (c *ConvexDB) SaveStats(stats ClickStats) error {
+	mungedStats := make(map[string]int)
+	for id, clicks := range stats {
+		mungedStats[linkID(id)] = clicks
+	}
+	args := UdfExecution{"stats:saveStats", map[string]interface{}{"stats": mungedStats, "flushedAt": float64(c.now().Unix())}, "json"}
+	return c.mutation(context.Background(), &args)
+}
+
+// IncrementAndGetClicks adds n clicks to the link short and returns its new
+// total, with the same semantics as SQLiteDB.IncrementAndGetClicks. Each
+// call is a mutation, so it costs a round trip to Convex, unlike the
+// batched SaveStats.
+func (c *ConvexDB) IncrementAndGetClicks(short string, n int) (int, error) {
+	args := UdfExecution{"stats:incrementClicks", map[string]interface{}{"normalizedId": linkID(short), "clicks": n}, "json"}
+	resp, err := c.mutationValue(context.Background(), &args)
+	if err != nil {
+		return 0, err
+	}
+	var total *float64
+	if err := json.Unmarshal(resp, &total); err != nil {
+		return 0, err
+	}
+	if total == nil {
+		return 0, fs.ErrNotExist
+	}
+	return int(*total), nil
+}
+
+// SaveImpressions adds impressions, the number of times each link was shown
+// since the last call, to the stored totals, as SQLiteDB.SaveImpressions
+// does.
+func (c *ConvexDB) SaveImpressions(impressions ClickStats) error {
+	byID := make(map[string]int, len(impressions))
+	for short, n := range impressions {
+		byID[linkID(short)] += n
+	}
+	args := UdfExecution{"stats:saveImpressions", map[string]interface{}{"impressions": byID}, "json"}
+	return c.mutation(context.Background(), &args)
+}
+
+// LoadImpressions returns the total impressions of each link that has any,
+// keyed by the link's name, as SQLiteDB.LoadImpressions does.
+func (c *ConvexDB) LoadImpressions() (ClickStats, error) {
+	args := UdfExecution{"stats:loadImpressions", map[string]interface{}{}, "json"}
+	resp, err := c.query(context.Background(), &args)
+	if err != nil {
+		return nil, err
+	}
+	var byName map[string]float64
+	if err := json.Unmarshal(resp, &byName); err != nil {
+		return nil, err
+	}
+	impressions := make(ClickStats, len(byName))
+	for name, n := range byName {
+		impressions[name] = int(n)
+	}
+	return impressions, nil
+}
+
+// LoadCTR returns the click-through rate of each link that has been shown,
+// with the same semantics as SQLiteDB.LoadCTR.
+func (c *ConvexDB) LoadCTR() (map[string]float64, error) {
+	byName, err := c.LoadImpressions()
+	if err != nil {
+		return nil, err
+	}
+	clicks, err := c.LoadStats()
+	if err != nil {
+		return nil, err
+	}
+	// LoadStats keys clicks by normalized ID.
+	impressions := make(ClickStats, len(byName))
+	for name, n := range byName {
+		impressions[linkID(name)] = n
+	}
+	return clickThroughRates(clicks, impressions), nil
+}
+
+// LoadStaleCandidates returns the n stalest links, stalest first, with the
+// same semantics as SQLiteDB.LoadStaleCandidates. It reads every link and
+// every stats row. Clicks are the totals from LoadStats, but when they were
+// last saved comes from the statsLog table, so a link clicked only before
+// the deployment had that table counts as never accessed.
+func (c *ConvexDB) LoadStaleCandidates(n int, w StalenessWeights) ([]*LinkWithScore, error) {
+	links, err := c.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+	clicks, err := c.LoadStats()
+	if err != nil {
+		return nil, err
+	}
+	activity := make(map[string]linkActivity, len(clicks))
+	for id, n := range clicks {
+		activity[id] = linkActivity{clicks: n}
+	}
+	c.LoadAllRawStats(context.Background())(func(row StatRow, seqErr error) bool {
+		if seqErr != nil {
+			err = seqErr
+			return false
+		}
+		id := linkID(row.Short)
+		if a := activity[id]; row.Created.After(a.lastAccessed) {
+			a.lastAccessed = row.Created
+			activity[id] = a
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return staleCandidates(links, activity, w, c.now(), n), nil
+}
+
+// LastStatsFlush returns when SaveStats last succeeded, or the zero time if
+// it never has.
+func (c *ConvexDB) LastStatsFlush() (time.Time, error) {
+	args := UdfExecution{"stats:lastFlush", map[string]interface{}{}, "json"}
+	resp, err := c.query(context.Background(), &args)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var flushed *float64
+	if err := json.Unmarshal(resp, &flushed); err != nil {
+		return time.Time{}, err
+	}
+	if flushed == nil {
+		return time.Time{}, nil
+	}
+	return time.Unix(int64(*flushed), 0).UTC(), nil
+}
+
+// DBStats returns the number of documents in each table of the deployment.
+// Convex does not expose storage sizes, so SizeBytes is always zero.
+func (c *ConvexDB) DBStats() (*StorageStats, error) {
+	args := UdfExecution{"stats:storageStats", map[string]interface{}{}, "json"}
+	resp, err := c.query(context.Background(), &args)
+	if err != nil {
+		return nil, err
+	}
+	var counts struct {
+		Links     int `json:"links"`
+		Aliases   int `json:"aliases"`
+		StatsRows int `json:"stats"`
+	}
+	if err := json.Unmarshal(resp, &counts); err != nil {
+		return nil, err
+	}
+	return &StorageStats{Links: counts.Links, Aliases: counts.Aliases, StatsRows: counts.StatsRows}, nil
+}
+
+func (c *ConvexDB) Alias(newShort, canonicalShort string) error {
+	args := UdfExecution{"alias", map[string]interface{}{"normalizedId": linkID(newShort), "short": newShort, "canonicalId": linkID(canonicalShort)}, "json"}
+	return c.mutation(context.Background(), &args)
+}
+
+// Batch runs f with a StoreTx that records the changes f makes, and then
+// applies them in order if f returns nil.
+//
+// Unlike SQLiteDB.Batch, this is not atomic: each change is a separate
+// mutation, so if one fails, Batch returns its error without undoing the
+// changes before it. Making a batch atomic would need a Convex mutation
+// that applies all of its changes. Loads within f read the deployment
+// directly, so they don't see the changes recorded earlier in f.
+func (c *ConvexDB) Batch(f func(tx StoreTx) error) error {
+	tx := &convexTx{c: c}
+	if err := f(tx); err != nil {
+		return err
+	}
+	for _, op := range tx.ops {
+		if err := op(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convexTx is the StoreTx passed to the function run by ConvexDB.Batch.
+type convexTx struct {
+	c   *ConvexDB
+	ops []func() error // changes to apply once the function returns
+}
+
+func (t *convexTx) Load(short string) (*Link, error) {
+	return t.c.Load(short)
+}
+
+func (t *convexTx) Save(link *Link) error {
+	if err := t.c.checkReserved(link.Name()); err != nil {
+		return err
+	}
+	l := *link
+	t.ops = append(t.ops, func() error { return t.c.Save(&l) })
+	return nil
+}
+
+func (t *convexTx) Delete(short string) error {
+	t.ops = append(t.ops, func() error { return t.c.Delete(short) })
+	return nil
+}
+
+func (t *convexTx) Alias(newShort, canonicalShort string) error {
+	t.ops = append(t.ops, func() error { return t.c.Alias(newShort, canonicalShort) })
+	return nil
+}
+
+// convexFunctions are the Convex functions used by ConvexDB, by the API
+// endpoint they are called with.
+var convexFunctions = []struct{ endpoint, path string }{
+	{"query", "load:loadOne"},
+	{"query", "load:loadAll"},
+	{"query", "load:loadWithStats"},
+	{"query", "load:loadModifiedSince"},
+	{"query", "load:loadNamespace"},
+	{"query", "load:loadCreatedBetween"},
+	{"query", "load:loadOwnerless"},
+	{"query", "load:loadMostEdited"},
+	{"query", "load:loadRandom"},
+	{"query", "load:loadPage"},
+	{"query", "load:listLinks"},
+	{"query", "load:loadIDs"},
+	{"query", "load:countBySource"},
+	{"query", "load:loadMany"},
+	{"query", "load:loadPinned"},
+	{"query", "stats:loadStats"},
+	{"query", "stats:loadStatsForLinks"},
+	{"query", "stats:loadStatsPage"},
+	{"query", "stats:loadStatsSince"},
+	{"query", "stats:loadRawStats"},
+	{"query", "stats:loadRawStatsPage"},
+	{"query", "stats:lastFlush"},
+	{"query", "stats:storageStats"},
+	{"query", "stats:loadImpressions"},
+	{"mutation", "store"},
+	{"mutation", "storeMany"},
+	{"mutation", "remove"},
+	{"mutation", "remove:removeMany"},
+	{"mutation", "touch"},
+	{"mutation", "pin"},
+	{"mutation", "consumeUse"},
+	{"mutation", "updateLong"},
+	{"mutation", "rewriteLongs"},
+	{"mutation", "setOwners"},
+	{"mutation", "renormalize"},
+	{"mutation", "alias"},
+	{"mutation", "stats:saveStats"},
+	{"mutation", "stats:resetAllStats"},
+	{"mutation", "stats:saveImpressions"},
+	{"mutation", "stats:incrementClicks"},
+}
+
+// Validate checks that c is configured correctly: that its URL reaches a
+// Convex deployment, that the deployment accepts its token, and that the
+// functions it uses are deployed. It returns an error describing each
+// problem found, so that misconfiguration can be reported at startup.
+func (c *ConvexDB) Validate(ctx context.Context) error {
+	if _, err := c.token(ctx); err != nil {
+		return fmt.Errorf("convex: getting authorization token: %w", err)
+	}
+	args := UdfExecution{"load:loadOne", map[string]interface{}{"normalizedId": ""}, "json"}
+	_, err := c.call(ctx, "query", &args)
+	switch {
+	case err == nil:
+	case isMissingFunction(err):
+		// Reported below.
+	case isInvalidToken(err):
+		return fmt.Errorf("convex: authorization token rejected by %s", c.deployment())
+	default:
+		return fmt.Errorf("convex: cannot reach %s: %w", c.deployment(), err)
+	}
+
+	// Call each function without a token. Deployed functions reject the
+	// call without running, so this has no side effects.
+	var missing []string
+	for _, f := range convexFunctions {
+		args := UdfExecution{f.path, map[string]interface{}{}, "json"}
+		if _, err := c.callWithToken(ctx, f.endpoint, &args, ""); err != nil && isMissingFunction(err) {
+			missing = append(missing, f.path)
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("convex: functions not deployed: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// deployment describes the Convex deployment c calls, for error messages.
+func (c *ConvexDB) deployment() string {
+	if t, ok := c.transport.(*UDFTransport); ok {
+		return t.URL
+	}
+	return "Convex deployment"
+}
+
+// isMissingFunction reports whether err is Convex's error for calling a
+// function that isn't deployed.
+func isMissingFunction(err error) bool {
+	return strings.Contains(err.Error(), "Could not find")
+}
+
+// isInvalidToken reports whether err is the error thrown by the functions in
+// src/convex when called with the wrong token.
+func isInvalidToken(err error) bool {
+	return strings.Contains(err.Error(), "Invalid authorization token")
 }
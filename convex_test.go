@@ -4,7 +4,21 @@
 package golink
 
 import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,7 +28,7 @@ import (
 )
 
 func clear(c *ConvexDB) {
-	c.mutation(&UdfExecution{Path: "clear", Args: map[string]interface{}{}, Format: "json"})
+	c.mutation(context.Background(), &UdfExecution{Path: "clear", Args: map[string]interface{}{}, Format: "json"})
 }
 
 func getDbUrl() string {
@@ -111,3 +125,1275 @@ func Test_Convex_SaveLoadStats(t *testing.T) {
 		t.Errorf("db.LoadStats got %v, want %v", got, want)
 	}
 }
+
+// fakeConvex is an in-memory stand-in for a Convex deployment running the
+// functions in src/convex, for tests that don't need a real backend.
+type fakeConvex struct {
+	mu    sync.Mutex
+	links map[string]LinkDocument // keyed by normalizedId
+	stats map[string]int          // keyed by normalizedId
+
+	missing map[string]bool // function paths to report as not deployed
+
+	lastFlush   *float64
+	statsLog    []fakeStatsEntry
+	impressions map[string]int // keyed by normalizedId
+}
+
+// fakeStatsEntry is a row of the statsLog table.
+type fakeStatsEntry struct {
+	id      string
+	clicks  int
+	created float64
+}
+
+// name returns the name of the link with normalized ID id, by which the
+// stats functions key their results.
+func (f *fakeConvex) name(id string) string {
+	doc := f.links[id]
+	return (&Link{Short: doc.Short, Namespace: doc.Namespace}).Name()
+}
+
+func newFakeConvex(t *testing.T) *httptest.Server {
+	f := &fakeConvex{
+		links: make(map[string]LinkDocument),
+		stats: make(map[string]int),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (f *fakeConvex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Path string                     `json:"path"`
+		Args map[string]json.RawMessage `json:"args"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	value, err := f.run(req.Path, req.Args)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		json.NewEncoder(w).Encode(ConvexResponse{Status: "error", ErrorMessage: err.Error()})
+		return
+	}
+	encoded, _ := json.Marshal(value)
+	json.NewEncoder(w).Encode(ConvexResponse{Status: "success", Value: encoded})
+}
+
+// store saves doc as the store mutation does, and returns its result.
+func (f *fakeConvex) store(doc LinkDocument, maxTotal, maxPerOwner int) map[string]any {
+	_, exists := f.links[doc.Id]
+	if !exists && maxTotal > 0 && len(f.links) >= maxTotal {
+		return map[string]any{"created": false, "totalCount": len(f.links)}
+	}
+	if !exists && maxPerOwner > 0 && doc.Owner != "" {
+		count := 0
+		for _, l := range f.links {
+			if l.Owner == doc.Owner {
+				count++
+			}
+		}
+		if count >= maxPerOwner {
+			return map[string]any{"created": false, "quotaCount": count}
+		}
+	}
+	old := f.links[doc.Id]
+	if old.CreatedFrom != "" {
+		doc.CreatedFrom = old.CreatedFrom
+	}
+	if old.Source != "" {
+		doc.Source = old.Source
+	}
+	doc.EditCount = old.EditCount + 1
+	doc.UseCount = old.UseCount
+	doc.Version = 1
+	if exists {
+		doc.Version = fakeVersion(old) + 1
+	}
+	f.links[doc.Id] = doc
+	return map[string]any{"created": !exists}
+}
+
+// fakeVersion returns the version of doc, which is 1 for documents stored
+// without one, as in the mutations.
+func fakeVersion(doc LinkDocument) int {
+	if doc.Version == 0 {
+		return 1
+	}
+	return doc.Version
+}
+
+func (f *fakeConvex) run(path string, args map[string]json.RawMessage) (any, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.missing[path] {
+		return nil, fmt.Errorf("Could not find public function for '%s'", path)
+	}
+	var token string
+	if err := json.Unmarshal(args["token"], &token); err != nil || token == "" {
+		return nil, errors.New("Invalid authorization token")
+	}
+	switch path {
+	case "load:loadOne":
+		var id string
+		json.Unmarshal(args["normalizedId"], &id)
+		if doc, ok := f.links[id]; ok {
+			return doc, nil
+		}
+		return nil, nil
+	case "load:loadMany":
+		var ids []string
+		json.Unmarshal(args["normalizedIds"], &ids)
+		docs := make([]any, len(ids))
+		for i, id := range ids {
+			if doc, ok := f.links[id]; ok {
+				docs[i] = doc
+			}
+		}
+		return docs, nil
+	case "load:loadAll":
+		docs := []LinkDocument{}
+		for _, doc := range f.links {
+			docs = append(docs, doc)
+		}
+		return docs, nil
+	case "load:loadModifiedSince":
+		var since float64
+		json.Unmarshal(args["since"], &since)
+		docs := []LinkDocument{}
+		for _, doc := range f.links {
+			if float64(doc.LastEdit) >= since {
+				docs = append(docs, doc)
+			}
+		}
+		return docs, nil
+	case "load:loadCreatedBetween":
+		var from, to float64
+		json.Unmarshal(args["from"], &from)
+		json.Unmarshal(args["to"], &to)
+		docs := []LinkDocument{}
+		for _, doc := range f.links {
+			if float64(doc.Created) >= from && float64(doc.Created) <= to {
+				docs = append(docs, doc)
+			}
+		}
+		sort.Slice(docs, func(i, j int) bool { return docs[i].Created < docs[j].Created })
+		return docs, nil
+	case "load:loadOwnerless":
+		docs := []LinkDocument{}
+		for _, doc := range f.links {
+			if strings.TrimSpace(doc.Owner) == "" {
+				docs = append(docs, doc)
+			}
+		}
+		sort.Slice(docs, func(i, j int) bool { return docs[i].Created < docs[j].Created })
+		return docs, nil
+	case "load:loadPage":
+		var after string
+		var n int
+		json.Unmarshal(args["after"], &after)
+		json.Unmarshal(args["n"], &n)
+		docs := []LinkDocument{}
+		for id, doc := range f.links {
+			if id > after {
+				docs = append(docs, doc)
+			}
+		}
+		sort.Slice(docs, func(i, j int) bool { return docs[i].Id < docs[j].Id })
+		if len(docs) > n {
+			docs = docs[:n]
+		}
+		return docs, nil
+	case "load:listLinks":
+		var offset, n int
+		var owner string
+		json.Unmarshal(args["offset"], &offset)
+		json.Unmarshal(args["n"], &n)
+		json.Unmarshal(args["owner"], &owner)
+		docs := []LinkDocument{}
+		for _, doc := range f.links {
+			if owner == "" || doc.Owner == owner {
+				docs = append(docs, doc)
+			}
+		}
+		sort.Slice(docs, func(i, j int) bool { return docs[i].Id < docs[j].Id })
+		total := len(docs)
+		if offset > len(docs) {
+			offset = len(docs)
+		}
+		docs = docs[offset:]
+		if len(docs) > n {
+			docs = docs[:n]
+		}
+		return map[string]any{"links": docs, "total": total}, nil
+	case "load:countBySource":
+		counts := make(map[string]int)
+		for _, doc := range f.links {
+			counts[doc.Source]++
+		}
+		return counts, nil
+	case "load:loadIDs":
+		ids := []string{}
+		for id := range f.links {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		return ids, nil
+	case "load:loadRandom":
+		var r float64
+		json.Unmarshal(args["r"], &r)
+		var ids []string
+		for id := range f.links {
+			ids = append(ids, id)
+		}
+		if len(ids) == 0 {
+			return nil, nil
+		}
+		sort.Strings(ids)
+		return f.links[ids[int(r*float64(len(ids)))]], nil
+	case "load:loadMostEdited":
+		var n int
+		json.Unmarshal(args["n"], &n)
+		docs := []LinkDocument{}
+		for _, doc := range f.links {
+			docs = append(docs, doc)
+		}
+		sort.Slice(docs, func(i, j int) bool {
+			if docs[i].EditCount != docs[j].EditCount {
+				return docs[i].EditCount > docs[j].EditCount
+			}
+			return docs[i].Id < docs[j].Id
+		})
+		if len(docs) > n {
+			docs = docs[:n]
+		}
+		return docs, nil
+	case "load:loadPinned":
+		docs := []LinkDocument{}
+		for _, doc := range f.links {
+			if doc.Pinned {
+				docs = append(docs, doc)
+			}
+		}
+		sort.Slice(docs, func(i, j int) bool {
+			if docs[i].LastEdit != docs[j].LastEdit {
+				return docs[i].LastEdit > docs[j].LastEdit
+			}
+			return docs[i].Id < docs[j].Id
+		})
+		return docs, nil
+	case "load:loadNamespace":
+		var namespace string
+		json.Unmarshal(args["namespace"], &namespace)
+		docs := []LinkDocument{}
+		for _, doc := range f.links {
+			if doc.Namespace == namespace {
+				docs = append(docs, doc)
+			}
+		}
+		return docs, nil
+	case "store":
+		var doc LinkDocument
+		if err := json.Unmarshal(args["link"], &doc); err != nil {
+			return nil, err
+		}
+		var maxTotal, maxPerOwner int
+		json.Unmarshal(args["maxTotalLinks"], &maxTotal)
+		json.Unmarshal(args["maxLinksPerOwner"], &maxPerOwner)
+		var createOnly bool
+		json.Unmarshal(args["createOnly"], &createOnly)
+		if _, exists := f.links[doc.Id]; exists && createOnly {
+			return map[string]any{"created": false, "exists": true}, nil
+		}
+		if raw, ok := args["expectedVersion"]; ok {
+			var version int
+			json.Unmarshal(raw, &version)
+			old, exists := f.links[doc.Id]
+			if !exists {
+				return map[string]any{"created": false, "missing": true}, nil
+			}
+			if fakeVersion(old) != version {
+				return map[string]any{"created": false, "conflict": true}, nil
+			}
+		}
+		return f.store(doc, maxTotal, maxPerOwner), nil
+	case "storeMany":
+		var docs []LinkDocument
+		if err := json.Unmarshal(args["links"], &docs); err != nil {
+			return nil, err
+		}
+		var maxTotal, maxPerOwner int
+		json.Unmarshal(args["maxTotalLinks"], &maxTotal)
+		json.Unmarshal(args["maxLinksPerOwner"], &maxPerOwner)
+		created := []bool{}
+		for _, doc := range docs {
+			result := f.store(doc, maxTotal, maxPerOwner)
+			if _, ok := result["created"]; len(result) > 1 || !ok {
+				result["created"] = created
+				return result, nil
+			}
+			created = append(created, result["created"].(bool))
+		}
+		return map[string]any{"created": created}, nil
+	case "updateLong":
+		var id, expectedOld, long string
+		var lastEdit float64
+		json.Unmarshal(args["normalizedId"], &id)
+		json.Unmarshal(args["expectedOld"], &expectedOld)
+		json.Unmarshal(args["long"], &long)
+		json.Unmarshal(args["lastEdit"], &lastEdit)
+		doc, ok := f.links[id]
+		if !ok {
+			return map[string]any{"status": "missing"}, nil
+		}
+		if doc.Long != expectedOld {
+			return map[string]any{"status": "conflict"}, nil
+		}
+		doc.Long = long
+		doc.LastEdit = ConvexTime(lastEdit)
+		doc.Version = fakeVersion(doc) + 1
+		f.links[id] = doc
+		return map[string]any{"status": "updated", "link": doc}, nil
+	case "rewriteLongs":
+		var updates []struct {
+			NormalizedId string `json:"normalizedId"`
+			ExpectedOld  string `json:"expectedOld"`
+			Long         string `json:"long"`
+		}
+		var lastEdit float64
+		json.Unmarshal(args["updates"], &updates)
+		json.Unmarshal(args["lastEdit"], &lastEdit)
+		for _, u := range updates {
+			if doc, ok := f.links[u.NormalizedId]; !ok || doc.Long != u.ExpectedOld {
+				return map[string]any{"status": "conflict", "normalizedId": u.NormalizedId}, nil
+			}
+		}
+		for _, u := range updates {
+			doc := f.links[u.NormalizedId]
+			doc.Long = u.Long
+			doc.LastEdit = ConvexTime(lastEdit)
+			doc.EditCount++
+			doc.Version = fakeVersion(doc) + 1
+			f.links[u.NormalizedId] = doc
+		}
+		return map[string]any{"status": "updated"}, nil
+	case "setOwners":
+		var updates []struct {
+			NormalizedId string `json:"normalizedId"`
+			Owner        string `json:"owner"`
+		}
+		var lastEdit float64
+		json.Unmarshal(args["updates"], &updates)
+		json.Unmarshal(args["lastEdit"], &lastEdit)
+		links, missing := []LinkDocument{}, []string{}
+		for _, u := range updates {
+			doc, ok := f.links[u.NormalizedId]
+			if !ok {
+				missing = append(missing, u.NormalizedId)
+				continue
+			}
+			doc.Owner = u.Owner
+			doc.LastEdit = ConvexTime(lastEdit)
+			doc.EditCount++
+			doc.Version = fakeVersion(doc) + 1
+			f.links[u.NormalizedId] = doc
+			links = append(links, doc)
+		}
+		return map[string]any{"links": links, "missing": missing}, nil
+	case "renormalize":
+		var renames []struct {
+			From string `json:"from"`
+			To   string `json:"to"`
+		}
+		json.Unmarshal(args["renames"], &renames)
+		docs := make([]LinkDocument, len(renames))
+		clicks := make([]int, len(renames))
+		for i, r := range renames {
+			doc, ok := f.links[r.From]
+			if !ok {
+				return map[string]any{"status": "conflict", "normalizedId": r.From}, nil
+			}
+			docs[i], clicks[i] = doc, f.stats[r.From]
+		}
+		for _, r := range renames {
+			delete(f.links, r.From)
+			delete(f.stats, r.From)
+		}
+		for i, r := range renames {
+			if _, ok := f.links[r.To]; ok {
+				return nil, fmt.Errorf("fake: %q already exists", r.To)
+			}
+			docs[i].Id = r.To
+			f.links[r.To] = docs[i]
+			if clicks[i] > 0 {
+				f.stats[r.To] = clicks[i]
+			}
+		}
+		return map[string]any{"status": "updated"}, nil
+	case "pin":
+		var id string
+		var pinned bool
+		json.Unmarshal(args["normalizedId"], &id)
+		json.Unmarshal(args["pinned"], &pinned)
+		doc, ok := f.links[id]
+		if !ok {
+			return false, nil
+		}
+		doc.Pinned = pinned
+		doc.Version = fakeVersion(doc) + 1
+		f.links[id] = doc
+		return true, nil
+	case "consumeUse":
+		var id string
+		var deleteExhausted bool
+		json.Unmarshal(args["normalizedId"], &id)
+		json.Unmarshal(args["deleteExhausted"], &deleteExhausted)
+		doc, ok := f.links[id]
+		if !ok {
+			return map[string]any{"status": "missing"}, nil
+		}
+		if doc.MaxUses > 0 && doc.UseCount >= doc.MaxUses {
+			return map[string]any{"status": "exhausted"}, nil
+		}
+		doc.UseCount++
+		doc.Version = fakeVersion(doc) + 1
+		if deleteExhausted && doc.MaxUses > 0 && doc.UseCount >= doc.MaxUses {
+			delete(f.links, id)
+			delete(f.stats, id)
+			return map[string]any{"status": "used", "link": doc, "deleted": true}, nil
+		}
+		f.links[id] = doc
+		return map[string]any{"status": "used", "link": doc}, nil
+	case "remove:removeMany":
+		var ids []string
+		json.Unmarshal(args["normalizedIds"], &ids)
+		deleted := []string{}
+		for _, id := range ids {
+			if _, ok := f.links[id]; ok {
+				delete(f.links, id)
+				delete(f.stats, id)
+				delete(f.impressions, id)
+				deleted = append(deleted, id)
+			}
+		}
+		return deleted, nil
+	case "remove":
+		var id string
+		json.Unmarshal(args["normalizedId"], &id)
+		_, ok := f.links[id]
+		delete(f.links, id)
+		delete(f.stats, id)
+		delete(f.impressions, id)
+		if !ok {
+			return false, nil
+		}
+		return "link", nil
+	case "stats:loadStats":
+		return f.stats, nil
+	case "stats:loadStatsPage":
+		// Cursors are the index of the next stats entry.
+		var cursor *string
+		var numItems int
+		json.Unmarshal(args["cursor"], &cursor)
+		json.Unmarshal(args["numItems"], &numItems)
+		var ids []string
+		for id := range f.stats {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		start := 0
+		if cursor != nil {
+			start, _ = strconv.Atoi(*cursor)
+		}
+		end := start + numItems
+		if end > len(ids) {
+			end = len(ids)
+		}
+		page := []map[string]any{}
+		for _, id := range ids[start:end] {
+			page = append(page, map[string]any{"short": f.name(id), "clicks": f.stats[id]})
+		}
+		return map[string]any{"page": page, "isDone": end == len(ids), "continueCursor": strconv.Itoa(end)}, nil
+	case "stats:incrementClicks":
+		var id string
+		var clicks int
+		json.Unmarshal(args["normalizedId"], &id)
+		json.Unmarshal(args["clicks"], &clicks)
+		if _, ok := f.links[id]; !ok {
+			return nil, nil
+		}
+		f.stats[id] += clicks
+		f.statsLog = append(f.statsLog, fakeStatsEntry{id, clicks, float64(time.Now().Unix())})
+		return f.stats[id], nil
+	case "stats:saveImpressions":
+		var impressions map[string]int
+		if err := json.Unmarshal(args["impressions"], &impressions); err != nil {
+			return nil, err
+		}
+		if f.impressions == nil {
+			f.impressions = make(map[string]int)
+		}
+		for id, n := range impressions {
+			if _, ok := f.links[id]; ok {
+				f.impressions[id] += n
+			}
+		}
+		return nil, nil
+	case "stats:loadImpressions":
+		impressions := make(map[string]int)
+		for id, n := range f.impressions {
+			if _, ok := f.links[id]; ok && n > 0 {
+				impressions[f.name(id)] = n
+			}
+		}
+		return impressions, nil
+	case "stats:resetAllStats":
+		f.stats = make(map[string]int)
+		f.statsLog = nil
+		return nil, nil
+	case "stats:saveStats":
+		var stats map[string]int
+		if err := json.Unmarshal(args["stats"], &stats); err != nil {
+			return nil, err
+		}
+		var flushed float64
+		json.Unmarshal(args["flushedAt"], &flushed)
+		for id, clicks := range stats {
+			if _, ok := f.links[id]; ok {
+				f.stats[id] += clicks
+				f.statsLog = append(f.statsLog, fakeStatsEntry{id, clicks, flushed})
+			}
+		}
+		f.lastFlush = &flushed
+		return nil, nil
+	case "stats:loadStatsSince":
+		var since float64
+		json.Unmarshal(args["since"], &since)
+		stats := make(map[string]int)
+		for _, e := range f.statsLog {
+			if _, ok := f.links[e.id]; ok && e.created >= since {
+				stats[f.name(e.id)] += e.clicks
+			}
+		}
+		return stats, nil
+	case "stats:loadRawStats":
+		var id string
+		json.Unmarshal(args["normalizedId"], &id)
+		rows := []map[string]any{}
+		for _, e := range f.statsLog {
+			if _, ok := f.links[e.id]; ok && e.id == id {
+				rows = append(rows, map[string]any{"short": f.name(e.id), "created": e.created, "clicks": e.clicks})
+			}
+		}
+		return rows, nil
+	case "stats:loadRawStatsPage":
+		// Cursors are the index of the next statsLog entry, which is
+		// in the order entries were saved.
+		var cursor *string
+		var numItems int
+		json.Unmarshal(args["cursor"], &cursor)
+		json.Unmarshal(args["numItems"], &numItems)
+		start := 0
+		if cursor != nil {
+			start, _ = strconv.Atoi(*cursor)
+		}
+		end := start + numItems
+		if end > len(f.statsLog) {
+			end = len(f.statsLog)
+		}
+		page := []map[string]any{}
+		for _, e := range f.statsLog[start:end] {
+			if _, ok := f.links[e.id]; ok {
+				page = append(page, map[string]any{"short": f.name(e.id), "created": e.created, "clicks": e.clicks})
+			}
+		}
+		return map[string]any{"page": page, "isDone": end == len(f.statsLog), "continueCursor": strconv.Itoa(end)}, nil
+	case "stats:lastFlush":
+		return f.lastFlush, nil
+	case "stats:storageStats":
+		return map[string]int{"links": len(f.links), "stats": len(f.stats)}, nil
+	}
+	return nil, fmt.Errorf("Could not find function for '%s'", path)
+}
+
+// Test that ConvexDB can be used from many goroutines at once.
+// Run with -race to detect data races.
+func Test_Convex_Concurrent(t *testing.T) {
+	srv := newFakeConvex(t)
+	db := NewConvexDB(srv.URL, "test")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				short := fmt.Sprintf("link-%d", n)
+				if err := db.Save(&Link{Short: short, Long: "long"}); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := db.Load(short); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := db.SaveStats(ClickStats{short: 1}); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := db.LoadStats(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	got, err := db.LoadStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		short := fmt.Sprintf("link%d", i)
+		if got[short] != 10 {
+			t.Errorf("db.LoadStats()[%q] = %d, want 10", short, got[short])
+		}
+	}
+}
+
+// Test that executing a function does not modify the caller's arguments.
+func Test_Convex_ArgsNotModified(t *testing.T) {
+	srv := newFakeConvex(t)
+	db := NewConvexDB(srv.URL, "test")
+
+	args := UdfExecution{"load:loadAll", map[string]interface{}{}, "json"}
+	if _, err := db.query(context.Background(), &args); err != nil {
+		t.Fatal(err)
+	}
+	if len(args.Args) != 0 {
+		t.Errorf("db.query modified args: %v", args.Args)
+	}
+}
+
+// Test caching of query results by ConvexDB.
+func Test_Convex_QueryCache(t *testing.T) {
+	srv := newFakeConvex(t)
+	db := NewConvexDB(srv.URL, "test")
+	now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	db.Now = func() time.Time { return now }
+	db.QueryCacheTTL = time.Minute
+	db.QueryCacheInvalidation = map[string][]string{
+		"stats:saveStats": {"stats:loadStats"},
+	}
+
+	if err := db.Save(&Link{Short: "a", Long: "long"}); err != nil {
+		t.Fatal(err)
+	}
+
+	wantStats := func(wantHits, wantMisses int64) {
+		t.Helper()
+		hits, misses := db.QueryCacheStats()
+		if hits != wantHits || misses != wantMisses {
+			t.Errorf("db.QueryCacheStats() = %d, %d; want %d, %d", hits, misses, wantHits, wantMisses)
+		}
+	}
+
+	db.Load("a")
+	db.Load("a")
+	wantStats(1, 1)
+
+	// a different query is cached separately
+	db.LoadStats()
+	wantStats(1, 2)
+
+	// saving stats only invalidates stats queries
+	db.SaveStats(ClickStats{"a": 1})
+	db.Load("a")
+	wantStats(2, 2)
+	got, err := db.LoadStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["a"] != 1 {
+		t.Errorf("db.LoadStats()[%q] = %d, want 1", "a", got["a"])
+	}
+	wantStats(2, 3)
+
+	// unlisted mutations invalidate everything
+	db.Save(&Link{Short: "a", Long: "other"})
+	link, err := db.Load("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Long != "other" {
+		t.Errorf("db.Load(%q).Long = %q, want %q", "a", link.Long, "other")
+	}
+	wantStats(2, 4)
+
+	// entries expire after the TTL
+	now = now.Add(time.Minute)
+	db.Load("a")
+	wantStats(2, 5)
+}
+
+// Test that ConvexDB sends context values as headers.
+func Test_Convex_ContextHeaders(t *testing.T) {
+	type ctxKey string
+	f := &fakeConvex{
+		links: make(map[string]LinkDocument),
+		stats: make(map[string]int),
+	}
+	var mu sync.Mutex
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r.Header.Get("X-Request-Id"))
+		mu.Unlock()
+		f.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	db := NewConvexDB(srv.URL, "test")
+	if _, err := db.LoadContext(context.WithValue(context.Background(), ctxKey("id"), "req-1"), "a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("db.LoadContext got %v, want fs.ErrNotExist", err)
+	}
+	db.ContextHeaders = map[any]string{ctxKey("id"): "X-Request-Id"}
+	if _, err := db.LoadContext(context.WithValue(context.Background(), ctxKey("id"), "req-2"), "a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("db.LoadContext got %v, want fs.ErrNotExist", err)
+	}
+	if _, err := db.Load("a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("db.Load got %v, want fs.ErrNotExist", err)
+	}
+
+	want := []string{"", "req-2", ""}
+	if !cmp.Equal(got, want) {
+		t.Errorf("X-Request-Id headers got %q, want %q", got, want)
+	}
+}
+
+// Test that ConvexDB gets a token from its TokenProvider for each call.
+func Test_Convex_TokenProvider(t *testing.T) {
+	f := &fakeConvex{
+		links: make(map[string]LinkDocument),
+		stats: make(map[string]int),
+	}
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		f.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	var tokens []string
+	errRotating := errors.New("token is being rotated")
+	next := "t1"
+	db := NewConvexDBWithTokenProvider(&UDFTransport{URL: srv.URL}, func(ctx context.Context) (string, error) {
+		if next == "" {
+			return "", errRotating
+		}
+		tokens = append(tokens, next)
+		return next, nil
+	})
+
+	if err := db.Save(&Link{Short: "a", Long: "http://a/"}); err != nil {
+		t.Fatal(err)
+	}
+	next = "t2"
+	if _, err := db.Load("a"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"t1", "t2"}; !cmp.Equal(tokens, want) {
+		t.Errorf("tokens used got %q, want %q", tokens, want)
+	}
+
+	next = ""
+	if _, err := db.Load("a"); !errors.Is(err, errRotating) {
+		t.Errorf("db.Load with failing provider got %v, want %v", err, errRotating)
+	}
+	if requests != 2 {
+		t.Errorf("made %d requests, want 2", requests)
+	}
+}
+
+// Test decoding Convex timestamps stored as numbers or ISO strings.
+func TestConvexTime(t *testing.T) {
+	tests := []struct {
+		doc     string
+		want    time.Time
+		wantErr bool
+	}{
+		{doc: `{"created": 1640995200}`, want: time.Unix(1640995200, 0)},
+		{doc: `{"created": "2022-01-01T00:00:00Z"}`, want: time.Unix(1640995200, 0)},
+		{doc: `{"created": "2022-01-01T01:00:00+01:00"}`, want: time.Unix(1640995200, 0)},
+		{doc: `{"created": "yesterday"}`, wantErr: true},
+		{doc: `{"created": true}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		var doc LinkDocument
+		err := json.Unmarshal([]byte(tt.doc), &doc)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("decoding %s succeeded, want error", tt.doc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("decoding %s: %v", tt.doc, err)
+			continue
+		}
+		if got := doc.link().Created; !got.Equal(tt.want) {
+			t.Errorf("decoding %s got %v, want %v", tt.doc, got, tt.want)
+		}
+	}
+}
+
+// Test that ConvexDB reports owners over their link quota.
+func Test_Convex_MaxLinksPerOwner(t *testing.T) {
+	srv := newFakeConvex(t)
+	db := NewConvexDB(srv.URL, "test")
+	db.MaxLinksPerOwner = 1
+
+	if err := db.Save(&Link{Short: "a", Owner: "foo@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Save(&Link{Short: "a", Long: "http://a/", Owner: "foo@example.com"}); err != nil {
+		t.Errorf("db.Save of existing link: %v", err)
+	}
+	err := db.Save(&Link{Short: "b", Owner: "foo@example.com"})
+	var quota *QuotaExceededError
+	if !errors.As(err, &quota) {
+		t.Fatalf("db.Save over quota got %v, want QuotaExceededError", err)
+	}
+	if quota.Count != 1 || quota.Limit != 1 {
+		t.Errorf("QuotaExceededError got %d/%d, want 1/1", quota.Count, quota.Limit)
+	}
+}
+
+// Test that ConvexDB.Validate reports each kind of misconfiguration.
+func Test_Convex_Validate(t *testing.T) {
+	f := &fakeConvex{
+		links:   make(map[string]LinkDocument),
+		stats:   make(map[string]int),
+		missing: make(map[string]bool),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	ctx := context.Background()
+
+	if err := NewConvexDB(srv.URL, "test").Validate(ctx); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+	if err := NewConvexDB(srv.URL, "").Validate(ctx); err == nil || !strings.Contains(err.Error(), "token rejected") {
+		t.Errorf("Validate with bad token got %v, want token error", err)
+	}
+	if err := NewConvexDB("http://127.0.0.1:1", "test").Validate(ctx); err == nil || !strings.Contains(err.Error(), "cannot reach") {
+		t.Errorf("Validate with bad URL got %v, want reachability error", err)
+	}
+
+	f.missing["load:loadAll"] = true
+	f.missing["store"] = true
+	err := NewConvexDB(srv.URL, "test").Validate(ctx)
+	if want := "functions not deployed: load:loadAll, store"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("Validate with missing functions got %v, want %q", err, want)
+	}
+}
+
+// Test that ConvexDB renames document fields with FieldMap.
+func Test_Convex_FieldMap(t *testing.T) {
+	var stored map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Path string
+			Args map[string]json.RawMessage
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		var value any
+		switch req.Path {
+		case "store":
+			json.Unmarshal(req.Args["link"], &stored)
+			value = map[string]any{"created": true}
+		case "load:loadOne":
+			value = map[string]any{"normalizedId": "foo", "slug": "Foo", "destination": "http://foo/", "created": 1, "lastEdit": 2, "owner": ""}
+		}
+		encoded, _ := json.Marshal(value)
+		json.NewEncoder(w).Encode(ConvexResponse{Status: "success", Value: encoded})
+	}))
+	t.Cleanup(srv.Close)
+
+	db := NewConvexDB(srv.URL, "test")
+	db.FieldMap = map[string]string{"short": "slug", "long": "destination"}
+
+	if err := db.Save(&Link{Short: "Foo", Long: "http://foo/"}); err != nil {
+		t.Fatal(err)
+	}
+	if stored["slug"] != "Foo" || stored["destination"] != "http://foo/" {
+		t.Errorf("stored document %v, want slug and destination fields", stored)
+	}
+	if _, ok := stored["short"]; ok {
+		t.Errorf("stored document %v has unmapped short field", stored)
+	}
+
+	link, err := db.Load("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Short != "Foo" || link.Long != "http://foo/" {
+		t.Errorf("db.Load got %+v, want Short Foo and Long http://foo/", link)
+	}
+}
+
+// Test that ConvexDB.LoadStats skips malformed entries unless strict.
+func Test_Convex_LoadStatsPartial(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := json.RawMessage(`{"a": 1, "b": "two", "c": null, "d": 4}`)
+		json.NewEncoder(w).Encode(ConvexResponse{Status: "success", Value: value})
+	}))
+	t.Cleanup(srv.Close)
+	db := NewConvexDB(srv.URL, "test")
+
+	clicks, skipped, err := db.LoadStatsPartial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ClickStats{"a": 1, "d": 4}); !cmp.Equal(clicks, want) {
+		t.Errorf("db.LoadStatsPartial got %v, want %v", clicks, want)
+	}
+	if len(skipped) != 2 {
+		t.Errorf("db.LoadStatsPartial skipped %v, want 2 errors", skipped)
+	}
+
+	clicks, err = db.LoadStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clicks) != 2 {
+		t.Errorf("db.LoadStats got %v, want 2 entries", clicks)
+	}
+
+	db.StrictStats = true
+	if _, err := db.LoadStats(); err == nil {
+		t.Error("strict db.LoadStats succeeded, want error")
+	}
+}
+
+// Test that ConvexDB can call functions through HTTP actions.
+func Test_Convex_HTTPActionTransport(t *testing.T) {
+	f := &fakeConvex{
+		links: make(map[string]LinkDocument),
+		stats: make(map[string]int),
+	}
+	mux := http.NewServeMux()
+	for path, route := range map[string]string{"store": "/links/save", "load:loadOne": "/links/get"} {
+		path := path
+		mux.HandleFunc(route, func(w http.ResponseWriter, r *http.Request) {
+			if got := r.Header.Get("X-Api-Version"); got != "2" {
+				t.Errorf("%s: X-Api-Version header %q, want 2", path, got)
+			}
+			var args map[string]json.RawMessage
+			if r.Method == "GET" {
+				json.Unmarshal([]byte(r.URL.Query().Get("args")), &args)
+			} else {
+				json.NewDecoder(r.Body).Decode(&args)
+			}
+			value, err := f.run(path, args)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			json.NewEncoder(w).Encode(value)
+		})
+	}
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	header := http.Header{"X-Api-Version": {"2"}}
+	db := NewConvexDBWithTransport(&HTTPActionTransport{Actions: map[string]HTTPAction{
+		"store":        {URL: srv.URL + "/links/save", Header: header},
+		"load:loadOne": {URL: srv.URL + "/links/get", Method: "GET", Header: header},
+	}}, "test")
+
+	if err := db.Save(&Link{Short: "foo", Long: "http://foo/"}); err != nil {
+		t.Fatal(err)
+	}
+	link, err := db.Load("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Long != "http://foo/" {
+		t.Errorf("db.Load got Long %q, want %q", link.Long, "http://foo/")
+	}
+	if _, err := db.Load("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("db.Load of missing link got %v, want fs.ErrNotExist", err)
+	}
+	if _, err := db.LoadAll(); err == nil || !strings.Contains(err.Error(), "load:loadAll") {
+		t.Errorf("db.LoadAll without an action got %v, want error naming load:loadAll", err)
+	}
+}
+
+// Test gzip compression of Convex request and response bodies.
+func Test_Convex_Gzip(t *testing.T) {
+	f := &fakeConvex{
+		links: make(map[string]LinkDocument),
+		stats: make(map[string]int),
+	}
+	var compressed []bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isGzip := r.Header.Get("Content-Encoding") == "gzip"
+		compressed = append(compressed, isGzip)
+		if isGzip {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			r.Body = io.NopCloser(zr)
+		}
+		// Always respond with a gzipped body.
+		rec := httptest.NewRecorder()
+		f.ServeHTTP(rec, r)
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		zw.Write(rec.Body.Bytes())
+		zw.Close()
+	}))
+	t.Cleanup(srv.Close)
+
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	db := NewConvexDBWithTransport(&UDFTransport{URL: srv.URL, Client: client, GzipRequestsOver: 200}, "test")
+
+	if err := db.Save(&Link{Short: "a", Long: "http://a/" + strings.Repeat("x", 200)}); err != nil {
+		t.Fatal(err)
+	}
+	link, err := db.Load("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(link.Long) != 209 {
+		t.Errorf("db.Load got Long of length %d, want 209", len(link.Long))
+	}
+	if want := []bool{true, false}; !cmp.Equal(compressed, want) {
+		t.Errorf("compressed requests got %v, want %v", compressed, want)
+	}
+}
+
+// Test that unexpected response bodies are truncated in errors.
+func Test_Convex_ErrorBodyLimit(t *testing.T) {
+	huge := strings.Repeat("x", 1<<20)
+	tests := []struct {
+		name   string
+		status int
+	}{
+		{"status", http.StatusBadGateway},
+		{"invalid", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				io.WriteString(w, huge)
+			}))
+			t.Cleanup(srv.Close)
+			db := NewConvexDBWithTransport(&UDFTransport{URL: srv.URL, MaxErrorBody: 100}, "test")
+
+			_, err := db.Load("a")
+			if err == nil {
+				t.Fatal("db.Load succeeded, want error")
+			}
+			if msg := err.Error(); len(msg) > 300 || !strings.Contains(msg, "(truncated)") {
+				t.Errorf("db.Load error of length %d is not truncated: %.300s", len(msg), msg)
+			}
+		})
+	}
+}
+
+// Test that an empty 200 response is reported as such, naming the function
+// called, rather than as a bare EOF.
+func Test_Convex_EmptyResponse(t *testing.T) {
+	for _, body := range []string{"", " \n"} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, body)
+		}))
+		t.Cleanup(srv.Close)
+		db := NewConvexDB(srv.URL, "test")
+
+		_, err := db.Load("a")
+		if !errors.Is(err, ErrEmptyResponse) {
+			t.Fatalf("db.Load with body %q got %v, want ErrEmptyResponse", body, err)
+		}
+		if want := "Convex returned an empty 200 response for load:loadOne"; !strings.Contains(err.Error(), want) {
+			t.Errorf("db.Load error %q does not contain %q", err, want)
+		}
+		if err := db.Save(&Link{Short: "a", Long: "http://a/"}); !errors.Is(err, ErrEmptyResponse) || !strings.Contains(err.Error(), "for store") {
+			t.Errorf("db.Save with body %q got %v, want ErrEmptyResponse for store", body, err)
+		}
+	}
+}
+
+// Test that network failures can be unwrapped from ConvexDB errors.
+func Test_Convex_NetworkErrorUnwraps(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close() // refuse connections
+	db := NewConvexDB(srv.URL, "test")
+
+	calls := map[string]func() error{
+		"Load":  func() error { _, err := db.Load("a"); return err },
+		"Save":  func() error { return db.Save(&Link{Short: "a", Long: "http://a/"}) },
+		"Stats": func() error { _, err := db.LoadStats(); return err },
+	}
+	for name, call := range calls {
+		err := call()
+		var opErr *net.OpError
+		if !errors.As(err, &opErr) {
+			t.Errorf("%s error %v does not unwrap to a *net.OpError", name, err)
+		}
+	}
+}
+
+// Test that RunQueries reports each query's result separately.
+func Test_Convex_RunQueries(t *testing.T) {
+	srv := newFakeConvex(t)
+	db := NewConvexDB(srv.URL, "test")
+	if err := db.Save(&Link{Short: "a", Long: "http://a/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := []UdfExecution{
+		{"load:loadOne", map[string]interface{}{"normalizedId": "a"}, "json"},
+		{"load:noSuchQuery", map[string]interface{}{}, "json"},
+		{"load:loadAll", map[string]interface{}{}, "json"},
+	}
+	results, err := db.RunQueries(context.Background(), queries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statuses []string
+	for _, r := range results {
+		statuses = append(statuses, r.Status)
+	}
+	if want := []string{"success", "error", "success"}; !cmp.Equal(statuses, want) {
+		t.Errorf("RunQueries got statuses %v, want %v", statuses, want)
+	}
+	link, err := db.decodeLink(results[0].Value)
+	if err != nil || link == nil || link.Long != "http://a/" {
+		t.Errorf("RunQueries result 0 decoded to %v, %v; want link a", link, err)
+	}
+	if !strings.Contains(results[1].ErrorMessage, "Could not find") {
+		t.Errorf("RunQueries result 1 error %q, want missing function", results[1].ErrorMessage)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.RunQueries(ctx, queries); !errors.Is(err, context.Canceled) {
+		t.Errorf("RunQueries with canceled context got %v, want context.Canceled", err)
+	}
+}
+
+// Test that ConvexDB.Renormalize makes links stored under an older
+// normalizer reachable again, keeping their stats.
+func Test_Convex_Renormalize(t *testing.T) {
+	f := &fakeConvex{
+		links: map[string]LinkDocument{
+			"a":       {Id: "a", Short: "a", Long: "http://a/"},
+			"foo-bar": {Id: "foo-bar", Short: "Foo-Bar", Long: "http://foo/"},
+		},
+		stats: map[string]int{"foo-bar": 3},
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	db := NewConvexDB(srv.URL, "test")
+
+	changed, err := db.Renormalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed != 1 {
+		t.Errorf("Renormalize changed %d links, want 1", changed)
+	}
+	for short, long := range map[string]string{"a": "http://a/", "Foo-Bar": "http://foo/"} {
+		if link, err := db.Load(short); err != nil || link.Long != long {
+			t.Errorf("Load(%q) got %v, %v; want %s", short, link, err, long)
+		}
+	}
+	f.mu.Lock()
+	if f.stats["foobar"] != 3 {
+		t.Errorf("stats got %v, want 3 clicks for foobar", f.stats)
+	}
+	f.mu.Unlock()
+
+	f.mu.Lock()
+	f.links["fOObar"] = LinkDocument{Id: "fOObar", Short: "foobar"}
+	f.mu.Unlock()
+	if _, err := db.Renormalize(); err == nil {
+		t.Error("Renormalize with colliding links succeeded, want error")
+	}
+}
+
+// Test that ConvexDB.LoadMany loads links with load:loadMany, or with
+// bounded concurrent load:loadOne queries if that isn't deployed.
+func Test_Convex_LoadMany(t *testing.T) {
+	for _, batch := range []bool{true, false} {
+		t.Run(fmt.Sprintf("batch=%v", batch), func(t *testing.T) {
+			f := &fakeConvex{
+				links:   make(map[string]LinkDocument),
+				stats:   make(map[string]int),
+				missing: map[string]bool{"load:loadMany": !batch},
+			}
+			var mu sync.Mutex
+			var inFlight, maxInFlight int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				mu.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				f.ServeHTTP(w, r)
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+			}))
+			t.Cleanup(srv.Close)
+			db := NewConvexDB(srv.URL, "test")
+			db.LoadManyConcurrency = 2
+
+			shorts := []string{"a", "b", "c", "d", "e"}
+			for _, short := range shorts {
+				if err := db.Save(&Link{Short: short, Long: "http://" + short + "/"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			links, err := db.LoadMany(context.Background(), append(shorts, "A", "missing", ""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]string)
+			for short, link := range links {
+				got[short] = link.Long
+			}
+			want := map[string]string{
+				"a": "http://a/", "A": "http://a/", "b": "http://b/",
+				"c": "http://c/", "d": "http://d/", "e": "http://e/",
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("LoadMany mismatch (-want +got):\n%s", diff)
+			}
+			if maxInFlight > 2 {
+				t.Errorf("LoadMany had %d calls in flight, want at most 2", maxInFlight)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if _, err := db.LoadMany(ctx, shorts); !errors.Is(err, context.Canceled) {
+				t.Errorf("LoadMany with canceled context got %v, want context.Canceled", err)
+			}
+		})
+	}
+}
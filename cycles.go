@@ -0,0 +1,144 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// DefaultLinkHosts are the hosts used when Options.LinkHosts is nil.
+var DefaultLinkHosts = []string{"go"}
+
+// linkHosts returns o.LinkHosts, or DefaultLinkHosts if it is nil.
+func (o *Options) linkHosts() []string {
+	if o.LinkHosts == nil {
+		return DefaultLinkHosts
+	}
+	return o.LinkHosts
+}
+
+// findCycles returns the cycles in the graph of links pointing at other
+// links through one of hosts. Each cycle lists link names in redirect order,
+// starting from its first link by normalized name, and a link pointing at
+// itself is a cycle of one. Cycles are found by a depth-first search in
+// order of normalized name, which reports at least one cycle through every
+// set of links that loop, though not every distinct cycle; breaking the
+// reported cycles and searching again finds any that remain.
+//
+// Templates are skipped, since their destination depends on the request,
+// as are URLs naming a short that isn't in links, such as an alias.
+func findCycles(links []*Link, hosts []string) [][]string {
+	byID := make(map[string]*Link, len(links))
+	ids := make([]string, 0, len(links))
+	for _, link := range links {
+		id := linkID(link.Name())
+		byID[id] = link
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	edges := make(map[string][]string, len(links))
+	for _, id := range ids {
+		link := byID[id]
+		targets := []string{link.Long}
+		for _, d := range link.Destinations {
+			targets = append(targets, d.URL)
+		}
+		seen := make(map[string]bool)
+		for _, target := range targets {
+			to, ok := linkTarget(target, hosts, byID)
+			if ok && !seen[to] {
+				seen[to] = true
+				edges[id] = append(edges[id], to)
+			}
+		}
+		sort.Strings(edges[id])
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int, len(ids))
+	var path []string
+	var cycles [][]string
+	var visit func(id string)
+	visit = func(id string) {
+		state[id] = visiting
+		path = append(path, id)
+		for _, to := range edges[id] {
+			switch state[to] {
+			case unvisited:
+				visit(to)
+			case visiting:
+				// to is on the current path, so the path from it
+				// back to id closes a cycle.
+				var cycle []string
+				for i := len(path) - 1; i >= 0; i-- {
+					if path[i] == to {
+						for _, c := range path[i:] {
+							cycle = append(cycle, byID[c].Name())
+						}
+						break
+					}
+				}
+				cycles = append(cycles, cycle)
+			}
+		}
+		path = path[:len(path)-1]
+		state[id] = done
+	}
+	for _, id := range ids {
+		if state[id] == unvisited {
+			visit(id)
+		}
+	}
+	return cycles
+}
+
+// linkTarget returns the normalized ID of the link in byID that the URL
+// target points at through one of hosts. Like serveGo, it resolves
+// "go/eng/foo" to the link foo in namespace eng if there is one, and
+// otherwise to the link eng. Schemeless URLs
+// such as "go/foo" are accepted, as browsers do.
+func linkTarget(target string, hosts []string, byID map[string]*Link) (string, bool) {
+	if strings.Contains(target, "{{") {
+		return "", false
+	}
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", false
+	}
+	host := u.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	isLinkHost := false
+	for _, h := range hosts {
+		if strings.EqualFold(host, h) {
+			isLinkHost = true
+			break
+		}
+	}
+	if !isLinkHost {
+		return "", false
+	}
+	short, rest, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if nsShort, _, _ := strings.Cut(rest, "/"); nsShort != "" {
+		if id := linkID(short + "/" + nsShort); byID[id] != nil {
+			return id, true
+		}
+	}
+	if id := linkID(short); short != "" && byID[id] != nil {
+		return id, true
+	}
+	return "", false
+}
@@ -0,0 +1,43 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"path"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDetectCycles(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.LinkHosts = []string{"go", "go.example.com"}
+	for _, link := range []*Link{
+		{Short: "a", Long: "http://go/b"},
+		{Short: "b", Long: "https://go.example.com:443/a/extra"},
+		{Short: "self", Long: "go/Self"},
+		{Short: "c", Long: "http://example.com/", Destinations: []WeightedDest{{URL: "http://go/eng/d", Weight: 1}}},
+		{Short: "d", Namespace: "eng", Long: "http://go/c"},
+		{Short: "e", Long: "http://go/a"}, // leads into a cycle, but isn't on one
+		{Short: "f", Long: "http://go/{{.Path}}"},
+		{Short: "g", Long: "http://other/g"},
+		{Short: "h", Long: "http://go/missing"},
+	} {
+		if err := db.Save(link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := db.DetectCycles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"a", "b"}, {"c", "eng/d"}, {"self"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("DetectCycles() mismatch (-want +got):\n%s", diff)
+	}
+}
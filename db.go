@@ -4,10 +4,21 @@
 package golink
 
 import (
+	"context"
 	_ "embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 )
 
 // Link is the structure stored for each go short link.
@@ -17,23 +28,1279 @@ type Link struct {
 	Created  time.Time
 	LastEdit time.Time // when the link was last edited
 	Owner    string    // user@domain
+
+	// Destinations optionally lists weighted alternative targets, for
+	// links that split traffic between several URLs. If empty, Long is
+	// always used. See ResolveDestination.
+	Destinations []WeightedDest `json:",omitempty"`
+
+	// RedirectCode is the HTTP status code used to redirect to the link:
+	// one of 301, 302, 307 or 308. Zero uses the server default.
+	RedirectCode int `json:",omitempty"`
+
+	// Namespace is the group the link belongs to, such as "eng" for
+	// http://go/eng/foo. Links in different namespaces may share a short
+	// name. Empty is the default namespace, for links like http://go/foo.
+	Namespace string `json:",omitempty"`
+
+	// AllowedOwners optionally restricts who may follow the link to its
+	// Owner and these users, such as for internal-only destinations. An
+	// entry starting with "@", as in "@example.com", allows every user in
+	// that domain. If empty, the link is public. The store only records
+	// the list; callers enforce it with CanAccess.
+	AllowedOwners []string `json:",omitempty"`
+
+	// ExpiresAt, if non-zero, is when the link stops being valid. The
+	// store only records it; callers check it with Expired.
+	ExpiresAt time.Time
+
+	// TTL, if positive, sets ExpiresAt to Created plus TTL when the link
+	// is saved, unless ExpiresAt is already set, which takes precedence.
+	// A negative TTL is an error. TTL itself is not stored.
+	TTL time.Duration `json:"-"`
+
+	// IconURL optionally records the URL of an icon for the link, such as
+	// its destination's favicon, so that listings can show it without
+	// fetching it each time. The store only records it.
+	IconURL string `json:",omitempty"`
+
+	// Pinned marks the link as featured, such as on the homepage. Pin and
+	// Unpin set it without saving the rest of the link.
+	Pinned bool `json:",omitempty"`
+
+	// MaxUses, if positive, is the number of times the link can be
+	// followed with ConsumeUse, such as for sharing a sensitive URL once.
+	// Zero allows unlimited uses.
+	MaxUses int `json:",omitempty"`
+
+	// UseCount is the number of times ConsumeUse has returned the link.
+	// It is maintained by the store, which ignores the value passed to
+	// Save.
+	UseCount int `json:",omitempty"`
+
+	// Source optionally records the app the link was created with, such
+	// as "slack", "web" or "cli", for reporting with CountBySource. Like
+	// CreatedFrom, it is kept from the first save that sets it, so that
+	// editing a link with another app doesn't change it.
+	Source string `json:",omitempty"`
+
+	// Headers optionally sets HTTP response headers on redirects to the
+	// link, such as Cache-Control or Referrer-Policy. Save refuses
+	// malformed header names and values with an *InvalidHeaderError.
+	Headers map[string]string `json:",omitempty"`
+
+	// CreatedFrom optionally records where the link was created from,
+	// such as the creator's IP address or a request ID, for abuse
+	// investigation. It is kept from the first save that sets it. For
+	// privacy, only LoadWithMeta returns it; other loads leave it empty.
+	CreatedFrom string `json:",omitempty"`
+
+	// EditCount is the number of times the link has been saved, starting
+	// at 1 when it is created. It is maintained by the store, which
+	// ignores the value passed to Save.
+	EditCount int `json:",omitempty"`
+}
+
+// Name returns the name that link is loaded by: its short name, qualified
+// by its namespace if it has one, as in "eng/foo".
+func (link *Link) Name() string {
+	if link.Namespace == "" {
+		return link.Short
+	}
+	return link.Namespace + "/" + link.Short
+}
+
+// Expired reports whether link has an ExpiresAt that is not after t.
+func (link *Link) Expired(t time.Time) bool {
+	return !link.ExpiresAt.IsZero() && !t.Before(link.ExpiresAt)
+}
+
+// CanAccess reports whether user may follow link: always if the link is
+// public, and otherwise if user is its Owner or is allowed by its
+// AllowedOwners. Users are compared case-insensitively, and the empty user
+// may only follow public links.
+func CanAccess(link *Link, user string) bool {
+	if len(link.AllowedOwners) == 0 {
+		return true
+	}
+	if user == "" {
+		return false
+	}
+	if strings.EqualFold(user, link.Owner) {
+		return true
+	}
+	for _, allowed := range link.AllowedOwners {
+		if strings.HasPrefix(allowed, "@") {
+			if len(user) > len(allowed) && strings.EqualFold(user[len(user)-len(allowed):], allowed) {
+				return true
+			}
+		} else if strings.EqualFold(user, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// validRedirectCodes are the allowed values of a non-zero Link.RedirectCode.
+var validRedirectCodes = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+// WeightedDest is a link destination that is chosen in proportion to its
+// weight relative to the other destinations of the link.
+type WeightedDest struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// ResolveDestination returns the target URL or template for link. If link
+// has weighted Destinations, one is picked at random in proportion to its
+// weight using r, or the math/rand default source if r is nil. Otherwise,
+// link.Long is returned.
+func ResolveDestination(link *Link, r *rand.Rand) string {
+	total := 0
+	for _, d := range link.Destinations {
+		if d.Weight > 0 {
+			total += d.Weight
+		}
+	}
+	if total == 0 {
+		return link.Long
+	}
+	var n int
+	if r != nil {
+		n = r.Intn(total)
+	} else {
+		n = rand.Intn(total)
+	}
+	for _, d := range link.Destinations {
+		if d.Weight <= 0 {
+			continue
+		}
+		if n < d.Weight {
+			return d.URL
+		}
+		n -= d.Weight
+	}
+	panic("unreachable")
 }
 
 // ClickStats is the number of clicks a set of links have received in a given
 // time period. It is keyed by link short name, with values of total clicks.
 type ClickStats map[string]int
 
-// linkID returns the normalized ID for a link short name.
+// StatEntry is the total clicks of one link, as streamed by StatsSeq. Short
+// is the key the store's LoadStats would use for the link.
+type StatEntry struct {
+	Short  string
+	Clicks int
+}
+
+// StatEntrySeq is a sequence of StatEntry values, each paired with a nil
+// error, or ending with an error if the stats could not be read. It has the
+// shape of iter.Seq2[StatEntry, error], so that it can be ranged over once
+// the module requires Go 1.23; until then, call it with a yield function,
+// which returns false to stop early.
+type StatEntrySeq func(yield func(StatEntry, error) bool)
+
+// StatRow is the clicks on one link recorded by one SaveStats call, as
+// returned by LoadRawStats. Short is the key the store's LoadStats would
+// use for the link.
+type StatRow struct {
+	Short   string
+	Created time.Time // when the clicks were saved
+	Clicks  int
+}
+
+// StatRowSeq is a sequence of StatRow values, with the same shape and
+// conventions as StatEntrySeq.
+type StatRowSeq func(yield func(StatRow, error) bool)
+
+// clickThroughRates returns the click-through rate of each link in
+// impressions: its clicks divided by the number of times it was shown.
+// Links that were never shown are omitted rather than dividing by zero.
+// Clicks also come from visits that didn't follow an impression, such as
+// typed or bookmarked links, so a rate can be greater than 1.
+func clickThroughRates(clicks, impressions ClickStats) map[string]float64 {
+	ctr := make(map[string]float64, len(impressions))
+	for short, n := range impressions {
+		if n <= 0 {
+			continue
+		}
+		ctr[short] = float64(clicks[short]) / float64(n)
+	}
+	return ctr
+}
+
+// StalenessWeights weighs the signals combined into a link's staleness
+// score by LoadStaleCandidates. Each signal is scaled to between 0 and 1
+// before being weighted, so the weights only set their relative importance.
+// If all weights are zero, the signals are weighed equally.
+type StalenessWeights struct {
+	Clicks       float64 // how few times the link has been clicked
+	LastAccessed float64 // how long since the link was last clicked
+	LastEdit     float64 // how long since the link was last edited
+}
+
+// LinkWithScore is a link ranked by LoadStaleCandidates, with the signals
+// its score was computed from.
+type LinkWithScore struct {
+	Link  *Link
+	Score float64 // higher is staler
+
+	Clicks int // total clicks on the link
+
+	// LastAccessed is when clicks on the link were last saved, or the zero
+	// time if it has never been clicked.
+	LastAccessed time.Time
+}
+
+// linkActivity is the clicks on a link and when they were last saved.
+type linkActivity struct {
+	clicks       int
+	lastAccessed time.Time
+}
+
+// staleCandidates scores links by staleness as of now, using the activity
+// of each, keyed by link ID, and returns the n stalest, stalest first.
+//
+// The clicks signal is 1/(1+clicks). The age signals are how long ago the
+// link was last accessed or edited, divided by the oldest such age among
+// links, so that the stalest link scores 1. A link never clicked counts as
+// last accessed when it was created.
+func staleCandidates(links []*Link, activity map[string]linkActivity, w StalenessWeights, now time.Time, n int) []*LinkWithScore {
+	if w == (StalenessWeights{}) {
+		w = StalenessWeights{Clicks: 1, LastAccessed: 1, LastEdit: 1}
+	}
+	age := func(t time.Time) float64 {
+		if d := now.Sub(t); d > 0 {
+			return float64(d)
+		}
+		return 0
+	}
+	accessed := func(l *Link, a linkActivity) time.Time {
+		if a.lastAccessed.IsZero() {
+			return l.Created
+		}
+		return a.lastAccessed
+	}
+
+	var maxAccess, maxEdit float64
+	for _, l := range links {
+		if d := age(accessed(l, activity[linkID(l.Name())])); d > maxAccess {
+			maxAccess = d
+		}
+		if d := age(l.LastEdit); d > maxEdit {
+			maxEdit = d
+		}
+	}
+	scaled := func(d, max float64) float64 {
+		if max == 0 {
+			return 0
+		}
+		return d / max
+	}
+
+	scored := make([]*LinkWithScore, 0, len(links))
+	for _, l := range links {
+		a := activity[linkID(l.Name())]
+		score := w.Clicks/float64(1+a.clicks) +
+			w.LastAccessed*scaled(age(accessed(l, a)), maxAccess) +
+			w.LastEdit*scaled(age(l.LastEdit), maxEdit)
+		scored = append(scored, &LinkWithScore{Link: l, Score: score, Clicks: a.clicks, LastAccessed: a.lastAccessed})
+	}
+	sort.Slice(scored, func(i, j int) bool {
+		if scored[i].Score != scored[j].Score {
+			return scored[i].Score > scored[j].Score
+		}
+		return linkID(scored[i].Link.Name()) < linkID(scored[j].Link.Name())
+	})
+	if n >= 0 && n < len(scored) {
+		scored = scored[:n]
+	}
+	return scored
+}
+
+// StorageStats describes the size of a store, as opposed to the clicks on
+// its links, for capacity monitoring.
+type StorageStats struct {
+	Links     int // number of stored links
+	Aliases   int // number of stored aliases
+	StatsRows int // number of stored per-link click counts
+
+	// SizeBytes is the approximate on-disk size of the store, or zero if
+	// the store can't report it.
+	SizeBytes int64
+}
+
+// splitName splits a link name, as returned by Link.Name, into its namespace
+// and short name.
+func splitName(name string) (namespace, short string) {
+	if namespace, short, ok := strings.Cut(name, "/"); ok {
+		return namespace, short
+	}
+	return "", name
+}
+
+// linkID returns the normalized ID for a link name, as returned by Link.Name.
+// A namespace and short name are normalized separately, so "Eng/Foo-Bar" has
+// the ID "eng/foobar".
 func linkID(short string) string {
+	if namespace, rest, ok := strings.Cut(short, "/"); ok {
+		return linkID(namespace) + "/" + linkID(rest)
+	}
 	id := url.PathEscape(strings.ToLower(short))
 	id = strings.ReplaceAll(id, "-", "")
 	return id
 }
 
+// Options holds settings shared by all Database implementations. The zero
+// value is ready to use. Options must not be changed while the Database is
+// in use.
+type Options struct {
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+
+	// DefaultOwner is the owner given to links saved with an empty Owner,
+	// such as those imported from a system without owners. If empty, such
+	// links are saved without an owner.
+	DefaultOwner string
+
+	// ReservedShorts is the set of short names that Save refuses, so that
+	// links can't shadow server routes. Names are compared in normalized
+	// form, so "Admin" is reserved if "admin" is. If nil,
+	// DefaultReservedShorts is used; to extend the defaults, copy them
+	// into a new map. SaveAdmin ignores reserved names.
+	ReservedShorts map[string]bool
+
+	// DisallowedShortChars are the characters that Save refuses in short
+	// names, since a router would take them as part of the URL rather
+	// than the name, so that the link could never be followed.
+	// Whitespace and control characters are always refused. If empty,
+	// DefaultDisallowedShortChars is used.
+	DisallowedShortChars string
+
+	// HierarchicalShorts allows "/" in short names, such as "team/docs",
+	// even if DisallowedShortChars has it, for servers that route the
+	// whole path to the link. Such names can be confused with namespaced
+	// names, so it is off by default.
+	HierarchicalShorts bool
+
+	// DeleteExhaustedLinks makes ConsumeUse delete a link with MaxUses once
+	// its last use is consumed, rather than keeping it to refuse with
+	// ErrLinkExhausted.
+	DeleteExhaustedLinks bool
+
+	// MaxLongLength is the longest Long URL, in bytes, that can be saved.
+	// NewSQLiteDB and NewConvexDB set it to DefaultMaxLongLength. Zero
+	// disables the limit. Links already stored over the limit still load,
+	// but can't be saved again until shortened.
+	MaxLongLength int
+
+	// MaxLinksPerOwner, if positive, is the most links a single owner may
+	// have. Saving a new link that would put its owner over the limit
+	// fails with a *QuotaExceededError; updates to existing links are
+	// always allowed. Links without an owner are not limited.
+	MaxLinksPerOwner int
+
+	// MaxTotalLinks, if positive, is the most links the store may hold
+	// across all owners, such as to bound a free-tier deployment. Saving a
+	// new link beyond it fails with a *QuotaExceededError with an empty
+	// Owner; updates to existing links are always allowed. The limit is
+	// checked atomically with the insert, so concurrent saves can't race
+	// past it.
+	MaxTotalLinks int
+
+	// CreationLimiter, if non-nil, limits how fast each owner may create
+	// links, such as with an OwnerRateLimiter, to curb runaway scripts.
+	// Saving a new link whose owner is over the rate fails with a
+	// *CreationRateLimitedError; updates to existing links are always
+	// allowed, as are links without an owner. Creations that are allowed
+	// but then not saved, such as when a batch fails, are refunded. It is
+	// a soft limit: unlike MaxLinksPerOwner, it is kept in memory rather
+	// than checked against the stored links.
+	CreationLimiter CreationLimiter
+
+	// Rand is the source of randomness for the store, such as for retry
+	// jitter and picking weighted destinations. If nil, the math/rand
+	// default source is used, which production code should keep; tests
+	// can set a seeded source for reproducible behavior. Rand is only
+	// used while holding a lock, so it needn't be safe for concurrent use.
+	Rand *rand.Rand
+
+	// Codec, if non-nil, encodes the Long URL and destination URLs of
+	// links before they are stored, and decodes them when loaded, such as
+	// with an AESGCMCodec to encrypt them at rest. Links are still looked
+	// up by their plaintext names. Changing the Codec makes links stored
+	// with the previous one unreadable.
+	Codec Codec
+
+	// CodecOwner also encodes link owners with Codec. Owners then can't
+	// be matched in storage, so it must not be combined with
+	// MaxLinksPerOwner.
+	CodecOwner bool
+
+	// LoadTransform, if non-nil, is applied to each link returned by Load
+	// and LoadAll, such as to rewrite links to a moved host without
+	// editing them. It is passed a copy owned by the caller, so the stored
+	// link is unchanged, and returns the link to use in its place. Links
+	// loaded to be edited and saved again will be saved as transformed.
+	LoadTransform func(*Link) *Link
+
+	// Canonicalizer, if non-nil, rewrites the Long URL of each saved link
+	// to a canonical form, which is what is stored, and the URL passed to
+	// LoadByLong, so that equivalent URLs are found as duplicates. See
+	// NewURLCanonicalizer for a built-in one. Changing the Canonicalizer
+	// doesn't rewrite links already stored; use RewriteLongs for that.
+	Canonicalizer func(string) (string, error)
+
+	// MillisecondTimes stores link Created and LastEdit times with
+	// millisecond precision. Otherwise they are truncated to whole seconds.
+	// Links stored with either setting load correctly with the other.
+	MillisecondTimes bool
+
+	// LinkHosts are the hosts that serve these links, such as "go" or
+	// "go.example.com", so that DetectCycles can tell which Long URLs
+	// point at other links. Hosts are compared case-insensitively and
+	// without ports. If nil, DefaultLinkHosts is used.
+	LinkHosts []string
+
+	// OnChange are called after each successful Save or Delete, so that
+	// other systems can react to link changes. Each call is made in its own
+	// goroutine, so observers don't block the caller but may see events
+	// out of order. Observers must not modify the event's Link.
+	OnChange []func(ChangeEvent)
+
+	// ChangeEvents, if non-nil, is sent each event passed to OnChange, in
+	// order. Events are dropped if the channel is not ready, so it should
+	// be buffered and drained promptly.
+	ChangeEvents chan<- ChangeEvent
+}
+
+// ChangeType is the kind of change described by a ChangeEvent.
+type ChangeType int
+
+const (
+	ChangeCreate ChangeType = iota + 1
+	ChangeUpdate
+	ChangeDelete
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case ChangeCreate:
+		return "create"
+	case ChangeUpdate:
+		return "update"
+	case ChangeDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("ChangeType(%d)", int(t))
+}
+
+// BatchResult reports the links saved by SaveMany.
+type BatchResult struct {
+	Created int // links that did not exist before
+	Updated int // links that replaced an existing link
+}
+
+// ChangeEvent describes a link that was saved or deleted.
+type ChangeEvent struct {
+	Type  ChangeType
+	Short string
+	Link  *Link // the link as saved, or nil for ChangeDelete
+}
+
+// notify reports ev to the observers in o without blocking.
+func (o *Options) notify(ev ChangeEvent) {
+	for _, f := range o.OnChange {
+		go f(ev)
+	}
+	if o.ChangeEvents != nil {
+		select {
+		case o.ChangeEvents <- ev:
+		default:
+		}
+	}
+}
+
+// randMu guards the use of every Options.Rand.
+var randMu sync.Mutex
+
+// randInt63n returns a random number in [0, n) from o.Rand, or 0 if n <= 0.
+func (o *Options) randInt63n(n int64) int64 {
+	if n <= 0 {
+		return 0
+	}
+	if o.Rand == nil {
+		return rand.Int63n(n)
+	}
+	randMu.Lock()
+	defer randMu.Unlock()
+	return o.Rand.Int63n(n)
+}
+
+// resolveDestination is like ResolveDestination, using o.Rand.
+func (o *Options) resolveDestination(link *Link) string {
+	if o.Rand == nil {
+		return ResolveDestination(link, nil)
+	}
+	randMu.Lock()
+	defer randMu.Unlock()
+	return ResolveDestination(link, o.Rand)
+}
+
+// ErrLinkExists is wrapped by the error returned by SaveNew when a link or
+// alias already has the name being saved.
+var ErrLinkExists = errors.New("link already exists")
+
+// ErrNoFreeShort is returned by CreateRandomShort when every random name it
+// tried was taken.
+var ErrNoFreeShort = errors.New("no free random short name found")
+
+// randomShortAlphabet is the base58 alphabet, which leaves out 0, O, I and
+// l, so that random short names can't be misread.
+const randomShortAlphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// randomShortAttempts is how many random names CreateRandomShort tries
+// before giving up with ErrNoFreeShort.
+const randomShortAttempts = 10
+
+// randomShort returns a random short name of n base58 characters, using
+// o.Rand.
+func (o *Options) randomShort(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = randomShortAlphabet[o.randInt63n(int64(len(randomShortAlphabet)))]
+	}
+	return string(b)
+}
+
+// createRandomShort saves a link to long owned by owner under a random name
+// of length characters with saveNew, which must fail with ErrLinkExists if
+// the name is taken, trying new names until one is free.
+func (o *Options) createRandomShort(saveNew func(*Link) (*Link, error), long, owner string, length int) (*Link, error) {
+	if length <= 0 {
+		return nil, fmt.Errorf("invalid random short length %d", length)
+	}
+	for i := 0; i < randomShortAttempts; i++ {
+		link, err := saveNew(&Link{Short: o.randomShort(length), Long: long, Owner: owner})
+		// Reserved names are as taken as stored ones.
+		if errors.Is(err, ErrLinkExists) || errors.Is(err, ErrReservedShort) {
+			continue
+		}
+		return link, err
+	}
+	return nil, fmt.Errorf("%w after %d attempts of length %d", ErrNoFreeShort, randomShortAttempts, length)
+}
+
+// transform applies o.LoadTransform to link, if set.
+func (o *Options) transform(link *Link) *Link {
+	if o.LoadTransform == nil {
+		return link
+	}
+	return o.LoadTransform(link)
+}
+
+// DefaultMaxLongLength is the default value of Options.MaxLongLength.
+const DefaultMaxLongLength = 8 << 10
+
+// ErrLongTooLong is wrapped by the *LongTooLongError returned when saving a
+// link whose Long URL is over Options.MaxLongLength.
+var ErrLongTooLong = errors.New("long URL is too long")
+
+// LongTooLongError reports a Long URL over the allowed length.
+type LongTooLongError struct {
+	Length int // length of the Long URL, in bytes
+	Max    int // maximum allowed length, in bytes
+}
+
+func (e *LongTooLongError) Error() string {
+	return fmt.Sprintf("%v: %d bytes, limit is %d", ErrLongTooLong, e.Length, e.Max)
+}
+
+func (e *LongTooLongError) Unwrap() error { return ErrLongTooLong }
+
+// options returns o. It lets code holding a Database find the Options of
+// the stores that embed them.
+func (o *Options) options() *Options { return o }
+
+// ErrConflict is wrapped by the error returned when a conditional update
+// finds that the link was changed since the caller last loaded it.
+var ErrConflict = errors.New("link was changed concurrently")
+
+// conflictBackoff is the delay before RetryOnConflict's first retry. It
+// doubles on each subsequent retry.
+const conflictBackoff = 10 * time.Millisecond
+
+// RetryOnConflict calls op, and retries it up to n more times with jittered
+// exponential backoff while it fails with an error wrapping ErrConflict. op
+// should reload whatever it conditions its change on, such as the Long URL
+// passed to UpdateLong as expectedOld, so that a retry can succeed.
+//
+// It returns op's last error, or ctx's error if ctx is done while waiting
+// to retry.
+func RetryOnConflict(ctx context.Context, n int, op func() error) error {
+	return new(Options).RetryOnConflict(ctx, n, op)
+}
+
+// RetryOnConflict is like the package-level RetryOnConflict, drawing its
+// jitter from o.Rand.
+func (o *Options) RetryOnConflict(ctx context.Context, n int, op func() error) error {
+	backoff := conflictBackoff
+	for i := 0; ; i++ {
+		err := op()
+		if i == n || !errors.Is(err, ErrConflict) {
+			return err
+		}
+		t := time.NewTimer(backoff + time.Duration(o.randInt63n(int64(backoff/2))))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// ErrLinkExhausted is returned by ConsumeUse for a link that has already
+// been used Link.MaxUses times.
+var ErrLinkExhausted = errors.New("link has no uses left")
+
+// ErrQuotaExceeded is wrapped by the *QuotaExceededError returned when
+// saving a link would put its owner over Options.MaxLinksPerOwner, or the
+// store over Options.MaxTotalLinks.
+var ErrQuotaExceeded = errors.New("link quota exceeded")
+
+// QuotaExceededError reports an owner who already has their maximum number
+// of links, or, if Owner is empty, a store that already holds its maximum
+// number of links.
+type QuotaExceededError struct {
+	Owner string
+	Count int // number of links owned, or stored if Owner is empty
+	Limit int // maximum number of links allowed
+}
+
+func (e *QuotaExceededError) Error() string {
+	if e.Owner == "" {
+		return fmt.Sprintf("%v: %d/%d links stored", ErrQuotaExceeded, e.Count, e.Limit)
+	}
+	return fmt.Sprintf("%v: %s has %d/%d links", ErrQuotaExceeded, e.Owner, e.Count, e.Limit)
+}
+
+func (e *QuotaExceededError) Unwrap() error { return ErrQuotaExceeded }
+
+// ErrCreationRateLimited is wrapped by the *CreationRateLimitedError
+// returned when saving a new link would have its owner create links faster
+// than Options.CreationLimiter allows.
+var ErrCreationRateLimited = errors.New("link creation rate limited")
+
+// CreationRateLimitedError reports an owner creating links too fast.
+type CreationRateLimitedError struct {
+	Owner      string
+	RetryAfter time.Duration // how long until the owner may create a link
+}
+
+func (e *CreationRateLimitedError) Error() string {
+	return fmt.Sprintf("%v: %s may create another link in %v", ErrCreationRateLimited, e.Owner, e.RetryAfter.Round(time.Second))
+}
+
+func (e *CreationRateLimitedError) Unwrap() error { return ErrCreationRateLimited }
+
+// checkCreationRate counts the creation of a link owned by owner against
+// o.CreationLimiter, and returns a *CreationRateLimitedError if the owner
+// is over the limit. If the creation is counted, owner is appended to
+// *charged, for refundCreations if the link isn't saved after all.
+func (o *Options) checkCreationRate(owner string, charged *[]string) error {
+	if o.CreationLimiter == nil || owner == "" {
+		return nil
+	}
+	if ok, retryAfter := o.CreationLimiter.Allow(owner); !ok {
+		return &CreationRateLimitedError{Owner: owner, RetryAfter: retryAfter}
+	}
+	*charged = append(*charged, owner)
+	return nil
+}
+
+// refundCreations refunds the creations counted by checkCreationRate for
+// each of owners.
+func (o *Options) refundCreations(owners []string) {
+	for _, owner := range owners {
+		o.CreationLimiter.Refund(owner)
+	}
+}
+
+// checkLong returns a *LongTooLongError if long is over o.MaxLongLength.
+func (o *Options) checkLong(long string) error {
+	if o.MaxLongLength > 0 && len(long) > o.MaxLongLength {
+		return &LongTooLongError{Length: len(long), Max: o.MaxLongLength}
+	}
+	return nil
+}
+
+// DefaultReservedShorts are the short names reserved when
+// Options.ReservedShorts is nil.
+var DefaultReservedShorts = map[string]bool{
+	"admin":   true,
+	"api":     true,
+	"healthz": true,
+	"static":  true,
+}
+
+// ErrEmptyShort is returned when saving a link whose short name is empty or
+// only whitespace and control characters, which could never be looked up.
+// Loading such a name returns an error wrapping both ErrEmptyShort and
+// fs.ErrNotExist, without querying the store.
+var ErrEmptyShort = errors.New("short name is empty")
+
+// checkShort returns an error wrapping ErrEmptyShort if short is blank.
+func checkShort(short string) error {
+	blank := strings.TrimFunc(short, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) == ""
+	if blank {
+		return fmt.Errorf("%q: %w", short, ErrEmptyShort)
+	}
+	return nil
+}
+
+// checkLoadShort is like checkShort, but the error also wraps
+// fs.ErrNotExist, for callers that treat it as a missing link.
+func checkLoadShort(short string) error {
+	if err := checkShort(short); err != nil {
+		return fmt.Errorf("%w: %w", err, fs.ErrNotExist)
+	}
+	return nil
+}
+
+// DefaultDisallowedShortChars are the characters refused in short names
+// when Options.DisallowedShortChars is empty: the path separator and the
+// characters that start a URL's query and fragment.
+const DefaultDisallowedShortChars = "/?#"
+
+// ErrInvalidShort is returned, wrapped in an *InvalidShortError, when
+// saving a link whose short name has a disallowed character.
+var ErrInvalidShort = errors.New("short name has a disallowed character")
+
+// InvalidShortError reports a short name with a character disallowed by
+// Options.DisallowedShortChars, or a whitespace or control character.
+type InvalidShortError struct {
+	Short string
+	Char  rune // the first disallowed character
+}
+
+func (e *InvalidShortError) Error() string {
+	return fmt.Sprintf("%v: %q in %q", ErrInvalidShort, e.Char, e.Short)
+}
+
+func (e *InvalidShortError) Unwrap() error { return ErrInvalidShort }
+
+// ErrInvalidHeader is returned, wrapped in an *InvalidHeaderError, when
+// saving a link with a malformed header in Link.Headers.
+var ErrInvalidHeader = errors.New("invalid link header")
+
+// InvalidHeaderError reports a header in Link.Headers whose name is not a
+// valid HTTP header name, or whose value has a character that would end
+// or corrupt the header, such as CR or LF.
+type InvalidHeaderError struct {
+	Name   string
+	Reason string // what is wrong with the header
+}
+
+func (e *InvalidHeaderError) Error() string {
+	return fmt.Sprintf("%v %q: %s", ErrInvalidHeader, e.Name, e.Reason)
+}
+
+func (e *InvalidHeaderError) Unwrap() error { return ErrInvalidHeader }
+
+// checkHeaders returns an *InvalidHeaderError for the first malformed
+// header in headers, in name order.
+func checkHeaders(headers map[string]string) error {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "" {
+			return &InvalidHeaderError{Name: name, Reason: "empty name"}
+		}
+		for _, r := range name {
+			if !isTokenChar(r) {
+				return &InvalidHeaderError{Name: name, Reason: fmt.Sprintf("%q in name", r)}
+			}
+		}
+		for _, r := range headers[name] {
+			// Tabs are allowed in values; other control characters,
+			// including CR and LF, would let a value inject headers.
+			if r != '\t' && (r < ' ' || r == 0x7f) {
+				return &InvalidHeaderError{Name: name, Reason: fmt.Sprintf("%q in value", r)}
+			}
+		}
+	}
+	return nil
+}
+
+// isTokenChar reports whether r may appear in an HTTP header name, which
+// is a token as defined by RFC 7230, section 3.2.6.
+func isTokenChar(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", r)
+}
+
+// MissingLinksError is returned by SetOwners when some of the links it was
+// asked to change don't exist. The links that do exist are still changed.
+type MissingLinksError struct {
+	Shorts []string // the names without a link, sorted
+}
+
+func (e *MissingLinksError) Error() string {
+	return fmt.Sprintf("%d links not found: %s", len(e.Shorts), strings.Join(e.Shorts, ", "))
+}
+
+func (e *MissingLinksError) Unwrap() error { return fs.ErrNotExist }
+
+// checkShortChars returns an *InvalidShortError if short has a character
+// disallowed by o.
+func (o *Options) checkShortChars(short string) error {
+	disallowed := o.DisallowedShortChars
+	if disallowed == "" {
+		disallowed = DefaultDisallowedShortChars
+	}
+	for _, r := range short {
+		if r == '/' && o.HierarchicalShorts {
+			continue
+		}
+		if unicode.IsSpace(r) || unicode.IsControl(r) || strings.ContainsRune(disallowed, r) {
+			return &InvalidShortError{Short: short, Char: r}
+		}
+	}
+	return nil
+}
+
+// ErrReservedShort is returned when saving a link with a reserved short name.
+var ErrReservedShort = errors.New("short name is reserved")
+
+// checkReserved returns an error wrapping ErrReservedShort if short is
+// reserved by o.ReservedShorts.
+//
+// The namespace of a qualified name is checked in place of the short name,
+// since it is what appears first in URLs.
+func (o *Options) checkReserved(short string) error {
+	reserved := o.ReservedShorts
+	if reserved == nil {
+		reserved = DefaultReservedShorts
+	}
+	first, _, _ := strings.Cut(short, "/")
+	id := linkID(first)
+	for name, ok := range reserved {
+		if ok && linkID(name) == id {
+			return fmt.Errorf("%q: %w", short, ErrReservedShort)
+		}
+	}
+	return nil
+}
+
+// now returns the current time according to o.Now.
+func (o *Options) now() time.Time {
+	if o.Now != nil {
+		return o.Now()
+	}
+	return time.Now()
+}
+
+// storedTime returns t at the precision it is stored with, as set by
+// MillisecondTimes.
+func (o *Options) storedTime(t time.Time) time.Time {
+	if o.MillisecondTimes {
+		return t.Truncate(time.Millisecond)
+	}
+	return t.Truncate(time.Second)
+}
+
+// prepareSave returns the link to store when saving link, with defaults
+// applied to any unset fields. A zero Created is set to the current time and
+// a zero LastEdit to Created, so that they are never stored as the Unix
+// epoch, and both are truncated to the stored precision. Long is
+// canonicalized by the Canonicalizer, and a TTL is converted to ExpiresAt.
+// link itself is not modified.
+//
+// It returns an error if link is not valid.
+func (o *Options) prepareSave(link *Link) (*Link, error) {
+	if err := checkShort(link.Short); err != nil {
+		return nil, err
+	}
+	if err := o.checkShortChars(link.Short); err != nil {
+		return nil, err
+	}
+	long, err := o.canonicalLong(link.Long)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.checkLong(long); err != nil {
+		return nil, err
+	}
+	if strings.Contains(link.Namespace, "/") {
+		return nil, fmt.Errorf("namespace %q must not contain a slash", link.Namespace)
+	}
+	if link.TTL < 0 {
+		return nil, fmt.Errorf("invalid TTL %v: must be positive", link.TTL)
+	}
+	if link.RedirectCode != 0 && !validRedirectCodes[link.RedirectCode] {
+		return nil, fmt.Errorf("invalid redirect code %d", link.RedirectCode)
+	}
+	if err := checkHeaders(link.Headers); err != nil {
+		return nil, err
+	}
+	for _, d := range link.Destinations {
+		if d.URL == "" {
+			return nil, errors.New("link destinations must have a URL")
+		}
+		if d.Weight < 0 {
+			return nil, fmt.Errorf("destination %q has negative weight %d", d.URL, d.Weight)
+		}
+	}
+
+	l := *link
+	l.Long = long
+	if l.Created.IsZero() {
+		l.Created = o.now().UTC()
+	}
+	if l.LastEdit.IsZero() {
+		l.LastEdit = l.Created
+	}
+	l.Created, l.LastEdit = o.storedTime(l.Created), o.storedTime(l.LastEdit)
+	if l.ExpiresAt.IsZero() && l.TTL > 0 {
+		l.ExpiresAt = l.Created.Add(l.TTL)
+	}
+	l.TTL = 0
+	if l.Owner == "" {
+		l.Owner = o.DefaultOwner
+	}
+	return &l, nil
+}
+
+// planRewrite returns copies of the links whose Long URL contains match,
+// with each occurrence replaced by replace, as described by
+// SQLiteDB.RewriteLongs. It returns an error naming each link whose
+// rewritten URL would be invalid.
+func (o *Options) planRewrite(links []*Link, match, replace string) ([]*Link, error) {
+	if match == "" {
+		return nil, errors.New("rewrite match must not be empty")
+	}
+	var changed []*Link
+	var errs []error
+	for _, link := range links {
+		if !strings.Contains(link.Long, match) {
+			continue
+		}
+		l := *link
+		long, err := o.canonicalLong(strings.ReplaceAll(link.Long, match, replace))
+		if err == nil {
+			l.Long = long
+			err = validateLong(l.Long, o)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%q: %w", l.Name(), err))
+			continue
+		}
+		changed = append(changed, &l)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	sort.Slice(changed, func(i, j int) bool {
+		return linkID(changed[i].Name()) < linkID(changed[j].Name())
+	})
+	return changed, nil
+}
+
+// linkNames returns the names of links.
+func linkNames(links []*Link) []string {
+	names := make([]string, len(links))
+	for i, link := range links {
+		names[i] = link.Name()
+	}
+	return names
+}
+
+// longMatcher returns a function reporting whether a Long URL matches
+// pattern, as described by SQLiteDB.LoadByLongPattern: "*" matches any run
+// of characters, "?" any single character, and the pattern may match
+// anywhere in the URL. ASCII letters match regardless of case, as with SQL
+// LIKE. An empty pattern matches nothing.
+func longMatcher(pattern string) func(long string) bool {
+	if pattern == "" {
+		return func(string) bool { return false }
+	}
+	var re strings.Builder
+	re.WriteString("(?s)")
+	for _, r := range asciiLower(pattern) {
+		switch r {
+		case '*':
+			re.WriteString(".*")
+		case '?':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	rx := regexp.MustCompile(re.String())
+	return func(long string) bool { return rx.MatchString(asciiLower(long)) }
+}
+
+// likePattern returns the SQL LIKE pattern, with escape character '\',
+// that matches the same strings as longMatcher(pattern).
+func likePattern(pattern string) string {
+	var like strings.Builder
+	like.WriteByte('%')
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			like.WriteByte('%')
+		case '?':
+			like.WriteByte('_')
+		case '%', '_', '\\':
+			like.WriteByte('\\')
+			like.WriteRune(r)
+		default:
+			like.WriteRune(r)
+		}
+	}
+	like.WriteByte('%')
+	return like.String()
+}
+
+// asciiLower returns s with ASCII letters lowercased.
+func asciiLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+// linkMap returns links keyed by their Name. It returns an error if two
+// links have names with the same normalized ID, since only one of them could
+// ever be loaded.
+func linkMap(links []*Link) (map[string]*Link, error) {
+	m := make(map[string]*Link, len(links))
+	byID := make(map[string]string, len(links)) // map ID => Name
+	for _, link := range links {
+		name := link.Name()
+		id := linkID(name)
+		if other, ok := byID[id]; ok {
+			return nil, fmt.Errorf("links %q and %q have the same normalized ID %q", other, name, id)
+		}
+		byID[id] = name
+		m[name] = link
+	}
+	return m, nil
+}
+
+// findCollisions groups links whose short names differ but normalize to the
+// same ID under the current linkID, keyed by that ID. Only one link in each
+// group can be loaded by its short name; the others need to be renamed or
+// deleted.
+func findCollisions(links []*Link) map[string][]*Link {
+	byID := make(map[string][]*Link)
+	for _, link := range links {
+		id := linkID(link.Name())
+		byID[id] = append(byID[id], link)
+	}
+	collisions := make(map[string][]*Link)
+	for id, group := range byID {
+		for _, link := range group[1:] {
+			if link.Name() != group[0].Name() {
+				collisions[id] = group
+				break
+			}
+		}
+	}
+	return collisions
+}
+
 type Database interface {
 	LoadAll() ([]*Link, error)
 	Load(short string) (*Link, error)
 	Save(link *Link) error
+	Delete(short string) error
 	LoadStats() (ClickStats, error)
+
+	// SaveStats adds stats to the stored click totals. Its values are the
+	// clicks since the last call, not new totals, so saving {a: 2} and
+	// then {a: 3} leaves LoadStats reporting 5 clicks for a.
 	SaveStats(stats ClickStats) error
+
+	// LastStatsFlush returns when SaveStats last succeeded, or the zero
+	// time if it never has.
+	LastStatsFlush() (time.Time, error)
+}
+
+// ListOptions selects a page of links for ListLinks.
+type ListOptions struct {
+	// Offset is the number of matching links to skip.
+	Offset int
+
+	// Limit is the most links to return. If zero, DefaultListLimit is used.
+	Limit int
+
+	// Owner, if set, limits the listing to links with this owner.
+	Owner string
+}
+
+// DefaultListLimit is the page size used when ListOptions.Limit is zero.
+const DefaultListLimit = 100
+
+// LinkPage is a page of links returned by ListLinks, in the form of a
+// typical paginated API response. Links are ordered by normalized name.
+type LinkPage struct {
+	Items      []*Link // the links on this page
+	Total      int     // the number of links matching the options
+	NextOffset int     // the Offset of the next page
+	HasMore    bool    // whether there are links after this page
+}
+
+// limit returns opts.Limit, or DefaultListLimit if it is not positive.
+func (opts ListOptions) limit() int {
+	if opts.Limit <= 0 {
+		return DefaultListLimit
+	}
+	return opts.Limit
+}
+
+// newLinkPage returns the page of items starting at opts.Offset, out of
+// total matching links.
+func newLinkPage(items []*Link, total int, opts ListOptions) *LinkPage {
+	next := opts.Offset + len(items)
+	return &LinkPage{
+		Items:      items,
+		Total:      total,
+		NextOffset: next,
+		HasMore:    next < total,
+	}
+}
+
+// ErrInvalidCursor is wrapped by the error returned by LoadPage when the
+// cursor was not returned by LoadPage. The caller should start over.
+var ErrInvalidCursor = errors.New("invalid page cursor")
+
+// cursorPrefix versions the cursors returned by LoadPage, so that the
+// format can change without misreading cursors saved by older versions.
+const cursorPrefix = "v1:"
+
+// encodeCursor returns the LoadPage cursor following the link with the
+// normalized name id.
+//
+// Cursors record the last link returned rather than an offset or a
+// backend-specific position, so they stay meaningful across restarts and
+// while links are added and deleted.
+func encodeCursor(id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorPrefix + id))
+}
+
+// decodeCursor returns the normalized name of the last link returned
+// before cursor. The empty cursor starts before the first link.
+func decodeCursor(cursor string) (string, error) {
+	if cursor == "" {
+		return "", nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(b), cursorPrefix) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidCursor, cursor)
+	}
+	return strings.TrimPrefix(string(b), cursorPrefix), nil
+}
+
+// pageLinks returns the first n of links, which were loaded in order of
+// normalized name with one extra to tell whether there is another page,
+// and the cursor of the next page.
+func pageLinks(links []*Link, n int) ([]*Link, string, error) {
+	if len(links) <= n {
+		return links, "", nil
+	}
+	links = links[:n]
+	return links, encodeCursor(linkID(links[n-1].Name())), nil
+}
+
+// StoreTx holds the operations that can be grouped with Batch. They behave
+// like the Database methods of the same names.
+type StoreTx interface {
+	Load(short string) (*Link, error)
+	Save(link *Link) error
+	Delete(short string) error
+	Alias(newShort, canonicalShort string) error
+}
+
+// StoreConfig describes the Database to construct with OpenStore.
+type StoreConfig struct {
+	// Backend selects the kind of Database: "sqlite", "convex", or
+	// "memory" (an in-memory SQLite database).
+	Backend string
+
+	// SQLitePath is the path of the SQLite database file.
+	// It is required by the "sqlite" backend.
+	SQLitePath string
+
+	// SQLiteOpenRetry configures retrying if the SQLite database can't be
+	// opened at first. The zero value doesn't retry.
+	SQLiteOpenRetry OpenRetry
+
+	// ConvexURL and ConvexToken are the URL of the Convex deployment and
+	// its authorization token. Both are required by the "convex" backend.
+	ConvexURL   string
+	ConvexToken string
+}
+
+// OpenStore returns the Database described by config. It returns an error if
+// the selected backend is missing required settings, or if settings for a
+// different backend are also present.
+func OpenStore(config StoreConfig) (Database, error) {
+	sqliteSet := config.SQLitePath != ""
+	convexSet := config.ConvexURL != "" || config.ConvexToken != ""
+	switch config.Backend {
+	case "sqlite":
+		if !sqliteSet {
+			return nil, errors.New("sqlite backend requires a database path")
+		}
+		if convexSet {
+			return nil, errors.New("sqlite backend does not use Convex settings")
+		}
+		db, err := NewSQLiteDBWithRetry(config.SQLitePath, config.SQLiteOpenRetry)
+		if err != nil {
+			return nil, fmt.Errorf("NewSQLiteDB(%q): %w", config.SQLitePath, err)
+		}
+		return db, nil
+	case "convex":
+		if config.ConvexURL == "" {
+			return nil, errors.New("convex backend requires a URL")
+		}
+		if config.ConvexToken == "" {
+			return nil, errors.New("convex backend requires an authorization token")
+		}
+		if sqliteSet {
+			return nil, errors.New("convex backend does not use a SQLite database path")
+		}
+		return NewConvexDB(config.ConvexURL, config.ConvexToken), nil
+	case "memory":
+		if sqliteSet || convexSet {
+			return nil, errors.New("memory backend does not use SQLite or Convex settings")
+		}
+		db, err := NewSQLiteDB(":memory:")
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case "":
+		return nil, errors.New("no storage backend selected")
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", config.Backend)
 }
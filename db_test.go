@@ -4,8 +4,21 @@
 package golink
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
 	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -18,9 +31,10 @@ func Test_SQLiteDB_SaveLoadLinks(t *testing.T) {
 		t.Error(err)
 	}
 
+	now := time.Now().UTC().Truncate(time.Second)
 	links := []*Link{
-		{Short: "short", Long: "long"},
-		{Short: "Foo.Bar", Long: "long"},
+		{Short: "short", Long: "long", Created: now, LastEdit: now, EditCount: 1},
+		{Short: "Foo.Bar", Long: "long", Created: now, LastEdit: now, EditCount: 1},
 	}
 
 	for _, link := range links {
@@ -95,3 +109,3784 @@ func Test_SQLiteDB_SaveLoadStats(t *testing.T) {
 		t.Errorf("db.LoadStats got %v, want %v", got, want)
 	}
 }
+
+// Test aliasing links for SQLiteDB
+func Test_SQLiteDB_Alias(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	link := &Link{Short: "oncall", Long: "https://pager.example.com", Created: now, LastEdit: now, EditCount: 1}
+	if err := db.Save(link); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Alias("on-call-team", "oncall"); err != nil {
+		t.Fatal(err)
+	}
+	// aliasing an alias points at the canonical link
+	if err := db.Alias("pager", "On-Call-Team"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, short := range []string{"oncall", "oncallteam", "pager"} {
+		got, err := db.Load(short)
+		if err != nil {
+			t.Fatalf("db.Load(%q): %v", short, err)
+		}
+		if !cmp.Equal(got, link) {
+			t.Errorf("db.Load(%q) got %v, want %v", short, *got, *link)
+		}
+	}
+
+	if err := db.Alias("missing", "nope"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("db.Alias to missing link got %v, want fs.ErrNotExist", err)
+	}
+	if err := db.Alias("oncall", "pager"); err == nil {
+		t.Errorf("db.Alias over an existing link succeeded, want error")
+	}
+	if err := db.Save(&Link{Short: "pager", Long: "other"}); err == nil {
+		t.Errorf("db.Save over an alias succeeded, want error")
+	}
+
+	if err := db.SaveStats(ClickStats{"oncall": 1, "pager": 2}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.LoadStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ClickStats{"oncall": 3}
+	if !cmp.Equal(got, want) {
+		t.Errorf("db.LoadStats got %v, want %v", got, want)
+	}
+}
+
+// Test that concurrent writers sharing a database file retry rather than
+// failing when the database is locked.
+func Test_SQLiteDB_ConcurrentWriters(t *testing.T) {
+	file := path.Join(t.TempDir(), "links.db")
+	var dbs []*SQLiteDB
+	for i := 0; i < 2; i++ {
+		db, err := NewSQLiteDB(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbs = append(dbs, db)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 4; i++ {
+		for _, db := range dbs {
+			wg.Add(1)
+			go func(db *SQLiteDB, n int) {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					short := fmt.Sprintf("link-%d-%d", n, j)
+					if err := db.Save(&Link{Short: short, Long: "long"}); err != nil {
+						errs <- err
+						return
+					}
+					if err := db.SaveStats(ClickStats{short: 1}); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}(db, i)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// Test loading a link along with its clicks for SQLiteDB
+func Test_SQLiteDB_LoadWithStats(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	links := []*Link{
+		{Short: "a", Long: "long", Created: now, LastEdit: now, EditCount: 1},
+		{Short: "b", Long: "long", Created: now, LastEdit: now, EditCount: 1},
+	}
+	for _, link := range links {
+		if err := db.Save(link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range []ClickStats{{"a": 1}, {"a": 2}} {
+		if err := db.SaveStats(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		short  string
+		link   *Link
+		clicks int
+	}{
+		{short: "a", link: links[0], clicks: 3},
+		{short: "b", link: links[1], clicks: 0},
+	}
+	for _, tt := range tests {
+		link, clicks, err := db.LoadWithStats(tt.short)
+		if err != nil {
+			t.Fatalf("db.LoadWithStats(%q): %v", tt.short, err)
+		}
+		if !cmp.Equal(link, tt.link) || clicks != tt.clicks {
+			t.Errorf("db.LoadWithStats(%q) got %v, %d, want %v, %d", tt.short, *link, clicks, *tt.link, tt.clicks)
+		}
+	}
+
+	if _, _, err := db.LoadWithStats("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("db.LoadWithStats(%q) got %v, want fs.ErrNotExist", "missing", err)
+	}
+}
+
+// Test that SQLiteDB fills in unset fields when saving
+func Test_SQLiteDB_SaveDefaults(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	db.Now = func() time.Time { return now }
+	db.DefaultOwner = "importer@example.com"
+
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		link *Link
+		want *Link
+	}{
+		{
+			link: &Link{Short: "a", Long: "long"},
+			want: &Link{Short: "a", Long: "long", Created: now, LastEdit: now, Owner: "importer@example.com", EditCount: 1},
+		},
+		{
+			link: &Link{Short: "b", Long: "long", Created: created, Owner: "foo@example.com"},
+			want: &Link{Short: "b", Long: "long", Created: created, LastEdit: created, Owner: "foo@example.com", EditCount: 1},
+		},
+	}
+	for _, tt := range tests {
+		if err := db.Save(tt.link); err != nil {
+			t.Fatal(err)
+		}
+		got, err := db.Load(tt.link.Short)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cmp.Equal(got, tt.want) {
+			t.Errorf("db.Load(%q) got %v, want %v", tt.link.Short, *got, *tt.want)
+		}
+	}
+}
+
+func TestLinkMap(t *testing.T) {
+	a := &Link{Short: "a"}
+	fooBar := &Link{Short: "Foo-Bar"}
+	got, err := linkMap([]*Link{a, fooBar})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]*Link{"a": a, "Foo-Bar": fooBar}
+	if !cmp.Equal(got, want) {
+		t.Errorf("linkMap got %v, want %v", got, want)
+	}
+
+	if _, err := linkMap([]*Link{a, fooBar, {Short: "foobar"}}); err == nil {
+		t.Errorf("linkMap with colliding links succeeded, want error")
+	}
+}
+
+// Test that every Link field is persisted by both backends.
+func TestLinkFieldsRegistered(t *testing.T) {
+	registered := make(map[string]bool)
+	for _, f := range linkFields {
+		registered[f.Field] = true
+	}
+	docType := reflect.TypeOf(LinkDocument{})
+	linkType := reflect.TypeOf(Link{})
+	for i := 0; i < linkType.NumField(); i++ {
+		name := linkType.Field(i).Name
+		if linkType.Field(i).Tag.Get("json") == "-" {
+			continue // not persisted, like TTL
+		}
+		if !registered[name] {
+			t.Errorf("Link.%s has no entry in linkFields", name)
+		}
+		if _, ok := docType.FieldByName(name); !ok {
+			t.Errorf("Link.%s has no LinkDocument field", name)
+		}
+	}
+}
+
+// Test that NewSQLiteDBWithRetry waits for a directory that appears late.
+func Test_SQLiteDB_OpenRetry(t *testing.T) {
+	dir := path.Join(t.TempDir(), "mnt")
+	file := path.Join(dir, "links.db")
+
+	_, err := NewSQLiteDBWithRetry(file, OpenRetry{Retries: 2, Delay: time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "gave up after 3 attempts") {
+		t.Errorf("NewSQLiteDBWithRetry with missing directory got %v, want error after 3 attempts", err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		os.Mkdir(dir, 0o755)
+	}()
+	db, err := NewSQLiteDBWithRetry(file, OpenRetry{Retries: 10, Delay: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewSQLiteDBWithRetry with late directory: %v", err)
+	}
+	if err := db.Save(&Link{Short: "a"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test that an in-memory SQLiteDB keeps its data across concurrent use,
+// which would otherwise open new, empty databases.
+func Test_SQLiteDB_Memory(t *testing.T) {
+	for _, f := range []string{":memory:", "file::memory:?cache=shared"} {
+		db, err := NewSQLiteDB(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Save(&Link{Short: "a", Long: "http://a/"}); err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				links, err := db.LoadAll()
+				if err != nil || len(links) != 1 {
+					t.Errorf("NewSQLiteDB(%q).LoadAll() = %v, %v; want one link", f, links, err)
+				}
+			}()
+		}
+		wg.Wait()
+		db.Close()
+	}
+}
+
+// Test that a SQLiteDB using a caller's *sql.DB leaves it open.
+func Test_SQLiteDB_FromConn(t *testing.T) {
+	conn, err := sql.Open("sqlite", path.Join(t.TempDir(), "links.db")+"?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	db, err := NewSQLiteDBFromConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Save(&Link{Short: "a", Long: "http://a/"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var long string
+	if err := conn.QueryRow("SELECT Long FROM Links WHERE ID = ?", "a").Scan(&long); err != nil {
+		t.Fatalf("querying caller's connection after Close: %v", err)
+	}
+	if long != "http://a/" {
+		t.Errorf("stored Long is %q, want %q", long, "http://a/")
+	}
+}
+
+// Test that NewSQLiteDB rejects a database missing a Links column.
+func Test_SQLiteDB_CheckSchema(t *testing.T) {
+	file := path.Join(t.TempDir(), "links.db")
+	if _, err := NewSQLiteDB(file); err != nil {
+		t.Fatal(err)
+	}
+
+	dropColumn := func(column string) {
+		db, err := sql.Open("sqlite", file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if _, err := db.Exec("ALTER TABLE Links DROP COLUMN " + column); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// columns added after the original schema are migrated
+	dropColumn("Destinations")
+	if _, err := NewSQLiteDB(file); err != nil {
+		t.Errorf("NewSQLiteDB with missing Destinations column: %v", err)
+	}
+
+	dropColumn("Owner")
+	if _, err := NewSQLiteDB(file); err == nil {
+		t.Errorf("NewSQLiteDB with missing Owner column succeeded, want error")
+	}
+}
+
+// Test loading stats for a subset of links for SQLiteDB
+func Test_SQLiteDB_LoadStatsForLinks(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, short := range []string{"a", "b-c", "d"} {
+		if err := db.Save(&Link{Short: short}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Alias("alias", "d"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []ClickStats{{"a": 1, "bc": 2, "d": 5}, {"a": 1}} {
+		if err := db.SaveStats(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An alias has the clicks of its canonical link.
+	got, err := db.LoadStatsForLinks([]string{"a", "B-C", "missing", "alias"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"a": 2, "B-C": 2, "missing": 0, "alias": 5}
+	if !cmp.Equal(got, want) {
+		t.Errorf("db.LoadStatsForLinks got %v, want %v", got, want)
+	}
+}
+
+func TestOpenStore(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  StoreConfig
+		want    any
+		wantErr bool
+	}{
+		{name: "sqlite", config: StoreConfig{Backend: "sqlite", SQLitePath: path.Join(t.TempDir(), "links.db")}, want: &SQLiteDB{}},
+		{name: "memory", config: StoreConfig{Backend: "memory"}, want: &SQLiteDB{}},
+		{name: "convex", config: StoreConfig{Backend: "convex", ConvexURL: "https://example.convex.cloud", ConvexToken: "token"}, want: &ConvexDB{}},
+		{name: "no-backend", config: StoreConfig{SQLitePath: "links.db"}, wantErr: true},
+		{name: "unknown-backend", config: StoreConfig{Backend: "postgres"}, wantErr: true},
+		{name: "sqlite-no-path", config: StoreConfig{Backend: "sqlite"}, wantErr: true},
+		{name: "convex-no-token", config: StoreConfig{Backend: "convex", ConvexURL: "https://example.convex.cloud"}, wantErr: true},
+		{name: "convex-no-url", config: StoreConfig{Backend: "convex", ConvexToken: "token"}, wantErr: true},
+		{name: "sqlite-and-convex", config: StoreConfig{Backend: "sqlite", SQLitePath: "links.db", ConvexURL: "https://example.convex.cloud"}, wantErr: true},
+		{name: "memory-and-sqlite", config: StoreConfig{Backend: "memory", SQLitePath: "links.db"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := OpenStore(tt.config)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("OpenStore(%+v) succeeded, want error", tt.config)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("OpenStore(%+v): %v", tt.config, err)
+			}
+			if reflect.TypeOf(got) != reflect.TypeOf(tt.want) {
+				t.Errorf("OpenStore(%+v) returned %T, want %T", tt.config, got, tt.want)
+			}
+		})
+	}
+}
+
+// Test that deleting a link for SQLiteDB also deletes its stats and aliases.
+func Test_SQLiteDB_Delete(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, short := range []string{"a", "b"} {
+		if err := db.Save(&Link{Short: short}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Alias("a2", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveStats(ClickStats{"a": 1, "b": 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("db.Delete of deleted link got %v, want fs.ErrNotExist", err)
+	}
+	for _, short := range []string{"a", "a2"} {
+		if _, err := db.Load(short); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("db.Load(%q) after delete got %v, want fs.ErrNotExist", short, err)
+		}
+	}
+
+	var orphans int
+	if err := db.db.QueryRow("SELECT count(*) FROM Stats WHERE ID NOT IN (SELECT ID FROM Links)").Scan(&orphans); err != nil {
+		t.Fatal(err)
+	}
+	if orphans != 0 {
+		t.Errorf("found %d orphaned stats rows after delete", orphans)
+	}
+
+	// reusing the short name doesn't resurrect old stats
+	if err := db.Save(&Link{Short: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.LoadStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ClickStats{"b": 2}
+	if !cmp.Equal(got, want) {
+		t.Errorf("db.LoadStats got %v, want %v", got, want)
+	}
+}
+
+// Test that saving an existing link for SQLiteDB keeps its stats.
+func Test_SQLiteDB_SaveKeepsStats(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Save(&Link{Short: "a", Long: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveStats(ClickStats{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Save(&Link{Short: "A", Long: "two"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.LoadStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ClickStats{"A": 1}
+	if !cmp.Equal(got, want) {
+		t.Errorf("db.LoadStats got %v, want %v", got, want)
+	}
+}
+
+// Test saving and loading links with weighted destinations for SQLiteDB
+func Test_SQLiteDB_Destinations(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	link := &Link{
+		Short:     "ab",
+		Long:      "https://a.example.com",
+		Created:   now,
+		LastEdit:  now,
+		EditCount: 1,
+		Destinations: []WeightedDest{
+			{URL: "https://a.example.com", Weight: 1},
+			{URL: "https://b.example.com", Weight: 3},
+		},
+	}
+	if err := db.Save(link); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.Load("ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(got, link) {
+		t.Errorf("db.Load got %v, want %v", *got, *link)
+	}
+
+	if err := db.Save(&Link{Short: "bad", Destinations: []WeightedDest{{URL: "x", Weight: -1}}}); err == nil {
+		t.Errorf("db.Save with negative weight succeeded, want error")
+	}
+}
+
+func TestResolveDestination(t *testing.T) {
+	plain := &Link{Long: "https://example.com"}
+	if got := ResolveDestination(plain, nil); got != plain.Long {
+		t.Errorf("ResolveDestination(plain) = %q, want %q", got, plain.Long)
+	}
+	zero := &Link{Long: "https://example.com", Destinations: []WeightedDest{{URL: "https://other.example.com"}}}
+	if got := ResolveDestination(zero, nil); got != zero.Long {
+		t.Errorf("ResolveDestination(zero weights) = %q, want %q", got, zero.Long)
+	}
+
+	weighted := &Link{
+		Long: "https://a.example.com",
+		Destinations: []WeightedDest{
+			{URL: "a", Weight: 1},
+			{URL: "never", Weight: 0},
+			{URL: "b", Weight: 3},
+		},
+	}
+	r := rand.New(rand.NewSource(1))
+	counts := make(map[string]int)
+	const n = 10000
+	for i := 0; i < n; i++ {
+		counts[ResolveDestination(weighted, r)]++
+	}
+	if counts["never"] != 0 {
+		t.Errorf("zero-weight destination picked %d times", counts["never"])
+	}
+	if got := float64(counts["b"]) / n; got < 0.72 || got > 0.78 {
+		t.Errorf("destination with 3/4 of weight picked %.3f of the time", got)
+	}
+}
+
+func TestFindCollisions(t *testing.T) {
+	fooBar := &Link{Short: "Foo-Bar"}
+	foobar := &Link{Short: "foobar"}
+	a := &Link{Short: "a"}
+	dup := &Link{Short: "a"}
+	got := findCollisions([]*Link{fooBar, a, foobar, dup})
+	want := map[string][]*Link{"foobar": {fooBar, foobar}}
+	if !cmp.Equal(got, want) {
+		t.Errorf("findCollisions got %v, want %v", got, want)
+	}
+}
+
+// Test finding collisions left by a normalization change for SQLiteDB
+func Test_SQLiteDB_FindCollisions(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, short := range []string{"foo.bar", "a"} {
+		if err := db.Save(&Link{Short: short}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := db.FindCollisions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("db.FindCollisions got %v, want none", got)
+	}
+
+	// simulate a row stored under an older normalizer that kept dashes
+	if _, err := db.db.Exec("INSERT INTO Links (ID, Short) VALUES ('foo-bar', 'Foo-Bar'), ('foobar', 'foobar')"); err != nil {
+		t.Fatal(err)
+	}
+	got, err = db.FindCollisions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shorts []string
+	for _, link := range got["foobar"] {
+		shorts = append(shorts, link.Short)
+	}
+	sort.Strings(shorts)
+	if len(got) != 1 || !cmp.Equal(shorts, []string{"Foo-Bar", "foobar"}) {
+		t.Errorf("db.FindCollisions got %v, want Foo-Bar and foobar colliding on foobar", got)
+	}
+}
+
+// Test that SQLiteDB.Renormalize makes links stored under an older
+// normalizer reachable again
+func Test_SQLiteDB_Renormalize(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Save(&Link{Short: "a", Long: "http://a/"}); err != nil {
+		t.Fatal(err)
+	}
+	// simulate rows stored under an older normalizer that kept dashes,
+	// with stats and an alias
+	for _, q := range []string{
+		"INSERT INTO Links (ID, Short, Long) VALUES ('foo-bar', 'Foo-Bar', 'http://foo/'), ('Eng/Docs', 'Docs', 'http://docs/')",
+		"UPDATE Links SET Namespace = 'Eng' WHERE Short = 'Docs'",
+		"INSERT INTO Stats (ID, Clicks) VALUES ('foo-bar', 3)",
+		"INSERT INTO Aliases (ID, Short, LinkID) VALUES ('fb', 'fb', 'foo-bar'), ('On-Call', 'On-Call', 'foo-bar')",
+	} {
+		if _, err := db.db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Load("Foo-Bar"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Load before Renormalize got %v, want fs.ErrNotExist", err)
+	}
+
+	changed, err := db.Renormalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed != 2 {
+		t.Errorf("Renormalize changed %d links, want 2", changed)
+	}
+	for short, long := range map[string]string{"a": "http://a/", "Foo-Bar": "http://foo/", "eng/docs": "http://docs/", "fb": "http://foo/", "oncall": "http://foo/"} {
+		if link, err := db.Load(short); err != nil || link.Long != long {
+			t.Errorf("Load(%q) got %v, %v; want %s", short, link, err, long)
+		}
+	}
+	stats, err := db.LoadStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["Foo-Bar"] != 3 {
+		t.Errorf("LoadStats got %v, want 3 clicks for Foo-Bar", stats)
+	}
+	if changed, err := db.Renormalize(); err != nil || changed != 0 {
+		t.Errorf("second Renormalize got %d, %v; want 0, nil", changed, err)
+	}
+
+	// an alias whose new ID is a link's
+	if _, err := db.db.Exec("INSERT INTO Aliases (ID, Short, LinkID) VALUES ('A', 'A', 'foobar')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Renormalize(); err == nil {
+		t.Error("Renormalize with an alias colliding with a link succeeded, want error")
+	}
+	if _, err := db.db.Exec("DELETE FROM Aliases WHERE ID = 'A'"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.db.Exec("INSERT INTO Links (ID, Short) VALUES ('fOObar', 'foobar')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Renormalize(); err == nil {
+		t.Error("Renormalize with colliding links succeeded, want error")
+	}
+	if link, err := db.Load("foobar"); err != nil || link.Short != "Foo-Bar" {
+		t.Errorf("Load(foobar) after failed Renormalize got %v, %v; want Foo-Bar unchanged", link, err)
+	}
+}
+
+// Test that SQLiteDB refuses reserved short names
+func Test_SQLiteDB_ReservedShorts(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, short := range []string{"admin", "Admin", "API", "healthz"} {
+		if err := db.Save(&Link{Short: short}); !errors.Is(err, ErrReservedShort) {
+			t.Errorf("db.Save(%q) got %v, want ErrReservedShort", short, err)
+		}
+	}
+	if err := db.SaveAdmin(&Link{Short: "admin"}); err != nil {
+		t.Errorf("db.SaveAdmin(%q): %v", "admin", err)
+	}
+
+	db.ReservedShorts = map[string]bool{"Health-Check": true}
+	if err := db.Save(&Link{Short: "healthcheck"}); !errors.Is(err, ErrReservedShort) {
+		t.Errorf("db.Save(%q) got %v, want ErrReservedShort", "healthcheck", err)
+	}
+	if err := db.Save(&Link{Short: "api"}); err != nil {
+		t.Errorf("db.Save(%q) with custom reserved names: %v", "api", err)
+	}
+}
+
+// Test that SQLiteDB returns only links edited at or after a time
+func Test_SQLiteDB_LoadModifiedSince(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, short := range []string{"a", "b", "c"} {
+		edit := base.Add(time.Duration(i) * time.Hour)
+		if err := db.Save(&Link{Short: short, Created: base, LastEdit: edit}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links, err := db.LoadModifiedSince(base.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, link := range links {
+		got = append(got, link.Short)
+	}
+	sort.Strings(got)
+	want := []string{"b", "c"}
+	if !cmp.Equal(got, want) {
+		t.Errorf("db.LoadModifiedSince got %v, want %v", got, want)
+	}
+}
+
+func TestLoadCreatedBetween(t *testing.T) {
+	type rangeStore interface {
+		Database
+		LoadCreatedBetween(from, to time.Time) ([]*Link, error)
+	}
+	stores := map[string]func(t *testing.T) rangeStore{
+		"sqlite": func(t *testing.T) rangeStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) rangeStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	base := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	// in creation order c, a, d, b
+	created := map[string]time.Time{
+		"a": base.Add(24 * time.Hour),
+		"b": base.Add(90 * 24 * time.Hour),
+		"c": base,
+		"d": base.Add(48 * time.Hour),
+	}
+	est := time.FixedZone("EST", -5*60*60)
+	tests := []struct {
+		from, to time.Time
+		want     []string
+	}{
+		{base, base.Add(48 * time.Hour), []string{"c", "a", "d"}},
+		{base.Add(time.Second), base.Add(48*time.Hour - time.Second), []string{"a"}},
+		{base.Add(24 * time.Hour).In(est), time.Time{}, []string{"a", "d", "b"}},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			for short, c := range created {
+				if err := db.Save(&Link{Short: short, Long: "http://" + short + "/", Created: c}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, tt := range tests {
+				links, err := db.LoadCreatedBetween(tt.from, tt.to)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, link := range links {
+					got = append(got, link.Short)
+				}
+				if !cmp.Equal(got, tt.want) {
+					t.Errorf("LoadCreatedBetween(%v, %v) got %v, want %v", tt.from, tt.to, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateLong(t *testing.T) {
+	type updateStore interface {
+		Database
+		UpdateLong(short, expectedOld, newLong string) error
+	}
+	stores := map[string]func(t *testing.T) updateStore{
+		"sqlite": func(t *testing.T) updateStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) updateStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	created := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			if err := db.Save(&Link{Short: "a", Long: "http://old/", Created: created}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := db.UpdateLong("b", "http://old/", "http://new/"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("UpdateLong of missing link got %v, want fs.ErrNotExist", err)
+			}
+			if err := db.UpdateLong("a", "http://stale/", "http://new/"); !errors.Is(err, ErrConflict) {
+				t.Errorf("UpdateLong with stale Long got %v, want ErrConflict", err)
+			}
+			if err := db.UpdateLong("a", "http://old/", "http://new/"); err != nil {
+				t.Fatalf("UpdateLong: %v", err)
+			}
+
+			link, err := db.Load("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if link.Long != "http://new/" {
+				t.Errorf("Load after UpdateLong got Long %q, want %q", link.Long, "http://new/")
+			}
+			if !link.LastEdit.After(created) {
+				t.Errorf("Load after UpdateLong got LastEdit %v, want after %v", link.LastEdit, created)
+			}
+		})
+	}
+}
+
+func TestListLinks(t *testing.T) {
+	type listStore interface {
+		Database
+		ListLinks(opts ListOptions) (*LinkPage, error)
+	}
+	stores := map[string]func(t *testing.T) listStore{
+		"sqlite": func(t *testing.T) listStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) listStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	tests := []struct {
+		opts      ListOptions
+		wantItems []string
+		wantPage  LinkPage // without Items
+	}{
+		{ListOptions{Limit: 2}, []string{"a", "b"}, LinkPage{Total: 5, NextOffset: 2, HasMore: true}},
+		{ListOptions{Offset: 4, Limit: 2}, []string{"e"}, LinkPage{Total: 5, NextOffset: 5}},
+		{ListOptions{Offset: 10}, nil, LinkPage{Total: 5, NextOffset: 10}},
+		{ListOptions{Owner: "b@example.com"}, []string{"b", "d"}, LinkPage{Total: 2, NextOffset: 2}},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			for i, short := range []string{"e", "d", "c", "b", "a"} {
+				owner := "a@example.com"
+				if i%2 == 1 {
+					owner = "b@example.com"
+				}
+				if err := db.Save(&Link{Short: short, Long: "http://" + short + "/", Owner: owner}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, tt := range tests {
+				page, err := db.ListLinks(tt.opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var items []string
+				for _, link := range page.Items {
+					items = append(items, link.Short)
+				}
+				if !cmp.Equal(items, tt.wantItems) {
+					t.Errorf("ListLinks(%+v) got items %v, want %v", tt.opts, items, tt.wantItems)
+				}
+				page.Items = nil
+				if !cmp.Equal(*page, tt.wantPage) {
+					t.Errorf("ListLinks(%+v) got %+v, want %+v", tt.opts, *page, tt.wantPage)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryOnConflict(t *testing.T) {
+	conflict := fmt.Errorf("%w: test", ErrConflict)
+	other := errors.New("other")
+	tests := []struct {
+		name      string
+		errs      []error // returned by successive calls
+		n         int
+		wantErr   error
+		wantCalls int
+	}{
+		{"success", []error{nil}, 3, nil, 1},
+		{"retried", []error{conflict, conflict, nil}, 3, nil, 3},
+		{"exhausted", []error{conflict, conflict, conflict}, 2, ErrConflict, 3},
+		{"other error", []error{other}, 3, other, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := RetryOnConflict(context.Background(), tt.n, func() error {
+				calls++
+				return tt.errs[calls-1]
+			})
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("RetryOnConflict got %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("RetryOnConflict made %d calls, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := RetryOnConflict(ctx, 3, func() error { return conflict })
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("RetryOnConflict with canceled context got %v, want context.Canceled", err)
+	}
+
+	// jitter is drawn from Options.Rand
+	o := &Options{Rand: rand.New(rand.NewSource(1))}
+	calls := 0
+	err = o.RetryOnConflict(context.Background(), 1, func() error {
+		calls++
+		return conflict
+	})
+	if !errors.Is(err, ErrConflict) || calls != 2 {
+		t.Errorf("Options.RetryOnConflict = %v after %d calls, want ErrConflict after 2", err, calls)
+	}
+}
+
+func TestLoadPage(t *testing.T) {
+	type pageStore interface {
+		Database
+		LoadPage(cursor string, n int) ([]*Link, string, error)
+	}
+	stores := map[string]func(t *testing.T) pageStore{
+		"sqlite": func(t *testing.T) pageStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) pageStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			for _, short := range []string{"b", "c", "d", "f", "g"} {
+				if err := db.Save(&Link{Short: short, Long: "http://" + short + "/"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var got []string
+			page := func(cursor string) string {
+				t.Helper()
+				links, next, err := db.LoadPage(cursor, 2)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, link := range links {
+					got = append(got, link.Short)
+				}
+				return next
+			}
+
+			cursor := page("")
+			// Changes behind the cursor are not seen, and deleting the
+			// link the cursor names does not invalidate it.
+			if err := db.Save(&Link{Short: "a", Long: "http://a/"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Delete("c"); err != nil {
+				t.Fatal(err)
+			}
+			// Changes ahead of the cursor are.
+			if err := db.Save(&Link{Short: "e", Long: "http://e/"}); err != nil {
+				t.Fatal(err)
+			}
+			for cursor != "" {
+				cursor = page(cursor)
+			}
+			if want := []string{"b", "c", "d", "e", "f", "g"}; !cmp.Equal(got, want) {
+				t.Errorf("LoadPage got %v, want %v", got, want)
+			}
+
+			if _, _, err := db.LoadPage("not a cursor", 2); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("LoadPage(invalid cursor) error = %v, want ErrInvalidCursor", err)
+			}
+		})
+	}
+}
+
+func TestMillisecondTimes(t *testing.T) {
+	type optionsStore interface {
+		Database
+		options() *Options
+	}
+	stores := map[string]func(t *testing.T) optionsStore{
+		"sqlite": func(t *testing.T) optionsStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) optionsStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	created := time.Date(2022, 6, 2, 1, 2, 3, 456789000, time.UTC)
+	for name, newStore := range stores {
+		for _, ms := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/ms=%v", name, ms), func(t *testing.T) {
+				db := newStore(t)
+				db.options().MillisecondTimes = ms
+				if err := db.Save(&Link{Short: "a", Long: "http://a/", Created: created}); err != nil {
+					t.Fatal(err)
+				}
+				link, err := db.Load("a")
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := created.Truncate(time.Second)
+				if ms {
+					want = created.Truncate(time.Millisecond)
+				}
+				if !link.Created.Equal(want) || !link.LastEdit.Equal(want) {
+					t.Errorf("Load(a) times = %v, %v, want %v", link.Created, link.LastEdit, want)
+				}
+			})
+		}
+	}
+}
+
+// Test that SQLiteDB orders links created in the same second by their
+// milliseconds
+func Test_SQLiteDB_LoadCreatedBetweenMillis(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.MillisecondTimes = true
+	second := time.Date(2022, 6, 2, 1, 2, 3, 0, time.UTC)
+	for short, ms := range map[string]int{"a": 900, "b": 100, "c": 500} {
+		created := second.Add(time.Duration(ms) * time.Millisecond)
+		if err := db.Save(&Link{Short: short, Long: "http://" + short + "/", Created: created}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links, err := db.LoadCreatedBetween(second, second.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, link := range links {
+		got = append(got, link.Short)
+	}
+	if want := []string{"b", "c", "a"}; !cmp.Equal(got, want) {
+		t.Errorf("LoadCreatedBetween got %v, want %v", got, want)
+	}
+}
+
+func TestRewriteLongs(t *testing.T) {
+	type rewriteStore interface {
+		Database
+		RewriteLongs(match, replace string) (int, error)
+		PreviewRewriteLongs(match, replace string) ([]string, error)
+	}
+	stores := map[string]func(t *testing.T) rewriteStore{
+		"sqlite": func(t *testing.T) rewriteStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) rewriteStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			for short, long := range map[string]string{
+				"a": "https://old.example.com/a",
+				"b": "https://old.example.com/b?from=old.example.com",
+				"c": "https://other.example.com/c",
+			} {
+				if err := db.Save(&Link{Short: short, Long: long}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := db.PreviewRewriteLongs("https://old.example.com", "not a url"); err == nil {
+				t.Error("PreviewRewriteLongs to invalid URLs succeeded, want error")
+			}
+			if n, err := db.RewriteLongs("https://old.example.com", "not a url"); err == nil || n != 0 {
+				t.Errorf("RewriteLongs to invalid URLs got %d, %v; want error", n, err)
+			}
+
+			names, err := db.PreviewRewriteLongs("old.example.com", "new.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"a", "b"}; !cmp.Equal(names, want) {
+				t.Errorf("PreviewRewriteLongs got %v, want %v", names, want)
+			}
+			if link, err := db.Load("a"); err != nil || link.Long != "https://old.example.com/a" {
+				t.Fatalf("Load(a) after preview got %v, %v; want it unchanged", link, err)
+			}
+
+			n, err := db.RewriteLongs("old.example.com", "new.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 2 {
+				t.Errorf("RewriteLongs updated %d links, want 2", n)
+			}
+			want := map[string]string{
+				"a": "https://new.example.com/a",
+				"b": "https://new.example.com/b?from=new.example.com",
+				"c": "https://other.example.com/c",
+			}
+			for short, long := range want {
+				link, err := db.Load(short)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if link.Long != long {
+					t.Errorf("Load(%q).Long = %q, want %q", short, link.Long, long)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadStatsSince(t *testing.T) {
+	type sinceStore interface {
+		Database
+		options() *Options
+		LoadStatsSince(t time.Time) (ClickStats, error)
+	}
+	stores := map[string]func(t *testing.T) sinceStore{
+		"sqlite": func(t *testing.T) sinceStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) sinceStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			now := time.Date(2022, 6, 2, 0, 0, 0, 0, time.UTC)
+			db.options().Now = func() time.Time { return now }
+			for _, short := range []string{"a", "b"} {
+				if err := db.Save(&Link{Short: short, Long: "http://" + short + "/"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.SaveStats(ClickStats{"a": 1, "b": 2}); err != nil {
+				t.Fatal(err)
+			}
+			now = now.Add(time.Minute)
+			pulled := now
+			if err := db.SaveStats(ClickStats{"a": 3}); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := db.LoadStatsSince(pulled)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (ClickStats{"a": 3}); !cmp.Equal(got, want) {
+				t.Errorf("LoadStatsSince got %v, want %v", got, want)
+			}
+			got, err = db.LoadStatsSince(time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (ClickStats{"a": 4, "b": 2}); !cmp.Equal(got, want) {
+				t.Errorf("LoadStatsSince(zero) got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadRawStats(t *testing.T) {
+	type rawStore interface {
+		Database
+		options() *Options
+		LoadRawStats(short string) ([]StatRow, error)
+		LoadAllRawStats(ctx context.Context) StatRowSeq
+	}
+	stores := map[string]func(t *testing.T) rawStore{
+		"sqlite": func(t *testing.T) rawStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) rawStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			start := time.Date(2022, 6, 2, 0, 0, 0, 0, time.UTC)
+			now := start
+			db.options().Now = func() time.Time { return now }
+			for _, short := range []string{"a", "b"} {
+				if err := db.Save(&Link{Short: short, Long: "http://" + short + "/"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.SaveStats(ClickStats{"a": 1}); err != nil {
+				t.Fatal(err)
+			}
+			now = now.Add(time.Minute)
+			if err := db.SaveStats(ClickStats{"a": 3, "b": 2}); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := db.LoadRawStats("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []StatRow{
+				{Short: "a", Created: start, Clicks: 1},
+				{Short: "a", Created: start.Add(time.Minute), Clicks: 3},
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("LoadRawStats(a) mismatch (-want +got):\n%s", diff)
+			}
+			if got, err := db.LoadRawStats("missing"); err != nil || len(got) != 0 {
+				t.Errorf("LoadRawStats(missing) got %v, %v; want none", got, err)
+			}
+
+			var all []StatRow
+			db.LoadAllRawStats(context.Background())(func(row StatRow, err error) bool {
+				if err != nil {
+					t.Fatal(err)
+				}
+				all = append(all, row)
+				return true
+			})
+			if len(all) != 3 || !cmp.Equal(all[0], want[0]) {
+				t.Errorf("LoadAllRawStats got %v, want 3 rows starting with %v", all, want[0])
+			}
+			total := 0
+			for _, row := range all {
+				total += row.Clicks
+			}
+			if total != 6 {
+				t.Errorf("LoadAllRawStats rows total %d clicks, want 6", total)
+			}
+		})
+	}
+}
+
+func TestStatsSeq(t *testing.T) {
+	type seqStore interface {
+		Database
+		StatsSeq(ctx context.Context) StatEntrySeq
+	}
+	stores := map[string]func(t *testing.T) seqStore{
+		"sqlite": func(t *testing.T) seqStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) seqStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			for _, short := range []string{"a", "b", "c"} {
+				if err := db.Save(&Link{Short: short, Long: "http://" + short + "/"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.SaveStats(ClickStats{"a": 1, "b": 2}); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []StatEntry
+			db.StatsSeq(context.Background())(func(e StatEntry, err error) bool {
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, e)
+				return true
+			})
+			if want := []StatEntry{{"a", 1}, {"b", 2}}; !cmp.Equal(got, want) {
+				t.Errorf("StatsSeq got %v, want %v", got, want)
+			}
+
+			n := 0
+			db.StatsSeq(context.Background())(func(StatEntry, error) bool {
+				n++
+				return false
+			})
+			if n != 1 {
+				t.Errorf("StatsSeq yielded %d entries after stopping, want 1", n)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			var err error
+			db.StatsSeq(ctx)(func(_ StatEntry, e error) bool {
+				err = e
+				return e == nil
+			})
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("StatsSeq with canceled context got %v, want context.Canceled", err)
+			}
+		})
+	}
+}
+
+// Test that stats are keyed by link name, not normalized ID, by every
+// store.
+func TestStatsKeys(t *testing.T) {
+	type statsStore interface {
+		Database
+		StatsSeq(ctx context.Context) StatEntrySeq
+		LoadStatsSince(t time.Time) (ClickStats, error)
+		LoadRawStats(short string) ([]StatRow, error)
+		LoadAllRawStats(ctx context.Context) StatRowSeq
+		SaveImpressions(impressions ClickStats) error
+		LoadImpressions() (ClickStats, error)
+	}
+	stores := map[string]func(t *testing.T) statsStore{
+		"sqlite": func(t *testing.T) statsStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) statsStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	const name = "Eng/Foo-Bar"
+	for storeName, newStore := range stores {
+		t.Run(storeName, func(t *testing.T) {
+			db := newStore(t)
+			if err := db.Save(&Link{Namespace: "Eng", Short: "Foo-Bar", Long: "http://foo/"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.SaveStats(ClickStats{"eng/foobar": 2}); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.SaveImpressions(ClickStats{"eng/foobar": 3}); err != nil {
+				t.Fatal(err)
+			}
+
+			var entries []StatEntry
+			db.StatsSeq(context.Background())(func(e StatEntry, err error) bool {
+				if err != nil {
+					t.Fatal(err)
+				}
+				entries = append(entries, e)
+				return true
+			})
+			if want := []StatEntry{{name, 2}}; !cmp.Equal(entries, want) {
+				t.Errorf("StatsSeq got %v, want %v", entries, want)
+			}
+			since, err := db.LoadStatsSince(time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (ClickStats{name: 2}); !cmp.Equal(since, want) {
+				t.Errorf("LoadStatsSince got %v, want %v", since, want)
+			}
+			rows, err := db.LoadRawStats("eng/foobar")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != 1 || rows[0].Short != name {
+				t.Errorf("LoadRawStats got %v, want one row for %q", rows, name)
+			}
+			var all []StatRow
+			db.LoadAllRawStats(context.Background())(func(row StatRow, err error) bool {
+				if err != nil {
+					t.Fatal(err)
+				}
+				all = append(all, row)
+				return true
+			})
+			if len(all) != 1 || all[0].Short != name {
+				t.Errorf("LoadAllRawStats got %v, want one row for %q", all, name)
+			}
+			impressions, err := db.LoadImpressions()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (ClickStats{name: 3}); !cmp.Equal(impressions, want) {
+				t.Errorf("LoadImpressions got %v, want %v", impressions, want)
+			}
+		})
+	}
+}
+
+func TestLoadOwnerless(t *testing.T) {
+	type ownerlessStore interface {
+		Database
+		LoadOwnerless() ([]*Link, error)
+	}
+	stores := map[string]func(t *testing.T) ownerlessStore{
+		"sqlite": func(t *testing.T) ownerlessStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) ownerlessStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	created := time.Date(2022, 6, 2, 0, 0, 0, 0, time.UTC)
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			links, err := db.LoadOwnerless()
+			if err != nil || len(links) != 0 {
+				t.Fatalf("LoadOwnerless on empty store got %v, %v; want no links", links, err)
+			}
+			for i, link := range []*Link{
+				{Short: "blank", Owner: "  "},
+				{Short: "owned", Owner: "foo@example.com"},
+				{Short: "empty"},
+				{Short: "tab", Owner: "\t\n"},
+			} {
+				link.Long = "http://" + link.Short + "/"
+				link.Created = created.Add(-time.Duration(i) * time.Hour)
+				if err := db.Save(link); err != nil {
+					t.Fatal(err)
+				}
+			}
+			links, err = db.LoadOwnerless()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, link := range links {
+				got = append(got, link.Short)
+			}
+			if want := []string{"tab", "empty", "blank"}; !cmp.Equal(got, want) {
+				t.Errorf("LoadOwnerless got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestLinkTTL(t *testing.T) {
+	stores := map[string]func(t *testing.T) Database{
+		"sqlite": func(t *testing.T) Database {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) Database {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	created := time.Date(2022, 6, 2, 0, 0, 0, 0, time.UTC)
+	explicit := created.Add(time.Hour)
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			links := []*Link{
+				{Short: "ttl", TTL: 30 * 24 * time.Hour},
+				{Short: "both", TTL: 30 * 24 * time.Hour, ExpiresAt: explicit},
+				{Short: "never"},
+			}
+			for _, link := range links {
+				link.Long = "http://" + link.Short + "/"
+				link.Created = created
+				if err := db.Save(link); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Save(&Link{Short: "negative", Long: "http://negative/", TTL: -time.Hour}); err == nil {
+				t.Error("db.Save with negative TTL succeeded, want error")
+			}
+
+			want := map[string]time.Time{
+				"ttl":   created.Add(30 * 24 * time.Hour),
+				"both":  explicit,
+				"never": {},
+			}
+			for short, expires := range want {
+				link, err := db.Load(short)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !link.ExpiresAt.Equal(expires) {
+					t.Errorf("Load(%q).ExpiresAt = %v, want %v", short, link.ExpiresAt, expires)
+				}
+				if link.Expired(created.Add(2*time.Hour)) != (short == "both") {
+					t.Errorf("Load(%q).Expired 2h after creation = %v", short, !(short == "both"))
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyShort(t *testing.T) {
+	type loadStore interface {
+		Database
+		LoadWithMeta(short string) (*Link, error)
+		LoadWithStats(short string) (*Link, int, error)
+		LoadVersioned(short string) (*Link, string, error)
+	}
+	stores := map[string]func(t *testing.T) loadStore{
+		"sqlite": func(t *testing.T) loadStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) loadStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			for _, short := range []string{"", "  ", "\t\n", "\x00\x7f"} {
+				if err := db.Save(&Link{Short: short, Long: "http://a/"}); !errors.Is(err, ErrEmptyShort) {
+					t.Errorf("db.Save(%q) got %v, want ErrEmptyShort", short, err)
+				}
+				_, err := db.Load(short)
+				if !errors.Is(err, ErrEmptyShort) || !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("db.Load(%q) got %v, want ErrEmptyShort and fs.ErrNotExist", short, err)
+				}
+				loaders := map[string]func() error{
+					"LoadWithMeta":  func() error { _, err := db.LoadWithMeta(short); return err },
+					"LoadWithStats": func() error { _, _, err := db.LoadWithStats(short); return err },
+					"LoadVersioned": func() error { _, _, err := db.LoadVersioned(short); return err },
+				}
+				for loader, load := range loaders {
+					if err := load(); !errors.Is(err, ErrEmptyShort) || !errors.Is(err, fs.ErrNotExist) {
+						t.Errorf("db.%s(%q) got %v, want ErrEmptyShort and fs.ErrNotExist", loader, short, err)
+					}
+				}
+			}
+			if err := db.Save(&Link{Short: " a ", Long: "http://a/"}); !errors.Is(err, ErrInvalidShort) {
+				t.Errorf("db.Save with padded short got %v, want ErrInvalidShort", err)
+			}
+		})
+	}
+}
+
+func TestInvalidShort(t *testing.T) {
+	type optionsStore interface {
+		Database
+		options() *Options
+	}
+	stores := map[string]func(t *testing.T) optionsStore{
+		"sqlite": func(t *testing.T) optionsStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) optionsStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	tests := []struct {
+		short                string
+		disallowedShortChars string
+		wantOK               bool // saved by default
+		wantHierarchicalOK   bool // saved with HierarchicalShorts
+	}{
+		{short: "a-b.c", wantOK: true, wantHierarchicalOK: true},
+		{short: "team/docs", wantHierarchicalOK: true},
+		{short: "a?b"},
+		{short: "a#b"},
+		{short: "a b"},
+		{short: "a\u00a0b"},
+		{short: "a\x01b"},
+		{short: "a\x7f"},
+		{short: "a?b", disallowedShortChars: "!", wantOK: true, wantHierarchicalOK: true},
+		{short: "a!b", disallowedShortChars: "!"},
+		{short: "a b", disallowedShortChars: "!"},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			for _, hierarchical := range []bool{false, true} {
+				db.options().HierarchicalShorts = hierarchical
+				for _, tt := range tests {
+					db.options().DisallowedShortChars = tt.disallowedShortChars
+					wantOK := tt.wantOK
+					if hierarchical {
+						wantOK = tt.wantHierarchicalOK
+					}
+					err := db.Save(&Link{Short: tt.short, Long: "http://a/"})
+					if wantOK {
+						if err != nil {
+							t.Errorf("db.Save(%q) with chars %q, hierarchical %v: %v", tt.short, tt.disallowedShortChars, hierarchical, err)
+						}
+						continue
+					}
+					var invalid *InvalidShortError
+					if !errors.As(err, &invalid) || !errors.Is(err, ErrInvalidShort) {
+						t.Errorf("db.Save(%q) with chars %q, hierarchical %v got %v, want InvalidShortError", tt.short, tt.disallowedShortChars, hierarchical, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCanAccess(t *testing.T) {
+	restricted := &Link{Short: "a", Owner: "owner@example.com", AllowedOwners: []string{"Friend@other.com", "@eng.example.com"}}
+	tests := []struct {
+		link *Link
+		user string
+		want bool
+	}{
+		{&Link{Short: "public"}, "", true},
+		{&Link{Short: "public"}, "anyone@example.com", true},
+		{restricted, "", false},
+		{restricted, "OWNER@example.com", true},
+		{restricted, "friend@other.com", true},
+		{restricted, "bob@eng.example.com", true},
+		{restricted, "bob@example.com", false},
+		{restricted, "bob@noteng.example.com", false},
+	}
+	for _, tt := range tests {
+		if got := CanAccess(tt.link, tt.user); got != tt.want {
+			t.Errorf("CanAccess(%q, %q) = %v, want %v", tt.link.Short, tt.user, got, tt.want)
+		}
+	}
+}
+
+func TestAllowedOwnersPersisted(t *testing.T) {
+	stores := map[string]func(t *testing.T) Database{
+		"sqlite": func(t *testing.T) Database {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) Database {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			allowed := []string{"friend@example.com", "@eng.example.com"}
+			for _, link := range []*Link{
+				{Short: "private", Long: "http://private/", AllowedOwners: allowed},
+				{Short: "public", Long: "http://public/"},
+			} {
+				if err := db.Save(link); err != nil {
+					t.Fatal(err)
+				}
+			}
+			private, err := db.Load("private")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(private.AllowedOwners, allowed) {
+				t.Errorf("Load(private).AllowedOwners = %q, want %q", private.AllowedOwners, allowed)
+			}
+			public, err := db.Load("public")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if public.AllowedOwners != nil {
+				t.Errorf("Load(public).AllowedOwners = %q, want nil", public.AllowedOwners)
+			}
+		})
+	}
+}
+
+func TestIconURLPersisted(t *testing.T) {
+	stores := map[string]func(t *testing.T) Database{
+		"sqlite": func(t *testing.T) Database {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) Database {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			const icon = "https://example.com/favicon.ico"
+			for _, link := range []*Link{
+				{Short: "icon", Long: "https://example.com/", IconURL: icon},
+				{Short: "plain", Long: "http://plain/"},
+			} {
+				if err := db.Save(link); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for short, want := range map[string]string{"icon": icon, "plain": ""} {
+				link, err := db.Load(short)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if link.IconURL != want {
+					t.Errorf("Load(%q).IconURL = %q, want %q", short, link.IconURL, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHeadersPersisted(t *testing.T) {
+	stores := map[string]func(t *testing.T) Database{
+		"sqlite": func(t *testing.T) Database {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) Database {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			headers := map[string]string{"Cache-Control": "no-store", "Referrer-Policy": "no-referrer"}
+			for _, link := range []*Link{
+				{Short: "headers", Long: "https://example.com/", Headers: headers},
+				{Short: "plain", Long: "http://plain/"},
+			} {
+				if err := db.Save(link); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for short, want := range map[string]map[string]string{"headers": headers, "plain": nil} {
+				link, err := db.Load(short)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cmp.Equal(link.Headers, want) {
+					t.Errorf("Load(%q).Headers = %v, want %v", short, link.Headers, want)
+				}
+			}
+
+			for _, bad := range []map[string]string{
+				{"X-Foo": "a\r\nSet-Cookie: b"},
+				{"X-Foo": "a\nb"},
+				{"Bad Name": "a"},
+				{"X-Foo:": "a"},
+				{"": "a"},
+			} {
+				err := db.Save(&Link{Short: "bad", Long: "http://bad/", Headers: bad})
+				var herr *InvalidHeaderError
+				if !errors.As(err, &herr) || !errors.Is(err, ErrInvalidHeader) {
+					t.Errorf("Save with headers %q got %v, want *InvalidHeaderError", bad, err)
+				}
+			}
+			if _, err := db.Load("bad"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Load(bad) got %v, want fs.ErrNotExist", err)
+			}
+		})
+	}
+}
+
+func TestPinned(t *testing.T) {
+	type pinStore interface {
+		Database
+		Pin(short string) error
+		Unpin(short string) error
+		LoadPinned() ([]*Link, error)
+	}
+	stores := map[string]func(t *testing.T) pinStore{
+		"sqlite": func(t *testing.T) pinStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) pinStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			edited := time.Date(2022, 6, 2, 0, 0, 0, 0, time.UTC)
+			for i, short := range []string{"a", "b", "c"} {
+				link := &Link{Short: short, Long: "http://" + short + "/", LastEdit: edited.Add(time.Duration(i) * time.Hour)}
+				if err := db.Save(link); err != nil {
+					t.Fatal(err)
+				}
+			}
+			pinned := func() []string {
+				t.Helper()
+				links, err := db.LoadPinned()
+				if err != nil {
+					t.Fatal(err)
+				}
+				var names []string
+				for _, link := range links {
+					names = append(names, link.Name())
+				}
+				return names
+			}
+			if got := pinned(); len(got) != 0 {
+				t.Errorf("LoadPinned with nothing pinned got %v, want none", got)
+			}
+
+			for _, short := range []string{"a", "c"} {
+				if err := db.Pin(short); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got, want := pinned(), []string{"c", "a"}; !cmp.Equal(got, want) {
+				t.Errorf("LoadPinned got %v, want %v", got, want)
+			}
+			link, err := db.Load("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !link.Pinned || link.Long != "http://a/" || !link.LastEdit.Equal(edited) {
+				t.Errorf("Load(a) after Pin got %+v, want pinned and otherwise unchanged", link)
+			}
+
+			if err := db.Unpin("c"); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := pinned(), []string{"a"}; !cmp.Equal(got, want) {
+				t.Errorf("LoadPinned after Unpin got %v, want %v", got, want)
+			}
+			if err := db.Pin("missing"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Pin(missing) got %v, want fs.ErrNotExist", err)
+			}
+		})
+	}
+}
+
+func TestConsumeUse(t *testing.T) {
+	type useStore interface {
+		Database
+		options() *Options
+		ConsumeUse(short string) (*Link, error)
+	}
+	stores := map[string]func(t *testing.T) useStore{
+		"sqlite": func(t *testing.T) useStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) useStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			for _, link := range []*Link{
+				{Short: "once", Long: "http://secret/", MaxUses: 1},
+				{Short: "twice", Long: "http://secret/2", MaxUses: 2},
+				{Short: "always", Long: "http://public/"},
+			} {
+				if err := db.Save(link); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			link, err := db.ConsumeUse("once")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if link.Long != "http://secret/" || link.UseCount != 1 {
+				t.Errorf("ConsumeUse(once) got %+v, want http://secret/ with UseCount 1", link)
+			}
+			if _, err := db.ConsumeUse("once"); !errors.Is(err, ErrLinkExhausted) {
+				t.Errorf("second ConsumeUse(once) got %v, want ErrLinkExhausted", err)
+			}
+			if link, err := db.Load("once"); err != nil || link.UseCount != 1 {
+				t.Errorf("Load(once) got %v, %v; want link with UseCount 1", link, err)
+			}
+
+			// Saving keeps the stored count.
+			if err := db.Save(&Link{Short: "once", Long: "http://secret/new", MaxUses: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.ConsumeUse("once"); !errors.Is(err, ErrLinkExhausted) {
+				t.Errorf("ConsumeUse(once) after Save got %v, want ErrLinkExhausted", err)
+			}
+
+			for i := 1; i <= 3; i++ {
+				if link, err := db.ConsumeUse("always"); err != nil || link.UseCount != i {
+					t.Errorf("ConsumeUse(always) #%d got %v, %v; want UseCount %d", i, link, err, i)
+				}
+			}
+			if _, err := db.ConsumeUse("missing"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("ConsumeUse(missing) got %v, want fs.ErrNotExist", err)
+			}
+
+			db.options().DeleteExhaustedLinks = true
+			for i := 1; i <= 2; i++ {
+				if _, err := db.ConsumeUse("twice"); err != nil {
+					t.Fatalf("ConsumeUse(twice) #%d: %v", i, err)
+				}
+			}
+			if _, err := db.Load("twice"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Load(twice) after its last use got %v, want fs.ErrNotExist", err)
+			}
+		})
+	}
+}
+
+// Test that concurrent ConsumeUse calls can't use a link more than MaxUses
+// times.
+func Test_SQLiteDB_ConsumeUseConcurrent(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Save(&Link{Short: "a", Long: "http://a/", MaxUses: 3}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	used := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.ConsumeUse("a")
+			if err != nil && !errors.Is(err, ErrLinkExhausted) {
+				t.Error(err)
+			}
+			if err == nil {
+				mu.Lock()
+				used++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if used != 3 {
+		t.Errorf("%d of 10 concurrent ConsumeUse calls succeeded, want 3", used)
+	}
+}
+
+func TestRandomLink(t *testing.T) {
+	type randomStore interface {
+		Database
+		options() *Options
+		RandomLink() (*Link, error)
+	}
+	stores := map[string]func(t *testing.T) randomStore{
+		"sqlite": func(t *testing.T) randomStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) randomStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			if _, err := db.RandomLink(); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("RandomLink on empty store got %v, want fs.ErrNotExist", err)
+			}
+			for _, short := range []string{"a", "b", "c", "d"} {
+				if err := db.Save(&Link{Short: short, Long: "http://" + short + "/"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			pick := func(seed int64) []string {
+				db.options().Rand = rand.New(rand.NewSource(seed))
+				var picked []string
+				for i := 0; i < 20; i++ {
+					link, err := db.RandomLink()
+					if err != nil {
+						t.Fatal(err)
+					}
+					picked = append(picked, link.Short)
+				}
+				return picked
+			}
+			first := pick(1)
+			if second := pick(1); !cmp.Equal(first, second) {
+				t.Errorf("RandomLink with the same seed picked %v, then %v", first, second)
+			}
+			seen := make(map[string]bool)
+			for _, short := range first {
+				seen[short] = true
+			}
+			if len(seen) < 2 {
+				t.Errorf("RandomLink picked only %v in 20 tries", first)
+			}
+		})
+	}
+}
+
+func TestLoadMostEdited(t *testing.T) {
+	type editStore interface {
+		Database
+		LoadMostEdited(n int) ([]*Link, error)
+	}
+	stores := map[string]func(t *testing.T) editStore{
+		"sqlite": func(t *testing.T) editStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) editStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	saves := map[string]int{"a": 1, "b": 3, "c": 2}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			for short, n := range saves {
+				for i := 0; i < n; i++ {
+					if err := db.Save(&Link{Short: short, Long: "http://" + short + "/", EditCount: 100}); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			links, err := db.LoadMostEdited(2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, link := range links {
+				got = append(got, fmt.Sprintf("%s:%d", link.Short, link.EditCount))
+			}
+			if want := []string{"b:3", "c:2"}; !cmp.Equal(got, want) {
+				t.Errorf("LoadMostEdited(2) got %v, want %v", got, want)
+			}
+			link, err := db.Load("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if link.EditCount != 1 {
+				t.Errorf("Load(%q).EditCount = %d, want 1", "a", link.EditCount)
+			}
+		})
+	}
+}
+
+// Test that SQLiteDB refuses to save overly long Long URLs
+func Test_SQLiteDB_MaxLongLength(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.MaxLongLength = 10
+
+	err = db.Save(&Link{Short: "a", Long: "http://a/long"})
+	var tooLong *LongTooLongError
+	if !errors.As(err, &tooLong) || !errors.Is(err, ErrLongTooLong) {
+		t.Fatalf("db.Save got %v, want LongTooLongError", err)
+	}
+	if tooLong.Length != 13 || tooLong.Max != 10 {
+		t.Errorf("LongTooLongError got %d/%d, want 13/10", tooLong.Length, tooLong.Max)
+	}
+
+	// links stored before the limit was lowered still load
+	db.MaxLongLength = 0
+	if err := db.Save(&Link{Short: "a", Long: "http://a/long"}); err != nil {
+		t.Fatal(err)
+	}
+	db.MaxLongLength = 10
+	link, err := db.Load("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Save(link); !errors.Is(err, ErrLongTooLong) {
+		t.Errorf("db.Save of existing link got %v, want ErrLongTooLong", err)
+	}
+
+	_, err = Import(db, strings.NewReader(`{"Short":"b","Long":"http://b/long"}`), ImportValidOnly)
+	if !errors.Is(err, ErrLongTooLong) {
+		t.Errorf("Import got %v, want ErrLongTooLong", err)
+	}
+}
+
+// Test that SQLiteDB stores and validates per-link redirect codes
+func Test_SQLiteDB_RedirectCode(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Save(&Link{Short: "a", Long: "http://a/", RedirectCode: 301}); err != nil {
+		t.Fatal(err)
+	}
+	link, err := db.Load("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.RedirectCode != 301 {
+		t.Errorf("db.Load got RedirectCode %d, want 301", link.RedirectCode)
+	}
+
+	for _, code := range []int{200, 303, 404} {
+		if err := db.Save(&Link{Short: "b", Long: "http://b/", RedirectCode: code}); err == nil {
+			t.Errorf("db.Save with RedirectCode %d succeeded, want error", code)
+		}
+	}
+}
+
+// Test that SQLiteDB reports successful changes to observers
+func Test_SQLiteDB_OnChange(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan ChangeEvent, 10)
+	db.ChangeEvents = events
+	var wg sync.WaitGroup
+	var observed atomic.Int32
+	db.OnChange = []func(ChangeEvent){func(ChangeEvent) {
+		observed.Add(1)
+		wg.Done()
+	}}
+
+	wg.Add(3)
+	if err := db.Save(&Link{Short: "a", Long: "http://a/"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Save(&Link{Short: "a", Long: "http://a/2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Save(&Link{Short: "b", RedirectCode: 200}); err == nil {
+		t.Fatal("db.Save of invalid link succeeded")
+	}
+	// deleting an alias deletes no link
+	if err := db.Alias("al", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("al"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("a"); err == nil {
+		t.Fatal("db.Delete of missing link succeeded")
+	}
+	wg.Wait()
+	close(events)
+
+	var got []string
+	for ev := range events {
+		got = append(got, ev.Type.String()+" "+ev.Short)
+	}
+	want := []string{"create a", "update a", "delete a"}
+	if !cmp.Equal(got, want) {
+		t.Errorf("change events got %q, want %q", got, want)
+	}
+	if n := observed.Load(); n != 3 {
+		t.Errorf("OnChange called %d times, want 3", n)
+	}
+}
+
+// Test that SQLiteDB reads are safe alongside writes.
+// Run with -race to detect data races.
+func Test_SQLiteDB_ConcurrentReads(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Save(&Link{Short: "a", Long: "http://a/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 20; j++ {
+			if err := db.Save(&Link{Short: fmt.Sprintf("link-%d", j), Long: "long"}); err != nil {
+				errs <- err
+				return
+			}
+			if err := db.SaveStats(ClickStats{"a": 1}); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, err := db.Load("a"); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := db.LoadAll(); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := db.LoadStats(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func BenchmarkSQLiteDB_LoadParallel(b *testing.B) {
+	db, err := NewSQLiteDB(path.Join(b.TempDir(), "links.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.Save(&Link{Short: fmt.Sprintf("link-%d", i), Long: "long"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, err := db.Load(fmt.Sprintf("link-%d", i%100)); err != nil {
+				b.Error(err)
+				return
+			}
+			i++
+		}
+	})
+}
+
+// Test that a SQLiteDB restored from DumpSQL has the same data
+func Test_SQLiteDB_DumpSQL(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := []*Link{
+		{Short: "a", Long: "http://a/?q='quoted'&x=\"y\"", Owner: "a@example.com"},
+		{Short: "b", Long: "line one\nline two", Destinations: []WeightedDest{{URL: "http://b/", Weight: 1}}},
+		{Short: "c", Long: "http://c/", RedirectCode: 301},
+	}
+	for _, link := range links {
+		if err := db.Save(link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Alias("a2", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveStats(ClickStats{"a": 1, "b": 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	var dump strings.Builder
+	if err := db.DumpSQL(&dump); err != nil {
+		t.Fatal(err)
+	}
+
+	file := path.Join(t.TempDir(), "restored.db")
+	raw, err := sql.Open("sqlite", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := raw.Exec(dump.String()); err != nil {
+		t.Fatalf("loading dump: %v\n%s", err, dump.String())
+	}
+	var version int
+	if err := raw.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != SQLiteSchemaVersion {
+		t.Errorf("restored user_version = %d, want %d", version, SQLiteSchemaVersion)
+	}
+	raw.Close()
+	restored, err := NewSQLiteDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sortLinks := cmpopts.SortSlices(func(a, b *Link) bool { return a.Short < b.Short })
+	want, err := db.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := restored.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(got, want, sortLinks) {
+		t.Errorf("restored links differ (-got +want):\n%s", cmp.Diff(got, want, sortLinks))
+	}
+	wantStats, err := db.LoadStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotStats, err := restored.LoadStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(gotStats, wantStats) {
+		t.Errorf("restored stats got %v, want %v", gotStats, wantStats)
+	}
+	if link, err := restored.Load("a2"); err != nil || link.Short != "a" {
+		t.Errorf("restored alias a2 got %v, %v; want link a", link, err)
+	}
+}
+
+// Test that SQLiteDB limits the number of links per owner
+func Test_SQLiteDB_MaxLinksPerOwner(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.MaxLinksPerOwner = 2
+
+	for _, short := range []string{"a", "b"} {
+		if err := db.Save(&Link{Short: short, Owner: "foo@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Save(&Link{Short: "c", Owner: "foo@example.com"})
+	var quota *QuotaExceededError
+	if !errors.As(err, &quota) || !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("db.Save over quota got %v, want QuotaExceededError", err)
+	}
+	if quota.Count != 2 || quota.Limit != 2 {
+		t.Errorf("QuotaExceededError got %d/%d, want 2/2", quota.Count, quota.Limit)
+	}
+
+	// updates, other owners, and unowned links are allowed
+	if err := db.Save(&Link{Short: "a", Long: "http://a/", Owner: "foo@example.com"}); err != nil {
+		t.Errorf("db.Save of existing link: %v", err)
+	}
+	if err := db.Save(&Link{Short: "c", Owner: "bar@example.com"}); err != nil {
+		t.Errorf("db.Save for another owner: %v", err)
+	}
+	if err := db.Save(&Link{Short: "d"}); err != nil {
+		t.Errorf("db.Save without owner: %v", err)
+	}
+}
+
+func TestMaxTotalLinks(t *testing.T) {
+	type optionsStore interface {
+		Database
+		options() *Options
+	}
+	stores := map[string]func(t *testing.T) optionsStore{
+		"sqlite": func(t *testing.T) optionsStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) optionsStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			db.options().MaxTotalLinks = 2
+			for _, link := range []*Link{{Short: "a"}, {Short: "b", Owner: "foo@example.com"}} {
+				if err := db.Save(link); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := db.Save(&Link{Short: "c", Owner: "bar@example.com"})
+			var quota *QuotaExceededError
+			if !errors.As(err, &quota) || !errors.Is(err, ErrQuotaExceeded) {
+				t.Fatalf("db.Save over total quota got %v, want QuotaExceededError", err)
+			}
+			if quota.Owner != "" || quota.Count != 2 || quota.Limit != 2 {
+				t.Errorf("QuotaExceededError got %q %d/%d, want \"\" 2/2", quota.Owner, quota.Count, quota.Limit)
+			}
+			if err := db.Save(&Link{Short: "a", Long: "http://a/"}); err != nil {
+				t.Errorf("db.Save of existing link: %v", err)
+			}
+		})
+	}
+}
+
+// Test that SQLiteDB keeps links in different namespaces apart
+func Test_SQLiteDB_Namespaces(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := []*Link{
+		{Short: "foo", Long: "http://foo/"},
+		{Namespace: "eng", Short: "foo", Long: "http://eng/foo"},
+		{Namespace: "sales", Short: "Foo", Long: "http://sales/foo"},
+	}
+	for _, link := range links {
+		if err := db.Save(link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Save(&Link{Namespace: "a/b", Short: "foo"}); err == nil {
+		t.Error("db.Save with a slash in the namespace succeeded")
+	}
+	if err := db.Save(&Link{Namespace: "admin", Short: "foo"}); !errors.Is(err, ErrReservedShort) {
+		t.Errorf("db.Save in a reserved namespace got %v, want ErrReservedShort", err)
+	}
+
+	for name, want := range map[string]string{"foo": "http://foo/", "ENG/foo": "http://eng/foo", "sales/f-o-o": "http://sales/foo"} {
+		link, err := db.Load(name)
+		if err != nil {
+			t.Errorf("db.Load(%q): %v", name, err)
+			continue
+		}
+		if link.Long != want {
+			t.Errorf("db.Load(%q) got %q, want %q", name, link.Long, want)
+		}
+	}
+
+	got, err := db.LoadNamespace("eng")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Name() != "eng/foo" {
+		t.Errorf("db.LoadNamespace(%q) got %v, want [eng/foo]", "eng", got)
+	}
+	got, err = db.LoadNamespace("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Name() != "foo" {
+		t.Errorf("db.LoadNamespace(%q) got %v, want [foo]", "", got)
+	}
+
+	if err := db.SaveStats(ClickStats{"eng/foo": 2}); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := db.LoadStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ClickStats{"eng/foo": 2}); !cmp.Equal(stats, want) {
+		t.Errorf("db.LoadStats got %v, want %v", stats, want)
+	}
+}
+
+// Test that SQLiteDB.LoadStats leaves out stats for links that don't exist
+func Test_SQLiteDB_LoadStatsOrphans(t *testing.T) {
+	file := path.Join(t.TempDir(), "links.db")
+	db, err := NewSQLiteDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Save(&Link{Short: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveStats(ClickStats{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write orphaned stats through a connection without foreign keys, as an
+	// older version would have.
+	raw, err := sql.Open("sqlite", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	for _, id := range []string{"gone", "alsogone"} {
+		if _, err := raw.Exec("INSERT INTO Stats (ID, Created, Clicks) VALUES (?, 0, 5)", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := db.LoadStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ClickStats{"a": 1}
+	if !cmp.Equal(got, want) {
+		t.Errorf("db.LoadStats got %v, want %v", got, want)
+	}
+}
+
+// Test that SQLiteDB.ResetAllStats clears stats but keeps links
+func Test_SQLiteDB_ResetAllStats(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, short := range []string{"a", "b"} {
+		if err := db.Save(&Link{Short: short}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.SaveStats(ClickStats{"a": 1, "b": 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.ResetAllStats(); err != nil {
+		t.Fatal(err)
+	}
+	links, err := db.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 2 {
+		t.Errorf("db.LoadAll after reset got %d links, want 2", len(links))
+	}
+	stats, err := db.LoadStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 0 {
+		t.Errorf("db.LoadStats after reset got %v, want none", stats)
+	}
+	clicks, err := db.LoadStatsForLinks([]string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"a": 0, "b": 0}; !cmp.Equal(clicks, want) {
+		t.Errorf("db.LoadStatsForLinks after reset got %v, want %v", clicks, want)
+	}
+}
+
+// Test that SQLiteDB.Touch updates only LastEdit
+func Test_SQLiteDB_Touch(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	db.Now = func() time.Time { return now }
+
+	link := &Link{Short: "a", Long: "http://a/", Owner: "foo@example.com", Created: created, LastEdit: created, EditCount: 1}
+	if err := db.Save(link); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Alias("a2", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Touch("a2"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := db.Load("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := *link
+	want.LastEdit = now
+	if !cmp.Equal(got, &want) {
+		t.Errorf("db.Load after Touch got %v, want %v", got, &want)
+	}
+
+	if err := db.Touch("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("db.Touch of missing link got %v, want fs.ErrNotExist", err)
+	}
+}
+
+// Test that SQLiteDB records when stats were last saved
+func Test_SQLiteDB_LastStatsFlush(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	db.Now = func() time.Time { return now }
+
+	flushed, err := db.LastStatsFlush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !flushed.IsZero() {
+		t.Errorf("db.LastStatsFlush before any flush got %v, want zero time", flushed)
+	}
+
+	if err := db.Save(&Link{Short: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		now = now.Add(time.Hour)
+		if err := db.SaveStats(ClickStats{"a": 1}); err != nil {
+			t.Fatal(err)
+		}
+		flushed, err = db.LastStatsFlush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !flushed.Equal(now) {
+			t.Errorf("db.LastStatsFlush got %v, want %v", flushed, now)
+		}
+	}
+}
+
+func Test_SQLiteDB_DBStats(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, short := range []string{"a", "b", "c"} {
+		if err := db.Save(&Link{Short: short, Long: "http://" + short + "/"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Alias("d", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveStats(ClickStats{"a": 1, "b": 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := db.DBStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Links != 3 || st.Aliases != 1 || st.StatsRows != 2 {
+		t.Errorf("db.DBStats got %+v, want 3 links, 1 alias and 2 stats rows", st)
+	}
+	if st.SizeBytes <= 0 {
+		t.Errorf("db.DBStats got SizeBytes %d, want positive", st.SizeBytes)
+	}
+}
+
+// Test that LoadTransform rewrites loaded links without changing the stored
+// link.
+func Test_SQLiteDB_LoadTransform(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Save(&Link{Short: "a", Long: "http://old.example.com/a"}); err != nil {
+		t.Fatal(err)
+	}
+	db.LoadTransform = func(link *Link) *Link {
+		link.Long = strings.Replace(link.Long, "old.example.com", "new.example.com", 1)
+		return link
+	}
+
+	const want = "http://new.example.com/a"
+	link, err := db.Load("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Long != want {
+		t.Errorf("db.Load got Long %q, want %q", link.Long, want)
+	}
+	links, err := db.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[0].Long != want {
+		t.Errorf("db.LoadAll got %v, want Long %q", links, want)
+	}
+
+	var stored string
+	if err := db.db.QueryRow("SELECT Long FROM Links WHERE ID = ?", linkID("a")).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != "http://old.example.com/a" {
+		t.Errorf("stored Long is %q, want unchanged", stored)
+	}
+}
+
+// Test that every Database adds saved stats to the stored totals.
+func TestSaveStatsAccumulates(t *testing.T) {
+	stores := map[string]func(t *testing.T) Database{
+		"sqlite": func(t *testing.T) Database {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) Database {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+		"cache": func(t *testing.T) Database {
+			backend, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := NewRefreshingCache(backend, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(c.Close)
+			return c
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			if err := db.Save(&Link{Short: "a", Long: "http://a/"}); err != nil {
+				t.Fatal(err)
+			}
+			for _, stats := range []ClickStats{{"a": 2}, {"a": 3}} {
+				if err := db.SaveStats(stats); err != nil {
+					t.Fatal(err)
+				}
+			}
+			stats, err := db.LoadStats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats["a"] != 5 {
+				t.Errorf("LoadStats got %d clicks for a, want 5", stats["a"])
+			}
+		})
+	}
+}
+
+func TestLoadByLongPattern(t *testing.T) {
+	codec, err := NewAESGCMCodec(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newSQLite := func(t *testing.T) *SQLiteDB {
+		db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	type patternStore interface {
+		Database
+		LoadByLongPattern(string) ([]*Link, error)
+	}
+	stores := map[string]func(t *testing.T) patternStore{
+		"sqlite": func(t *testing.T) patternStore {
+			return newSQLite(t)
+		},
+		"sqlite-codec": func(t *testing.T) patternStore {
+			db := newSQLite(t)
+			db.Codec = codec
+			return db
+		},
+		"convex": func(t *testing.T) patternStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	links := map[string]string{
+		"a": "https://jira.old.com/browse/A-1",
+		"b": "https://JIRA.OLD.COM/",
+		"c": "https://jira.new.com/",
+		"d": "https://example.com/100%_done",
+	}
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"", nil},
+		{"jira.old.com", []string{"a", "b"}},
+		{"jira.*.com/", []string{"a", "b", "c"}},
+		{"https://jira.???.com/", []string{"a", "b", "c"}},
+		{"100%_", []string{"d"}},
+		{"100_", nil},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			for short, long := range links {
+				if err := db.Save(&Link{Short: short, Long: long}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, tt := range tests {
+				got, err := db.LoadByLongPattern(tt.pattern)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var shorts []string
+				for _, link := range got {
+					shorts = append(shorts, link.Short)
+				}
+				sort.Strings(shorts)
+				if !cmp.Equal(shorts, tt.want) {
+					t.Errorf("LoadByLongPattern(%q) got %v, want %v", tt.pattern, shorts, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func Test_SQLiteDB_Batch(t *testing.T) {
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []ChangeEvent
+	changes := make(chan ChangeEvent, 10)
+	db.ChangeEvents = changes
+	if err := db.Save(&Link{Short: "old", Long: "http://old/"}); err != nil {
+		t.Fatal(err)
+	}
+	<-changes
+
+	// a failed batch changes nothing
+	errBoom := errors.New("boom")
+	err = db.Batch(func(tx StoreTx) error {
+		if err := tx.Save(&Link{Short: "new", Long: "http://new/"}); err != nil {
+			return err
+		}
+		if _, err := tx.Load("new"); err != nil {
+			t.Errorf("tx.Load(%q) within batch: %v", "new", err)
+		}
+		return errBoom
+	})
+	if err != errBoom {
+		t.Fatalf("db.Batch got %v, want %v", err, errBoom)
+	}
+	if _, err := db.Load("new"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("db.Load(%q) after failed batch got %v, want fs.ErrNotExist", "new", err)
+	}
+
+	// a successful batch applies every change
+	err = db.Batch(func(tx StoreTx) error {
+		link, err := tx.Load("old")
+		if err != nil {
+			return err
+		}
+		link.Short = "new"
+		if err := tx.Save(link); err != nil {
+			return err
+		}
+		if err := tx.Delete("old"); err != nil {
+			return err
+		}
+		return tx.Alias("old", "new")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := db.Load("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Short != "new" {
+		t.Errorf("db.Load(%q) got link %q, want alias of %q", "old", link.Short, "new")
+	}
+	for len(events) < 2 {
+		events = append(events, <-changes)
+	}
+	if events[0].Type != ChangeCreate || events[1].Type != ChangeDelete {
+		t.Errorf("got events %v, want create and delete", events)
+	}
+}
+
+// Test that CreatedFrom is kept from the first save and only returned by
+// LoadWithMeta.
+func TestLoadWithMeta(t *testing.T) {
+	type metaStore interface {
+		Database
+		LoadWithMeta(short string) (*Link, error)
+	}
+	stores := map[string]func(t *testing.T) metaStore{
+		"sqlite": func(t *testing.T) metaStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) metaStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			if err := db.Save(&Link{Short: "a", Long: "http://a/", CreatedFrom: "192.0.2.1"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Save(&Link{Short: "a", Long: "http://b/", CreatedFrom: "192.0.2.2"}); err != nil {
+				t.Fatal(err)
+			}
+
+			link, err := db.Load("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if link.CreatedFrom != "" {
+				t.Errorf("Load got CreatedFrom %q, want empty", link.CreatedFrom)
+			}
+			links, err := db.LoadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(links) != 1 || links[0].CreatedFrom != "" {
+				t.Errorf("LoadAll got %v, want one link without CreatedFrom", links)
+			}
+
+			link, err = db.LoadWithMeta("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if link.Long != "http://b/" || link.CreatedFrom != "192.0.2.1" {
+				t.Errorf("LoadWithMeta got Long %q, CreatedFrom %q; want %q, %q", link.Long, link.CreatedFrom, "http://b/", "192.0.2.1")
+			}
+		})
+	}
+}
+
+// Test that a seeded Options.Rand makes random choices reproducible
+func TestOptionsRand(t *testing.T) {
+	link := &Link{Destinations: []WeightedDest{{URL: "a", Weight: 1}, {URL: "b", Weight: 1}, {URL: "c", Weight: 1}}}
+	picks := func() []string {
+		o := &Options{Rand: rand.New(rand.NewSource(7))}
+		var got []string
+		for i := 0; i < 20; i++ {
+			got = append(got, o.resolveDestination(link))
+		}
+		return got
+	}
+	first := picks()
+	if second := picks(); !cmp.Equal(first, second) {
+		t.Errorf("picks with the same seed differ: %v, %v", first, second)
+	}
+}
+
+func TestSaveMany(t *testing.T) {
+	type batchStore interface {
+		Database
+		SaveMany(links []*Link) (BatchResult, error)
+		options() *Options
+	}
+	stores := map[string]struct {
+		new func(t *testing.T) batchStore
+		// partial is what SaveMany reports saving when it fails partway:
+		// SQLite saves the whole batch in one transaction, while Convex
+		// keeps the links saved before one over a quota.
+		partial BatchResult
+	}{
+		"sqlite": {
+			new: func(t *testing.T) batchStore {
+				db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return db
+			},
+		},
+		"convex": {
+			new: func(t *testing.T) batchStore {
+				return NewConvexDB(newFakeConvex(t).URL, "test")
+			},
+			partial: BatchResult{Created: 1},
+		},
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := store.new(t)
+			if err := db.Save(&Link{Short: "a", Long: "http://a/old"}); err != nil {
+				t.Fatal(err)
+			}
+			result, err := db.SaveMany([]*Link{
+				{Short: "a", Long: "http://a/new"},
+				{Short: "b", Long: "http://b/"},
+				{Short: "c", Long: "http://c/"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (BatchResult{Created: 2, Updated: 1}); result != want {
+				t.Errorf("SaveMany got %+v, want %+v", result, want)
+			}
+			if link, err := db.Load("a"); err != nil || link.Long != "http://a/new" {
+				t.Errorf("Load(a) got %v, %v; want updated link", link, err)
+			}
+
+			db.options().MaxTotalLinks = 4
+			result, err = db.SaveMany([]*Link{{Short: "d"}, {Short: "e"}})
+			if !errors.Is(err, ErrQuotaExceeded) {
+				t.Fatalf("SaveMany over quota got error %v, want ErrQuotaExceeded", err)
+			}
+			if result != store.partial {
+				t.Errorf("SaveMany over quota got %+v, want %+v", result, store.partial)
+			}
+			links, err := db.LoadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := 3 + store.partial.Created; len(links) != want {
+				t.Errorf("after failed SaveMany, %d links stored, want %d", len(links), want)
+			}
+
+			if _, err := db.SaveMany([]*Link{{Short: "f"}, {Short: "api"}}); !errors.Is(err, ErrReservedShort) {
+				t.Errorf("SaveMany with reserved short got %v, want ErrReservedShort", err)
+			}
+		})
+	}
+}
+
+func TestAllIDs(t *testing.T) {
+	type idStore interface {
+		Database
+		AllIDs() ([]string, error)
+	}
+	stores := map[string]func(t *testing.T) idStore{
+		"sqlite": func(t *testing.T) idStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) idStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			ids, err := db.AllIDs()
+			if err != nil || len(ids) != 0 {
+				t.Fatalf("AllIDs of empty store got %v, %v; want none", ids, err)
+			}
+			for _, link := range []*Link{
+				{Short: "Foo-Bar", Long: "http://foo/"},
+				{Short: "a", Long: "http://a/"},
+				{Namespace: "Eng", Short: "Docs", Long: "http://eng/docs"},
+			} {
+				if err := db.Save(link); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ids, err = db.AllIDs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{"a", "eng/docs", "foobar"}
+			if !cmp.Equal(ids, want) {
+				t.Errorf("AllIDs got %v, want %v", ids, want)
+			}
+		})
+	}
+}
+
+func TestLoadCTR(t *testing.T) {
+	type ctrStore interface {
+		Database
+		SaveImpressions(impressions ClickStats) error
+		LoadImpressions() (ClickStats, error)
+		LoadCTR() (map[string]float64, error)
+	}
+	stores := map[string]func(t *testing.T) ctrStore{
+		"sqlite": func(t *testing.T) ctrStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) ctrStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			for _, short := range []string{"a", "b", "c"} {
+				if err := db.Save(&Link{Short: short, Long: "http://" + short}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Impressions add up across saves, and are dropped for links
+			// that don't exist.
+			for _, impressions := range []ClickStats{{"a": 4, "b": 2}, {"A": 4, "missing": 1}} {
+				if err := db.SaveImpressions(impressions); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.SaveStats(ClickStats{"a": 2, "b": 3, "c": 5}); err != nil {
+				t.Fatal(err)
+			}
+
+			impressions, err := db.LoadImpressions()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (ClickStats{"a": 8, "b": 2}); !cmp.Equal(impressions, want) {
+				t.Errorf("LoadImpressions() = %v, want %v", impressions, want)
+			}
+
+			// c was never shown, so it has no rate rather than dividing by
+			// zero. b was clicked more often than shown.
+			ctr, err := db.LoadCTR()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := map[string]float64{"a": 0.25, "b": 1.5}; !cmp.Equal(ctr, want) {
+				t.Errorf("LoadCTR() = %v, want %v", ctr, want)
+			}
+
+			if err := db.Delete("b"); err != nil {
+				t.Fatal(err)
+			}
+			ctr, err = db.LoadCTR()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := map[string]float64{"a": 0.25}; !cmp.Equal(ctr, want) {
+				t.Errorf("LoadCTR() after deleting b = %v, want %v", ctr, want)
+			}
+		})
+	}
+}
+
+func TestLoadStaleCandidates(t *testing.T) {
+	type staleStore interface {
+		Database
+		LoadStaleCandidates(n int, w StalenessWeights) ([]*LinkWithScore, error)
+	}
+	stores := map[string]func(t *testing.T) staleStore{
+		"sqlite": func(t *testing.T) staleStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) staleStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			now := time.Now().Truncate(time.Second)
+			twoYears, oneYear, oneDay := now.AddDate(-2, 0, 0), now.AddDate(-1, 0, 0), now.AddDate(0, 0, -1)
+			links := []*Link{
+				{Short: "old", Long: "http://old", Created: twoYears, LastEdit: twoYears},
+				{Short: "busy", Long: "http://busy", Created: twoYears, LastEdit: oneYear},
+				{Short: "new", Long: "http://new", Created: oneDay, LastEdit: oneDay},
+			}
+			for _, link := range links {
+				if err := db.Save(link); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.SaveStats(ClickStats{"busy": 10}); err != nil {
+				t.Fatal(err)
+			}
+
+			shorts := func(scored []*LinkWithScore) []string {
+				var s []string
+				for _, l := range scored {
+					s = append(s, l.Link.Short)
+				}
+				return s
+			}
+
+			// Equal weights: old is unclicked and oldest on every count,
+			// while new is unclicked but recent, and busy is clicked.
+			scored, err := db.LoadStaleCandidates(-1, StalenessWeights{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := shorts(scored), []string{"old", "new", "busy"}; !cmp.Equal(got, want) {
+				t.Errorf("LoadStaleCandidates(-1, {}) = %v, want %v", got, want)
+			}
+			if len(scored) == 3 {
+				if got := scored[0].Score; got != 3 {
+					t.Errorf("old scored %v, want 3", got)
+				}
+				if busy := scored[2]; busy.Clicks != 10 || busy.LastAccessed.IsZero() {
+					t.Errorf("busy has Clicks = %d, LastAccessed = %v; want 10 and non-zero", busy.Clicks, busy.LastAccessed)
+				}
+				if old := scored[0]; old.Clicks != 0 || !old.LastAccessed.IsZero() {
+					t.Errorf("old has Clicks = %d, LastAccessed = %v; want 0 and zero", old.Clicks, old.LastAccessed)
+				}
+			}
+
+			// Weighing only edits ranks busy, edited a year ago, above new,
+			// and n limits the results.
+			scored, err = db.LoadStaleCandidates(2, StalenessWeights{LastEdit: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := shorts(scored), []string{"old", "busy"}; !cmp.Equal(got, want) {
+				t.Errorf("LoadStaleCandidates(2, {LastEdit: 1}) = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestIncrementAndGetClicks(t *testing.T) {
+	type counterStore interface {
+		Database
+		IncrementAndGetClicks(short string, n int) (int, error)
+	}
+	stores := map[string]func(t *testing.T) counterStore{
+		"sqlite": func(t *testing.T) counterStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) counterStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			if err := db.Save(&Link{Short: "a", Long: "http://a/"}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.IncrementAndGetClicks("missing", 1); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("IncrementAndGetClicks(missing) got %v, want fs.ErrNotExist", err)
+			}
+
+			// Increments add to the clicks saved with SaveStats.
+			if err := db.SaveStats(ClickStats{"a": 5}); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := db.IncrementAndGetClicks("a", 2); err != nil || got != 7 {
+				t.Errorf("IncrementAndGetClicks(a, 2) = %d, %v; want 7", got, err)
+			}
+
+			// Concurrent increments each see a distinct total, and none
+			// are lost.
+			const workers = 10
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			seen := make(map[int]bool)
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					total, err := db.IncrementAndGetClicks("a", 1)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					if seen[total] {
+						t.Errorf("total %d returned twice", total)
+					}
+					seen[total] = true
+				}()
+			}
+			wg.Wait()
+
+			stats, err := db.LoadStats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := stats["a"], 7+workers; got != want {
+				t.Errorf("LoadStats()[a] = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestDeleteMany(t *testing.T) {
+	type deleteManyStore interface {
+		Database
+		DeleteMany(shorts []string) (int, error)
+	}
+	stores := map[string]func(t *testing.T) deleteManyStore{
+		"sqlite": func(t *testing.T) deleteManyStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) deleteManyStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			for _, short := range []string{"a", "b", "c"} {
+				if err := db.Save(&Link{Short: short, Long: "http://" + short}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.SaveStats(ClickStats{"a": 1, "c": 2}); err != nil {
+				t.Fatal(err)
+			}
+
+			// Missing links aren't counted, nor are names given twice.
+			deleted, err := db.DeleteMany([]string{"A", "missing", "b", "a"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deleted != 2 {
+				t.Errorf("DeleteMany deleted %d links, want 2", deleted)
+			}
+			for _, short := range []string{"a", "b"} {
+				if _, err := db.Load(short); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("Load(%q) after DeleteMany got %v, want fs.ErrNotExist", short, err)
+				}
+			}
+			if _, err := db.Load("c"); err != nil {
+				t.Errorf("Load(c) after DeleteMany: %v", err)
+			}
+			stats, err := db.LoadStats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (ClickStats{"c": 2}); !cmp.Equal(stats, want) {
+				t.Errorf("LoadStats() after DeleteMany = %v, want %v", stats, want)
+			}
+
+			if deleted, err := db.DeleteMany(nil); err != nil || deleted != 0 {
+				t.Errorf("DeleteMany(nil) = %d, %v; want 0", deleted, err)
+			}
+		})
+	}
+}
+
+func TestCreateRandomShort(t *testing.T) {
+	type randomShortStore interface {
+		Database
+		options() *Options
+		SaveNew(link *Link) error
+		CreateRandomShort(long, owner string, length int) (*Link, error)
+	}
+	stores := map[string]func(t *testing.T) randomShortStore{
+		"sqlite": func(t *testing.T) randomShortStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) randomShortStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+
+			// SaveNew never replaces a link.
+			if err := db.SaveNew(&Link{Short: "a", Long: "http://a/"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.SaveNew(&Link{Short: "A", Long: "http://other/"}); !errors.Is(err, ErrLinkExists) {
+				t.Errorf("SaveNew(A) got %v, want ErrLinkExists", err)
+			}
+			if link, err := db.Load("a"); err != nil || link.Long != "http://a/" {
+				t.Errorf("Load(a) after SaveNew = %v, %v; want http://a/", link, err)
+			}
+
+			db.options().Rand = rand.New(rand.NewSource(1))
+			first, err := db.CreateRandomShort("http://first/", "alice@example.com", 6)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(first.Short) != 6 || strings.Trim(first.Short, randomShortAlphabet) != "" {
+				t.Errorf("CreateRandomShort made %q, want 6 base58 characters", first.Short)
+			}
+			if link, err := db.Load(first.Short); err != nil || link.Long != "http://first/" || link.Owner != "alice@example.com" {
+				t.Errorf("Load(%q) = %+v, %v; want the created link", first.Short, link, err)
+			}
+
+			// With the same seed, the first name tried is taken, so
+			// another is chosen rather than replacing the link.
+			db.options().Rand = rand.New(rand.NewSource(1))
+			second, err := db.CreateRandomShort("http://second/", "", 6)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if linkID(second.Short) == linkID(first.Short) {
+				t.Errorf("CreateRandomShort reused %q", first.Short)
+			}
+			if link, err := db.Load(first.Short); err != nil || link.Long != "http://first/" {
+				t.Errorf("Load(%q) after collision = %v, %v; want http://first/", first.Short, link, err)
+			}
+
+			// Once every name of a length is taken, it gives up.
+			for _, c := range randomShortAlphabet {
+				if err := db.Save(&Link{Short: string(c), Long: "http://taken/"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := db.CreateRandomShort("http://none/", "", 1); !errors.Is(err, ErrNoFreeShort) {
+				t.Errorf("CreateRandomShort(length 1) got %v, want ErrNoFreeShort", err)
+			}
+			if _, err := db.CreateRandomShort("http://none/", "", 0); err == nil {
+				t.Error("CreateRandomShort(length 0) succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestSaveIfVersion(t *testing.T) {
+	type versionedStore interface {
+		Database
+		LoadVersioned(short string) (*Link, string, error)
+		SaveIfVersion(link *Link, version string) error
+		Pin(short string) error
+	}
+	stores := map[string]func(t *testing.T) versionedStore{
+		"sqlite": func(t *testing.T) versionedStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) versionedStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			if err := db.Save(&Link{Short: "a", Long: "http://a/"}); err != nil {
+				t.Fatal(err)
+			}
+
+			link, v1, err := db.LoadVersioned("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			link.Long = "http://a/1"
+			if err := db.SaveIfVersion(link, v1); err != nil {
+				t.Fatalf("SaveIfVersion at current version: %v", err)
+			}
+
+			// The first save changed the version, so a second writer that
+			// loaded the same version conflicts.
+			stale := &Link{Short: "a", Long: "http://a/stale"}
+			if err := db.SaveIfVersion(stale, v1); !errors.Is(err, ErrConflict) {
+				t.Errorf("SaveIfVersion at stale version got %v, want ErrConflict", err)
+			}
+			link, v2, err := db.LoadVersioned("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if link.Long != "http://a/1" || v2 == v1 {
+				t.Errorf("LoadVersioned(a) = %q at version %q, want http://a/1 at a version other than %q", link.Long, v2, v1)
+			}
+
+			// Changes other than saves change the version too.
+			if err := db.Pin("a"); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.SaveIfVersion(link, v2); !errors.Is(err, ErrConflict) {
+				t.Errorf("SaveIfVersion after Pin got %v, want ErrConflict", err)
+			}
+
+			if err := db.SaveIfVersion(&Link{Short: "missing", Long: "http://missing/"}, v1); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("SaveIfVersion(missing) got %v, want fs.ErrNotExist", err)
+			}
+			if _, err := db.Load("missing"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Load(missing) after SaveIfVersion got %v, want fs.ErrNotExist", err)
+			}
+		})
+	}
+}
+
+func TestSetOwners(t *testing.T) {
+	type ownerStore interface {
+		Database
+		options() *Options
+		SetOwners(mapping map[string]string) (int, error)
+	}
+	stores := map[string]func(t *testing.T) ownerStore{
+		"sqlite": func(t *testing.T) ownerStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) ownerStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			created := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+			for _, short := range []string{"a", "b", "c"} {
+				link := &Link{Short: short, Long: "http://" + short + "/", Owner: "old@example.com", Created: created, LastEdit: created}
+				if err := db.Save(link); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			now := created.Add(time.Hour)
+			db.options().Now = func() time.Time { return now }
+			updated, err := db.SetOwners(map[string]string{
+				"a":       "new@example.com",
+				"B":       "other@example.com",
+				"missing": "new@example.com",
+				"gone":    "new@example.com",
+			})
+			if updated != 2 {
+				t.Errorf("SetOwners updated %d links, want 2", updated)
+			}
+			var missing *MissingLinksError
+			if !errors.As(err, &missing) || !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("SetOwners got error %v, want *MissingLinksError", err)
+			}
+			if want := []string{"gone", "missing"}; !cmp.Equal(missing.Shorts, want) {
+				t.Errorf("MissingLinksError.Shorts = %q, want %q", missing.Shorts, want)
+			}
+
+			for short, want := range map[string]string{"a": "new@example.com", "b": "other@example.com", "c": "old@example.com"} {
+				link, err := db.Load(short)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if link.Owner != want {
+					t.Errorf("Load(%q).Owner = %q, want %q", short, link.Owner, want)
+				}
+				wantEdit := now
+				if short == "c" {
+					wantEdit = created
+				}
+				if !link.LastEdit.Equal(wantEdit) {
+					t.Errorf("Load(%q).LastEdit = %v, want %v", short, link.LastEdit, wantEdit)
+				}
+			}
+
+			if updated, err := db.SetOwners(map[string]string{"c": "new@example.com"}); updated != 1 || err != nil {
+				t.Errorf("SetOwners(c) = %d, %v; want 1, nil", updated, err)
+			}
+		})
+	}
+}
+
+func TestCountBySource(t *testing.T) {
+	type sourceStore interface {
+		Database
+		CountBySource() (map[string]int, error)
+	}
+	stores := map[string]func(t *testing.T) sourceStore{
+		"sqlite": func(t *testing.T) sourceStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) sourceStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			for _, link := range []*Link{
+				{Short: "a", Long: "http://a/", Source: "slack"},
+				{Short: "b", Long: "http://b/", Source: "slack"},
+				{Short: "c", Long: "http://c/", Source: "web"},
+				{Short: "d", Long: "http://d/"},
+			} {
+				if err := db.Save(link); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Editing a link with another app keeps the app it was
+			// created with.
+			if err := db.Save(&Link{Short: "a", Long: "http://a/2", Source: "cli"}); err != nil {
+				t.Fatal(err)
+			}
+			link, err := db.Load("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if link.Source != "slack" {
+				t.Errorf("Load(a).Source = %q, want slack", link.Source)
+			}
+
+			counts, err := db.CountBySource()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := map[string]int{"slack": 2, "web": 1, "": 1}; !cmp.Equal(counts, want) {
+				t.Errorf("CountBySource() = %v, want %v", counts, want)
+			}
+		})
+	}
+}
+
+// Test that opening a SQLite database checks and records its schema version.
+func Test_SQLiteDB_SchemaVersion(t *testing.T) {
+	file := path.Join(t.TempDir(), "links.db")
+	setVersion := func(version int) {
+		t.Helper()
+		db, err := NewSQLiteDB(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if _, err := db.db.Exec(fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantVersion := func(db *SQLiteDB) {
+		t.Helper()
+		if version, err := db.SchemaVersion(); err != nil || version != SQLiteSchemaVersion {
+			t.Errorf("SchemaVersion() = %d, %v; want %d", version, err, SQLiteSchemaVersion)
+		}
+	}
+
+	// A new database is at the current version.
+	db, err := NewSQLiteDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantVersion(db)
+	if err := db.Save(&Link{Short: "a", Long: "http://a/"}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// One that is behind is migrated forward, keeping its links.
+	setVersion(0)
+	db, err = NewSQLiteDB(file)
+	if err != nil {
+		t.Fatalf("NewSQLiteDB of database behind the current version: %v", err)
+	}
+	wantVersion(db)
+	if _, err := db.Load("a"); err != nil {
+		t.Errorf("Load(a) after migrating: %v", err)
+	}
+	db.Close()
+
+	// One that is newer is refused, and left unchanged.
+	setVersion(SQLiteSchemaVersion + 1)
+	_, err = NewSQLiteDB(file)
+	var tooNew *SchemaTooNewError
+	if !errors.As(err, &tooNew) || !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("NewSQLiteDB of newer database got %v, want *SchemaTooNewError", err)
+	}
+	if tooNew.Version != SQLiteSchemaVersion+1 || tooNew.Supported != SQLiteSchemaVersion {
+		t.Errorf("SchemaTooNewError = %+v, want version %d, supported %d", tooNew, SQLiteSchemaVersion+1, SQLiteSchemaVersion)
+	}
+	conn, err := sql.Open("sqlite", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := NewSQLiteDBFromConn(conn); !errors.Is(err, ErrSchemaTooNew) {
+		t.Errorf("NewSQLiteDBFromConn of newer database got %v, want ErrSchemaTooNew", err)
+	}
+	if version, err := schemaVersion(conn); err != nil || version != SQLiteSchemaVersion+1 {
+		t.Errorf("schema version after refusing to open = %d, %v; want %d", version, err, SQLiteSchemaVersion+1)
+	}
+}
+
+func TestCreationRateLimit(t *testing.T) {
+	type limitedStore interface {
+		Database
+		options() *Options
+		SaveMany(links []*Link) (BatchResult, error)
+	}
+	stores := map[string]func(t *testing.T) limitedStore{
+		"sqlite": func(t *testing.T) limitedStore {
+			db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return db
+		},
+		"convex": func(t *testing.T) limitedStore {
+			return NewConvexDB(newFakeConvex(t).URL, "test")
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			db := newStore(t)
+			now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+			limiter := NewOwnerRateLimiter(2, time.Hour)
+			limiter.Now = func() time.Time { return now }
+			db.options().CreationLimiter = limiter
+
+			save := func(short, owner string) error {
+				return db.Save(&Link{Short: short, Long: "http://" + short + "/", Owner: owner})
+			}
+			for _, short := range []string{"a", "b"} {
+				if err := save(short, "alice@example.com"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := save("c", "alice@example.com")
+			var limited *CreationRateLimitedError
+			if !errors.As(err, &limited) || !errors.Is(err, ErrCreationRateLimited) {
+				t.Fatalf("third Save got %v, want *CreationRateLimitedError", err)
+			}
+			if limited.Owner != "alice@example.com" || limited.RetryAfter != 30*time.Minute {
+				t.Errorf("CreationRateLimitedError = %+v, want alice@example.com retrying after 30m", limited)
+			}
+			if _, err := db.Load("c"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Load(c) after limited Save got %v, want fs.ErrNotExist", err)
+			}
+
+			// Updates, other owners and links without an owner aren't
+			// limited.
+			if err := save("a", "alice@example.com"); err != nil {
+				t.Errorf("updating a: %v", err)
+			}
+			if err := save("d", "bob@example.com"); err != nil {
+				t.Errorf("saving d for another owner: %v", err)
+			}
+			if err := save("e", ""); err != nil {
+				t.Errorf("saving e without an owner: %v", err)
+			}
+
+			now = now.Add(30 * time.Minute)
+			if err := save("c", "alice@example.com"); err != nil {
+				t.Errorf("Save(c) once the limit refilled: %v", err)
+			}
+
+			// A batch refused for going over the limit saves nothing, and
+			// doesn't count against the owner.
+			var batch []*Link
+			for _, short := range []string{"f", "g", "h"} {
+				batch = append(batch, &Link{Short: short, Long: "http://" + short + "/", Owner: "carol@example.com"})
+			}
+			if _, err := db.SaveMany(batch); !errors.Is(err, ErrCreationRateLimited) {
+				t.Fatalf("SaveMany over the limit got %v, want ErrCreationRateLimited", err)
+			}
+			if _, err := db.Load("f"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Load(f) after refused SaveMany got %v, want fs.ErrNotExist", err)
+			}
+			if _, err := db.SaveMany(batch[:2]); err != nil {
+				t.Errorf("SaveMany within the limit after a refused batch: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"reflect"
+	"sort"
+)
+
+// DiffOptions configures Diff.
+type DiffOptions struct {
+	// CompareTimes also reports links whose Created or LastEdit times
+	// differ. Stores may keep times at different precisions, so they are
+	// ignored by default.
+	CompareTimes bool
+}
+
+// StoreDiff describes the differences between the links in two stores, as
+// returned by Diff. Each list is ordered by normalized name.
+type StoreDiff struct {
+	OnlyInA []*Link    // links in store a but not b
+	OnlyInB []*Link    // links in store b but not a
+	Changed []LinkDiff // links in both stores that differ
+}
+
+// Empty reports whether the stores hold the same links.
+func (d *StoreDiff) Empty() bool {
+	return len(d.OnlyInA) == 0 && len(d.OnlyInB) == 0 && len(d.Changed) == 0
+}
+
+// LinkDiff describes a link that differs between two stores.
+type LinkDiff struct {
+	Name   string   // name of the link, as returned by Link.Name
+	A, B   *Link    // the link in each store
+	Fields []string // names of the Link fields that differ
+}
+
+// Diff compares the links in stores a and b, such as to check that a
+// migration from one to the other is complete. Links are matched by
+// normalized name and compared by every stored field except CreatedFrom,
+// which isn't loaded, EditCount and UseCount, which are counted by each
+// store, and, unless opts.CompareTimes is set, Created and LastEdit.
+func Diff(a, b Database, opts DiffOptions) (*StoreDiff, error) {
+	linksA, err := a.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+	linksB, err := b.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*Link, len(linksB))
+	for _, link := range linksB {
+		byID[linkID(link.Name())] = link
+	}
+
+	d := new(StoreDiff)
+	for _, la := range linksA {
+		id := linkID(la.Name())
+		lb, ok := byID[id]
+		if !ok {
+			d.OnlyInA = append(d.OnlyInA, la)
+			continue
+		}
+		delete(byID, id)
+		if fields := diffLink(la, lb, opts); len(fields) > 0 {
+			d.Changed = append(d.Changed, LinkDiff{Name: la.Name(), A: la, B: lb, Fields: fields})
+		}
+	}
+	for _, lb := range byID {
+		d.OnlyInB = append(d.OnlyInB, lb)
+	}
+
+	sortLinks(d.OnlyInA)
+	sortLinks(d.OnlyInB)
+	sort.Slice(d.Changed, func(i, j int) bool {
+		return linkID(d.Changed[i].Name) < linkID(d.Changed[j].Name)
+	})
+	return d, nil
+}
+
+// diffLink returns the names of the fields that differ between a and b.
+func diffLink(a, b *Link, opts DiffOptions) []string {
+	var fields []string
+	check := func(name string, equal bool) {
+		if !equal {
+			fields = append(fields, name)
+		}
+	}
+	check("Short", a.Short == b.Short)
+	check("Long", a.Long == b.Long)
+	if opts.CompareTimes {
+		check("Created", a.Created.Equal(b.Created))
+		check("LastEdit", a.LastEdit.Equal(b.LastEdit))
+	}
+	check("Owner", a.Owner == b.Owner)
+	check("Destinations", len(a.Destinations) == 0 && len(b.Destinations) == 0 || reflect.DeepEqual(a.Destinations, b.Destinations))
+	check("RedirectCode", a.RedirectCode == b.RedirectCode)
+	check("AllowedOwners", len(a.AllowedOwners) == 0 && len(b.AllowedOwners) == 0 || reflect.DeepEqual(a.AllowedOwners, b.AllowedOwners))
+	check("ExpiresAt", a.ExpiresAt.Equal(b.ExpiresAt))
+	check("IconURL", a.IconURL == b.IconURL)
+	check("Pinned", a.Pinned == b.Pinned)
+	check("MaxUses", a.MaxUses == b.MaxUses)
+	check("Source", a.Source == b.Source)
+	check("Headers", len(a.Headers) == 0 && len(b.Headers) == 0 || reflect.DeepEqual(a.Headers, b.Headers))
+	return fields
+}
+
+// sortLinks sorts links by normalized name.
+func sortLinks(links []*Link) {
+	sort.Slice(links, func(i, j int) bool {
+		return linkID(links[i].Name()) < linkID(links[j].Name())
+	})
+}
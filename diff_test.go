@@ -0,0 +1,87 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiff(t *testing.T) {
+	a, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewConvexDB(newFakeConvex(t).URL, "test")
+
+	created := time.Date(2022, 6, 2, 0, 0, 0, 0, time.UTC)
+	for _, link := range []*Link{
+		{Short: "same", Long: "http://same/", Owner: "foo@example.com"},
+		{Short: "onlya", Long: "http://a/"},
+		{Short: "long", Long: "http://old/"},
+		{Short: "time", Long: "http://time/", Created: created},
+	} {
+		if err := a.Save(link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, link := range []*Link{
+		{Short: "Same", Long: "http://same/", Owner: "foo@example.com"},
+		{Short: "onlyb", Long: "http://b/"},
+		{Short: "long", Long: "http://new/", Owner: "bar@example.com"},
+		{Short: "time", Long: "http://time/", Created: created.Add(time.Hour)},
+	} {
+		if err := b.Save(link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := func(d *StoreDiff) (onlyA, onlyB []string, changed map[string][]string) {
+		for _, link := range d.OnlyInA {
+			onlyA = append(onlyA, link.Name())
+		}
+		for _, link := range d.OnlyInB {
+			onlyB = append(onlyB, link.Name())
+		}
+		changed = make(map[string][]string)
+		for _, c := range d.Changed {
+			changed[c.Name] = c.Fields
+		}
+		return onlyA, onlyB, changed
+	}
+
+	d, err := Diff(a, b, DiffOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	onlyA, onlyB, changed := names(d)
+	if want := []string{"onlya"}; !cmp.Equal(onlyA, want) {
+		t.Errorf("OnlyInA = %v, want %v", onlyA, want)
+	}
+	if want := []string{"onlyb"}; !cmp.Equal(onlyB, want) {
+		t.Errorf("OnlyInB = %v, want %v", onlyB, want)
+	}
+	want := map[string][]string{
+		"long": {"Long", "Owner"},
+		"same": {"Short"},
+	}
+	if diff := cmp.Diff(want, changed); diff != "" {
+		t.Errorf("Changed mismatch (-want +got):\n%s", diff)
+	}
+
+	d, err = Diff(a, b, DiffOptions{CompareTimes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, changed := names(d); !cmp.Equal(changed["time"], []string{"Created", "LastEdit"}) {
+		t.Errorf("Changed[time] with CompareTimes = %v, want Created and LastEdit", changed["time"])
+	}
+
+	if d, err := Diff(a, a, DiffOptions{CompareTimes: true}); err != nil || !d.Empty() {
+		t.Errorf("Diff of a store with itself got %+v, %v; want empty", d, err)
+	}
+}
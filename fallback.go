@@ -0,0 +1,44 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"errors"
+	"io/fs"
+)
+
+// FallbackStore is a Database that serves a fallback link for short names
+// that don't exist, such as one pointing at a page for creating the link or
+// at a search for the name, so that every caller of Load gets the same
+// handling of unknown links.
+//
+// Fallback links are never stored. Because Load never reports a missing
+// link while Fallback accepts its name, code that needs to know whether a
+// link exists, such as before creating it, should use the wrapped Database.
+type FallbackStore struct {
+	Database
+
+	// Fallback returns the link to serve for short when it doesn't exist,
+	// or false to report fs.ErrNotExist as usual.
+	Fallback func(short string) (*Link, bool)
+}
+
+// NewFallbackStore returns a FallbackStore that serves links from db, and
+// the links returned by fallback for names that db doesn't have.
+func NewFallbackStore(db Database, fallback func(short string) (*Link, bool)) *FallbackStore {
+	return &FallbackStore{Database: db, Fallback: fallback}
+}
+
+// Load returns a Link by its short name, or the fallback link for short if
+// it does not exist.
+func (s *FallbackStore) Load(short string) (*Link, error) {
+	link, err := s.Database.Load(short)
+	if !errors.Is(err, fs.ErrNotExist) || s.Fallback == nil {
+		return link, err
+	}
+	if fallback, ok := s.Fallback(short); ok {
+		return fallback, nil
+	}
+	return nil, err
+}
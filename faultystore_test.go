@@ -0,0 +1,276 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fault describes how a faultyStore operation misbehaves.
+type fault struct {
+	Err   error         // error to return
+	Delay time.Duration // delay before every call, failing or not
+
+	// OnCall, if non-zero, fails only the OnCall'th call (starting at 1).
+	// Every, if non-zero, fails every Every'th call.
+	// If both are zero, every call fails.
+	OnCall int
+	Every  int
+}
+
+// faultyStore is a Database that delegates to another Database, but can be
+// told to fail or delay specific operations. It is safe for concurrent use.
+type faultyStore struct {
+	db Database
+
+	mu     sync.Mutex
+	faults map[string]fault // keyed by method name
+	calls  map[string]int   // keyed by method name
+}
+
+func newFaultyStore(db Database) *faultyStore {
+	return &faultyStore{
+		db:     db,
+		faults: make(map[string]fault),
+		calls:  make(map[string]int),
+	}
+}
+
+// setFault configures the named method, such as "Load", to misbehave as
+// described by f, and resets its call count.
+func (s *faultyStore) setFault(method string, f fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[method] = f
+	s.calls[method] = 0
+}
+
+// clearFault stops the named method from misbehaving.
+func (s *faultyStore) clearFault(method string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.faults, method)
+}
+
+// inject records a call to method, sleeps for any configured delay, and
+// returns the error the call should fail with, if any.
+func (s *faultyStore) inject(method string) error {
+	s.mu.Lock()
+	s.calls[method]++
+	n := s.calls[method]
+	f, ok := s.faults[method]
+	s.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	time.Sleep(f.Delay)
+	switch {
+	case f.OnCall != 0:
+		if n != f.OnCall {
+			return nil
+		}
+	case f.Every != 0:
+		if n%f.Every != 0 {
+			return nil
+		}
+	}
+	return f.Err
+}
+
+func (s *faultyStore) LoadAll() ([]*Link, error) {
+	if err := s.inject("LoadAll"); err != nil {
+		return nil, err
+	}
+	return s.db.LoadAll()
+}
+
+func (s *faultyStore) Load(short string) (*Link, error) {
+	if err := s.inject("Load"); err != nil {
+		return nil, err
+	}
+	return s.db.Load(short)
+}
+
+func (s *faultyStore) Save(link *Link) error {
+	if err := s.inject("Save"); err != nil {
+		return err
+	}
+	return s.db.Save(link)
+}
+
+func (s *faultyStore) Delete(short string) error {
+	if err := s.inject("Delete"); err != nil {
+		return err
+	}
+	return s.db.Delete(short)
+}
+
+func (s *faultyStore) LoadStats() (ClickStats, error) {
+	if err := s.inject("LoadStats"); err != nil {
+		return nil, err
+	}
+	return s.db.LoadStats()
+}
+
+func (s *faultyStore) SaveStats(stats ClickStats) error {
+	if err := s.inject("SaveStats"); err != nil {
+		return err
+	}
+	return s.db.SaveStats(stats)
+}
+
+func (s *faultyStore) LastStatsFlush() (time.Time, error) {
+	if err := s.inject("LastStatsFlush"); err != nil {
+		return time.Time{}, err
+	}
+	return s.db.LastStatsFlush()
+}
+
+func TestFaultyStore(t *testing.T) {
+	sqlite, err := NewSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newFaultyStore(sqlite)
+	errBoom := errors.New("boom")
+
+	s.setFault("Save", fault{Err: errBoom, OnCall: 2})
+	for i, want := range []error{nil, errBoom, nil} {
+		if err := s.Save(&Link{Short: "a"}); err != want {
+			t.Errorf("Save call %d got %v, want %v", i+1, err, want)
+		}
+	}
+
+	s.setFault("Load", fault{Err: errBoom, Every: 2})
+	for i, want := range []error{nil, errBoom, nil, errBoom} {
+		if _, err := s.Load("a"); err != want {
+			t.Errorf("Load call %d got %v, want %v", i+1, err, want)
+		}
+	}
+	s.clearFault("Load")
+	if _, err := s.Load("a"); err != nil {
+		t.Errorf("Load after clearFault got %v, want nil", err)
+	}
+}
+
+// Test how serveGo handles errors loading links.
+func TestServeGoErrors(t *testing.T) {
+	sqlite, err := NewSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newFaultyStore(sqlite)
+	db = s
+	s.Save(&Link{Short: "a", Long: "http://example.com/"})
+
+	tests := []struct {
+		name     string
+		err      error
+		wantCode int
+	}{
+		{name: "ok", wantCode: http.StatusFound},
+		{name: "not-exist", err: fs.ErrNotExist, wantCode: http.StatusOK}, // home page
+		{name: "timeout", err: errors.New("convex: timeout"), wantCode: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.err != nil {
+				s.setFault("Load", fault{Err: tt.err})
+			} else {
+				s.clearFault("Load")
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/a", nil)
+			r.Header.Set("X-Forwarded-User", "foo@example.com")
+			serveGo(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("serveGo got status %d, want %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+// Test that clicks are kept for the next flush if saving stats fails.
+func TestFlushStatsError(t *testing.T) {
+	sqlite, err := NewSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newFaultyStore(sqlite)
+	db = s
+	s.Save(&Link{Short: "a"})
+	stats.mu.Lock()
+	stats.dirty = ClickStats{"a": 1}
+	stats.mu.Unlock()
+
+	s.setFault("SaveStats", fault{Err: errors.New("boom"), OnCall: 1})
+	if err := flushStats(); err == nil {
+		t.Fatal("flushStats succeeded, want error")
+	}
+	if err := flushStats(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.LoadStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["a"] != 1 {
+		t.Errorf("LoadStats()[%q] = %d, want 1", "a", got["a"])
+	}
+}
+
+// Test that reaching --stats-flush-max clicks signals an early flush, and
+// that the unsaved count survives a failed flush.
+func TestStatsFlushMax(t *testing.T) {
+	sqlite, err := NewSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newFaultyStore(sqlite)
+	db = s
+	s.Save(&Link{Short: "a"})
+	if err := initStats(); err != nil {
+		t.Fatal(err)
+	}
+	defer func(max int) { *statsFlushMax = max }(*statsFlushMax)
+	*statsFlushMax = 2
+	select {
+	case <-statsFlushNow:
+	default:
+	}
+
+	recordClick("a")
+	select {
+	case <-statsFlushNow:
+		t.Fatal("flush signaled after 1 click, want 2")
+	default:
+	}
+	recordClick("a")
+	select {
+	case <-statsFlushNow:
+	default:
+		t.Fatal("flush not signaled after 2 clicks")
+	}
+
+	s.setFault("SaveStats", fault{Err: errors.New("boom"), OnCall: 1})
+	if err := flushStats(); err == nil {
+		t.Fatal("flushStats succeeded, want error")
+	}
+	if got := UnsavedClicks(); got != 2 {
+		t.Errorf("UnsavedClicks after failed flush = %d, want 2", got)
+	}
+	if err := flushStats(); err != nil {
+		t.Fatal(err)
+	}
+	if got := UnsavedClicks(); got != 0 {
+		t.Errorf("UnsavedClicks after flush = %d, want 0", got)
+	}
+}
@@ -17,6 +17,8 @@ import (
 	"io/fs"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
@@ -25,6 +27,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -44,13 +47,18 @@ var (
 	verbose           = flag.Bool("verbose", false, "be verbose")
 	controlURL        = flag.String("control-url", ipn.DefaultControlURL, "the URL base of the control plane (i.e. coordination server)")
 	sqlitefile        = flag.String("sqlitedb", "", "path of SQLite database to store links")
+	sqliteRetries     = flag.Int("sqlitedb-open-retries", 0, "number of times to retry opening the SQLite database, for volumes that may mount late")
+	sqliteRetryDelay  = flag.Duration("sqlitedb-open-retry-delay", time.Second, "delay before the first retry of opening the SQLite database, doubling after each")
 	convexHost        = flag.String("convex-host", "", "URL of the Convex backend to use for storage")
 	convexToken       = flag.String("convex-token", "", "Authorization token to pass to the Convex backend")
+	convexValidate    = flag.Bool("convex-validate", false, "check the Convex backend configuration on startup and exit if it is invalid")
 	publicPort        = flag.Int("public-port", 0, "Public port to listen on, if desired.")
 	dev               = flag.String("dev-listen", "", "if non-empty, listen on this addr and run in dev mode; auto-set sqlitedb if empty and don't use tsnet")
 	snapshot          = flag.String("snapshot", "", "file path of snapshot file")
 	hostname          = flag.String("hostname", defaultHostname, "service name")
 	resolveFromBackup = flag.String("resolve-from-backup", "", "resolve a link from snapshot file and exit")
+	statsFlushEvery   = flag.Duration("stats-flush-interval", time.Minute, "how often to save click stats")
+	statsFlushMax     = flag.Int("stats-flush-max", 0, "if positive, save click stats as soon as this many clicks are unsaved, without waiting for --stats-flush-interval")
 )
 
 var stats struct {
@@ -59,8 +67,26 @@ var stats struct {
 
 	// dirty identifies short link clicks that have not yet been stored.
 	dirty ClickStats
+
+	// unsaved is the total of the clicks in dirty.
+	unsaved int
+
+	// impressions identifies the number of times short links were shown,
+	// such as on the home page, that have not yet been stored. They are
+	// saved along with dirty, if db supports it.
+	impressions ClickStats
+}
+
+// impressionStore is implemented by databases that store impressions for
+// click-through rates.
+type impressionStore interface {
+	SaveImpressions(impressions ClickStats) error
 }
 
+// statsFlushNow is signaled when --stats-flush-max clicks are unsaved, to
+// have flushStatsLoop flush them without waiting for its timer.
+var statsFlushNow = make(chan struct{}, 1)
+
 // LastSnapshot is the data snapshot (as returned by the /.export handler)
 // that will be loaded on startup.
 var LastSnapshot []byte
@@ -101,17 +127,26 @@ func Run() error {
 		}
 	}
 
+	config := StoreConfig{
+		Backend:         "sqlite",
+		SQLitePath:      *sqlitefile,
+		SQLiteOpenRetry: OpenRetry{Retries: *sqliteRetries, Delay: *sqliteRetryDelay},
+	}
 	if *convexHost != "" {
-		if *convexToken == "" {
-			log.Fatal("A authorization token must be provided when using Convex.")
-		}
-		db = NewConvexDB(*convexHost, *convexToken)
+		config = StoreConfig{Backend: "convex", ConvexURL: *convexHost, ConvexToken: *convexToken}
 	}
-
 	if db == nil {
 		var err error
-		if db, err = NewSQLiteDB(*sqlitefile); err != nil {
-			return fmt.Errorf("NewSQLiteDB(%q): %w", *sqlitefile, err)
+		if db, err = OpenStore(config); err != nil {
+			return err
+		}
+	}
+	if c, ok := db.(*ConvexDB); ok && *convexValidate {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := c.Validate(ctx)
+		cancel()
+		if err != nil {
+			return err
 		}
 	}
 
@@ -279,36 +314,105 @@ func initStats() error {
 
 	stats.clicks = clicks
 	stats.dirty = make(ClickStats)
+	stats.unsaved = 0
 
 	return nil
 }
 
-// flushStats writes any pending link stats to db.
+// flushStats writes any pending link stats to db. Clicks and impressions
+// are written independently, and those that fail are kept to be written by
+// the next flush.
 func flushStats() error {
 	stats.mu.Lock()
 	defer stats.mu.Unlock()
 
-	if len(stats.dirty) == 0 {
-		return nil
+	var clicksErr, impressionsErr error
+	if len(stats.dirty) > 0 {
+		if clicksErr = db.SaveStats(stats.dirty); clicksErr == nil {
+			stats.dirty = make(ClickStats)
+			stats.unsaved = 0
+		}
 	}
 
-	if err := db.SaveStats(stats.dirty); err != nil {
-		return err
+	if len(stats.impressions) > 0 {
+		if is, ok := db.(impressionStore); ok {
+			impressionsErr = is.SaveImpressions(stats.impressions)
+		}
+		if impressionsErr == nil {
+			stats.impressions = nil
+		}
 	}
-	stats.dirty = make(ClickStats)
-	return nil
+	return errors.Join(clicksErr, impressionsErr)
 }
 
-// flushStatsLoop will flush stats every minute.  This function never returns.
+// flushStatsLoop will flush stats every --stats-flush-interval, or sooner
+// once --stats-flush-max clicks are unsaved.  This function never returns.
 func flushStatsLoop() {
+	ticker := time.NewTicker(*statsFlushEvery)
+	defer ticker.Stop()
 	for {
 		if err := flushStats(); err != nil {
 			log.Printf("flushing stats: %v", err)
 		}
-		time.Sleep(time.Minute)
+		select {
+		case <-ticker.C:
+		case <-statsFlushNow:
+		}
 	}
 }
 
+// recordClick counts a click of the link short, and signals flushStatsLoop
+// if that brings the unsaved clicks to --stats-flush-max.
+func recordClick(short string) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	if stats.clicks == nil {
+		stats.clicks = make(ClickStats)
+	}
+	stats.clicks[short]++
+	if stats.dirty == nil {
+		stats.dirty = make(ClickStats)
+	}
+	stats.dirty[short]++
+	stats.unsaved++
+
+	if *statsFlushMax > 0 && stats.unsaved >= *statsFlushMax {
+		select {
+		case statsFlushNow <- struct{}{}:
+		default:
+			// A flush is already pending.
+		}
+	}
+}
+
+// RecordImpression counts n impressions of the link short: times it was
+// shown to a user, who could then click it. Like clicks, they are kept in
+// memory and saved by the next flush, rather than written on every view.
+// Impressions divided into clicks give the click-through rates reported by
+// the database's LoadCTR.
+func RecordImpression(short string, n int) {
+	if n <= 0 {
+		return
+	}
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	if stats.impressions == nil {
+		stats.impressions = make(ClickStats)
+	}
+	stats.impressions[short] += n
+}
+
+// UnsavedClicks returns the number of clicks counted but not yet saved to
+// the database, for monitoring how many would be lost if the server
+// stopped now.
+func UnsavedClicks() int {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	return stats.unsaved
+}
+
 func serveHome(w http.ResponseWriter, short string) {
 	var clicks []visitData
 
@@ -331,6 +435,10 @@ func serveHome(w http.ResponseWriter, short string) {
 		clicks = clicks[:200]
 	}
 
+	for _, c := range clicks {
+		RecordImpression(c.Short, 1)
+	}
+
 	homeTmpl.Execute(w, homeData{
 		Short:  short,
 		Clicks: clicks,
@@ -387,7 +495,19 @@ func serveGo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	link, err := db.Load(short)
+	// go/eng/foo is the link foo in namespace eng, if there is one.
+	// Otherwise it is the link eng, with the path foo.
+	var link *Link
+	var err error
+	if nsShort, rest, _ := strings.Cut(remainder, "/"); nsShort != "" {
+		link, err = loadLink(r.Context(), short+"/"+nsShort)
+		if err == nil {
+			remainder = rest
+		}
+	}
+	if link == nil && (err == nil || errors.Is(err, fs.ErrNotExist)) {
+		link, err = loadLink(r.Context(), short)
+	}
 	if errors.Is(err, fs.ErrNotExist) {
 		serveHome(w, short)
 		return
@@ -397,27 +517,84 @@ func serveGo(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	stats.mu.Lock()
-	if stats.clicks == nil {
-		stats.clicks = make(ClickStats)
+	// Expired links are kept by the store but no longer followed.
+	if link.Expired(time.Now()) {
+		serveHome(w, short)
+		return
 	}
-	stats.clicks[link.Short]++
-	if stats.dirty == nil {
-		stats.dirty = make(ClickStats)
+	currentUser, _ := currentUser(r)
+	if !CanAccess(link, currentUser) {
+		http.Error(w, "link not allowed for this user", http.StatusForbidden)
+		return
 	}
-	stats.dirty[link.Short]++
-	stats.mu.Unlock()
 
-	currentUser, _ := currentUser(r)
+	// Links with MaxUses are followed through ConsumeUse, so that they
+	// stop resolving once they are used up.
+	if c, ok := db.(interface {
+		ConsumeUse(string) (*Link, error)
+	}); ok && link.MaxUses > 0 {
+		link, err = c.ConsumeUse(link.Name())
+		if errors.Is(err, ErrLinkExhausted) || errors.Is(err, fs.ErrNotExist) {
+			serveHome(w, short)
+			return
+		}
+		if err != nil {
+			log.Printf("serving %q: %v", short, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	recordClick(link.Name())
 
-	target, err := expandLink(link.Long, expandEnv{Now: time.Now().UTC(), Path: remainder, User: currentUser})
+	target, err := expandTarget(link, remainder, currentUser, nil)
 	if err != nil {
-		log.Printf("expanding %q: %v", link.Long, err)
+		log.Printf("expanding %q: %v", link.Name(), err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(w, r, target, http.StatusFound)
+	code := http.StatusFound
+	if link.RedirectCode != 0 {
+		code = link.RedirectCode
+	}
+	for name, value := range link.Headers {
+		w.Header().Set(name, value)
+	}
+	http.Redirect(w, r, target, code)
+}
+
+// loadLink loads the link for short from db, passing ctx along to backends
+// that support it, such as ConvexDB.
+func loadLink(ctx context.Context, short string) (*Link, error) {
+	if db, ok := db.(interface {
+		LoadContext(context.Context, string) (*Link, error)
+	}); ok {
+		return db.LoadContext(ctx, short)
+	}
+	return db.Load(short)
+}
+
+// resolveDestination returns the target of link, picking weighted
+// destinations with db's source of randomness if it has one.
+func resolveDestination(link *Link) string {
+	if o, ok := db.(interface{ options() *Options }); ok {
+		return o.options().resolveDestination(link)
+	}
+	return ResolveDestination(link, nil)
+}
+
+// expandTarget returns the URL that a request by user for link redirects to.
+// remainder is the rest of the request URI after the link's name,
+// including any query, as sent. Weighted destinations are picked with r,
+// or with db's source of randomness if r is nil.
+func expandTarget(link *Link, remainder, user string, r *rand.Rand) (string, error) {
+	var long string
+	if r != nil {
+		long = ResolveDestination(link, r)
+	} else {
+		long = resolveDestination(link)
+	}
+	return expandLink(long, expandEnv{Now: time.Now().UTC(), Path: remainder, User: user})
 }
 
 // acceptHTML returns whether the request can accept a text/html response.
@@ -516,6 +693,26 @@ func expandLink(long string, env expandEnv) (string, error) {
 	return long, nil
 }
 
+// previewSeed seeds the source Preview picks weighted destinations with.
+const previewSeed = 1
+
+// Preview returns the URL that a request for link would be redirected to,
+// without saving the link or counting a click, so that a link can be
+// checked before it is saved. path is the remainder of the request path
+// after the link's name, and query is the request's query, if any.
+//
+// Preview resolves link the same way as serving it does, except that a
+// weighted destination is picked using a source with a fixed seed, so that
+// previews are reproducible, and that there is no current user, so
+// {{.User}} expands to the empty string.
+func Preview(link *Link, path string, query url.Values) (string, error) {
+	remainder := path
+	if len(query) > 0 {
+		remainder += "?" + query.Encode()
+	}
+	return expandTarget(link, remainder, "", rand.New(rand.NewSource(previewSeed)))
+}
+
 func devMode() bool { return *dev != "" }
 
 func currentUser(r *http.Request) (string, error) {
@@ -538,7 +735,8 @@ func currentUser(r *http.Request) (string, error) {
 
 }
 
-var reShortName = regexp.MustCompile(`^\w[\w\-\.]*$`)
+// reShortName matches a short name, optionally qualified by a namespace.
+var reShortName = regexp.MustCompile(`^(\w[\w\-\.]*/)?\w[\w\-\.]*$`)
 
 // serveSave handles requests to save or update a Link.  Both short name and
 // long URL are validated for proper format. Existing links may only be updated
@@ -550,7 +748,7 @@ func serveSave(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if !reShortName.MatchString(short) {
-		http.Error(w, "short may only contain letters, numbers, dash, and period", http.StatusBadRequest)
+		http.Error(w, "short may only contain letters, numbers, dash, and period, optionally after a namespace and slash", http.StatusBadRequest)
 		return
 	}
 	if _, err := texttemplate.New("").Funcs(expandFuncMap).Parse(long); err != nil {
@@ -589,11 +787,25 @@ func serveSave(w http.ResponseWriter, r *http.Request) {
 			Created: now,
 		}
 	}
-	link.Short = short
+	// short may be an alias, in which case the edit applies to the
+	// canonical link and its short name is left alone.
+	if linkID(link.Name()) == linkID(short) {
+		link.Namespace, link.Short = splitName(short)
+	}
 	link.Long = long
 	link.LastEdit = now
 	link.Owner = owner
 	if err := db.Save(link); err != nil {
+		var limited *CreationRateLimitedError
+		if errors.As(err, &limited) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limited.RetryAfter.Seconds()))))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if errors.Is(err, ErrReservedShort) || errors.Is(err, ErrEmptyShort) || errors.Is(err, ErrInvalidShort) || errors.Is(err, ErrLongTooLong) || errors.Is(err, ErrQuotaExceeded) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -642,7 +854,7 @@ func restoreLastSnapshot() error {
 		if link.Short == "" {
 			continue
 		}
-		_, err := db.Load(link.Short)
+		_, err := db.Load(link.Name())
 		if err == nil {
 			continue // exists
 		}
@@ -673,5 +885,5 @@ func resolveLink(link string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return expandLink(l.Long, expandEnv{Now: time.Now().UTC(), Path: remainder})
+	return expandTarget(l, remainder, "", nil)
 }
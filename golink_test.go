@@ -4,6 +4,9 @@
 package golink
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 )
@@ -151,3 +154,99 @@ func TestResolveLink(t *testing.T) {
 		})
 	}
 }
+
+func TestPreview(t *testing.T) {
+	tests := []struct {
+		name  string
+		link  *Link
+		path  string
+		query url.Values
+		want  string
+	}{
+		{
+			name: "plain",
+			link: &Link{Long: "http://example.com/foo"},
+			path: "bar",
+			want: "http://example.com/foo/bar",
+		},
+		{
+			name:  "query",
+			link:  &Link{Long: "http://example.com/search/"},
+			query: url.Values{"q": {"foo"}},
+			want:  "http://example.com/search/?q=foo",
+		},
+		{
+			name: "no user",
+			link: &Link{Long: "http://example.com/{{.User}}"},
+			want: "http://example.com/",
+		},
+		{
+			name: "template",
+			link: &Link{Long: "http://example.com/{{with .Path}}x/{{PathEscape .}}{{end}}"},
+			path: "a b",
+			want: "http://example.com/x/a%20b",
+		},
+		{
+			name: "single destination",
+			link: &Link{Long: "http://unused/", Destinations: []WeightedDest{{URL: "http://a/", Weight: 1}, {URL: "http://b/", Weight: 0}}},
+			want: "http://a/",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Preview(tt.link, tt.path, tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Preview = %q; want %q", got, tt.want)
+			}
+		})
+	}
+
+	// previews of weighted links are reproducible
+	link := &Link{Destinations: []WeightedDest{{URL: "http://a/", Weight: 1}, {URL: "http://b/", Weight: 1}}}
+	first, err := Preview(link, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if got, _ := Preview(link, "", nil); got != first {
+			t.Fatalf("Preview got %q, then %q", first, got)
+		}
+	}
+}
+
+func TestServeGoAccess(t *testing.T) {
+	var err error
+	db, err = NewSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Save(&Link{Short: "secret", Long: "http://secret/", Owner: "a@example.com", AllowedOwners: []string{"b@example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user     string
+		wantCode int
+	}{
+		{"a@example.com", http.StatusFound},
+		{"b@example.com", http.StatusFound},
+		{"c@example.com", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/secret", nil)
+			r.Header.Set("X-Forwarded-User", tt.user)
+			w := httptest.NewRecorder()
+			serveGo(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("serveGo for %q got status %d, want %d", tt.user, w.Code, tt.wantCode)
+			}
+			if loc := w.Header().Get("Location"); tt.wantCode == http.StatusForbidden && loc != "" {
+				t.Errorf("serveGo for %q redirected to %q", tt.user, loc)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// ImportMode controls how Import handles a dump containing invalid records.
+type ImportMode int
+
+const (
+	// ImportAllOrNothing imports no records if any record is invalid.
+	ImportAllOrNothing ImportMode = iota
+
+	// ImportValidOnly imports the valid records and reports the invalid ones.
+	ImportValidOnly
+)
+
+// ImportError describes a record that could not be imported.
+type ImportError struct {
+	Line  int    // 1-based line number of the record in the dump
+	Short string // short name of the record, if it could be decoded
+	Err   error
+}
+
+func (e *ImportError) Error() string {
+	if e.Short == "" {
+		return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d (%q): %v", e.Line, e.Short, e.Err)
+}
+
+func (e *ImportError) Unwrap() error { return e.Err }
+
+// Import saves the links in r to db. r is in the format served by /.export:
+// one JSON encoded Link per line. Blank lines are skipped.
+//
+// Every record is validated before anything is saved, including against
+// the MaxLongLength of db's Options, if it has them. The returned error
+// joins an *ImportError for every invalid record, so that all problems in
+// the dump can be fixed in one pass. In ImportAllOrNothing mode nothing is
+// saved if any record is invalid; in ImportValidOnly mode the valid records
+// are saved regardless. Import returns the number of links saved.
+func Import(db Database, r io.Reader, mode ImportMode) (int, error) {
+	var links []*Link
+	var lines []int
+	var errs []error
+
+	var opts Options
+	if o, ok := db.(interface{ options() *Options }); ok {
+		opts = *o.options()
+	}
+
+	bs := bufio.NewScanner(r)
+	line := 0
+	for bs.Scan() {
+		line++
+		if len(strings.TrimSpace(bs.Text())) == 0 {
+			continue
+		}
+		link := new(Link)
+		if err := json.Unmarshal(bs.Bytes(), link); err != nil {
+			errs = append(errs, &ImportError{Line: line, Err: err})
+			continue
+		}
+		if err := validateImport(link, &opts); err != nil {
+			errs = append(errs, &ImportError{Line: line, Short: link.Short, Err: err})
+			continue
+		}
+		links = append(links, link)
+		lines = append(lines, line)
+	}
+	if err := bs.Err(); err != nil {
+		return 0, err
+	}
+	if len(errs) > 0 && mode == ImportAllOrNothing {
+		return 0, errors.Join(errs...)
+	}
+
+	var saved int
+	for i, link := range links {
+		if err := db.Save(link); err != nil {
+			errs = append(errs, &ImportError{Line: lines[i], Short: link.Short, Err: err})
+			continue
+		}
+		saved++
+	}
+	return saved, errors.Join(errs...)
+}
+
+// validateImport reports whether link is fit to be imported: it must have a
+// short name, a Long URL accepted by validateLong, and timestamps that are
+// neither in the future nor out of order.
+func validateImport(link *Link, opts *Options) error {
+	var errs []error
+	if strings.TrimSpace(link.Short) == "" {
+		errs = append(errs, errors.New("missing short name"))
+	}
+	if err := validateLong(link.Long, opts); err != nil {
+		errs = append(errs, err)
+	}
+
+	now := time.Now()
+	if link.Created.After(now) {
+		errs = append(errs, fmt.Errorf("created time %v is in the future", link.Created))
+	}
+	if link.LastEdit.After(now) {
+		errs = append(errs, fmt.Errorf("last edit time %v is in the future", link.LastEdit))
+	}
+	if !link.Created.IsZero() && !link.LastEdit.IsZero() && link.LastEdit.Before(link.Created) {
+		errs = append(errs, fmt.Errorf("last edit time %v is before created time %v", link.LastEdit, link.Created))
+	}
+	return errors.Join(errs...)
+}
+
+// validateLong reports whether long is a valid Long URL: a URL with a
+// scheme, or a template using only the functions in expandFuncMap, within
+// the length limit in opts.
+func validateLong(long string, opts *Options) error {
+	var errs []error
+	if err := opts.checkLong(long); err != nil {
+		errs = append(errs, err)
+	}
+	switch long := strings.TrimSpace(long); {
+	case long == "":
+		errs = append(errs, errors.New("missing long URL"))
+	case strings.HasPrefix(long, "{{"):
+		// Templates are only resolved when the link is followed.
+	default:
+		if u, err := url.Parse(long); err != nil {
+			errs = append(errs, fmt.Errorf("invalid long URL: %w", err))
+		} else if u.Scheme == "" {
+			errs = append(errs, fmt.Errorf("long URL %q has no scheme", long))
+		}
+	}
+
+	if strings.Contains(long, "{{") {
+		if _, err := texttemplate.New("").Funcs(expandFuncMap).Parse(long); err != nil {
+			errs = append(errs, fmt.Errorf("invalid long URL template: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// tailscaleFields are the lowercased JSON field names of links exported by
+// Tailscale's golink, all of which map onto Link fields of the same name.
+var tailscaleFields = map[string]bool{
+	"short":    true,
+	"long":     true,
+	"created":  true,
+	"lastedit": true,
+	"owner":    true,
+}
+
+// ImportTailscale saves the links exported by Tailscale's golink, from its
+// /.export endpoint, to db. Fields that don't map onto Link are dropped, with
+// a warning logged once for each. Links without an owner get db's
+// DefaultOwner, and templates must only use functions supported here.
+//
+// Invalid records are reported and skipped as by Import in ImportValidOnly
+// mode. ImportTailscale returns the number of links saved.
+func ImportTailscale(db Database, r io.Reader) (int, error) {
+	var converted bytes.Buffer
+	var errs []error
+	dropped := make(map[string]bool)
+
+	bs := bufio.NewScanner(r)
+	line := 0
+	for bs.Scan() {
+		line++
+		// Keep one line per input line, so that Import reports the
+		// same line numbers.
+		if len(strings.TrimSpace(bs.Text())) == 0 {
+			converted.WriteByte('\n')
+			continue
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(bs.Bytes(), &fields); err != nil {
+			errs = append(errs, &ImportError{Line: line, Err: err})
+			converted.WriteByte('\n')
+			continue
+		}
+		for name := range fields {
+			if tailscaleFields[strings.ToLower(name)] {
+				continue
+			}
+			if !dropped[name] {
+				log.Printf("importing Tailscale golink links: dropping unsupported field %q", name)
+				dropped[name] = true
+			}
+			delete(fields, name)
+		}
+		b, err := json.Marshal(fields)
+		if err != nil {
+			return 0, err
+		}
+		converted.Write(b)
+		converted.WriteByte('\n')
+	}
+	if err := bs.Err(); err != nil {
+		return 0, err
+	}
+
+	saved, err := Import(db, &converted, ImportValidOnly)
+	return saved, errors.Join(append(errs, err)...)
+}
@@ -0,0 +1,129 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImport(t *testing.T) {
+	const dump = `{"Short":"a","Long":"http://a/"}
+{"Short":"","Long":"http://empty/"}
+
+{"Short":"b","Long":42}
+{"Short":"c","Long":"http://c/","Created":"2022-01-02T00:00:00Z","LastEdit":"2022-01-01T00:00:00Z"}
+{"Short":"d","Long":"{{with .Path}}http://d/{{.}}{{end}}"}
+{"Short":"e","Long":"no-scheme"}
+`
+	wantLines := []int{2, 4, 5, 7}
+
+	tests := []struct {
+		mode      ImportMode
+		wantSaved int
+	}{
+		{ImportAllOrNothing, 0},
+		{ImportValidOnly, 2},
+	}
+	for _, tt := range tests {
+		db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		saved, err := Import(db, strings.NewReader(dump), tt.mode)
+		if saved != tt.wantSaved {
+			t.Errorf("Import(mode %d) saved %d links, want %d", tt.mode, saved, tt.wantSaved)
+		}
+		var gotLines []int
+		for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+			var ie *ImportError
+			if !errors.As(err, &ie) {
+				t.Fatalf("Import(mode %d) error %v is not an *ImportError", tt.mode, err)
+			}
+			gotLines = append(gotLines, ie.Line)
+		}
+		if len(gotLines) != len(wantLines) {
+			t.Fatalf("Import(mode %d) reported lines %v, want %v", tt.mode, gotLines, wantLines)
+		}
+		for i := range gotLines {
+			if gotLines[i] != wantLines[i] {
+				t.Errorf("Import(mode %d) reported lines %v, want %v", tt.mode, gotLines, wantLines)
+				break
+			}
+		}
+
+		links, err := db.LoadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(links) != tt.wantSaved {
+			t.Errorf("Import(mode %d) stored %d links, want %d", tt.mode, len(links), tt.wantSaved)
+		}
+	}
+}
+
+func TestImportTailscale(t *testing.T) {
+	const dump = `{"Short":"a","Long":"http://a/","Created":"2022-06-02T00:00:00Z","LastEdit":"2022-06-03T00:00:00Z","Owner":"amelie@example.com"}
+not json
+{"Short":"b","Long":"http://b/{{.Path}}","Unknown":true}
+{"Short":"c","Long":"http://c/{{NoSuchFunc .Path}}"}
+`
+	db, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.DefaultOwner = "default@example.com"
+
+	saved, err := ImportTailscale(db, strings.NewReader(dump))
+	if saved != 2 {
+		t.Errorf("ImportTailscale saved %d links, want 2", saved)
+	}
+	for _, line := range []int{2, 4} {
+		found := false
+		for _, e := range flattenErrors(err) {
+			var ie *ImportError
+			if errors.As(e, &ie) && ie.Line == line {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("ImportTailscale error %v does not report line %d", err, line)
+		}
+	}
+
+	a, err := db.Load("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Owner != "amelie@example.com" || a.Created.Format(time.RFC3339) != "2022-06-02T00:00:00Z" {
+		t.Errorf("Load(a) = %+v, want owner and created time from the dump", a)
+	}
+	b, err := db.Load("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Owner != "default@example.com" {
+		t.Errorf("Load(b).Owner = %q, want default owner", b.Owner)
+	}
+}
+
+// flattenErrors returns the leaves of a tree of joined errors.
+func flattenErrors(err error) []error {
+	j, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		if err == nil {
+			return nil
+		}
+		return []error{err}
+	}
+	var errs []error
+	for _, e := range j.Unwrap() {
+		errs = append(errs, flattenErrors(e)...)
+	}
+	return errs
+}
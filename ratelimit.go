@@ -0,0 +1,98 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"sync"
+	"time"
+)
+
+// CreationLimiter limits how fast owners may create links, for
+// Options.CreationLimiter.
+type CreationLimiter interface {
+	// Allow reports whether owner may create a link now, counting the
+	// creation against them if so. If not, it returns how long until
+	// they may.
+	Allow(owner string) (ok bool, retryAfter time.Duration)
+
+	// Refund takes back a creation allowed for owner that didn't happen,
+	// such as because the transaction saving the link rolled back.
+	Refund(owner string)
+}
+
+// OwnerRateLimiter is a CreationLimiter that lets each owner create Burst
+// links at once, and then one more every Interval/Burst, like a token
+// bucket per owner. Its state is kept in memory, so it is reset on restart.
+type OwnerRateLimiter struct {
+	Burst    int           // links an owner may create at once
+	Interval time.Duration // time for an owner's allowance to refill from empty
+
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+
+	mu        sync.Mutex
+	next      map[string]time.Time // owner -> when their allowance is full
+	lastPrune time.Time
+}
+
+// NewOwnerRateLimiter returns an OwnerRateLimiter allowing each owner
+// burst links per interval.
+func NewOwnerRateLimiter(burst int, interval time.Duration) *OwnerRateLimiter {
+	return &OwnerRateLimiter{Burst: burst, Interval: interval}
+}
+
+func (l *OwnerRateLimiter) now() time.Time {
+	if l.Now != nil {
+		return l.Now()
+	}
+	return time.Now()
+}
+
+func (l *OwnerRateLimiter) Allow(owner string) (bool, time.Duration) {
+	if l.Burst <= 0 || l.Interval <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if l.next == nil {
+		l.next = make(map[string]time.Time)
+	}
+	// Owners whose allowance has refilled are forgotten, at most once per
+	// interval, so that idle owners don't accumulate.
+	if now.Sub(l.lastPrune) >= l.Interval {
+		for o, full := range l.next {
+			if !full.After(now) {
+				delete(l.next, o)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	// Each link uses up perLink of the owner's allowance, which is full
+	// again at l.next[owner]. Time is kept rather than a count of links
+	// left, so that the allowance refills exactly.
+	perLink := l.Interval / time.Duration(l.Burst)
+	full := l.next[owner]
+	if full.Before(now) {
+		full = now
+	}
+	if wait := full.Sub(now) - (l.Interval - perLink); wait > 0 {
+		return false, wait
+	}
+	l.next[owner] = full.Add(perLink)
+	return true, 0
+}
+
+func (l *OwnerRateLimiter) Refund(owner string) {
+	if l.Burst <= 0 || l.Interval <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if full, ok := l.next[owner]; ok {
+		l.next[owner] = full.Add(-l.Interval / time.Duration(l.Burst))
+	}
+}
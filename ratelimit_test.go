@@ -0,0 +1,52 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOwnerRateLimiter(t *testing.T) {
+	now := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	l := NewOwnerRateLimiter(2, time.Hour)
+	l.Now = func() time.Time { return now }
+
+	allow := func(owner string, wantOK bool, wantRetry time.Duration) {
+		t.Helper()
+		ok, retry := l.Allow(owner)
+		if ok != wantOK || retry != wantRetry {
+			t.Errorf("Allow(%q) at %v = %v, %v; want %v, %v", owner, now.Format(time.Kitchen), ok, retry, wantOK, wantRetry)
+		}
+	}
+
+	// An owner can use their whole allowance at once, and then one link
+	// refills every half hour.
+	allow("alice", true, 0)
+	allow("alice", true, 0)
+	allow("alice", false, 30*time.Minute)
+	allow("bob", true, 0)
+
+	now = now.Add(20 * time.Minute)
+	allow("alice", false, 10*time.Minute)
+	now = now.Add(10 * time.Minute)
+	allow("alice", true, 0)
+	allow("alice", false, 30*time.Minute)
+
+	// A refund gives back a link's share of the allowance.
+	l.Refund("alice")
+	allow("alice", true, 0)
+	allow("alice", false, 30*time.Minute)
+
+	// The allowance refills no further than Burst.
+	now = now.Add(24 * time.Hour)
+	allow("alice", true, 0)
+	allow("alice", true, 0)
+	allow("alice", false, 30*time.Minute)
+
+	// Idle owners are forgotten once their allowance has refilled.
+	if _, ok := l.next["bob"]; ok {
+		t.Errorf("bob's refilled allowance was kept")
+	}
+}
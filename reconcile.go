@@ -0,0 +1,139 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ModifiedSinceLoader is a store that reports its recently edited links, as
+// SQLiteDB and ConvexDB do.
+type ModifiedSinceLoader interface {
+	LoadModifiedSince(t time.Time) ([]*Link, error)
+}
+
+// reconcileRetryDelay is how long a Reconciler first waits to retry a failed
+// sync. It doubles with each failure, up to the Reconciler's interval.
+const reconcileRetryDelay = time.Second
+
+// Reconciler copies the links edited in one store to another in the
+// background, such as to keep a new backend up to date with the old one
+// during a migration.
+//
+// Each sync copies the links edited since the newest LastEdit copied by the
+// previous one, so links edited at exactly that time are copied again, which
+// is harmless. Deleted links are not copied, since LoadModifiedSince doesn't
+// report them; compare the stores with Diff to find them. Stats and
+// CreatedFrom are not copied.
+type Reconciler struct {
+	src      ModifiedSinceLoader
+	dst      Database
+	interval time.Duration
+
+	mu        sync.Mutex // serializes syncs
+	watermark time.Time  // newest LastEdit copied
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewReconciler returns a Reconciler that copies links edited in src to dst
+// every interval once started. The first sync copies every link.
+func NewReconciler(src ModifiedSinceLoader, dst Database, interval time.Duration) *Reconciler {
+	return &Reconciler{src: src, dst: dst, interval: interval}
+}
+
+// Start syncs in the background, immediately and then every interval, until
+// ctx is done or Stop is called. A failed sync is retried sooner, after a
+// delay that doubles with each failure. It must not be called again until
+// the Reconciler has been stopped.
+func (r *Reconciler) Start(ctx context.Context) {
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.done = make(chan struct{})
+	go r.loop(ctx)
+}
+
+// Stop stops syncing in the background, and waits for a sync in progress to
+// finish.
+func (r *Reconciler) Stop() {
+	if r.cancel == nil {
+		return
+	}
+	r.cancel()
+	<-r.done
+}
+
+func (r *Reconciler) loop(ctx context.Context) {
+	defer close(r.done)
+	retry := reconcileRetryDelay
+	for {
+		wait := r.interval
+		n, err := r.Sync(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			log.Printf("reconciling links: %v; retrying in %v", err, retry)
+			wait = retry
+			if retry *= 2; retry > r.interval {
+				retry = r.interval
+			}
+		default:
+			log.Printf("reconciling links: copied %d", n)
+			retry = reconcileRetryDelay
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+// Sync copies the links edited since the last successful sync, and returns
+// the number copied. If it fails partway, the next sync copies the same
+// links again. Links are saved with SaveAdmin if the destination has it, so
+// that reserved names are copied too.
+func (r *Reconciler) Sync(ctx context.Context) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	links, err := r.src.LoadModifiedSince(r.watermark)
+	if err != nil {
+		return 0, err
+	}
+	save := r.dst.Save
+	if admin, ok := r.dst.(interface{ SaveAdmin(*Link) error }); ok {
+		save = admin.SaveAdmin
+	}
+	watermark := r.watermark
+	for i, link := range links {
+		if err := ctx.Err(); err != nil {
+			return i, err
+		}
+		if err := save(link); err != nil {
+			return i, fmt.Errorf("copying %q: %w", link.Name(), err)
+		}
+		if link.LastEdit.After(watermark) {
+			watermark = link.LastEdit
+		}
+	}
+	r.watermark = watermark
+	return len(links), nil
+}
+
+// Watermark returns the newest LastEdit copied, from which the next sync
+// starts, or the zero time before the first successful sync.
+func (r *Reconciler) Watermark() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.watermark
+}
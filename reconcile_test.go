@@ -0,0 +1,100 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestReconciler(t *testing.T) {
+	src, err := NewSQLiteDB(path.Join(t.TempDir(), "src.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := NewSQLiteDB(path.Join(t.TempDir(), "dst.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2022, 6, 2, 0, 0, 0, 0, time.UTC)
+	src.Now = func() time.Time { return now }
+
+	for _, link := range []*Link{
+		{Short: "a", Long: "http://a/"},
+		{Short: "admin", Long: "http://admin/"},
+	} {
+		if err := src.SaveAdmin(link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := NewReconciler(src, dst, time.Hour)
+	n, err := r.Sync(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("first Sync copied %d links, want 2", n)
+	}
+	if got := r.Watermark(); !got.Equal(now) {
+		t.Errorf("Watermark = %v, want %v", got, now)
+	}
+
+	now = now.Add(time.Minute)
+	for _, link := range []*Link{
+		{Short: "a", Long: "http://a/new", LastEdit: now},
+		{Short: "b", Long: "http://b/"},
+	} {
+		if err := src.Save(link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.Sync(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	d, err := Diff(src, dst, DiffOptions{CompareTimes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Empty() {
+		t.Errorf("stores differ after Sync: %+v", d)
+	}
+}
+
+// Test that a started Reconciler syncs in the background until stopped.
+func TestReconcilerStart(t *testing.T) {
+	src, err := NewSQLiteDB(path.Join(t.TempDir(), "src.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := NewSQLiteDB(path.Join(t.TempDir(), "dst.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Save(&Link{Short: "a", Long: "http://a/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReconciler(src, dst, time.Hour)
+	r.Start(context.Background())
+	defer r.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := dst.Load("a")
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Fatal(err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("link not copied by the first background sync")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.Stop()
+}
@@ -0,0 +1,193 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrNoRoute is returned by RoutingStore for a link that no rule matches
+// when there is no default store.
+var ErrNoRoute = errors.New("no store for link")
+
+// RoutingRule sends links whose name starts with Prefix to Store.
+type RoutingRule struct {
+	// Prefix is compared with link names in normalized form, as IDs are,
+	// so "Ext/" matches "ext/foo" and "EXT/Foo-Bar" alike. A prefix ending
+	// in "/", such as "ext/", matches the links in a namespace.
+	Prefix string
+
+	Store Database
+}
+
+// RoutingStore is a Database that keeps links in different stores
+// depending on their names, such as "ext/" links in a public Convex
+// deployment and the rest in an internal SQLite database.
+//
+// Load, Save and Delete go to the store of the first rule matching the
+// link's name, or to Default if none does. LoadAll, LoadStats and Count
+// combine every store. Stores listed more than once, such as in a rule and
+// as Default, are only read once, so they must be comparable, as pointers
+// are. Each store normalizes and validates the links it keeps itself, with
+// its own Options.
+//
+// Links are not moved when the rules change: a link kept in a store that
+// its name no longer routes to is still listed by LoadAll, but can't be
+// loaded or deleted through the RoutingStore.
+type RoutingStore struct {
+	Rules []RoutingRule
+
+	// Default keeps links that no rule matches. If nil, they are refused
+	// with ErrNoRoute.
+	Default Database
+}
+
+// NewRoutingStore returns a RoutingStore sending links to the store of the
+// first of rules that matches them, and others to def.
+func NewRoutingStore(def Database, rules ...RoutingRule) *RoutingStore {
+	return &RoutingStore{Rules: rules, Default: def}
+}
+
+// route returns the store for the link named short.
+func (s *RoutingStore) route(short string) (Database, error) {
+	id := linkID(short)
+	for _, r := range s.Rules {
+		if strings.HasPrefix(id, linkID(r.Prefix)) {
+			return r.Store, nil
+		}
+	}
+	if s.Default == nil {
+		return nil, fmt.Errorf("%q: %w", short, ErrNoRoute)
+	}
+	return s.Default, nil
+}
+
+// stores returns each of s's stores once, in the order of the rules and
+// then Default.
+func (s *RoutingStore) stores() []Database {
+	var stores []Database
+	seen := make(map[Database]bool)
+	add := func(db Database) {
+		if db != nil && !seen[db] {
+			seen[db] = true
+			stores = append(stores, db)
+		}
+	}
+	for _, r := range s.Rules {
+		add(r.Store)
+	}
+	add(s.Default)
+	return stores
+}
+
+func (s *RoutingStore) Load(short string) (*Link, error) {
+	db, err := s.route(short)
+	if err != nil {
+		return nil, err
+	}
+	return db.Load(short)
+}
+
+func (s *RoutingStore) Save(link *Link) error {
+	db, err := s.route(link.Name())
+	if err != nil {
+		return err
+	}
+	return db.Save(link)
+}
+
+func (s *RoutingStore) Delete(short string) error {
+	db, err := s.route(short)
+	if err != nil {
+		return err
+	}
+	return db.Delete(short)
+}
+
+// LoadAll returns the links in every store.
+//
+// The caller owns the returned values.
+func (s *RoutingStore) LoadAll() ([]*Link, error) {
+	var links []*Link
+	for _, db := range s.stores() {
+		l, err := db.LoadAll()
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, l...)
+	}
+	return links, nil
+}
+
+// Count returns the number of links in every store.
+func (s *RoutingStore) Count() (int, error) {
+	links, err := s.LoadAll()
+	if err != nil {
+		return 0, err
+	}
+	return len(links), nil
+}
+
+// LoadStats returns the clicks in every store, keyed as each store keys
+// them.
+func (s *RoutingStore) LoadStats() (ClickStats, error) {
+	stats := make(ClickStats)
+	for _, db := range s.stores() {
+		st, err := db.LoadStats()
+		if err != nil {
+			return nil, err
+		}
+		for short, clicks := range st {
+			stats[short] += clicks
+		}
+	}
+	return stats, nil
+}
+
+// SaveStats saves the clicks on each link to its store. Clicks on links
+// that no store is routed to are dropped, as stores drop clicks on links
+// that don't exist. Each store saves its share even if another fails, and
+// the errors are joined.
+func (s *RoutingStore) SaveStats(stats ClickStats) error {
+	byStore := make(map[Database]ClickStats)
+	for short, clicks := range stats {
+		db, err := s.route(short)
+		if err != nil {
+			continue
+		}
+		if byStore[db] == nil {
+			byStore[db] = make(ClickStats)
+		}
+		byStore[db][short] += clicks
+	}
+	var errs []error
+	for _, db := range s.stores() {
+		if st, ok := byStore[db]; ok {
+			if err := db.SaveStats(st); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LastStatsFlush returns the oldest of the stores' last flushes, or the
+// zero time if any store has never flushed, so that stats are only
+// reported as fresh if they are fresh in every store.
+func (s *RoutingStore) LastStatsFlush() (time.Time, error) {
+	var oldest time.Time
+	for i, db := range s.stores() {
+		t, err := db.LastStatsFlush()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if i == 0 || t.Before(oldest) {
+			oldest = t
+		}
+	}
+	return oldest, nil
+}
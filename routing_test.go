@@ -0,0 +1,94 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRoutingStore(t *testing.T) {
+	internal, err := NewSQLiteDB(path.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := NewConvexDB(newFakeConvex(t).URL, "test")
+	s := NewRoutingStore(internal, RoutingRule{Prefix: "Ext/", Store: public})
+
+	links := []*Link{
+		{Short: "a", Long: "http://a/"},
+		{Namespace: "ext", Short: "Docs", Long: "http://docs/"},
+		{Namespace: "eng", Short: "b", Long: "http://b/"},
+	}
+	for _, link := range links {
+		if err := s.Save(link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// ext/ links are only in the public store, matched in normalized form.
+	if _, err := public.Load("ext/docs"); err != nil {
+		t.Errorf("public.Load(ext/docs) got %v, want link", err)
+	}
+	if _, err := internal.Load("ext/docs"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("internal.Load(ext/docs) got %v, want fs.ErrNotExist", err)
+	}
+	if _, err := public.Load("a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("public.Load(a) got %v, want fs.ErrNotExist", err)
+	}
+	if link, err := s.Load("EXT/docs"); err != nil || link.Long != "http://docs/" {
+		t.Errorf("Load(EXT/docs) = %v, %v; want http://docs/", link, err)
+	}
+
+	all, err := s.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, link := range all {
+		names = append(names, link.Name())
+	}
+	sort.Strings(names)
+	if want := []string{"a", "eng/b", "ext/Docs"}; !cmp.Equal(names, want) {
+		t.Errorf("LoadAll() names = %q, want %q", names, want)
+	}
+	if n, err := s.Count(); err != nil || n != 3 {
+		t.Errorf("Count() = %d, %v; want 3", n, err)
+	}
+
+	if err := s.SaveStats(ClickStats{"a": 1, "ext/docs": 2}); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := s.LoadStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ClickStats{"a": 1, "ext/docs": 2}); !cmp.Equal(stats, want) {
+		t.Errorf("LoadStats() = %v, want %v", stats, want)
+	}
+	if flushed, err := s.LastStatsFlush(); err != nil || flushed.IsZero() {
+		t.Errorf("LastStatsFlush() = %v, %v; want non-zero", flushed, err)
+	}
+
+	if err := s.Delete("ext/docs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := public.Load("ext/docs"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("public.Load(ext/docs) after Delete got %v, want fs.ErrNotExist", err)
+	}
+
+	// Without a default store, unmatched links are refused.
+	s.Default = nil
+	if err := s.Save(&Link{Short: "c", Long: "http://c/"}); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("Save(c) without Default got %v, want ErrNoRoute", err)
+	}
+	if _, err := s.Load("a"); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("Load(a) without Default got %v, want ErrNoRoute", err)
+	}
+}
@@ -4,11 +4,46 @@ CREATE TABLE IF NOT EXISTS Links (
 	Long     TEXT    NOT NULL DEFAULT "",
 	Created  INTEGER NOT NULL DEFAULT (strftime('%s', 'now')), -- unix seconds
 	LastEdit INTEGER NOT NULL DEFAULT (strftime('%s', 'now')), -- unix seconds
-	Owner	 TEXT    NOT NULL DEFAULT ""
+	Owner	 TEXT    NOT NULL DEFAULT "",
+	Destinations TEXT NOT NULL DEFAULT "", -- JSON array of weighted destinations, if any
+	RedirectCode INTEGER NOT NULL DEFAULT 0, -- HTTP redirect status, or 0 for the server default
+	Namespace TEXT NOT NULL DEFAULT "", -- namespace of the link, or "" for the default; part of ID
+	CreatedFrom TEXT NOT NULL DEFAULT "", -- where the link was created from, such as an IP address
+	EditCount INTEGER NOT NULL DEFAULT 1, -- number of times the link has been saved
+	CreatedMillis INTEGER NOT NULL DEFAULT 0, -- millisecond part of Created
+	LastEditMillis INTEGER NOT NULL DEFAULT 0, -- millisecond part of LastEdit
+	AllowedOwners TEXT NOT NULL DEFAULT "", -- JSON array of users allowed to follow the link, if restricted
+	ExpiresAt INTEGER NOT NULL DEFAULT 0, -- unix seconds when the link expires, or 0 if it doesn't
+	IconURL TEXT NOT NULL DEFAULT "", -- URL of an icon for the link, such as its destination's favicon
+	Pinned INTEGER NOT NULL DEFAULT 0, -- 1 if the link is featured, else 0
+	MaxUses INTEGER NOT NULL DEFAULT 0, -- number of times the link can be consumed, or 0 for unlimited
+	UseCount INTEGER NOT NULL DEFAULT 0, -- number of times the link has been consumed
+	Version INTEGER NOT NULL DEFAULT 1, -- incremented by every change to the link, for SaveIfVersion
+	Source TEXT NOT NULL DEFAULT "", -- app the link was created with, such as "slack", or "" if unknown
+	Headers TEXT NOT NULL DEFAULT "" -- JSON object of response headers to set on redirects, if any
 );
 
+CREATE INDEX IF NOT EXISTS LinksLastEdit ON Links(LastEdit);
+CREATE INDEX IF NOT EXISTS LinksCreated ON Links(Created);
+
 CREATE TABLE IF NOT EXISTS Stats (
-	ID       TEXT    NOT NULL DEFAULT "",
+	ID       TEXT    NOT NULL DEFAULT "" REFERENCES Links(ID) ON DELETE CASCADE,
 	Created  INTEGER NOT NULL DEFAULT (strftime('%s', 'now')), -- unix seconds
 	Clicks   INTEGER
 );
+
+CREATE TABLE IF NOT EXISTS StatsMeta (
+	ID        INTEGER PRIMARY KEY CHECK (ID = 0), -- single row
+	LastFlush INTEGER NOT NULL -- unix seconds of the last SaveStats
+);
+
+CREATE TABLE IF NOT EXISTS Impressions (
+	ID          TEXT    PRIMARY KEY REFERENCES Links(ID) ON DELETE CASCADE,
+	Impressions INTEGER NOT NULL DEFAULT 0 -- number of times the link was shown
+);
+
+CREATE TABLE IF NOT EXISTS Aliases (
+	ID       TEXT    PRIMARY KEY,         -- normalized version of Short (oncall)
+	Short    TEXT    NOT NULL DEFAULT "", -- user-provided alias name (On-Call)
+	LinkID   TEXT    NOT NULL REFERENCES Links(ID) ON DELETE CASCADE -- ID of the canonical link
+);
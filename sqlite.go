@@ -1,163 +1,2489 @@
 package golink
 
 import (
+	"bufio"
 	"context"
 	"database/sql"
 	_ "embed"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 // SQLiteDB stores Links in a SQLite database.
 type SQLiteDB struct {
-	db *sql.DB
-	mu sync.RWMutex
+	Options
+
+	db     *sql.DB
+	ownsDB bool // whether Close closes db
+
+	// mu serializes writes, so that the checks a write makes before
+	// changing the database can't be invalidated by another write. Reads
+	// don't take it, since *sql.DB is safe for concurrent use.
+	mu sync.Mutex
+
+	// charged lists the owners of the links created by the transaction in
+	// progress, whose creations inTx refunds if it rolls back. It is
+	// guarded by mu.
+	charged []string
+}
+
+//go:embed schema.sql
+var sqlSchema string
+
+const (
+	// busyRetries is the number of times a write is retried after failing
+	// because the database is busy or locked by another connection.
+	busyRetries = 8
+
+	// busyBackoff is the delay before the first retry of a busy write. It
+	// doubles on each subsequent retry.
+	busyBackoff = 5 * time.Millisecond
+)
+
+// isBusy reports whether err is a SQLite error with a (possibly extended)
+// SQLITE_BUSY or SQLITE_LOCKED result code.
+func isBusy(err error) bool {
+	var serr *sqlite.Error
+	if !errors.As(err, &serr) {
+		return false
+	}
+	switch serr.Code() & 0xff {
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+		return true
+	}
+	return false
+}
+
+// retryBusy calls f, retrying with jittered exponential backoff while it
+// fails because the database is busy or locked. Any other error is returned
+// immediately.
+func (s *SQLiteDB) retryBusy(f func() error) error {
+	backoff := busyBackoff
+	for i := 0; ; i++ {
+		err := f()
+		if i == busyRetries || !isBusy(err) {
+			return err
+		}
+		// Jitter keeps competing writers from retrying in lockstep.
+		time.Sleep(backoff + time.Duration(s.randInt63n(int64(backoff/2))))
+		backoff *= 2
+	}
+}
+
+// linkFields maps each persisted Link field to its column in the Links table,
+// in the order used by linkValues and scanLink. A new Link field needs a
+// column in schema.sql and an entry here, with a Def so that the column is
+// added to databases created before it existed. Created and LastEdit are
+// stored as Unix seconds with their milliseconds in a second column.
+var linkFields = []struct {
+	Field  string // Link struct field
+	Column string // Links table column
+	Def    string // column definition for ALTER TABLE ... ADD COLUMN
+
+	// Update is the value the column is set to when an existing link is
+	// saved. If empty, it is set to the saved value.
+	Update string
+}{
+	{"Short", "Short", "", ""},
+	{"Long", "Long", "", ""},
+	{"Created", "Created", "", ""},
+	{"LastEdit", "LastEdit", "", ""},
+	{"Owner", "Owner", "", ""},
+	{"Destinations", "Destinations", `TEXT NOT NULL DEFAULT ""`, ""},
+	{"RedirectCode", "RedirectCode", `INTEGER NOT NULL DEFAULT 0`, ""},
+	{"Namespace", "Namespace", `TEXT NOT NULL DEFAULT ""`, ""},
+	{"CreatedFrom", "CreatedFrom", `TEXT NOT NULL DEFAULT ""`, `CASE WHEN Links.CreatedFrom = '' THEN excluded.CreatedFrom ELSE Links.CreatedFrom END`},
+	{"EditCount", "EditCount", `INTEGER NOT NULL DEFAULT 1`, `Links.EditCount + 1`},
+	{"Created", "CreatedMillis", `INTEGER NOT NULL DEFAULT 0`, ""},
+	{"LastEdit", "LastEditMillis", `INTEGER NOT NULL DEFAULT 0`, ""},
+	{"AllowedOwners", "AllowedOwners", `TEXT NOT NULL DEFAULT ""`, ""},
+	{"ExpiresAt", "ExpiresAt", `INTEGER NOT NULL DEFAULT 0`, ""},
+	{"IconURL", "IconURL", `TEXT NOT NULL DEFAULT ""`, ""},
+	{"Pinned", "Pinned", `INTEGER NOT NULL DEFAULT 0`, ""},
+	{"MaxUses", "MaxUses", `INTEGER NOT NULL DEFAULT 0`, ""},
+	{"UseCount", "UseCount", `INTEGER NOT NULL DEFAULT 0`, `Links.UseCount`},
+	{"Source", "Source", `TEXT NOT NULL DEFAULT ""`, `CASE WHEN Links.Source = '' THEN excluded.Source ELSE Links.Source END`},
+	{"Headers", "Headers", `TEXT NOT NULL DEFAULT ""`, ""},
+}
+
+// versionColumnDef is the definition of the Links.Version column, which
+// isn't a Link field, so it's added to older databases apart from
+// linkFields. Every change to a link increments its version, which
+// LoadVersioned returns and SaveIfVersion checks.
+const versionColumnDef = `INTEGER NOT NULL DEFAULT 1`
+
+var (
+	// linkColumns is the list of Links columns read by scanLink.
+	linkColumns string
+
+	// saveLinkSQL inserts a link with the values from linkValues, or
+	// updates it in place if it already exists. It doesn't use INSERT OR
+	// REPLACE, which would delete the old row and cascade to its stats and
+	// aliases.
+	saveLinkSQL string
+)
+
+func init() {
+	var columns, names, updates []string
+	for _, f := range linkFields {
+		columns = append(columns, "Links."+f.Column)
+		names = append(names, f.Column)
+		update := f.Update
+		if update == "" {
+			update = "excluded." + f.Column
+		}
+		updates = append(updates, f.Column+" = "+update)
+	}
+	updates = append(updates, "Version = Links.Version + 1")
+	linkColumns = strings.Join(columns, ", ")
+	saveLinkSQL = fmt.Sprintf("INSERT INTO Links (ID, %s) VALUES (?%s) ON CONFLICT (ID) DO UPDATE SET %s",
+		strings.Join(names, ", "), strings.Repeat(", ?", len(names)), strings.Join(updates, ", "))
+}
+
+// linkValues returns the values stored for link, in linkFields order.
+func linkValues(link *Link) ([]any, error) {
+	var destinations string
+	if len(link.Destinations) > 0 {
+		b, err := json.Marshal(link.Destinations)
+		if err != nil {
+			return nil, err
+		}
+		destinations = string(b)
+	}
+	var allowedOwners string
+	if len(link.AllowedOwners) > 0 {
+		b, err := json.Marshal(link.AllowedOwners)
+		if err != nil {
+			return nil, err
+		}
+		allowedOwners = string(b)
+	}
+	var headers string
+	if len(link.Headers) > 0 {
+		b, err := json.Marshal(link.Headers)
+		if err != nil {
+			return nil, err
+		}
+		headers = string(b)
+	}
+	var expiresAt int64 // 0 if the link doesn't expire
+	if !link.ExpiresAt.IsZero() {
+		expiresAt = link.ExpiresAt.Unix()
+	}
+	return []any{link.Short, link.Long, link.Created.Unix(), link.LastEdit.Unix(), link.Owner, destinations, link.RedirectCode, link.Namespace, link.CreatedFrom,
+		1, // EditCount of a new link; updates increment the stored count
+		millis(link.Created), millis(link.LastEdit), allowedOwners, expiresAt, link.IconURL, link.Pinned, link.MaxUses,
+		0, // UseCount of a new link; updates keep the stored count
+		link.Source, headers,
+	}, nil
+}
+
+// millis returns the millisecond part of t, which is stored apart from its
+// Unix seconds so that the seconds remain comparable with older rows.
+func millis(t time.Time) int64 {
+	return int64(t.Nanosecond() / int(time.Millisecond))
+}
+
+// scanLink scans a row selected with linkColumns into a new Link. Any
+// additional columns selected after linkColumns are scanned into extra.
+func scanLink(row interface{ Scan(...any) error }, extra ...any) (*Link, error) {
+	link := new(Link)
+	var created, lastEdit, createdMillis, lastEditMillis, expiresAt int64
+	var destinations, allowedOwners, headers string
+	dest := append([]any{&link.Short, &link.Long, &created, &lastEdit, &link.Owner, &destinations, &link.RedirectCode, &link.Namespace, &link.CreatedFrom, &link.EditCount, &createdMillis, &lastEditMillis, &allowedOwners, &expiresAt, &link.IconURL, &link.Pinned, &link.MaxUses, &link.UseCount, &link.Source, &headers}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	link.Created = time.UnixMilli(created*1000 + createdMillis).UTC()
+	link.LastEdit = time.UnixMilli(lastEdit*1000 + lastEditMillis).UTC()
+	if expiresAt != 0 {
+		link.ExpiresAt = time.Unix(expiresAt, 0).UTC()
+	}
+	if destinations != "" {
+		if err := json.Unmarshal([]byte(destinations), &link.Destinations); err != nil {
+			return nil, fmt.Errorf("link %q has invalid destinations: %w", link.Short, err)
+		}
+	}
+	if allowedOwners != "" {
+		if err := json.Unmarshal([]byte(allowedOwners), &link.AllowedOwners); err != nil {
+			return nil, fmt.Errorf("link %q has invalid allowed owners: %w", link.Short, err)
+		}
+	}
+	if headers != "" {
+		if err := json.Unmarshal([]byte(headers), &link.Headers); err != nil {
+			return nil, fmt.Errorf("link %q has invalid headers: %w", link.Short, err)
+		}
+	}
+	return link, nil
+}
+
+// scan is like scanLink, but decodes fields encoded with s.Codec, and
+// leaves out CreatedFrom, which only LoadWithMeta returns.
+func (s *SQLiteDB) scan(row interface{ Scan(...any) error }, extra ...any) (*Link, error) {
+	link, err := s.scanMeta(row, extra...)
+	if err != nil {
+		return nil, err
+	}
+	link.CreatedFrom = ""
+	return link, nil
+}
+
+// scanMeta is like scan, but keeps CreatedFrom.
+func (s *SQLiteDB) scanMeta(row interface{ Scan(...any) error }, extra ...any) (*Link, error) {
+	link, err := scanLink(row, extra...)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.decodeFields(link); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// checkSchema verifies that the Links table in db has a column for every
+// field in linkFields, adding any missing columns that have a definition.
+func checkSchema(db *sql.DB) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info('Links')")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		columns[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, f := range linkFields {
+		if columns[f.Column] {
+			continue
+		}
+		if f.Def == "" {
+			return fmt.Errorf("Links table has no column %q for Link.%s", f.Column, f.Field)
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE Links ADD COLUMN %s %s", f.Column, f.Def)); err != nil {
+			return fmt.Errorf("adding column %q for Link.%s: %w", f.Column, f.Field, err)
+		}
+	}
+	if !columns["Version"] {
+		if _, err := db.Exec("ALTER TABLE Links ADD COLUMN Version " + versionColumnDef); err != nil {
+			return fmt.Errorf("adding column \"Version\": %w", err)
+		}
+	}
+	return nil
+}
+
+// migrateStatsForeignKey rebuilds a Stats table created before Stats.ID
+// referenced Links.ID, dropping any stats left behind by deleted links.
+func migrateStatsForeignKey(db *sql.DB) error {
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM pragma_foreign_key_list('Stats')").Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	tx, err := db.BeginTx(context.TODO(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("ALTER TABLE Stats RENAME TO OldStats"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(sqlSchema); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO Stats (ID, Created, Clicks) SELECT ID, Created, Clicks FROM OldStats WHERE ID IN (SELECT ID FROM Links)"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DROP TABLE OldStats"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// OpenRetry configures how NewSQLiteDBWithRetry retries opening a database
+// that is not yet available, such as one on a networked volume that is
+// still being mounted.
+type OpenRetry struct {
+	// Retries is the number of times to retry after the first attempt
+	// fails. Zero tries only once.
+	Retries int
+
+	// Delay is the wait before the first retry. It doubles before each
+	// subsequent retry.
+	Delay time.Duration
+}
+
+// NewSQLiteDB returns a new SQLiteDB that stores links in a SQLite database stored at f.
+//
+// If f is an in-memory database, such as ":memory:" or
+// "file::memory:?cache=shared", the SQLiteDB uses a single connection,
+// since each new connection would otherwise open a separate, empty
+// database. Operations on such a store are then serialized, and a Batch
+// function must use its StoreTx rather than the SQLiteDB.
+func NewSQLiteDB(f string) (*SQLiteDB, error) {
+	return NewSQLiteDBWithRetry(f, OpenRetry{})
+}
+
+// NewSQLiteDBWithRetry is like NewSQLiteDB, but retries connecting to the
+// database and applying its schema as described by retry. If every attempt
+// fails, the error says how many were made and wraps the last failure.
+func NewSQLiteDBWithRetry(f string, retry OpenRetry) (*SQLiteDB, error) {
+	// Enforce foreign keys on every connection, so that deleting a link
+	// also deletes its stats and aliases. Reads aren't serialized with
+	// writes, so have them wait out a concurrent write's lock rather than
+	// fail.
+	const pragmas = "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)"
+	dsn := f + "?" + pragmas
+	if strings.Contains(f, "?") {
+		dsn = f + "&" + pragmas
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if isMemoryDB(f) {
+		// The database lives only as long as its one connection.
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+		db.SetConnMaxLifetime(0)
+		db.SetConnMaxIdleTime(0)
+	}
+
+	delay := retry.Delay
+	for attempt := 1; ; attempt++ {
+		err = db.Ping()
+		if err == nil {
+			if err = checkSchemaVersion(db); errors.Is(err, ErrSchemaTooNew) {
+				db.Close()
+				return nil, err
+			}
+		}
+		if err == nil {
+			_, err = db.Exec(sqlSchema)
+		}
+		if err == nil {
+			break
+		}
+		if attempt > retry.Retries {
+			db.Close()
+			if retry.Retries == 0 {
+				return nil, err
+			}
+			return nil, fmt.Errorf("opening SQLite database: gave up after %d attempts: %w", attempt, err)
+		}
+		log.Printf("opening SQLite database (attempt %d of %d): %v; retrying in %v", attempt, retry.Retries+1, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	if err := migrateSchema(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteDB{Options: Options{MaxLongLength: DefaultMaxLongLength}, db: db, ownsDB: true}, nil
+}
+
+// isMemoryDB reports whether the database file name f refers to an
+// in-memory database.
+func isMemoryDB(f string) bool {
+	return f == ":memory:" || strings.HasPrefix(f, "file::memory:") || strings.Contains(f, "mode=memory")
+}
+
+// NewSQLiteDBFromConn returns a SQLiteDB that stores links in db, an
+// already open SQLite database, such as one from a pool the caller manages
+// or a shared-cache in-memory database. The schema is applied and migrated
+// as by NewSQLiteDB.
+//
+// The caller keeps ownership of db: Close does not close it, and db must
+// stay open while the SQLiteDB is in use. NewSQLiteDB enforces foreign keys
+// and sets a busy timeout on every connection; callers should configure db
+// to do the same, such as with the DSN parameters
+// "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)" of the
+// modernc.org/sqlite driver, or deleting a link may leave its stats behind.
+func NewSQLiteDBFromConn(db *sql.DB) (*SQLiteDB, error) {
+	if err := checkSchemaVersion(db); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqlSchema); err != nil {
+		return nil, err
+	}
+	if err := migrateSchema(db); err != nil {
+		return nil, err
+	}
+	return &SQLiteDB{Options: Options{MaxLongLength: DefaultMaxLongLength}, db: db}, nil
+}
+
+// SQLiteSchemaVersion is the version of the database schema this package
+// writes, which it records in the database's user_version. It is
+// incremented by schema changes that older versions of the package can't
+// use, so that they refuse to open the database rather than write to it
+// with a mismatched schema. Additions that older versions ignore, such as
+// new columns with defaults, don't need a new version.
+const SQLiteSchemaVersion = 1
+
+// ErrSchemaTooNew is returned, wrapped in a *SchemaTooNewError, when
+// opening a SQLite database whose schema is newer than SQLiteSchemaVersion,
+// such as after rolling back to an older binary.
+var ErrSchemaTooNew = errors.New("database schema is newer than supported")
+
+// SchemaTooNewError reports a database with a schema version newer than
+// this package supports.
+type SchemaTooNewError struct {
+	Version   int // the database's schema version
+	Supported int // SQLiteSchemaVersion
+}
+
+func (e *SchemaTooNewError) Error() string {
+	return fmt.Sprintf("%v: database is at version %d, but at most %d is supported", ErrSchemaTooNew, e.Version, e.Supported)
+}
+
+func (e *SchemaTooNewError) Unwrap() error { return ErrSchemaTooNew }
+
+// schemaVersion returns the schema version recorded in db.
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+// checkSchemaVersion returns a *SchemaTooNewError if db's schema is newer
+// than SQLiteSchemaVersion. It is checked before anything is written.
+func checkSchemaVersion(db *sql.DB) error {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > SQLiteSchemaVersion {
+		return &SchemaTooNewError{Version: version, Supported: SQLiteSchemaVersion}
+	}
+	return nil
+}
+
+// SchemaVersion returns the schema version recorded in the database, which
+// is SQLiteSchemaVersion once it has been opened and migrated.
+func (s *SQLiteDB) SchemaVersion() (int, error) {
+	return schemaVersion(s.db)
+}
+
+// migrateSchema brings a database that sqlSchema has been applied to up to
+// date with the current schema, and records that it is at
+// SQLiteSchemaVersion.
+func migrateSchema(db *sql.DB) error {
+	if err := migrateStatsForeignKey(db); err != nil {
+		return err
+	}
+	if err := checkSchema(db); err != nil {
+		return err
+	}
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version < SQLiteSchemaVersion {
+		// PRAGMA arguments can't be bound parameters.
+		if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", SQLiteSchemaVersion)); err != nil {
+			return fmt.Errorf("recording schema version: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close closes the database, unless it was provided by the caller to
+// NewSQLiteDBFromConn.
+func (s *SQLiteDB) Close() error {
+	if !s.ownsDB {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// LoadAll returns all stored Links.
+//
+// The caller owns the returned values.
+func (s *SQLiteDB) LoadAll() ([]*Link, error) {
+	var links []*Link
+	rows, err := s.db.Query("SELECT " + linkColumns + " FROM Links")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		link, err := s.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, s.transform(link))
+	}
+	return links, rows.Err()
+}
+
+// LoadNamespace returns all stored Links in namespace. The empty namespace
+// selects links in the default namespace.
+//
+// The caller owns the returned values.
+func (s *SQLiteDB) LoadNamespace(namespace string) ([]*Link, error) {
+	var links []*Link
+	rows, err := s.db.Query("SELECT "+linkColumns+" FROM Links WHERE Namespace = ?", namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		link, err := s.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// LoadModifiedSince returns the Links last edited at or after t, for
+// incremental syncing. The sync job should pass the latest LastEdit it has
+// seen. Deleted links are not reported, so a periodic full LoadAll is still
+// needed to reconcile deletions.
+//
+// The caller owns the returned values.
+func (s *SQLiteDB) LoadModifiedSince(t time.Time) ([]*Link, error) {
+	var links []*Link
+	rows, err := s.db.Query("SELECT "+linkColumns+" FROM Links WHERE LastEdit >= ?", t.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		link, err := s.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// LoadByLongPattern returns the Links whose Long URL matches pattern, such
+// as all links to a host being migrated. In pattern, "*" matches any run of
+// characters and "?" matches any single character; all other characters
+// match themselves, with ASCII letters matched regardless of case. The
+// pattern may match any part of the URL, so "jira.old.com" finds every
+// link to that host. An empty pattern matches no links.
+//
+// The caller owns the returned values.
+func (s *SQLiteDB) LoadByLongPattern(pattern string) ([]*Link, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	match := longMatcher(pattern)
+	query := "SELECT " + linkColumns + " FROM Links WHERE Long LIKE ? ESCAPE '\\'"
+	args := []any{likePattern(pattern)}
+	if s.Codec != nil {
+		// Stored URLs are encoded, so match them once decoded.
+		query, args = "SELECT "+linkColumns+" FROM Links", nil
+	}
+	var links []*Link
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		link, err := s.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		if s.Codec == nil || match(link.Long) {
+			links = append(links, link)
+		}
+	}
+	return links, rows.Err()
+}
+
+// LoadByLong returns the Links whose Long URL is long, once canonicalized
+// by s.Canonicalizer, such as to find an existing link before creating a
+// duplicate.
+//
+// The caller owns the returned values.
+func (s *SQLiteDB) LoadByLong(long string) ([]*Link, error) {
+	long, err := s.canonicalLong(long)
+	if err != nil {
+		return nil, err
+	}
+	query := "SELECT " + linkColumns + " FROM Links WHERE Long = ?"
+	args := []any{long}
+	if s.Codec != nil {
+		// Stored URLs are encoded, so compare them once decoded.
+		query, args = "SELECT "+linkColumns+" FROM Links", nil
+	}
+	var links []*Link
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		link, err := s.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		if link.Long == long {
+			links = append(links, link)
+		}
+	}
+	return links, rows.Err()
+}
+
+// LoadOwnerless returns the Links whose Owner is empty or only whitespace,
+// ordered by creation time, so that they can be assigned owners. It returns
+// no links if every link has an owner. With CodecOwner, only links with an
+// empty Owner are found, since other owners are stored encoded.
+//
+// The caller owns the returned values.
+func (s *SQLiteDB) LoadOwnerless() ([]*Link, error) {
+	var links []*Link
+	rows, err := s.db.Query("SELECT " + linkColumns + " FROM Links WHERE trim(Owner, ' ' || char(9, 10, 11, 12, 13)) = '' ORDER BY Created, CreatedMillis, ID")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		link, err := s.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// AllIDs returns the ID of every link, in order. IDs are normalized names,
+// such as "eng/foobar" for a link saved as "Eng/Foo-Bar", rather than the
+// names as saved. Only the primary key index
+// is read, so it is much cheaper than LoadAll when only the set of links
+// matters, such as to compare two stores.
+func (s *SQLiteDB) AllIDs() ([]string, error) {
+	var ids []string
+	rows, err := s.db.Query("SELECT ID FROM Links ORDER BY ID")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// CountBySource returns the number of links created with each app, keyed by
+// Link.Source. Links without a source are counted under "".
+func (s *SQLiteDB) CountBySource() (map[string]int, error) {
+	rows, err := s.db.Query("SELECT Source, count(*) FROM Links GROUP BY Source")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var source string
+		var n int
+		if err := rows.Scan(&source, &n); err != nil {
+			return nil, err
+		}
+		counts[source] = n
+	}
+	return counts, rows.Err()
+}
+
+// LoadCreatedBetween returns the Links created from from to to inclusive,
+// ordered by creation time. A zero to means until now. Times are compared
+// as the stored Unix seconds, so their time zones don't matter.
+//
+// The caller owns the returned values.
+func (s *SQLiteDB) LoadCreatedBetween(from, to time.Time) ([]*Link, error) {
+	if to.IsZero() {
+		to = s.now()
+	}
+	var links []*Link
+	rows, err := s.db.Query("SELECT "+linkColumns+" FROM Links WHERE Created BETWEEN ? AND ? ORDER BY Created, CreatedMillis, ID", from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		link, err := s.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// ListLinks returns the page of links described by opts, ordered by
+// normalized name. An offset past the last link returns an empty page.
+//
+// The caller owns the returned values.
+func (s *SQLiteDB) ListLinks(opts ListOptions) (*LinkPage, error) {
+	if opts.Offset < 0 {
+		return nil, fmt.Errorf("invalid offset %d", opts.Offset)
+	}
+	where, args := "", []any{}
+	if opts.Owner != "" {
+		where, args = " WHERE Owner = ?", append(args, opts.Owner)
+	}
+
+	// Count and list in one read transaction, so that they agree.
+	tx, err := s.db.BeginTx(context.TODO(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var total int
+	if err := tx.QueryRow("SELECT count(*) FROM Links"+where, args...).Scan(&total); err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query("SELECT "+linkColumns+" FROM Links"+where+" ORDER BY ID LIMIT ? OFFSET ?", append(args, opts.limit(), opts.Offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []*Link{}
+	for rows.Next() {
+		link, err := s.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return newLinkPage(items, total, opts), nil
+}
+
+// LoadPage returns up to n links ordered by normalized name, starting after
+// cursor, and the cursor of the next page. The empty cursor starts at the
+// first link, and an empty next cursor means there are no more links.
+//
+// Cursors are opaque strings that may be persisted and passed to LoadPage
+// after a restart, or to another process using the same store, to resume a
+// sync. A cursor records the last link returned rather than an offset, so
+// resuming never repeats or skips links that existed throughout the sync:
+// links saved or deleted after the cursor's position are seen (or not) as
+// they are when their page is loaded, and links added before it are only
+// seen by a new sync. A cursor stays valid even if the link it names is
+// deleted. A string that is not a cursor returns an error wrapping
+// ErrInvalidCursor.
+//
+// The caller owns the returned values.
+func (s *SQLiteDB) LoadPage(cursor string, n int) ([]*Link, string, error) {
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if n <= 0 {
+		return nil, "", fmt.Errorf("invalid page size %d", n)
+	}
+	// Load one extra link to tell whether there is another page.
+	rows, err := s.db.Query("SELECT "+linkColumns+" FROM Links WHERE ID > ? ORDER BY ID LIMIT ?", after, n+1)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	var links []*Link
+	for rows.Next() {
+		link, err := s.scan(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	return pageLinks(links, n)
+}
+
+// RandomLink returns a link chosen uniformly at random, such as for a "link
+// of the day", using s.Rand so that tests can make the choice
+// deterministic. Only the chosen link is loaded.
+//
+// It returns fs.ErrNotExist if there are no links.
+func (s *SQLiteDB) RandomLink() (*Link, error) {
+	tx, err := s.db.BeginTx(context.TODO(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var count int64
+	if err := tx.QueryRow("SELECT count(*) FROM Links").Scan(&count); err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, fs.ErrNotExist
+	}
+	row := tx.QueryRow("SELECT "+linkColumns+" FROM Links ORDER BY ID LIMIT 1 OFFSET ?", s.randInt63n(count))
+	link, err := s.scan(row)
+	if err != nil {
+		return nil, err
+	}
+	return s.transform(link), nil
+}
+
+// LoadMostEdited returns the n links that have been saved the most times,
+// most edited first, to find links that keep being changed.
+//
+// The caller owns the returned values.
+func (s *SQLiteDB) LoadMostEdited(n int) ([]*Link, error) {
+	var links []*Link
+	rows, err := s.db.Query("SELECT "+linkColumns+" FROM Links ORDER BY EditCount DESC, ID LIMIT ?", n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		link, err := s.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// LoadAllMap returns all stored Links keyed by their Short name.
+//
+// It returns an error if two links normalize to the same ID.
+//
+// The caller owns the returned values.
+func (s *SQLiteDB) LoadAllMap() (map[string]*Link, error) {
+	links, err := s.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+	return linkMap(links)
+}
+
+// FindCollisions returns, keyed by normalized ID, each set of links with
+// different short names that normalize to the same ID. Such collisions can
+// be left behind by changes to normalization or by imports. An empty map
+// means there are no collisions.
+//
+// The caller owns the returned values.
+func (s *SQLiteDB) FindCollisions() (map[string][]*Link, error) {
+	// IDs are unique in the Links table, but may have been computed by an
+	// older normalizer, so group by the current normalization of Short.
+	links, err := s.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+	return findCollisions(links), nil
+}
+
+// Renormalize recomputes the ID of every link under the current
+// normalization, so that links stored under an older one can be loaded by
+// their short names again. Their stats and the aliases pointing at them
+// are moved to the new IDs, and aliases are given new IDs from their own
+// names too. It returns the number of links whose IDs changed.
+//
+// The changes are made in one transaction. If two links or aliases would
+// have the same ID, nothing is changed, and the error names them; see
+// FindCollisions.
+func (s *SQLiteDB) Renormalize() (changed int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = s.retryBusy(func() error {
+		changed = 0
+		return s.inTx(func(tx *sql.Tx) error {
+			rows, err := tx.Query("SELECT ID, Short, Namespace FROM Links ORDER BY ID")
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			renames := make(map[string]string) // old ID -> new ID
+			byID := make(map[string]string)    // new ID -> link name
+			for rows.Next() {
+				var id string
+				var link Link
+				if err := rows.Scan(&id, &link.Short, &link.Namespace); err != nil {
+					return err
+				}
+				newID := linkID(link.Name())
+				if other, ok := byID[newID]; ok {
+					return fmt.Errorf("links %q and %q have the same normalized ID %q", other, link.Name(), newID)
+				}
+				byID[newID] = link.Name()
+				if newID != id {
+					renames[id] = newID
+				}
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			rows.Close()
+
+			// Aliases recorded without their name keep their IDs.
+			rows, err = tx.Query("SELECT ID, Short FROM Aliases ORDER BY ID")
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			aliasRenames := make(map[string]string) // old ID -> new ID
+			for rows.Next() {
+				var id, short string
+				if err := rows.Scan(&id, &short); err != nil {
+					return err
+				}
+				newID := id
+				if short != "" {
+					newID = linkID(short)
+				}
+				if other, ok := byID[newID]; ok {
+					return fmt.Errorf("%q and alias %q have the same normalized ID %q", other, short, newID)
+				}
+				byID[newID] = short
+				if newID != id {
+					aliasRenames[id] = newID
+				}
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			rows.Close()
+			if len(renames) == 0 && len(aliasRenames) == 0 {
+				return nil
+			}
+
+			// Rows are moved to temporary IDs first, so that one link can
+			// take another's old ID. Stats, Impressions and Aliases refer to
+			// IDs that don't exist in between, so foreign keys are checked
+			// only at commit.
+			if _, err := tx.Exec("PRAGMA defer_foreign_keys = ON"); err != nil {
+				return err
+			}
+			const tmp = "\x00renormalize:"
+			move := func(from, to string) error {
+				for _, q := range []string{
+					"UPDATE Links SET ID = ?1 WHERE ID = ?2",
+					"UPDATE Stats SET ID = ?1 WHERE ID = ?2",
+					"UPDATE Impressions SET ID = ?1 WHERE ID = ?2",
+					"UPDATE Aliases SET LinkID = ?1 WHERE LinkID = ?2",
+				} {
+					if _, err := tx.Exec(q, to, from); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			for id := range renames {
+				if err := move(id, tmp+id); err != nil {
+					return err
+				}
+			}
+			for id, newID := range renames {
+				if err := move(tmp+id, newID); err != nil {
+					return err
+				}
+			}
+			const renameAlias = "UPDATE Aliases SET ID = ?1 WHERE ID = ?2"
+			for id := range aliasRenames {
+				if _, err := tx.Exec(renameAlias, tmp+id, id); err != nil {
+					return err
+				}
+			}
+			for id, newID := range aliasRenames {
+				if _, err := tx.Exec(renameAlias, newID, tmp+id); err != nil {
+					return err
+				}
+			}
+			changed = len(renames)
+			return nil
+		})
+	})
+	return changed, err
+}
+
+// DetectCycles returns the cycles of links whose Long URL or destinations
+// point at each other through LinkHosts, such as go/a pointing at go/b and
+// go/b back at go/a, which redirect forever. See findCycles.
+func (s *SQLiteDB) DetectCycles() ([][]string, error) {
+	links, err := s.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+	return findCycles(links, s.linkHosts()), nil
+}
+
+// CheckLinks checks whether the destination of each stored link is still
+// reachable, making at most opts.Concurrency requests at once. Template
+// links can't be checked and are marked Unverifiable. The store is not
+// modified.
+func (s *SQLiteDB) CheckLinks(ctx context.Context, opts CheckOptions) ([]LinkHealth, error) {
+	links, err := s.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+	return checkLinks(ctx, links, opts)
+}
+
+// Load returns a Link by its short name. If short is an alias, the canonical
+// link is returned.
+//
+// It returns fs.ErrNotExist if the link does not exist.
+//
+// The caller owns the returned value.
+func (s *SQLiteDB) Load(short string) (*Link, error) {
+	if err := checkLoadShort(short); err != nil {
+		return nil, err
+	}
+	link, err := s.load(s.db, short)
+	if err != nil {
+		return nil, err
+	}
+	return s.transform(link), nil
+}
+
+// load is like Load, but queries q and does not apply s.LoadTransform.
+func (s *SQLiteDB) load(q interface {
+	QueryRow(string, ...any) *sql.Row
+}, short string) (*Link, error) {
+	row := q.QueryRow("SELECT "+linkColumns+" FROM Links WHERE ID = COALESCE((SELECT LinkID FROM Aliases WHERE ID = ?1), ?1) LIMIT 1", linkID(short))
+	link, err := s.scan(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = fs.ErrNotExist
+		}
+		return nil, err
+	}
+	return link, nil
+}
+
+// LoadWithMeta is like Load, but also returns the link's CreatedFrom, for
+// administrators investigating abuse.
+//
+// The caller owns the returned value.
+func (s *SQLiteDB) LoadWithMeta(short string) (*Link, error) {
+	if err := checkLoadShort(short); err != nil {
+		return nil, err
+	}
+	row := s.db.QueryRow("SELECT "+linkColumns+" FROM Links WHERE ID = COALESCE((SELECT LinkID FROM Aliases WHERE ID = ?1), ?1) LIMIT 1", linkID(short))
+	link, err := s.scanMeta(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = fs.ErrNotExist
+		}
+		return nil, err
+	}
+	return link, nil
+}
+
+// LoadWithStats returns a Link by its short name along with its total number
+// of clicks, in a single query. If short is an alias, the canonical link and
+// its clicks are returned.
+//
+// It returns fs.ErrNotExist if the link does not exist.
+//
+// The caller owns the returned value.
+func (s *SQLiteDB) LoadWithStats(short string) (*Link, int, error) {
+	if err := checkLoadShort(short); err != nil {
+		return nil, 0, err
+	}
+	var clicks int
+	row := s.db.QueryRow("SELECT "+linkColumns+", COALESCE(Totals.Clicks, 0) FROM Links LEFT JOIN (SELECT ID, sum(Clicks) AS Clicks FROM Stats GROUP BY ID) AS Totals ON Totals.ID = Links.ID WHERE Links.ID = COALESCE((SELECT LinkID FROM Aliases WHERE ID = ?1), ?1) LIMIT 1", linkID(short))
+	link, err := s.scan(row, &clicks)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = fs.ErrNotExist
+		}
+		return nil, 0, err
+	}
+	return link, clicks, nil
+}
+
+// LoadVersioned is like Load, but also returns the stored version of the
+// link, an opaque token to pass to SaveIfVersion. The version changes with
+// every change to the link, however it is made.
+//
+// The caller owns the returned value.
+func (s *SQLiteDB) LoadVersioned(short string) (*Link, string, error) {
+	if err := checkLoadShort(short); err != nil {
+		return nil, "", err
+	}
+	var version int64
+	row := s.db.QueryRow("SELECT "+linkColumns+", Links.Version FROM Links WHERE ID = COALESCE((SELECT LinkID FROM Aliases WHERE ID = ?1), ?1) LIMIT 1", linkID(short))
+	link, err := s.scan(row, &version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = fs.ErrNotExist
+		}
+		return nil, "", err
+	}
+	return s.transform(link), strconv.FormatInt(version, 10), nil
+}
+
+// SaveIfVersion saves link as Save does, but only if the stored link is
+// still at version, as returned by LoadVersioned. It returns an error
+// wrapping ErrConflict if the link has changed since, and fs.ErrNotExist
+// if it no longer exists.
+func (s *SQLiteDB) SaveIfVersion(link *Link, version string) error {
+	if err := s.checkReserved(link.Name()); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ev ChangeEvent
+	err := s.retryBusy(func() error {
+		return s.inTx(func(tx *sql.Tx) error {
+			var stored int64
+			err := tx.QueryRow("SELECT Version FROM Links WHERE ID = ?", linkID(link.Name())).Scan(&stored)
+			if errors.Is(err, sql.ErrNoRows) {
+				return fs.ErrNotExist
+			}
+			if err != nil {
+				return err
+			}
+			if strconv.FormatInt(stored, 10) != version {
+				return fmt.Errorf("%w: %q is no longer at version %s", ErrConflict, link.Name(), version)
+			}
+			ev, err = s.saveTx(tx, link)
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+	s.notify(ev)
+	return nil
+}
+
+// SaveNew saves link as Save does, but only if no link or alias has its
+// name, checking and saving in one transaction. It returns an error
+// wrapping ErrLinkExists otherwise.
+func (s *SQLiteDB) SaveNew(link *Link) error {
+	_, err := s.saveNew(link)
+	return err
+}
+
+// saveNew is SaveNew, returning the link as stored.
+func (s *SQLiteDB) saveNew(link *Link) (*Link, error) {
+	if err := s.checkReserved(link.Name()); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ev ChangeEvent
+	err := s.retryBusy(func() error {
+		return s.inTx(func(tx *sql.Tx) error {
+			id := linkID(link.Name())
+			var exists bool
+			if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM Links WHERE ID = ?1) OR EXISTS (SELECT 1 FROM Aliases WHERE ID = ?1)", id).Scan(&exists); err != nil {
+				return err
+			}
+			if exists {
+				return fmt.Errorf("%q: %w", link.Name(), ErrLinkExists)
+			}
+			var err error
+			ev, err = s.saveTx(tx, link)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.notify(ev)
+	return ev.Link, nil
+}
+
+// CreateRandomShort saves a link to long owned by owner under a new random
+// short name of length base58 characters, drawn from s.Rand, and returns
+// it, such as for shortening a URL without choosing a name. Each name is
+// saved with SaveNew semantics, so a name taken concurrently is never
+// overwritten; it is retried with another name, up to a bound, after which
+// an error wrapping ErrNoFreeShort is returned. Names are compared in
+// normalized form, which ignores case, so short lengths run out sooner than
+// the size of the alphabet suggests.
+func (s *SQLiteDB) CreateRandomShort(long, owner string, length int) (*Link, error) {
+	return s.createRandomShort(s.saveNew, long, owner, length)
+}
+
+// Save saves a Link.
+//
+// Defaults from s.Options are applied to unset fields of the stored link.
+// It returns an error wrapping ErrReservedShort if link.Short is reserved,
+// and an error if link.Short is already in use as an alias.
+func (s *SQLiteDB) Save(link *Link) error {
+	if err := s.checkReserved(link.Name()); err != nil {
+		return err
+	}
+	return s.SaveAdmin(link)
+}
+
+// SaveAdmin is like Save, but allows links with reserved short names.
+func (s *SQLiteDB) SaveAdmin(link *Link) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ev ChangeEvent
+	err := s.retryBusy(func() (err error) {
+		ev, err = s.save(link)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.notify(ev)
+	return nil
+}
+
+// SaveMany saves links as Save does, and reports how many were created and
+// how many replaced existing links. The links are saved in one transaction,
+// so if any can't be saved, none are, and the result is zero.
+func (s *SQLiteDB) SaveMany(links []*Link) (BatchResult, error) {
+	for _, link := range links {
+		if err := s.checkReserved(link.Name()); err != nil {
+			return BatchResult{}, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []ChangeEvent
+	err := s.retryBusy(func() error {
+		events = events[:0]
+		return s.inTx(func(tx *sql.Tx) error {
+			for _, link := range links {
+				ev, err := s.saveTx(tx, link)
+				if err != nil {
+					return err
+				}
+				events = append(events, ev)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return BatchResult{}, err
+	}
+	var result BatchResult
+	for _, ev := range events {
+		if ev.Type == ChangeCreate {
+			result.Created++
+		} else {
+			result.Updated++
+		}
+		s.notify(ev)
+	}
+	return result, nil
+}
+
+// save saves link, and returns the event describing the change.
+func (s *SQLiteDB) save(link *Link) (ev ChangeEvent, err error) {
+	err = s.inTx(func(tx *sql.Tx) error {
+		ev, err = s.saveTx(tx, link)
+		return err
+	})
+	return ev, err
+}
+
+// saveTx saves link as part of tx, and returns the event describing the
+// change. The checks and the save share tx, so that other connections can't
+// invalidate the checks before the save.
+func (s *SQLiteDB) saveTx(tx *sql.Tx, link *Link) (ChangeEvent, error) {
+	link, err := s.prepareSave(link)
+	if err != nil {
+		return ChangeEvent{}, err
+	}
+	stored, err := s.encodeFields(link)
+	if err != nil {
+		return ChangeEvent{}, err
+	}
+	values, err := linkValues(stored)
+	if err != nil {
+		return ChangeEvent{}, err
+	}
+
+	var canonical string
+	err = tx.QueryRow("SELECT LinkID FROM Aliases WHERE ID = ?", linkID(link.Name())).Scan(&canonical)
+	if err == nil {
+		return ChangeEvent{}, fmt.Errorf("%q is an alias of %q", link.Name(), canonical)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return ChangeEvent{}, err
+	}
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM Links WHERE ID = ?)", linkID(link.Name())).Scan(&exists); err != nil {
+		return ChangeEvent{}, err
+	}
+
+	if !exists && s.MaxTotalLinks > 0 {
+		var count int
+		if err := tx.QueryRow("SELECT count(*) FROM Links").Scan(&count); err != nil {
+			return ChangeEvent{}, err
+		}
+		if count >= s.MaxTotalLinks {
+			return ChangeEvent{}, &QuotaExceededError{Count: count, Limit: s.MaxTotalLinks}
+		}
+	}
+	if !exists && s.MaxLinksPerOwner > 0 && link.Owner != "" {
+		var count int
+		if err := tx.QueryRow("SELECT count(*) FROM Links WHERE Owner = ?", link.Owner).Scan(&count); err != nil {
+			return ChangeEvent{}, err
+		}
+		if count >= s.MaxLinksPerOwner {
+			return ChangeEvent{}, &QuotaExceededError{Owner: link.Owner, Count: count, Limit: s.MaxLinksPerOwner}
+		}
+	}
+	if !exists {
+		if err := s.checkCreationRate(link.Owner, &s.charged); err != nil {
+			return ChangeEvent{}, err
+		}
+	}
+
+	result, err := tx.Exec(saveLinkSQL, append([]any{linkID(link.Name())}, values...)...)
+	if err != nil {
+		return ChangeEvent{}, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return ChangeEvent{}, err
+	}
+	if rows != 1 {
+		return ChangeEvent{}, fmt.Errorf("expected to affect 1 row, affected %d", rows)
+	}
+	ev := ChangeEvent{Type: ChangeCreate, Short: link.Name(), Link: link}
+	if exists {
+		ev.Type = ChangeUpdate
+	}
+	return ev, nil
+}
+
+// LoadStats returns click stats for links. Stats rows whose link no longer
+// exists, which can be left behind if foreign keys were not enforced when
+// the link was deleted, are left out.
+func (s *SQLiteDB) LoadStats() (ClickStats, error) {
+	stats := make(map[string]int)
+	var err error
+	s.StatsSeq(context.Background())(func(e StatEntry, seqErr error) bool {
+		if seqErr != nil {
+			err = seqErr
+			return false
+		}
+		stats[e.Short] = e.Clicks
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// StatsSeq streams the total clicks of each link that has any, as LoadStats
+// returns them, in order of normalized name, without holding them all in
+// memory. Iteration stops with ctx.Err() if ctx is done.
+//
+// The query stays open while the sequence is iterated, so with an in-memory
+// database, which has a single connection, the loop must not use s.
+func (s *SQLiteDB) StatsSeq(ctx context.Context) StatEntrySeq {
+	return func(yield func(StatEntry, error) bool) {
+		// Joining Links skips orphaned stats.
+		rows, err := s.db.QueryContext(ctx, "SELECT Links.Short, Links.Namespace, sum(Stats.Clicks) FROM Stats JOIN Links ON Links.ID = Stats.ID GROUP BY Stats.ID ORDER BY Stats.ID")
+		if err != nil {
+			yield(StatEntry{}, err)
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var link Link
+			var clicks int
+			if err := rows.Scan(&link.Short, &link.Namespace, &clicks); err != nil {
+				yield(StatEntry{}, err)
+				return
+			}
+			if !yield(StatEntry{Short: link.Name(), Clicks: clicks}, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(StatEntry{}, err)
+		}
+	}
+}
+
+// LoadStatsSince returns the clicks on each link recorded by SaveStats at
+// or after t, keyed as by LoadStats, such as the clicks since an analytics
+// job last pulled them. The job records the time before each pull and
+// passes it to the next, so that no clicks are counted twice. Times are
+// compared as the stored Unix seconds, so a pull should not be made in the
+// same second as a flush.
+func (s *SQLiteDB) LoadStatsSince(t time.Time) (ClickStats, error) {
+	rows, err := s.db.Query("SELECT Links.Short, Links.Namespace, sum(Stats.Clicks) FROM Stats JOIN Links ON Links.ID = Stats.ID WHERE Stats.Created >= ? GROUP BY Stats.ID", t.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stats := make(ClickStats)
+	for rows.Next() {
+		var link Link
+		var clicks int
+		if err := rows.Scan(&link.Short, &link.Namespace, &clicks); err != nil {
+			return nil, err
+		}
+		stats[link.Name()] = clicks
+	}
+	return stats, rows.Err()
+}
+
+// LoadRawStats returns the clicks on the link short recorded by each
+// SaveStats call, oldest first, rather than their total, such as to chart
+// clicks over time. If short is an alias, the stats of its canonical link
+// are returned. A link that doesn't exist has no stats.
+func (s *SQLiteDB) LoadRawStats(short string) ([]StatRow, error) {
+	var stats []StatRow
+	var err error
+	s.rawStats(context.Background(), "WHERE Stats.ID = COALESCE((SELECT LinkID FROM Aliases WHERE ID = ?1), ?1)", linkID(short))(func(row StatRow, seqErr error) bool {
+		if seqErr != nil {
+			stats, err = nil, seqErr
+			return false
+		}
+		stats = append(stats, row)
+		return true
+	})
+	return stats, err
+}
+
+// LoadAllRawStats streams the clicks on every link recorded by each
+// SaveStats call, oldest first, as LoadRawStats returns them for one link.
+// Iteration stops with ctx.Err() if ctx is done.
+//
+// The query stays open while the sequence is iterated, so with an in-memory
+// database, which has a single connection, the loop must not use s.
+func (s *SQLiteDB) LoadAllRawStats(ctx context.Context) StatRowSeq {
+	return s.rawStats(ctx, "")
+}
+
+// rawStats streams the Stats rows selected by where, in the order they
+// were saved.
+func (s *SQLiteDB) rawStats(ctx context.Context, where string, args ...any) StatRowSeq {
+	return func(yield func(StatRow, error) bool) {
+		// Joining Links skips orphaned stats.
+		rows, err := s.db.QueryContext(ctx, "SELECT Links.Short, Links.Namespace, Stats.Created, Stats.Clicks FROM Stats JOIN Links ON Links.ID = Stats.ID "+where+" ORDER BY Stats.Created, Stats.rowid", args...)
+		if err != nil {
+			yield(StatRow{}, err)
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var link Link
+			var created int64
+			var clicks int
+			if err := rows.Scan(&link.Short, &link.Namespace, &created, &clicks); err != nil {
+				yield(StatRow{}, err)
+				return
+			}
+			if !yield(StatRow{Short: link.Name(), Created: time.Unix(created, 0).UTC(), Clicks: clicks}, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			yield(StatRow{}, err)
+		}
+	}
+}
+
+// LoadStatsForLinks returns the total clicks for each of the given links,
+// keyed by the short names as provided. The clicks of an alias are those
+// of its canonical link. Links that have never been clicked (or do not
+// exist) have 0 clicks.
+func (s *SQLiteDB) LoadStatsForLinks(shorts []string) (map[string]int, error) {
+	clicks := make(map[string]int, len(shorts))
+	if len(shorts) == 0 {
+		return clicks, nil
+	}
+	var ids []any
+	seen := make(map[string]bool)
+	for _, short := range shorts {
+		clicks[short] = 0
+		if id := linkID(short); !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	// Each requested ID is mapped to its canonical link's ID, if it is an
+	// alias, before its stats are summed.
+	values := strings.Repeat(", (?)", len(ids))[2:]
+	rows, err := s.db.Query("WITH Requested(ID) AS (VALUES "+values+") SELECT Requested.ID, sum(Stats.Clicks) FROM Requested JOIN Stats ON Stats.ID = COALESCE((SELECT LinkID FROM Aliases WHERE Aliases.ID = Requested.ID), Requested.ID) GROUP BY Requested.ID", ids...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	byID := make(map[string]int)
+	for rows.Next() {
+		var id string
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		byID[id] = n
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, short := range shorts {
+		clicks[short] = byID[linkID(short)]
+	}
+	return clicks, nil
+}
+
+// SaveStats records click stats for links.  The provided map includes
+// incremental clicks that have occurred since the last time SaveStats
+// was called, which are added to the totals. Clicks on an alias are
+// recorded against its canonical link.
+func (s *SQLiteDB) SaveStats(stats ClickStats) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.retryBusy(func() error { return s.saveStats(stats) })
+}
+
+func (s *SQLiteDB) saveStats(stats ClickStats) error {
+	tx, err := s.db.BeginTx(context.TODO(), nil)
+	if err != nil {
+		return err
+	}
+	now := s.now().Unix()
+	for short, clicks := range stats {
+		// Clicks for links that have since been deleted are dropped.
+		_, err := tx.Exec("INSERT INTO Stats (ID, Created, Clicks) SELECT ID, ?2, ?3 FROM Links WHERE ID = COALESCE((SELECT LinkID FROM Aliases WHERE ID = ?1), ?1)", linkID(short), now, clicks)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.Exec("INSERT INTO StatsMeta (ID, LastFlush) VALUES (0, ?) ON CONFLICT (ID) DO UPDATE SET LastFlush = excluded.LastFlush", now); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// IncrementAndGetClicks adds n clicks to the link short and returns its new
+// total, as one transaction, so that concurrent calls each see a distinct
+// total. Clicks on an alias count towards its canonical link. It returns
+// fs.ErrNotExist if the link doesn't exist.
+//
+// Unlike SaveStats, which flushes clicks counted in memory, each call is a
+// write to the database, so it should only be used where the running total
+// is needed at once, such as to show a visitor count, and not for every
+// redirect. The clicks are recorded as a Stats row, as a SaveStats call
+// would record them, but LastStatsFlush is not changed.
+func (s *SQLiteDB) IncrementAndGetClicks(short string, n int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var total int
+	err := s.retryBusy(func() error {
+		tx, err := s.db.BeginTx(context.TODO(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		var id string
+		err = tx.QueryRow("SELECT ID FROM Links WHERE ID = COALESCE((SELECT LinkID FROM Aliases WHERE ID = ?1), ?1)", linkID(short)).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fs.ErrNotExist
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO Stats (ID, Created, Clicks) VALUES (?, ?, ?)", id, s.now().Unix(), n); err != nil {
+			return err
+		}
+		if err := tx.QueryRow("SELECT sum(Clicks) FROM Stats WHERE ID = ?", id).Scan(&total); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// SaveImpressions adds impressions, the number of times each link was shown
+// since the last call, such as in a list of popular links, to the stored
+// totals. Like clicks, impressions of an alias are recorded against its
+// canonical link, and those of links that don't exist are dropped.
+func (s *SQLiteDB) SaveImpressions(impressions ClickStats) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.retryBusy(func() error {
+		tx, err := s.db.BeginTx(context.TODO(), nil)
+		if err != nil {
+			return err
+		}
+		for short, n := range impressions {
+			_, err := tx.Exec("INSERT INTO Impressions (ID, Impressions) SELECT ID, ?2 FROM Links WHERE ID = COALESCE((SELECT LinkID FROM Aliases WHERE ID = ?1), ?1) ON CONFLICT (ID) DO UPDATE SET Impressions = Impressions + excluded.Impressions", linkID(short), n)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// LoadImpressions returns the total impressions of each link that has any,
+// keyed as LoadStats keys clicks.
+func (s *SQLiteDB) LoadImpressions() (ClickStats, error) {
+	rows, err := s.db.Query("SELECT Links.Short, Links.Namespace, Impressions.Impressions FROM Impressions JOIN Links ON Links.ID = Impressions.ID WHERE Impressions.Impressions > 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	impressions := make(ClickStats)
+	for rows.Next() {
+		var link Link
+		var n int
+		if err := rows.Scan(&link.Short, &link.Namespace, &n); err != nil {
+			return nil, err
+		}
+		impressions[link.Name()] = n
+	}
+	return impressions, rows.Err()
+}
+
+// LoadCTR returns the click-through rate of each link that has been shown:
+// its total clicks divided by its total impressions. Links without
+// impressions are left out. Since clicks are counted however a link is
+// visited, not only from where it was shown, a rate can exceed 1.
+func (s *SQLiteDB) LoadCTR() (map[string]float64, error) {
+	impressions, err := s.LoadImpressions()
+	if err != nil {
+		return nil, err
+	}
+	clicks, err := s.LoadStats()
+	if err != nil {
+		return nil, err
+	}
+	return clickThroughRates(clicks, impressions), nil
+}
+
+// LoadStaleCandidates returns the n stalest links, stalest first, for
+// reviewing in a cleanup drive. Each link is scored by how few clicks it
+// has, how long since its clicks were last saved, and how long since it
+// was last edited, weighed by w. If n is negative, every link is returned.
+//
+// The caller owns the returned values.
+func (s *SQLiteDB) LoadStaleCandidates(n int, w StalenessWeights) ([]*LinkWithScore, error) {
+	links, err := s.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+	// Joining Links skips orphaned stats.
+	rows, err := s.db.Query("SELECT Stats.ID, sum(Stats.Clicks), max(Stats.Created) FROM Stats JOIN Links ON Links.ID = Stats.ID GROUP BY Stats.ID")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	activity := make(map[string]linkActivity)
+	for rows.Next() {
+		var id string
+		var clicks int
+		var last int64
+		if err := rows.Scan(&id, &clicks, &last); err != nil {
+			return nil, err
+		}
+		activity[id] = linkActivity{clicks: clicks, lastAccessed: time.Unix(last, 0).UTC()}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return staleCandidates(links, activity, w, s.now(), n), nil
 }
 
-//go:embed schema.sql
-var sqlSchema string
-
-// NewSQLiteDB returns a new SQLiteDB that stores links in a SQLite database stored at f.
-func NewSQLiteDB(f string) (*SQLiteDB, error) {
-	db, err := sql.Open("sqlite", f)
+// LastStatsFlush returns when SaveStats last succeeded, or the zero time if
+// it never has.
+func (s *SQLiteDB) LastStatsFlush() (time.Time, error) {
+	var flushed int64
+	err := s.db.QueryRow("SELECT LastFlush FROM StatsMeta WHERE ID = 0").Scan(&flushed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
 	if err != nil {
-		return nil, err
+		return time.Time{}, err
 	}
-	if err := db.Ping(); err != nil {
+	return time.Unix(flushed, 0).UTC(), nil
+}
+
+// DBStats returns the number of rows in each table of the database, and the
+// size of the database file according to its page count.
+func (s *SQLiteDB) DBStats() (*StorageStats, error) {
+	st := new(StorageStats)
+	err := s.db.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM Links),
+		(SELECT COUNT(*) FROM Aliases),
+		(SELECT COUNT(*) FROM Stats),
+		(SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size())`,
+	).Scan(&st.Links, &st.Aliases, &st.StatsRows, &st.SizeBytes)
+	if err != nil {
 		return nil, err
 	}
+	return st, nil
+}
+
+// Touch sets the LastEdit time of a link to now, without otherwise changing
+// it, to record that the link was reviewed. If short is an alias, its
+// canonical link is touched.
+//
+// It returns fs.ErrNotExist if the link does not exist.
+func (s *SQLiteDB) Touch(short string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.retryBusy(func() error {
+		now := s.storedTime(s.now())
+		result, err := s.db.Exec("UPDATE Links SET LastEdit = ?2, LastEditMillis = ?3, Version = Version + 1 WHERE ID = COALESCE((SELECT LinkID FROM Aliases WHERE ID = ?1), ?1)", linkID(short), now.Unix(), millis(now))
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rows == 0 {
+			return fs.ErrNotExist
+		}
+		return nil
+	})
+}
+
+// ConsumeUse records a use of a link and returns it, with UseCount
+// including this use. If short is an alias, its canonical link is used. The
+// count is checked and incremented in one transaction, so a link with
+// MaxUses is never returned more than MaxUses times, however many callers
+// race for it.
+//
+// It returns ErrLinkExhausted if the link has already been used MaxUses
+// times, and fs.ErrNotExist if the link does not exist. With
+// DeleteExhaustedLinks, the last use deletes the link, so later calls
+// return fs.ErrNotExist.
+func (s *SQLiteDB) ConsumeUse(short string) (*Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if _, err = db.Exec(sqlSchema); err != nil {
+	var link *Link
+	var deleted bool
+	err := s.retryBusy(func() error {
+		deleted = false
+		return s.inTx(func(tx *sql.Tx) error {
+			var err error
+			if link, err = s.load(tx, short); err != nil {
+				return err
+			}
+			result, err := tx.Exec("UPDATE Links SET UseCount = UseCount + 1, Version = Version + 1 WHERE ID = ? AND (MaxUses = 0 OR UseCount < MaxUses)", linkID(link.Name()))
+			if err != nil {
+				return err
+			}
+			rows, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if rows == 0 {
+				return fmt.Errorf("%q: %w", short, ErrLinkExhausted)
+			}
+			link.UseCount++
+			if s.DeleteExhaustedLinks && link.MaxUses > 0 && link.UseCount >= link.MaxUses {
+				deleted = true
+				_, err := deleteTx(tx, link.Name())
+				return err
+			}
+			return nil
+		})
+	})
+	if err != nil {
 		return nil, err
 	}
+	if deleted {
+		s.notify(ChangeEvent{Type: ChangeDelete, Short: link.Name()})
+	}
+	return s.transform(link), nil
+}
 
-	return &SQLiteDB{db: db}, nil
+// Pin marks a link as Pinned, without otherwise changing it. If short is an
+// alias, its canonical link is pinned.
+//
+// It returns fs.ErrNotExist if the link does not exist.
+func (s *SQLiteDB) Pin(short string) error {
+	return s.setPinned(short, true)
 }
 
-// LoadAll returns all stored Links.
+// Unpin clears the Pinned mark of a link, as Pin sets it.
+func (s *SQLiteDB) Unpin(short string) error {
+	return s.setPinned(short, false)
+}
+
+func (s *SQLiteDB) setPinned(short string, pinned bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.retryBusy(func() error {
+		result, err := s.db.Exec("UPDATE Links SET Pinned = ?2, Version = Version + 1 WHERE ID = COALESCE((SELECT LinkID FROM Aliases WHERE ID = ?1), ?1)", linkID(short), pinned)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rows == 0 {
+			return fs.ErrNotExist
+		}
+		return nil
+	})
+}
+
+// LoadPinned returns the Pinned links, most recently edited first.
 //
 // The caller owns the returned values.
-func (s *SQLiteDB) LoadAll() ([]*Link, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
+func (s *SQLiteDB) LoadPinned() ([]*Link, error) {
 	var links []*Link
-	rows, err := s.db.Query("SELECT Short, Long, Created, LastEdit, Owner FROM Links")
+	rows, err := s.db.Query("SELECT " + linkColumns + " FROM Links WHERE Pinned ORDER BY LastEdit DESC, LastEditMillis DESC, ID")
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
-		link := new(Link)
-		var created, lastEdit int64
-		err := rows.Scan(&link.Short, &link.Long, &created, &lastEdit, &link.Owner)
+		link, err := s.scan(rows)
 		if err != nil {
 			return nil, err
 		}
-		link.Created = time.Unix(created, 0).UTC()
-		link.LastEdit = time.Unix(lastEdit, 0).UTC()
 		links = append(links, link)
 	}
 	return links, rows.Err()
 }
 
-// Load returns a Link by its short name.
-//
-// It returns fs.ErrNotExist if the link does not exist.
+// UpdateLong sets the Long URL of a link to newLong and its LastEdit time
+// to now, but only if its Long URL is still expectedOld, so that an edit
+// doesn't clobber a concurrent one. If short is an alias, its canonical
+// link is updated. Checking that newLong is reachable is left to the
+// caller.
 //
-// The caller owns the returned value.
-func (s *SQLiteDB) Load(short string) (*Link, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// It returns an error wrapping ErrConflict if the stored Long URL is not
+// expectedOld, and fs.ErrNotExist if the link does not exist.
+func (s *SQLiteDB) UpdateLong(short, expectedOld, newLong string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	link := new(Link)
-	var created, lastEdit int64
-	row := s.db.QueryRow("SELECT Short, Long, Created, LastEdit, Owner FROM Links WHERE ID = ?1 LIMIT 1", linkID(short))
-	err := row.Scan(&link.Short, &link.Long, &created, &lastEdit, &link.Owner)
+	var ev ChangeEvent
+	err := s.retryBusy(func() error {
+		return s.inTx(func(tx *sql.Tx) error {
+			link, err := s.load(tx, short)
+			if err != nil {
+				return err
+			}
+			if link.Long != expectedOld {
+				return fmt.Errorf("%w: %q no longer points to %q", ErrConflict, link.Name(), expectedOld)
+			}
+			link.Long = newLong
+			link.LastEdit = s.now().UTC()
+			ev, err = s.saveTx(tx, link)
+			return err
+		})
+	})
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			err = fs.ErrNotExist
-		}
-		return nil, err
+		return err
 	}
-	link.Created = time.Unix(created, 0).UTC()
-	link.LastEdit = time.Unix(lastEdit, 0).UTC()
-	return link, nil
+	s.notify(ev)
+	return nil
 }
 
-// Save saves a Link.
-func (s *SQLiteDB) Save(link *Link) error {
+// RewriteLongs replaces each occurrence of match in the Long URL of every
+// link with replace, such as to move links to a new host, and sets their
+// LastEdit to now. It returns the number of links changed. Links are
+// rewritten in one transaction, and none are changed if any rewritten URL
+// would be invalid; the error then names each such link.
+func (s *SQLiteDB) RewriteLongs(match, replace string) (int, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	result, err := s.db.Exec("INSERT OR REPLACE INTO Links (ID, Short, Long, Created, LastEdit, Owner) VALUES (?, ?, ?, ?, ?, ?)", linkID(link.Short), link.Short, link.Long, link.Created.Unix(), link.LastEdit.Unix(), link.Owner)
+	var events []ChangeEvent
+	err := s.retryBusy(func() error {
+		events = nil
+		return s.inTx(func(tx *sql.Tx) error {
+			links, err := s.loadStored(tx)
+			if err != nil {
+				return err
+			}
+			changed, err := s.planRewrite(links, match, replace)
+			if err != nil {
+				return err
+			}
+			now := s.now().UTC()
+			for _, link := range changed {
+				link.LastEdit = now
+				ev, err := s.saveTx(tx, link)
+				if err != nil {
+					return err
+				}
+				events = append(events, ev)
+			}
+			return nil
+		})
+	})
 	if err != nil {
-		return err
+		return 0, err
 	}
-	rows, err := result.RowsAffected()
+	for _, ev := range events {
+		s.notify(ev)
+	}
+	return len(events), nil
+}
+
+// SetOwners sets the Owner of each link named in mapping to the owner it
+// maps to, and its LastEdit to now, such as to apply a reassignment after a
+// reorganization. It returns the number of links changed. The links are
+// changed in one transaction. Names without a link are skipped, and
+// reported by a *MissingLinksError once the other links are changed.
+func (s *SQLiteDB) SetOwners(mapping map[string]string) (int, error) {
+	shorts := make([]string, 0, len(mapping))
+	for short := range mapping {
+		shorts = append(shorts, short)
+	}
+	sort.Strings(shorts)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []ChangeEvent
+	var missing []string
+	err := s.retryBusy(func() error {
+		events, missing = nil, nil
+		return s.inTx(func(tx *sql.Tx) error {
+			now := s.now().UTC()
+			for _, short := range shorts {
+				link, err := s.load(tx, short)
+				if errors.Is(err, fs.ErrNotExist) {
+					missing = append(missing, short)
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				link.Owner = mapping[short]
+				link.LastEdit = now
+				ev, err := s.saveTx(tx, link)
+				if err != nil {
+					return err
+				}
+				events = append(events, ev)
+			}
+			return nil
+		})
+	})
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if rows != 1 {
-		return fmt.Errorf("expected to affect 1 row, affected %d", rows)
+	for _, ev := range events {
+		s.notify(ev)
 	}
-	return nil
+	if len(missing) > 0 {
+		return len(events), &MissingLinksError{Shorts: missing}
+	}
+	return len(events), nil
 }
 
-// LoadStats returns click stats for links.
-func (s *SQLiteDB) LoadStats() (ClickStats, error) {
-	allLinks, err := s.LoadAll()
+// PreviewRewriteLongs returns the names of the links that RewriteLongs
+// would change, without changing them, or the error it would return.
+func (s *SQLiteDB) PreviewRewriteLongs(match, replace string) ([]string, error) {
+	links, err := s.loadStored(s.db)
 	if err != nil {
 		return nil, err
 	}
-	linkmap := make(map[string]string, len(allLinks)) // map ID => Short
-	for _, link := range allLinks {
-		linkmap[linkID(link.Short)] = link.Short
+	changed, err := s.planRewrite(links, match, replace)
+	if err != nil {
+		return nil, err
 	}
+	return linkNames(changed), nil
+}
 
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	rows, err := s.db.Query("SELECT ID, sum(Clicks) FROM Stats GROUP BY ID")
+// loadStored returns all links as stored, querying q and not applying
+// s.LoadTransform.
+func (s *SQLiteDB) loadStored(q interface {
+	Query(string, ...any) (*sql.Rows, error)
+}) ([]*Link, error) {
+	rows, err := q.Query("SELECT " + linkColumns + " FROM Links")
 	if err != nil {
 		return nil, err
 	}
-	stats := make(map[string]int)
+	defer rows.Close()
+	var links []*Link
 	for rows.Next() {
-		var id string
-		var clicks int
-		err := rows.Scan(&id, &clicks)
+		link, err := s.scan(rows)
 		if err != nil {
 			return nil, err
 		}
-		short := linkmap[id]
-		stats[short] = clicks
+		links = append(links, link)
 	}
-	return stats, rows.Err()
+	return links, rows.Err()
 }
 
-// SaveStats records click stats for links.  The provided map includes
-// incremental clicks that have occurred since the last time SaveStats
-// was called.
-func (s *SQLiteDB) SaveStats(stats ClickStats) error {
+// ResetAllStats deletes the click stats of every link, leaving the links
+// themselves alone.
+func (s *SQLiteDB) ResetAllStats() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.retryBusy(func() error {
+		_, err := s.db.Exec("DELETE FROM Stats")
+		return err
+	})
+}
+
+// Delete removes a link by its short name, along with its stats and aliases.
+// If short is an alias, only the alias is removed, and observers are not
+// notified, since no link was deleted.
+//
+// It returns fs.ErrNotExist if the link does not exist.
+func (s *SQLiteDB) Delete(short string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var link bool
+	err := s.retryBusy(func() (err error) {
+		link, err = s.delete(short)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if link {
+		s.notify(ChangeEvent{Type: ChangeDelete, Short: short})
+	}
+	return nil
+}
+
+func (s *SQLiteDB) delete(short string) (link bool, err error) {
+	err = s.inTx(func(tx *sql.Tx) (err error) {
+		link, err = deleteTx(tx, short)
+		return err
+	})
+	return link, err
+}
+
+// DeleteMany removes the links with the given short names, along with
+// their stats and aliases, in one transaction, and returns how many were
+// deleted. Names without a link, including those of aliases, are skipped.
+func (s *SQLiteDB) DeleteMany(shorts []string) (deleted int, err error) {
+	if len(shorts) == 0 {
+		return 0, nil
+	}
+	names := make(map[string]string, len(shorts)) // by ID, for change events
+	var ids []any
+	for _, short := range shorts {
+		id := linkID(short)
+		if _, ok := names[id]; !ok {
+			names[id] = short
+			ids = append(ids, id)
+		}
+	}
+	in := "IN (" + strings.Repeat(", ?", len(ids))[2:] + ")"
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	var existing []string
+	err = s.retryBusy(func() error {
+		existing = nil
+		return s.inTx(func(tx *sql.Tx) error {
+			rows, err := tx.Query("SELECT ID FROM Links WHERE ID "+in, ids...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var id string
+				if err := rows.Scan(&id); err != nil {
+					return err
+				}
+				existing = append(existing, id)
+			}
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			// As in deleteTx, dependent rows are removed explicitly in case
+			// foreign keys are not being enforced.
+			for _, q := range []string{
+				"DELETE FROM Stats WHERE ID " + in,
+				"DELETE FROM Impressions WHERE ID " + in,
+				"DELETE FROM Aliases WHERE LinkID " + in,
+				"DELETE FROM Links WHERE ID " + in,
+			} {
+				if _, err := tx.Exec(q, ids...); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range existing {
+		s.notify(ChangeEvent{Type: ChangeDelete, Short: names[id]})
+	}
+	return len(existing), nil
+}
+
+// deleteTx deletes a link as part of tx, or the alias short if there is no
+// such link, and reports whether it was a link.
+func deleteTx(tx *sql.Tx, short string) (link bool, err error) {
+	id := linkID(short)
+
+	// The Stats, Impressions and Aliases foreign keys cascade the delete,
+	// but stats are removed explicitly too so that they never outlive the
+	// link even if foreign keys are not being enforced.
+	if _, err := tx.Exec("DELETE FROM Stats WHERE ID = ?", id); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("DELETE FROM Impressions WHERE ID = ?", id); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("DELETE FROM Aliases WHERE LinkID = ?", id); err != nil {
+		return false, err
+	}
+	result, err := tx.Exec("DELETE FROM Links WHERE ID = ?", id)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if rows > 0 {
+		return true, nil
+	}
+	result, err = tx.Exec("DELETE FROM Aliases WHERE ID = ?", id)
+	if err != nil {
+		return false, err
+	}
+	if rows, err = result.RowsAffected(); err != nil {
+		return false, err
+	}
+	if rows == 0 {
+		return false, fs.ErrNotExist
+	}
+	return false, nil
+}
+
+// inTx runs f in a new transaction, which is committed if f succeeds and
+// rolled back otherwise. Link creations counted against s.CreationLimiter
+// by a transaction that doesn't commit are refunded, so that neither
+// failed batches nor busy retries count against owners. The caller must
+// hold s.mu.
+func (s *SQLiteDB) inTx(f func(tx *sql.Tx) error) (err error) {
+	s.charged = s.charged[:0]
+	defer func() {
+		if err != nil && len(s.charged) > 0 {
+			s.refundCreations(s.charged)
+		}
+		s.charged = s.charged[:0]
+	}()
 	tx, err := s.db.BeginTx(context.TODO(), nil)
 	if err != nil {
 		return err
 	}
-	now := time.Now().Unix()
-	for short, clicks := range stats {
-		_, err := tx.Exec("INSERT INTO Stats (ID, Created, Clicks) VALUES (?, ?, ?)", linkID(short), now, clicks)
-		if err != nil {
-			tx.Rollback()
+	defer tx.Rollback()
+	if err := f(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Batch runs f with a StoreTx whose operations all happen in a single
+// transaction, so that several changes succeed or fail together. The
+// transaction is committed if f returns nil, and rolled back if it returns
+// an error, which Batch returns. OnChange observers are notified only once
+// the transaction has committed.
+//
+// Other writes wait until f returns, so f should not block. Unlike the
+// other writes, Batch does not retry if the database is busy, since f
+// might not be safe to run twice.
+func (s *SQLiteDB) Batch(f func(tx StoreTx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []ChangeEvent
+	err := s.inTx(func(tx *sql.Tx) error {
+		stx := &sqliteTx{s: s, tx: tx}
+		if err := f(stx); err != nil {
 			return err
 		}
+		events = stx.events
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-	return tx.Commit()
+	for _, ev := range events {
+		s.notify(ev)
+	}
+	return nil
+}
+
+// sqliteTx is the StoreTx passed to the function run by SQLiteDB.Batch.
+type sqliteTx struct {
+	s      *SQLiteDB
+	tx     *sql.Tx
+	events []ChangeEvent // to notify once committed
+}
+
+// Load returns a Link by its short name, including changes made earlier
+// in the transaction. Options.LoadTransform is not applied.
+func (t *sqliteTx) Load(short string) (*Link, error) {
+	return t.s.load(t.tx, short)
+}
+
+func (t *sqliteTx) Save(link *Link) error {
+	if err := t.s.checkReserved(link.Name()); err != nil {
+		return err
+	}
+	ev, err := t.s.saveTx(t.tx, link)
+	if err != nil {
+		return err
+	}
+	t.events = append(t.events, ev)
+	return nil
+}
+
+func (t *sqliteTx) Delete(short string) error {
+	link, err := deleteTx(t.tx, short)
+	if err != nil {
+		return err
+	}
+	if link {
+		t.events = append(t.events, ChangeEvent{Type: ChangeDelete, Short: short})
+	}
+	return nil
+}
+
+func (t *sqliteTx) Alias(newShort, canonicalShort string) error {
+	return aliasTx(t.tx, newShort, canonicalShort)
+}
+
+// Alias records newShort as an alias of the link canonicalShort. Loading
+// newShort returns the canonical link, and clicks recorded for newShort are
+// counted towards the canonical link.
+//
+// If canonicalShort is itself an alias, newShort becomes an alias of the link
+// it points to. Aliases do not outlive their canonical link: deleting the
+// canonical link deletes its aliases too.
+//
+// It returns fs.ErrNotExist if canonicalShort does not exist.
+func (s *SQLiteDB) Alias(newShort, canonicalShort string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.retryBusy(func() error { return s.alias(newShort, canonicalShort) })
+}
+
+func (s *SQLiteDB) alias(newShort, canonicalShort string) error {
+	return s.inTx(func(tx *sql.Tx) error { return aliasTx(tx, newShort, canonicalShort) })
+}
+
+// aliasTx records an alias as part of tx.
+func aliasTx(tx *sql.Tx, newShort, canonicalShort string) error {
+	var target string
+	row := tx.QueryRow("SELECT ID FROM Links WHERE ID = COALESCE((SELECT LinkID FROM Aliases WHERE ID = ?1), ?1) LIMIT 1", linkID(canonicalShort))
+	if err := row.Scan(&target); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			err = fs.ErrNotExist
+		}
+		return err
+	}
+
+	id := linkID(newShort)
+	if id == target {
+		return fmt.Errorf("cannot alias %q to itself", newShort)
+	}
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM Links WHERE ID = ?)", id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("alias %q conflicts with an existing link", newShort)
+	}
+
+	_, err := tx.Exec("INSERT OR REPLACE INTO Aliases (ID, Short, LinkID) VALUES (?, ?, ?)", id, newShort, target)
+	return err
+}
+
+// DumpSQL writes SQL statements to w that recreate the database's schema and
+// data, suitable for loading into an empty database with `sqlite3 < dump.sql`.
+// Rows are written as they are read, from a single read transaction, so the
+// dump is consistent and memory use doesn't grow with the database.
+func (s *SQLiteDB) DumpSQL(w io.Writer) error {
+	tx, err := s.db.BeginTx(context.TODO(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	type object struct{ typ, name, sql string }
+	var objects []object
+	rows, err := tx.Query("SELECT type, name, sql FROM sqlite_master WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_%' ORDER BY type = 'table' DESC, rowid")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var o object
+		if err := rows.Scan(&o.typ, &o.name, &o.sql); err != nil {
+			rows.Close()
+			return err
+		}
+		objects = append(objects, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// The schema version is restored too, so that a database loaded from
+	// the dump is checked and migrated as the original would be.
+	var version int
+	if err := tx.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	// Tables are written in creation order, which need not satisfy their
+	// foreign keys, so the dump disables them while loading.
+	io.WriteString(bw, "PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\n")
+	fmt.Fprintf(bw, "PRAGMA user_version=%d;\n", version)
+	for _, o := range objects {
+		fmt.Fprintf(bw, "%s;\n", o.sql)
+		if o.typ != "table" {
+			continue
+		}
+		if err := dumpTable(tx, bw, o.name); err != nil {
+			return fmt.Errorf("dumping %s: %w", o.name, err)
+		}
+	}
+	io.WriteString(bw, "COMMIT;\n")
+	return bw.Flush()
+}
+
+// dumpTable writes an INSERT statement to w for each row of table.
+func dumpTable(tx *sql.Tx, w *bufio.Writer, table string) error {
+	rows, err := tx.Query("SELECT * FROM " + quoteIdent(table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = quoteIdent(c)
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (", quoteIdent(table), strings.Join(quoted, ", "))
+
+	values := make([]any, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		w.WriteString(insert)
+		for i, v := range values {
+			if i > 0 {
+				w.WriteString(", ")
+			}
+			w.WriteString(sqlLiteral(v))
+		}
+		if _, err := w.WriteString(");\n"); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// quoteIdent quotes a SQL identifier.
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// sqlLiteral returns v, a value scanned from a SQLite row, as a SQL literal.
+func sqlLiteral(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			return "NULL" // SQLite stores NaN as NULL
+		case math.IsInf(v, 1):
+			return "9e999"
+		case math.IsInf(v, -1):
+			return "-9e999"
+		}
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0" // keep the value a REAL
+		}
+		return s
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case []byte:
+		return fmt.Sprintf("X'%x'", v)
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	case time.Time:
+		return "'" + v.Format(time.RFC3339Nano) + "'"
+	}
+	return "'" + strings.ReplaceAll(fmt.Sprint(v), "'", "''") + "'"
 }
@@ -14,10 +14,20 @@ import type {
   FilterApi,
   FunctionReference,
 } from "convex/server";
+import type * as alias from "../alias";
 import type * as clear from "../clear";
+import type * as consumeUse from "../consumeUse";
 import type * as load from "../load";
+import type * as pin from "../pin";
+import type * as remove from "../remove";
+import type * as renormalize from "../renormalize";
+import type * as rewriteLongs from "../rewriteLongs";
+import type * as setOwners from "../setOwners";
 import type * as stats from "../stats";
 import type * as store from "../store";
+import type * as storeMany from "../storeMany";
+import type * as touch from "../touch";
+import type * as updateLong from "../updateLong";
 
 /**
  * A utility for referencing Convex functions in your app's API.
@@ -28,10 +38,20 @@ import type * as store from "../store";
  * ```
  */
 declare const fullApi: ApiFromModules<{
+  alias: typeof alias;
   clear: typeof clear;
+  consumeUse: typeof consumeUse;
   load: typeof load;
+  pin: typeof pin;
+  remove: typeof remove;
+  renormalize: typeof renormalize;
+  rewriteLongs: typeof rewriteLongs;
+  setOwners: typeof setOwners;
   stats: typeof stats;
   store: typeof store;
+  storeMany: typeof storeMany;
+  touch: typeof touch;
+  updateLong: typeof updateLong;
 }>;
 export declare const api: FilterApi<
   typeof fullApi,
@@ -0,0 +1,53 @@
+import { mutation } from "./_generated/server";
+import { v } from "convex/values";
+
+export default mutation({
+  args: {
+    normalizedId: v.string(),
+    short: v.string(),
+    canonicalId: v.string(),
+    token: v.string(),
+  },
+  handler: async (ctx, { normalizedId, short, canonicalId, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    let canonical = await ctx.db
+      .query("links")
+      .withIndex("by_normalizedId", (q) => q.eq("normalizedId", canonicalId))
+      .first();
+    if (canonical === null) {
+      // canonicalId may itself be an alias; point at the link it resolves to.
+      const alias = await ctx.db
+        .query("aliases")
+        .withIndex("by_normalizedId", (q) => q.eq("normalizedId", canonicalId))
+        .first();
+      if (alias !== null) {
+        canonical = await ctx.db.get(alias.link);
+      }
+    }
+    if (canonical === null) {
+      throw new Error(`Link not found: ${canonicalId}`);
+    }
+    if (canonical.normalizedId === normalizedId) {
+      throw new Error(`Cannot alias ${short} to itself`);
+    }
+    const conflict = await ctx.db
+      .query("links")
+      .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+      .first();
+    if (conflict !== null) {
+      throw new Error(`Alias ${short} conflicts with an existing link`);
+    }
+    const alias = { normalizedId, short, link: canonical._id };
+    const existing = await ctx.db
+      .query("aliases")
+      .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+      .first();
+    if (existing !== null) {
+      await ctx.db.replace(existing._id, alias);
+      return;
+    }
+    await ctx.db.insert("aliases", alias);
+  },
+});
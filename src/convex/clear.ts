@@ -14,6 +14,15 @@ export default mutation({
     for await (const stat of ctx.db.query("stats").fullTableScan()) {
       deletions.push(ctx.db.delete(stat._id));
     }
+    for await (const alias of ctx.db.query("aliases").fullTableScan()) {
+      deletions.push(ctx.db.delete(alias._id));
+    }
+    for await (const meta of ctx.db.query("statsMeta").fullTableScan()) {
+      deletions.push(ctx.db.delete(meta._id));
+    }
+    for await (const counter of ctx.db.query("linkCount").fullTableScan()) {
+      deletions.push(ctx.db.delete(counter._id));
+    }
     await Promise.all(deletions);
   },
 });
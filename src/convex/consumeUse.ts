@@ -0,0 +1,46 @@
+import { mutation } from "./_generated/server";
+import { v } from "convex/values";
+import { deleteLink } from "./remove";
+
+export default mutation({
+  args: {
+    normalizedId: v.string(),
+    deleteExhausted: v.boolean(),
+    token: v.string(),
+  },
+  handler: async (ctx, { normalizedId, deleteExhausted, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    let link = await ctx.db
+      .query("links")
+      .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+      .first();
+    if (link === null) {
+      const alias = await ctx.db
+        .query("aliases")
+        .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+        .first();
+      if (alias !== null) {
+        link = await ctx.db.get(alias.link);
+      }
+    }
+    if (link === null) {
+      return { status: "missing" };
+    }
+    // Mutations are transactions, so concurrent uses can't both pass this
+    // check for the last use.
+    const maxUses = link.maxUses ?? 0;
+    const useCount = (link.useCount ?? 0) + 1;
+    if (maxUses > 0 && useCount > maxUses) {
+      return { status: "exhausted" };
+    }
+    if (deleteExhausted && maxUses > 0 && useCount >= maxUses) {
+      await deleteLink(ctx, link._id);
+      return { status: "used", link: { ...link, useCount }, deleted: true };
+    }
+    const version = (link.version ?? 1) + 1;
+    await ctx.db.patch(link._id, { useCount, version });
+    return { status: "used", link: { ...link, useCount, version } };
+  },
+});
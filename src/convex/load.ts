@@ -1,16 +1,60 @@
-import { query } from "./_generated/server";
+import { query, QueryCtx } from "./_generated/server";
 import { v } from "convex/values";
 
+async function resolve(ctx: QueryCtx, normalizedId: string) {
+  const link = await ctx.db
+    .query("links")
+    .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+    .first();
+  if (link !== null) {
+    return link;
+  }
+  const alias = await ctx.db
+    .query("aliases")
+    .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+    .first();
+  if (alias === null) {
+    return null;
+  }
+  return await ctx.db.get(alias.link);
+}
+
 export const loadOne = query({
   args: { normalizedId: v.string(), token: v.string() },
   handler: async (ctx, { normalizedId, token }) => {
     if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
       throw new Error("Invalid authorization token");
     }
-    return await ctx.db
-      .query("links")
-      .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+    return await resolve(ctx, normalizedId);
+  },
+});
+
+export const loadMany = query({
+  args: { normalizedIds: v.array(v.string()), token: v.string() },
+  handler: async (ctx, { normalizedIds, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    // The result has a link, or null, for each ID, in order.
+    return await Promise.all(normalizedIds.map((id) => resolve(ctx, id)));
+  },
+});
+
+export const loadWithStats = query({
+  args: { normalizedId: v.string(), token: v.string() },
+  handler: async (ctx, { normalizedId, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    const link = await resolve(ctx, normalizedId);
+    if (link === null) {
+      return null;
+    }
+    const stat = await ctx.db
+      .query("stats")
+      .withIndex("byLink", (q) => q.eq("link", link._id))
       .first();
+    return { link, clicks: stat?.clicks ?? 0 };
   },
 });
 
@@ -24,3 +68,181 @@ export const loadAll = query({
     return await ctx.db.query("links").fullTableScan().collect();
   },
 });
+
+export const loadModifiedSince = query({
+  args: { since: v.number(), token: v.string() },
+  handler: async (ctx, { since, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    return await ctx.db
+      .query("links")
+      .withIndex("by_lastEdit", (q) => q.gte("lastEdit", since))
+      .collect();
+  },
+});
+
+export const loadCreatedBetween = query({
+  args: { from: v.number(), to: v.number(), token: v.string() },
+  handler: async (ctx, { from, to, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    // Index order is ascending by created.
+    return await ctx.db
+      .query("links")
+      .withIndex("by_created", (q) => q.gte("created", from).lte("created", to))
+      .collect();
+  },
+});
+
+export const loadOwnerless = query({
+  args: { token: v.string() },
+  handler: async (ctx, { token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    // Index order is ascending by created.
+    const links = await ctx.db.query("links").withIndex("by_created").collect();
+    return links.filter((link) => link.owner.trim() === "");
+  },
+});
+
+export const loadIDs = query({
+  args: { token: v.string() },
+  handler: async (ctx, { token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    // Documents are read whole, but only their IDs are sent back.
+    const links = await ctx.db
+      .query("links")
+      .withIndex("by_normalizedId")
+      .collect();
+    return links.map((link) => link.normalizedId);
+  },
+});
+
+export const countBySource = query({
+  args: { token: v.string() },
+  handler: async (ctx, { token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    let counts: Record<string, number> = {};
+    for await (const link of ctx.db.query("links")) {
+      const source = link.source ?? "";
+      counts[source] = (counts[source] ?? 0) + 1;
+    }
+    return counts;
+  },
+});
+
+export const loadPinned = query({
+  args: { token: v.string() },
+  handler: async (ctx, { token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    return await ctx.db
+      .query("links")
+      .withIndex("by_lastEdit")
+      .order("desc")
+      .filter((q) => q.eq(q.field("pinned"), true))
+      .collect();
+  },
+});
+
+export const loadPage = query({
+  args: { after: v.string(), n: v.number(), token: v.string() },
+  handler: async (ctx, { after, n, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    return await ctx.db
+      .query("links")
+      .withIndex("by_normalizedId", (q) => q.gt("normalizedId", after))
+      .take(n);
+  },
+});
+
+export const listLinks = query({
+  args: {
+    offset: v.number(),
+    n: v.number(),
+    owner: v.string(),
+    token: v.string(),
+  },
+  handler: async (ctx, { offset, n, owner, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    // Convex has no count or offset, so read the matching links here and
+    // return only the requested page, with their total.
+    let matching = ctx.db.query("links").withIndex("by_normalizedId");
+    if (owner !== "") {
+      matching = matching.filter((q) => q.eq(q.field("owner"), owner));
+    }
+    const links = [];
+    let total = 0;
+    for await (const link of matching) {
+      if (total >= offset && links.length < n) {
+        links.push(link);
+      }
+      total++;
+    }
+    return { links, total };
+  },
+});
+
+export const loadRandom = query({
+  args: { r: v.number(), token: v.string() },
+  handler: async (ctx, { r, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    // Convex has no count or offset, so read the links here and return
+    // only the chosen one. r is chosen by the caller, since queries must
+    // be deterministic.
+    const links = await ctx.db
+      .query("links")
+      .withIndex("by_normalizedId")
+      .collect();
+    if (links.length === 0) {
+      return null;
+    }
+    return links[Math.floor(r * links.length)];
+  },
+});
+
+export const loadMostEdited = query({
+  args: { n: v.number(), token: v.string() },
+  handler: async (ctx, { n, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    // Links without an editCount were stored before edits were counted,
+    // and sort last, as if saved once.
+    return await ctx.db
+      .query("links")
+      .withIndex("by_editCount")
+      .order("desc")
+      .take(n);
+  },
+});
+
+export const loadNamespace = query({
+  args: { namespace: v.string(), token: v.string() },
+  handler: async (ctx, { namespace, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    // Links in the default namespace are stored without a namespace field.
+    return await ctx.db
+      .query("links")
+      .withIndex("by_namespace", (q) =>
+        q.eq("namespace", namespace === "" ? undefined : namespace)
+      )
+      .collect();
+  },
+});
@@ -0,0 +1,33 @@
+import { mutation } from "./_generated/server";
+import { v } from "convex/values";
+
+export default mutation({
+  args: { normalizedId: v.string(), pinned: v.boolean(), token: v.string() },
+  handler: async (ctx, { normalizedId, pinned, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    let link = await ctx.db
+      .query("links")
+      .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+      .first();
+    if (link === null) {
+      const alias = await ctx.db
+        .query("aliases")
+        .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+        .first();
+      if (alias === null) {
+        return false;
+      }
+      link = await ctx.db.get(alias.link);
+      if (link === null) {
+        return false;
+      }
+    }
+    await ctx.db.patch(link._id, {
+      pinned,
+      version: (link.version ?? 1) + 1,
+    });
+    return true;
+  },
+});
@@ -0,0 +1,86 @@
+import { mutation, MutationCtx } from "./_generated/server";
+import { v } from "convex/values";
+import { Id } from "./_generated/dataModel";
+import { adjustLinkCount } from "./store";
+
+// deleteLink deletes a link along with its stats, impressions and aliases. It's shared
+// with consumeUse, which deletes exhausted links.
+export async function deleteLink(ctx: MutationCtx, link: Id<"links">) {
+  let deletions = [];
+  for await (const stat of ctx.db
+    .query("stats")
+    .withIndex("byLink", (q) => q.eq("link", link))) {
+    deletions.push(ctx.db.delete(stat._id));
+  }
+  for await (const entry of ctx.db
+    .query("statsLog")
+    .withIndex("byLink", (q) => q.eq("link", link))) {
+    deletions.push(ctx.db.delete(entry._id));
+  }
+  for await (const impression of ctx.db
+    .query("impressions")
+    .withIndex("byLink", (q) => q.eq("link", link))) {
+    deletions.push(ctx.db.delete(impression._id));
+  }
+  for await (const alias of ctx.db
+    .query("aliases")
+    .withIndex("byLink", (q) => q.eq("link", link))) {
+    deletions.push(ctx.db.delete(alias._id));
+  }
+  deletions.push(ctx.db.delete(link));
+  await Promise.all(deletions);
+  await adjustLinkCount(ctx, -1);
+}
+
+export default mutation({
+  args: { normalizedId: v.string(), token: v.string() },
+  handler: async (ctx, { normalizedId, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    const link = await ctx.db
+      .query("links")
+      .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+      .first();
+    // The result says what was deleted, so that deleting an alias isn't
+    // reported as deleting a link, or is false if nothing was.
+    if (link === null) {
+      // Deleting an alias only removes the alias.
+      const alias = await ctx.db
+        .query("aliases")
+        .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+        .first();
+      if (alias === null) {
+        return false;
+      }
+      await ctx.db.delete(alias._id);
+      return "alias";
+    }
+    await deleteLink(ctx, link._id);
+    return "link";
+  },
+});
+
+// removeMany deletes the links with the given normalized IDs, and returns
+// the IDs of those that existed. Unlike the default mutation, it doesn't
+// delete aliases named by the IDs.
+export const removeMany = mutation({
+  args: { normalizedIds: v.array(v.string()), token: v.string() },
+  handler: async (ctx, { normalizedIds, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    const deleted: string[] = [];
+    for (const normalizedId of new Set(normalizedIds)) {
+      const link = await ctx.db
+        .query("links")
+        .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+        .first();
+      if (link !== null) {
+        await deleteLink(ctx, link._id);
+        deleted.push(normalizedId);
+      }
+    }
+    return deleted;
+  },
+});
@@ -0,0 +1,41 @@
+import { mutation } from "./_generated/server";
+import { v } from "convex/values";
+
+export default mutation({
+  args: {
+    renames: v.array(v.object({ from: v.string(), to: v.string() })),
+    token: v.string(),
+  },
+  handler: async (ctx, { renames, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    // Find every link before patching any, so that a link saved or deleted
+    // since the caller loaded them leaves all of them unchanged. Stats and
+    // aliases refer to links by document ID, so they need no changes.
+    const links = [];
+    for (const { from } of renames) {
+      const link = await ctx.db
+        .query("links")
+        .withIndex("by_normalizedId", (q) => q.eq("normalizedId", from))
+        .first();
+      if (link === null) {
+        return { status: "conflict", normalizedId: from };
+      }
+      links.push(link);
+    }
+    for (const { to } of renames) {
+      const existing = await ctx.db
+        .query("links")
+        .withIndex("by_normalizedId", (q) => q.eq("normalizedId", to))
+        .first();
+      if (existing !== null && !links.some((l) => l._id === existing._id)) {
+        return { status: "conflict", normalizedId: to };
+      }
+    }
+    for (let i = 0; i < links.length; i++) {
+      await ctx.db.patch(links[i]._id, { normalizedId: renames[i].to });
+    }
+    return { status: "updated" };
+  },
+});
@@ -0,0 +1,43 @@
+import { mutation } from "./_generated/server";
+import { v } from "convex/values";
+
+export default mutation({
+  args: {
+    updates: v.array(
+      v.object({
+        normalizedId: v.string(),
+        expectedOld: v.string(),
+        long: v.string(),
+      })
+    ),
+    lastEdit: v.number(),
+    token: v.string(),
+  },
+  handler: async (ctx, { updates, lastEdit, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    // Check every link before patching any, so that a conflict leaves
+    // all of them unchanged.
+    const links = [];
+    for (const { normalizedId, expectedOld } of updates) {
+      const link = await ctx.db
+        .query("links")
+        .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+        .first();
+      if (link === null || link.long !== expectedOld) {
+        return { status: "conflict", normalizedId };
+      }
+      links.push(link);
+    }
+    for (let i = 0; i < links.length; i++) {
+      await ctx.db.patch(links[i]._id, {
+        long: updates[i].long,
+        lastEdit,
+        editCount: (links[i].editCount ?? 1) + 1,
+        version: (links[i].version ?? 1) + 1,
+      });
+    }
+    return { status: "updated" };
+  },
+});
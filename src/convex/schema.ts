@@ -8,12 +8,64 @@ export const LinkDoc = {
   created: v.number(),
   lastEdit: v.number(),
   owner: v.string(),
+  destinations: v.optional(
+    v.array(v.object({ url: v.string(), weight: v.number() }))
+  ),
+  redirectCode: v.optional(v.number()),
+  namespace: v.optional(v.string()),
+  createdFrom: v.optional(v.string()),
+  editCount: v.optional(v.number()),
+  allowedOwners: v.optional(v.array(v.string())),
+  expiresAt: v.optional(v.number()),
+  iconUrl: v.optional(v.string()),
+  pinned: v.optional(v.boolean()),
+  maxUses: v.optional(v.number()),
+  useCount: v.optional(v.number()),
+  // Incremented by every change to the link, for conditional saves.
+  version: v.optional(v.number()),
+  source: v.optional(v.string()),
+  // Response headers to set on redirects, by header name.
+  headers: v.optional(v.record(v.string(), v.string())),
 };
 
 export default defineSchema({
-  links: defineTable(LinkDoc).index("by_normalizedId", ["normalizedId"]),
+  links: defineTable(LinkDoc)
+    .index("by_normalizedId", ["normalizedId"])
+    .index("by_lastEdit", ["lastEdit"])
+    .index("by_created", ["created"])
+    .index("by_editCount", ["editCount"])
+    .index("by_owner", ["owner"])
+    .index("by_namespace", ["namespace"]),
   stats: defineTable({
     link: v.id("links"),
     clicks: v.number(),
   }).index("byLink", ["link"]),
+  // Clicks recorded by each flush, for loading the clicks since a time.
+  statsLog: defineTable({
+    link: v.id("links"),
+    clicks: v.number(),
+    created: v.number(),
+  })
+    .index("byLink", ["link"])
+    .index("by_created", ["created"]),
+  // Times each link was shown, for click-through rates.
+  impressions: defineTable({
+    link: v.id("links"),
+    impressions: v.number(),
+  }).index("byLink", ["link"]),
+  statsMeta: defineTable({
+    lastFlush: v.number(),
+  }),
+  // The number of links, kept by the mutations that insert and delete
+  // them, so that maxTotalLinks is checked without reading every link.
+  linkCount: defineTable({
+    count: v.number(),
+  }),
+  aliases: defineTable({
+    normalizedId: v.string(),
+    short: v.string(),
+    link: v.id("links"),
+  })
+    .index("by_normalizedId", ["normalizedId"])
+    .index("byLink", ["link"]),
 });
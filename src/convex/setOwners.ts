@@ -0,0 +1,51 @@
+import { mutation } from "./_generated/server";
+import { v } from "convex/values";
+
+export default mutation({
+  args: {
+    updates: v.array(
+      v.object({
+        normalizedId: v.string(),
+        owner: v.string(),
+      })
+    ),
+    lastEdit: v.number(),
+    token: v.string(),
+  },
+  handler: async (ctx, { updates, lastEdit, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    const links = [];
+    const missing = [];
+    for (const { normalizedId, owner } of updates) {
+      let link = await ctx.db
+        .query("links")
+        .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+        .first();
+      if (link === null) {
+        // Setting the owner of an alias sets its canonical link's.
+        const alias = await ctx.db
+          .query("aliases")
+          .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+          .first();
+        if (alias !== null) {
+          link = await ctx.db.get(alias.link);
+        }
+      }
+      if (link === null) {
+        missing.push(normalizedId);
+        continue;
+      }
+      const changes = {
+        owner,
+        lastEdit,
+        editCount: (link.editCount ?? 1) + 1,
+        version: (link.version ?? 1) + 1,
+      };
+      await ctx.db.patch(link._id, changes);
+      links.push({ ...link, ...changes });
+    }
+    return { links, missing };
+  },
+});
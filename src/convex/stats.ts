@@ -1,5 +1,12 @@
 import { query, mutation } from "./_generated/server";
 import { v } from "convex/values";
+import { Doc, Id } from "./_generated/dataModel";
+
+// linkName returns the name of link, by which stats are keyed, as Link.Name
+// does in Go.
+function linkName(link: Doc<"links">) {
+  return link.namespace ? `${link.namespace}/${link.short}` : link.short;
+}
 
 export const loadStats = query({
   args: { token: v.string() },
@@ -23,31 +30,380 @@ export const loadStats = query({
   },
 });
 
+export const loadStatsPage = query({
+  args: {
+    cursor: v.union(v.string(), v.null()),
+    numItems: v.number(),
+    token: v.string(),
+  },
+  handler: async (ctx, { cursor, numItems, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    const links = await ctx.db
+      .query("links")
+      .withIndex("by_normalizedId")
+      .paginate({ cursor, numItems });
+    const page = [];
+    for (const link of links.page) {
+      const clicks = (
+        await ctx.db
+          .query("stats")
+          .withIndex("byLink", (q) => q.eq("link", link._id))
+          .first()
+      )?.clicks;
+      if (clicks) {
+        page.push({ short: linkName(link), clicks });
+      }
+    }
+    return {
+      page,
+      isDone: links.isDone,
+      continueCursor: links.continueCursor,
+    };
+  },
+});
+
+export const loadStatsSince = query({
+  args: { since: v.number(), token: v.string() },
+  handler: async (ctx, { since, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    const byLink = new Map<Id<"links">, number>();
+    for await (const entry of ctx.db
+      .query("statsLog")
+      .withIndex("by_created", (q) => q.gte("created", since))) {
+      byLink.set(entry.link, (byLink.get(entry.link) ?? 0) + entry.clicks);
+    }
+    let stats: Record<string, number> = {};
+    for (const [id, clicks] of byLink) {
+      const link = await ctx.db.get(id);
+      if (link !== null) {
+        stats[linkName(link)] = clicks;
+      }
+    }
+    return stats;
+  },
+});
+
+export const loadRawStats = query({
+  args: { normalizedId: v.string(), token: v.string() },
+  handler: async (ctx, { normalizedId, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    let link = await ctx.db
+      .query("links")
+      .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+      .first();
+    if (link === null) {
+      const alias = await ctx.db
+        .query("aliases")
+        .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+        .first();
+      if (alias !== null) {
+        link = await ctx.db.get(alias.link);
+      }
+    }
+    if (link === null) {
+      return [];
+    }
+    const entries = await ctx.db
+      .query("statsLog")
+      .withIndex("byLink", (q) => q.eq("link", link!._id))
+      .collect();
+    return entries
+      .sort((a, b) => a.created - b.created)
+      .map(({ created, clicks }) => ({
+        short: linkName(link!),
+        created,
+        clicks,
+      }));
+  },
+});
+
+export const loadRawStatsPage = query({
+  args: {
+    cursor: v.union(v.string(), v.null()),
+    numItems: v.number(),
+    token: v.string(),
+  },
+  handler: async (ctx, { cursor, numItems, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    const entries = await ctx.db
+      .query("statsLog")
+      .withIndex("by_created")
+      .paginate({ cursor, numItems });
+    const page = [];
+    for (const { link: id, created, clicks } of entries.page) {
+      const link = await ctx.db.get(id);
+      if (link !== null) {
+        page.push({ short: linkName(link), created, clicks });
+      }
+    }
+    return {
+      page,
+      isDone: entries.isDone,
+      continueCursor: entries.continueCursor,
+    };
+  },
+});
+
+export const loadStatsForLinks = query({
+  args: { normalizedIds: v.array(v.string()), token: v.string() },
+  handler: async (ctx, { normalizedIds, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    let stats: Record<string, number> = {};
+    for (const normalizedId of normalizedIds) {
+      let link = await ctx.db
+        .query("links")
+        .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+        .first();
+      if (link === null) {
+        // The clicks of an alias are those of its canonical link.
+        const alias = await ctx.db
+          .query("aliases")
+          .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+          .first();
+        if (alias !== null) {
+          link = await ctx.db.get(alias.link);
+        }
+      }
+      if (link === null) {
+        continue;
+      }
+      const clicks = (
+        await ctx.db
+          .query("stats")
+          .withIndex("byLink", (q) => q.eq("link", link._id))
+          .first()
+      )?.clicks;
+      if (clicks) {
+        stats[normalizedId] = clicks;
+      }
+    }
+    return stats;
+  },
+});
+
+export const lastFlush = query({
+  args: { token: v.string() },
+  handler: async (ctx, { token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    const meta = await ctx.db.query("statsMeta").first();
+    return meta?.lastFlush ?? null;
+  },
+});
+
+// Convex has no count operation, so this reads each table's IDs. It is
+// still cheap next to loadStats, which joins every link to its stats.
+export const storageStats = query({
+  args: { token: v.string() },
+  handler: async (ctx, { token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    const count = async (table: "links" | "aliases" | "stats") => {
+      let n = 0;
+      for await (const _ of ctx.db.query(table)) {
+        n++;
+      }
+      return n;
+    };
+    return {
+      links: await count("links"),
+      aliases: await count("aliases"),
+      stats: await count("stats"),
+    };
+  },
+});
+
 export const saveStats = mutation({
-  args: { stats: v.record(v.string(), v.number()), token: v.string() },
-  handler: async (ctx, { stats, token }) => {
+  args: {
+    stats: v.record(v.string(), v.number()),
+    flushedAt: v.optional(v.number()),
+    token: v.string(),
+  },
+  handler: async (ctx, { stats, flushedAt, token }) => {
     if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
       throw new Error("Invalid authorization token");
     }
+    const lastFlush = flushedAt ?? Date.now() / 1000;
     for (const [normalizedId, clicks] of Object.entries(stats)) {
-      const link = await ctx.db
+      let link = await ctx.db
         .query("links")
         .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
         .first();
+      if (link === null) {
+        // Clicks on an alias count towards its canonical link.
+        const alias = await ctx.db
+          .query("aliases")
+          .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+          .first();
+        if (alias !== null) {
+          link = await ctx.db.get(alias.link);
+        }
+      }
       if (link !== null) {
         let stat = await ctx.db
           .query("stats")
           .withIndex("byLink", (q) => q.eq("link", link._id))
           .first();
+        // Stats are clicks since the last flush, so add rather than replace.
         if (stat !== null) {
           stat.clicks += clicks;
           await ctx.db.replace(stat._id, stat);
         } else {
           await ctx.db.insert("stats", { link: link._id, clicks: clicks });
         }
+        await ctx.db.insert("statsLog", {
+          link: link._id,
+          clicks,
+          created: lastFlush,
+        });
       } else {
         console.warn("Writing stats for nonexistent link: ", normalizedId);
       }
     }
+    // Recorded in the same transaction as the stats.
+    const meta = await ctx.db.query("statsMeta").first();
+    if (meta !== null) {
+      await ctx.db.patch(meta._id, { lastFlush });
+    } else {
+      await ctx.db.insert("statsMeta", { lastFlush });
+    }
+  },
+});
+
+export const incrementClicks = mutation({
+  args: {
+    normalizedId: v.string(),
+    clicks: v.number(),
+    token: v.string(),
+  },
+  handler: async (ctx, { normalizedId, clicks, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    let link = await ctx.db
+      .query("links")
+      .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+      .first();
+    if (link === null) {
+      // Clicks on an alias count towards its canonical link.
+      const alias = await ctx.db
+        .query("aliases")
+        .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+        .first();
+      if (alias !== null) {
+        link = await ctx.db.get(alias.link);
+      }
+    }
+    if (link === null) {
+      return null;
+    }
+    // Mutations are serializable, so concurrent increments each return a
+    // distinct total.
+    const stat = await ctx.db
+      .query("stats")
+      .withIndex("byLink", (q) => q.eq("link", link._id))
+      .first();
+    let total = clicks;
+    if (stat !== null) {
+      total += stat.clicks;
+      await ctx.db.patch(stat._id, { clicks: total });
+    } else {
+      await ctx.db.insert("stats", { link: link._id, clicks });
+    }
+    await ctx.db.insert("statsLog", {
+      link: link._id,
+      clicks,
+      created: Date.now() / 1000,
+    });
+    return total;
+  },
+});
+
+export const saveImpressions = mutation({
+  args: {
+    impressions: v.record(v.string(), v.number()),
+    token: v.string(),
+  },
+  handler: async (ctx, { impressions, token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    for (const [normalizedId, n] of Object.entries(impressions)) {
+      let link = await ctx.db
+        .query("links")
+        .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+        .first();
+      if (link === null) {
+        // Impressions of an alias count towards its canonical link.
+        const alias = await ctx.db
+          .query("aliases")
+          .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+          .first();
+        if (alias !== null) {
+          link = await ctx.db.get(alias.link);
+        }
+      }
+      if (link === null) {
+        continue;
+      }
+      const existing = await ctx.db
+        .query("impressions")
+        .withIndex("byLink", (q) => q.eq("link", link._id))
+        .first();
+      // Impressions are counted since the last flush, so add to the total.
+      if (existing !== null) {
+        await ctx.db.patch(existing._id, {
+          impressions: existing.impressions + n,
+        });
+      } else {
+        await ctx.db.insert("impressions", { link: link._id, impressions: n });
+      }
+    }
+  },
+});
+
+export const loadImpressions = query({
+  args: { token: v.string() },
+  handler: async (ctx, { token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    let impressions: Record<string, number> = {};
+    for await (const entry of ctx.db.query("impressions")) {
+      const link = await ctx.db.get(entry.link);
+      if (link !== null && entry.impressions > 0) {
+        impressions[linkName(link)] = entry.impressions;
+      }
+    }
+    return impressions;
+  },
+});
+
+export const resetAllStats = mutation({
+  args: { token: v.string() },
+  handler: async (ctx, { token }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    let deletions = [];
+    for await (const stat of ctx.db.query("stats").fullTableScan()) {
+      deletions.push(ctx.db.delete(stat._id));
+    }
+    for await (const entry of ctx.db.query("statsLog").fullTableScan()) {
+      deletions.push(ctx.db.delete(entry._id));
+    }
+    await Promise.all(deletions);
   },
 });
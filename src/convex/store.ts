@@ -1,23 +1,156 @@
-import { mutation } from "./_generated/server";
-import { v } from "convex/values";
+import { mutation, MutationCtx } from "./_generated/server";
+import { Infer, v } from "convex/values";
 import { LinkDoc } from "./schema";
 
+const Link = v.object(LinkDoc);
+
+export type StoreResult = {
+  created: boolean;
+  quotaCount?: number;
+  totalCount?: number;
+  // Set instead of storing if expectedVersion was given and the link
+  // doesn't exist or has another version.
+  missing?: boolean;
+  conflict?: boolean;
+  // Set instead of storing if createOnly was given and the link exists.
+  exists?: boolean;
+};
+
+// countLinks returns the number of links from the linkCount document. A
+// deployment without one, such as one created before it was kept, counts
+// its links once here to create it.
+export async function countLinks(ctx: MutationCtx): Promise<number> {
+  const counter = await ctx.db.query("linkCount").first();
+  if (counter !== null) {
+    return counter.count;
+  }
+  let count = 0;
+  for await (const _ of ctx.db.query("links")) {
+    count++;
+  }
+  await ctx.db.insert("linkCount", { count });
+  return count;
+}
+
+// adjustLinkCount adds delta to the linkCount document, if there is one.
+// Without one, the links are counted when they are next needed.
+export async function adjustLinkCount(ctx: MutationCtx, delta: number) {
+  const counter = await ctx.db.query("linkCount").first();
+  if (counter !== null) {
+    await ctx.db.patch(counter._id, { count: counter.count + delta });
+  }
+}
+
+// storeLink creates or replaces link. It's shared with storeMany, so that
+// a batch of links is checked exactly as they would be one at a time. If
+// expectedVersion is given, link only replaces an existing link at that
+// version. If createOnly is set, link is only stored if it doesn't exist.
+export async function storeLink(
+  ctx: MutationCtx,
+  link: Infer<typeof Link>,
+  maxLinksPerOwner?: number,
+  maxTotalLinks?: number,
+  expectedVersion?: number,
+  createOnly?: boolean
+): Promise<StoreResult> {
+  const alias = await ctx.db
+    .query("aliases")
+    .withIndex("by_normalizedId", (q) =>
+      q.eq("normalizedId", link.normalizedId)
+    )
+    .first();
+  if (alias !== null && createOnly) {
+    return { created: false, exists: true };
+  }
+  if (alias !== null) {
+    throw new Error(`${link.short} is an alias of another link`);
+  }
+  let existing = await ctx.db
+    .query("links")
+    .withIndex("by_normalizedId", (q) =>
+      q.eq("normalizedId", link.normalizedId)
+    )
+    .first();
+  if (existing !== null && createOnly) {
+    return { created: false, exists: true };
+  }
+  if (expectedVersion !== undefined) {
+    if (existing === null) {
+      return { created: false, missing: true };
+    }
+    if ((existing.version ?? 1) !== expectedVersion) {
+      return { created: false, conflict: true };
+    }
+  }
+  if (existing !== null) {
+    // Where and with which app the link was created are kept from the
+    // first save.
+    await ctx.db.replace(existing._id, {
+      ...link,
+      createdFrom: existing.createdFrom || link.createdFrom,
+      source: existing.source || link.source,
+      editCount: (existing.editCount ?? 1) + 1,
+      useCount: existing.useCount,
+      version: (existing.version ?? 1) + 1,
+    });
+    return { created: false };
+  }
+  // Mutations are transactions, so the count can't change before the
+  // insert below.
+  if (maxTotalLinks !== undefined && maxTotalLinks > 0) {
+    const count = await countLinks(ctx);
+    if (count >= maxTotalLinks) {
+      return { created: false, totalCount: count };
+    }
+  }
+  if (
+    maxLinksPerOwner !== undefined &&
+    maxLinksPerOwner > 0 &&
+    link.owner !== ""
+  ) {
+    const owned = await ctx.db
+      .query("links")
+      .withIndex("by_owner", (q) => q.eq("owner", link.owner))
+      .collect();
+    if (owned.length >= maxLinksPerOwner) {
+      return { created: false, quotaCount: owned.length };
+    }
+  }
+  await ctx.db.insert("links", { ...link, editCount: 1, version: 1 });
+  await adjustLinkCount(ctx, 1);
+  return { created: true };
+}
+
 export default mutation({
-  args: { link: v.object(LinkDoc), token: v.string() },
-  handler: async (ctx, { link, token }) => {
+  args: {
+    link: Link,
+    token: v.string(),
+    maxLinksPerOwner: v.optional(v.number()),
+    maxTotalLinks: v.optional(v.number()),
+    expectedVersion: v.optional(v.number()),
+    createOnly: v.optional(v.boolean()),
+  },
+  handler: async (
+    ctx,
+    {
+      link,
+      token,
+      maxLinksPerOwner,
+      maxTotalLinks,
+      expectedVersion,
+      createOnly,
+    }
+  ) => {
     if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
       throw new Error("Invalid authorization token");
     }
-    let existing = await ctx.db
-      .query("links")
-      .withIndex("by_normalizedId", (q) =>
-        q.eq("normalizedId", link.normalizedId)
-      )
-      .first();
-    if (existing !== null) {
-      await ctx.db.replace(existing._id, link);
-      return;
-    }
-    await ctx.db.insert("links", link);
+    return await storeLink(
+      ctx,
+      link,
+      maxLinksPerOwner,
+      maxTotalLinks,
+      expectedVersion,
+      createOnly
+    );
   },
 });
@@ -0,0 +1,30 @@
+import { mutation } from "./_generated/server";
+import { v } from "convex/values";
+import { LinkDoc } from "./schema";
+import { storeLink } from "./store";
+
+export default mutation({
+  args: {
+    links: v.array(v.object(LinkDoc)),
+    token: v.string(),
+    maxLinksPerOwner: v.optional(v.number()),
+    maxTotalLinks: v.optional(v.number()),
+  },
+  handler: async (ctx, { links, token, maxLinksPerOwner, maxTotalLinks }) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    // created has an entry for each link saved. Links are saved in order
+    // up to the first that would exceed a quota; the ones before it are
+    // kept, so that the caller can report them.
+    const created = [];
+    for (const link of links) {
+      const result = await storeLink(ctx, link, maxLinksPerOwner, maxTotalLinks);
+      if (result.quotaCount !== undefined || result.totalCount !== undefined) {
+        return { ...result, created };
+      }
+      created.push(result.created);
+    }
+    return { created };
+  },
+});
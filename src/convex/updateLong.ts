@@ -0,0 +1,42 @@
+import { mutation } from "./_generated/server";
+import { v } from "convex/values";
+
+export default mutation({
+  args: {
+    normalizedId: v.string(),
+    expectedOld: v.string(),
+    long: v.string(),
+    lastEdit: v.number(),
+    token: v.string(),
+  },
+  handler: async (
+    ctx,
+    { normalizedId, expectedOld, long, lastEdit, token }
+  ) => {
+    if (token === "" || token !== process.env.CONVEX_AUTH_TOKEN) {
+      throw new Error("Invalid authorization token");
+    }
+    let link = await ctx.db
+      .query("links")
+      .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+      .first();
+    if (link === null) {
+      const alias = await ctx.db
+        .query("aliases")
+        .withIndex("by_normalizedId", (q) => q.eq("normalizedId", normalizedId))
+        .first();
+      if (alias !== null) {
+        link = await ctx.db.get(alias.link);
+      }
+    }
+    if (link === null) {
+      return { status: "missing" };
+    }
+    if (link.long !== expectedOld) {
+      return { status: "conflict" };
+    }
+    const version = (link.version ?? 1) + 1;
+    await ctx.db.patch(link._id, { long, lastEdit, version });
+    return { status: "updated", link: { ...link, long, lastEdit, version } };
+  },
+});
@@ -0,0 +1,333 @@
+// Copyright 2022 Tailscale Inc & Contributors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package golink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ConvexTransport carries ConvexDB's calls to Convex functions.
+type ConvexTransport interface {
+	// Call runs the function described by args, which is a query or a
+	// mutation as given by endpoint, and returns its result value. The
+	// authorization token is already in args.Args. header holds extra HTTP
+	// headers to send with the call, and may be nil.
+	Call(ctx context.Context, endpoint string, args *UdfExecution, header http.Header) (json.RawMessage, error)
+}
+
+// UDFTransport calls functions through a Convex deployment's generic
+// /api/query and /api/mutation endpoints. It is used by NewConvexDB.
+type UDFTransport struct {
+	URL string // URL of the deployment
+
+	// Client makes the requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// GzipRequestsOver, if positive, is the size in bytes above which
+	// request bodies are gzip-compressed and sent with Content-Encoding:
+	// gzip. Only enable it for deployments that accept compressed bodies.
+	GzipRequestsOver int
+
+	// MaxErrorBody is the most bytes of an unexpected response body that
+	// are read into an error. If zero, DefaultMaxErrorBody is used.
+	MaxErrorBody int
+}
+
+// ErrEmptyResponse is wrapped by the error UDFTransport returns when Convex
+// responds with a 200 status but no body, such as from a misconfigured
+// deployment, rather than with a result.
+var ErrEmptyResponse = errors.New("Convex returned an empty 200 response")
+
+// DefaultMaxErrorBody is the default limit on how much of an unexpected
+// response body a transport includes in an error.
+const DefaultMaxErrorBody = 4 << 10
+
+func (t *UDFTransport) Call(ctx context.Context, endpoint string, args *UdfExecution, header http.Header) (json.RawMessage, error) {
+	url := fmt.Sprintf("%s/api/%s", t.URL, endpoint)
+	encodedArgs, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	req, err := newJSONRequest(ctx, "POST", url, encodedArgs, t.GzipRequestsOver)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := httpClient(t.Client).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := responseBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	max := maxErrorBody(t.MaxErrorBody)
+	if resp.StatusCode != 200 {
+		msg := readErrorBody(body, max)
+		return nil, fmt.Errorf("unexpected status code from Convex: %d: %s", resp.StatusCode, msg)
+	}
+
+	// Keep the start of the body, to report it if it isn't valid.
+	head := &headWriter{max: max}
+	var convexResponse ConvexResponse
+	err = json.NewDecoder(io.TeeReader(body, head)).Decode(&convexResponse)
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w for %s", ErrEmptyResponse, args.Path)
+	}
+	if err != nil {
+		// The decoder stops reading where the body stopped being valid, so
+		// read on to fill the head, which tells whether the body is too
+		// long to report whole.
+		if n := max + 1 - len(head.buf); n > 0 {
+			io.Copy(head, io.LimitReader(body, int64(n)))
+		}
+		return nil, fmt.Errorf("invalid response from Convex: %w: %s", err, truncateErrorBody(head.buf, max))
+	}
+	if convexResponse.Status == "success" {
+		return convexResponse.Value, nil
+	}
+	if convexResponse.Status == "error" {
+		return nil, fmt.Errorf("error from Convex: %s", convexResponse.ErrorMessage)
+	}
+	return nil, fmt.Errorf("unexpected response status from Convex: %q", convexResponse.Status)
+}
+
+// HTTPAction describes an HTTP action exposing a Convex function.
+type HTTPAction struct {
+	URL string // full URL of the action
+
+	// Method is the HTTP method to use. If empty, POST is used. For POST
+	// and other methods with a body, the function's arguments, including
+	// the token, are sent as a JSON object in the body. For GET, they are
+	// sent as the same JSON object in the "args" query parameter.
+	Method string
+
+	// Header holds extra headers to send with each call.
+	Header http.Header
+}
+
+// HTTPActionTransport calls functions through HTTP actions at custom
+// paths, for deployments that don't expose the generic query and mutation
+// API. An action responds to a successful call with a 2xx status and the
+// function's result as its JSON body, or an empty body for null.
+//
+// Actions are looked up by the path of the function they stand in for.
+// ConvexDB methods call these functions:
+//
+//	Load                  load:loadOne
+//	LoadMany              load:loadMany, or load:loadOne if missing
+//	LoadAll, LoadAllMap   load:loadAll
+//	LoadWithStats         load:loadWithStats
+//	LoadModifiedSince     load:loadModifiedSince
+//	LoadNamespace         load:loadNamespace
+//	LoadCreatedBetween    load:loadCreatedBetween
+//	LoadOwnerless         load:loadOwnerless
+//	LoadMostEdited        load:loadMostEdited
+//	RandomLink            load:loadRandom
+//	LoadPage              load:loadPage
+//	ListLinks             load:listLinks
+//	AllIDs                load:loadIDs
+//	CountBySource         load:countBySource
+//	Save, SaveAdmin       store
+//	SaveIfVersion         store
+//	LoadVersioned         load:loadOne
+//	SaveNew               store
+//	CreateRandomShort     store
+//	SaveMany              storeMany
+//	Delete                remove
+//	DeleteMany            remove:removeMany
+//	Touch                 touch
+//	Pin, Unpin            pin
+//	ConsumeUse            consumeUse
+//	LoadPinned            load:loadPinned
+//	UpdateLong            updateLong
+//	RewriteLongs          rewriteLongs
+//	SetOwners             setOwners
+//	Renormalize           load:loadAll, renormalize
+//	Alias                 alias
+//	LoadStats             stats:loadStats
+//	LoadStatsForLinks     stats:loadStatsForLinks
+//	StatsSeq              stats:loadStatsPage
+//	LoadStatsSince        stats:loadStatsSince
+//	LoadRawStats          stats:loadRawStats
+//	LoadAllRawStats       stats:loadRawStatsPage
+//	SaveStats             stats:saveStats
+//	IncrementAndGetClicks stats:incrementClicks
+//	LastStatsFlush        stats:lastFlush
+//	ResetAllStats         stats:resetAllStats
+//	DBStats               stats:storageStats
+//	SaveImpressions       stats:saveImpressions
+//	LoadImpressions       stats:loadImpressions
+//	LoadCTR               stats:loadImpressions, stats:loadStats
+//	LoadStaleCandidates   load:loadAll, stats:loadStats, stats:loadRawStatsPage
+type HTTPActionTransport struct {
+	Actions map[string]HTTPAction // keyed by function path
+
+	// Client makes the requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// GzipRequestsOver and MaxErrorBody are as for UDFTransport.
+	GzipRequestsOver int
+	MaxErrorBody     int
+}
+
+func (t *HTTPActionTransport) Call(ctx context.Context, endpoint string, args *UdfExecution, header http.Header) (json.RawMessage, error) {
+	action, ok := t.Actions[args.Path]
+	if !ok {
+		// Worded like Convex's own error, so that Validate reports it.
+		return nil, fmt.Errorf("Could not find HTTP action for %q", args.Path)
+	}
+	encodedArgs, err := json.Marshal(args.Args)
+	if err != nil {
+		return nil, err
+	}
+	method := action.Method
+	if method == "" {
+		method = "POST"
+	}
+	var req *http.Request
+	if method == "GET" {
+		u, err := url.Parse(action.URL)
+		if err != nil {
+			return nil, err
+		}
+		q := u.Query()
+		q.Set("args", string(encodedArgs))
+		u.RawQuery = q.Encode()
+		if req, err = http.NewRequestWithContext(ctx, method, u.String(), nil); err != nil {
+			return nil, err
+		}
+	} else {
+		if req, err = newJSONRequest(ctx, method, action.URL, encodedArgs, t.GzipRequestsOver); err != nil {
+			return nil, err
+		}
+	}
+	for name, values := range action.Header {
+		req.Header[name] = values
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := httpClient(t.Client).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := responseBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	max := maxErrorBody(t.MaxErrorBody)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := readErrorBody(body, max)
+		return nil, fmt.Errorf("unexpected status code from Convex action %s: %d: %s", args.Path, resp.StatusCode, msg)
+	}
+	value, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(value)) == 0 {
+		return json.RawMessage("null"), nil
+	}
+	if !json.Valid(value) {
+		return nil, fmt.Errorf("invalid JSON response from Convex action %s: %s", args.Path, truncateErrorBody(value, max))
+	}
+	return value, nil
+}
+
+// newJSONRequest returns a request with body as its JSON content, gzipped if
+// it is over gzipOver bytes and gzipOver is positive.
+func newJSONRequest(ctx context.Context, method, url string, body []byte, gzipOver int) (*http.Request, error) {
+	compress := gzipOver > 0 && len(body) > gzipOver
+	if compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	return req, nil
+}
+
+// responseBody returns the body of resp, decompressing it if it is gzipped
+// and the http.Transport has not already done so.
+func responseBody(resp *http.Response) (io.Reader, error) {
+	if resp.Uncompressed || !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return resp.Body, nil
+	}
+	return gzip.NewReader(resp.Body)
+}
+
+// httpClient returns c, or http.DefaultClient if c is nil.
+func httpClient(c *http.Client) *http.Client {
+	if c == nil {
+		return http.DefaultClient
+	}
+	return c
+}
+
+// maxErrorBody returns max, or DefaultMaxErrorBody if max is zero.
+func maxErrorBody(max int) int {
+	if max == 0 {
+		return DefaultMaxErrorBody
+	}
+	return max
+}
+
+// readErrorBody reads at most max bytes of r, for inclusion in an error.
+func readErrorBody(r io.Reader, max int) string {
+	b, _ := io.ReadAll(io.LimitReader(r, int64(max)+1))
+	return truncateErrorBody(b, max)
+}
+
+// truncateErrorBody returns b as a string, cut to max bytes and marked as
+// truncated if it is longer.
+func truncateErrorBody(b []byte, max int) string {
+	if len(b) <= max {
+		return string(b)
+	}
+	return fmt.Sprintf("%s... (truncated)", b[:max])
+}
+
+// headWriter keeps the first max+1 bytes written to it, enough to tell
+// whether more than max were written.
+type headWriter struct {
+	buf []byte
+	max int
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	n := w.max + 1 - len(w.buf)
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > 0 {
+		w.buf = append(w.buf, p[:n]...)
+	}
+	return len(p), nil
+}